@@ -0,0 +1,216 @@
+// Package client is a Go client of the wBAN prices API, versioned along with the server so that their types match.
+//
+//	c, err := client.New("https://prices.bananobridge.org", client.WithTimeout(5*time.Second))
+//	if err != nil {
+//		return err
+//	}
+//	prices, err := c.Prices(ctx, "ban", "eth")
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const DEFAULT_TIMEOUT = 10 * time.Second
+
+// Largest error body read from the API.
+const MAX_ERROR_BODY_SIZE = 4096
+
+// Client calls the API at a base URL. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	apiKey     string
+}
+
+// Option customizes a Client created by New.
+type Option func(*Client)
+
+// WithHTTPClient makes the client send its requests with httpClient, whose timeout then applies.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithTimeout sets the timeout of the requests, DEFAULT_TIMEOUT by default.
+func WithTimeout(timeout time.Duration) Option {
+	return func(c *Client) {
+		httpClient := *c.httpClient
+		httpClient.Timeout = timeout
+		c.httpClient = &httpClient
+	}
+}
+
+// WithAPIKey authenticates the requests with an API key, lifting the anonymous rate limit.
+func WithAPIKey(key string) Option {
+	return func(c *Client) { c.apiKey = key }
+}
+
+// New returns a client of the API at baseURL, e.g. https://prices.bananobridge.org.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid base URL %q, expected an absolute http or https URL", baseURL)
+	}
+
+	c := &Client{baseURL: strings.TrimSuffix(baseURL, "/"), httpClient: &http.Client{Timeout: DEFAULT_TIMEOUT}}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// Error is returned when the API answers with an error status.
+type Error struct {
+	StatusCode int
+	Message    string
+	Code       string        // Stable code of the error, like upstream_unavailable or rate_limited, empty with plain text errors.
+	RequestID  string        // To be quoted when reporting the error, if the API returned one.
+	RetryAfter time.Duration // Zero when the API didn't say.
+}
+
+func (e *Error) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("wban prices API returned %d: %s (request %s)", e.StatusCode, e.Message, e.RequestID)
+	}
+	return fmt.Sprintf("wban prices API returned %d: %s", e.StatusCode, e.Message)
+}
+
+// Envelope holds the prices along with their freshness, as returned with ?meta=true.
+type Envelope struct {
+	Prices         map[string]float64 `json:"prices"`
+	UpdatedAt      time.Time          `json:"updated_at"`
+	Source         string             `json:"source"`
+	Sources        map[string]string  `json:"sources"`
+	BelowQuorum    []string           `json:"below_quorum"`
+	Suspect        []string           `json:"suspect"`
+	Raw            map[string]float64 `json:"raw"`
+	Stale          bool               `json:"stale"`
+	TTLRemainingMs int64              `json:"ttl_remaining_ms"`
+	AgeMs          int64              `json:"age_ms"`
+	Partial        bool               `json:"partial"`
+	Errors         map[string]string  `json:"errors"`
+}
+
+// Conversion is the result of Convert.
+type Conversion struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+	Result float64 `json:"result"`
+	Rate   float64 `json:"rate"`
+}
+
+// Prices returns the USD prices of symbols, all the supported ones without any.
+func (c *Client) Prices(ctx context.Context, symbols ...string) (map[string]float64, error) {
+	var prices map[string]float64
+	err := c.get(ctx, "/prices", pricesQuery(symbols), &prices)
+	return prices, err
+}
+
+// PricesWithMeta returns the USD prices of symbols, all the supported ones without any, along with their freshness.
+func (c *Client) PricesWithMeta(ctx context.Context, symbols ...string) (*Envelope, error) {
+	query := pricesQuery(symbols)
+	query.Set("meta", "true")
+	var envelope Envelope
+	if err := c.get(ctx, "/prices", query, &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+// Price returns the USD price of a symbol.
+func (c *Client) Price(ctx context.Context, symbol string) (float64, error) {
+	var price float64
+	err := c.get(ctx, "/prices/"+url.PathEscape(symbol), url.Values{"value_only": {"true"}}, &price)
+	return price, err
+}
+
+// Convert converts an amount between two symbols, or USD.
+func (c *Client) Convert(ctx context.Context, from, to string, amount float64) (*Conversion, error) {
+	query := url.Values{"from": {from}, "to": {to}, "amount": {strconv.FormatFloat(amount, 'f', -1, 64)}}
+	var conversion Conversion
+	if err := c.get(ctx, "/convert", query, &conversion); err != nil {
+		return nil, err
+	}
+	return &conversion, nil
+}
+
+func pricesQuery(symbols []string) url.Values {
+	query := url.Values{}
+	if len(symbols) > 0 {
+		query.Set("symbols", strings.Join(symbols, ","))
+	}
+	return query
+}
+
+// get sends a GET request to path and decodes its JSON response into v.
+func (c *Client) get(ctx context.Context, path string, query url.Values, v any) error {
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("wban prices API %s: %w", path, err)
+	}
+	return nil
+}
+
+// responseError returns the error of a non-200 response, whose body is either a JSON error or plain text.
+func responseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, MAX_ERROR_BODY_SIZE))
+	apiErr := &Error{StatusCode: resp.StatusCode, RequestID: resp.Header.Get("X-Request-ID")}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	var errorBody struct {
+		Error     string `json:"error"`
+		Code      string `json:"code"`
+		RequestID string `json:"request_id"`
+	}
+	if json.Unmarshal(body, &errorBody) == nil && errorBody.Error != "" {
+		apiErr.Message, apiErr.Code = errorBody.Error, errorBody.Code
+		if errorBody.RequestID != "" {
+			apiErr.RequestID = errorBody.RequestID
+		}
+	} else {
+		apiErr.Message = strings.TrimSpace(string(body))
+	}
+	if apiErr.Message == "" {
+		apiErr.Message = http.StatusText(resp.StatusCode)
+	}
+	return apiErr
+}
+
+// IsNotFound reports whether err is the API answering that a symbol isn't supported.
+func IsNotFound(err error) bool {
+	var apiErr *Error
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
@@ -0,0 +1,216 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client of a fake API served by handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc, opts ...Option) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	c, err := New(server.URL+"/", append([]Option{WithHTTPClient(server.Client())}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNewRejectsInvalidURLs(t *testing.T) {
+	for _, baseURL := range []string{"", "prices.bananobridge.org", "ftp://prices.bananobridge.org", "https://"} {
+		if _, err := New(baseURL); err == nil {
+			t.Errorf("New(%q) succeeded", baseURL)
+		}
+	}
+}
+
+func TestRequests(t *testing.T) {
+	tests := []struct {
+		name  string
+		call  func(c *Client) (any, error)
+		want  string // Path and query of the request.
+		reply string
+		check func(t *testing.T, got any)
+	}{
+		{
+			"all prices", func(c *Client) (any, error) { return c.Prices(context.Background()) },
+			"/prices", `{"ban":0.00734,"eth":2512.85}`,
+			func(t *testing.T, got any) {
+				if prices := got.(map[string]float64); len(prices) != 2 || prices["ban"] != 0.00734 || prices["eth"] != 2512.85 {
+					t.Errorf("prices = %v", prices)
+				}
+			},
+		},
+		{
+			"some prices", func(c *Client) (any, error) { return c.Prices(context.Background(), "ban", "eth") },
+			"/prices?symbols=ban%2Ceth", `{"ban":0.00734,"eth":2512.85}`, nil,
+		},
+		{
+			"prices with meta", func(c *Client) (any, error) { return c.PricesWithMeta(context.Background(), "ban") },
+			"/prices?meta=true&symbols=ban",
+			`{"prices":{"ban":0.00734},"updated_at":"2024-06-01T12:00:00Z","source":"coinex","sources":{"ban":"binance"},"stale":true,"ttl_remaining_ms":0,"age_ms":42000,"partial":false}`,
+			func(t *testing.T, got any) {
+				envelope := got.(*Envelope)
+				if envelope.Prices["ban"] != 0.00734 || !envelope.Stale || envelope.AgeMs != 42000 || envelope.Sources["ban"] != "binance" ||
+					!envelope.UpdatedAt.Equal(time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)) {
+					t.Errorf("envelope = %+v", envelope)
+				}
+			},
+		},
+		{
+			"price", func(c *Client) (any, error) { return c.Price(context.Background(), "wban/bsc") },
+			"/prices/wban%2Fbsc?value_only=true", `0.00734`,
+			func(t *testing.T, got any) {
+				if got.(float64) != 0.00734 {
+					t.Errorf("price = %v", got)
+				}
+			},
+		},
+		{
+			"convert", func(c *Client) (any, error) { return c.Convert(context.Background(), "ban", "usd", 1e-7) },
+			"/convert?amount=0.0000001&from=ban&to=usd", `{"from":"ban","to":"usd","amount":1e-7,"result":7.34e-10,"rate":0.00734}`,
+			func(t *testing.T, got any) {
+				if want := (Conversion{From: "ban", To: "usd", Amount: 1e-7, Result: 7.34e-10, Rate: 0.00734}); *got.(*Conversion) != want {
+					t.Errorf("conversion = %+v, want %+v", got, want)
+				}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.RequestURI() != tt.want {
+					t.Errorf("request = %s, want %s", r.URL.RequestURI(), tt.want)
+				}
+				if accept := r.Header.Get("Accept"); accept != "application/json" {
+					t.Errorf("Accept = %q", accept)
+				}
+				if auth := r.Header.Get("Authorization"); auth != "" {
+					t.Errorf("anonymous request sent Authorization %q", auth)
+				}
+				w.Write([]byte(tt.reply))
+			})
+			got, err := tt.call(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.check != nil {
+				tt.check(t, got)
+			}
+		})
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "Bearer s3cret" {
+			t.Errorf("Authorization = %q, want the API key", auth)
+		}
+		w.Write([]byte(`{}`))
+	}, WithAPIKey("s3cret"))
+	if _, err := c.Prices(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		header   http.Header
+		body     string
+		want     Error
+		notFound bool
+	}{
+		{
+			"JSON error", http.StatusServiceUnavailable,
+			http.Header{"Retry-After": {"30"}, "X-Request-Id": {"from-header"}},
+			`{"error":"coinex rate limit exceeded","code":"upstream_rate_limited","request_id":"from-body"}`,
+			Error{StatusCode: 503, Message: "coinex rate limit exceeded", Code: "upstream_rate_limited", RequestID: "from-body", RetryAfter: 30 * time.Second}, false,
+		},
+		{
+			"unknown symbol", http.StatusNotFound, http.Header{"X-Request-Id": {"abc"}},
+			`{"error":"unknown symbol \"doge\"","symbols":["ban","eth"],"code":"not_found"}`,
+			Error{StatusCode: 404, Message: `unknown symbol "doge"`, Code: "not_found", RequestID: "abc"}, true,
+		},
+		{
+			"plain text", http.StatusBadGateway, nil, "upstream unavailable\n",
+			Error{StatusCode: 502, Message: "upstream unavailable"}, false,
+		},
+		{
+			"empty body", http.StatusInternalServerError, nil, "",
+			Error{StatusCode: 500, Message: "Internal Server Error"}, false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				for key, values := range tt.header {
+					w.Header()[key] = values
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			_, err := c.Prices(context.Background())
+			var apiErr *Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want an *Error", err)
+			}
+			if *apiErr != tt.want {
+				t.Errorf("error = %+v, want %+v", *apiErr, tt.want)
+			}
+			if IsNotFound(err) != tt.notFound {
+				t.Errorf("IsNotFound() = %t, want %t", IsNotFound(err), tt.notFound)
+			}
+		})
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	err := &Error{StatusCode: 503, Message: "prices too old", RequestID: "abc"}
+	if want := "wban prices API returned 503: prices too old (request abc)"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+	err.RequestID = ""
+	if want := "wban prices API returned 503: prices too old"; err.Error() != want {
+		t.Errorf("Error() = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestMalformedResponse(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ban":"soon"}`))
+	})
+	_, err := c.Prices(context.Background())
+	if err == nil || !strings.HasPrefix(err.Error(), "wban prices API /prices: json: cannot unmarshal") {
+		t.Errorf("error = %v, want a decoding error naming the path", err)
+	}
+	if IsNotFound(err) {
+		t.Error("decoding error reported as not found")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-release }))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	c, err := New(server.URL, WithTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Prices(context.Background())
+	var urlErr *url.Error
+	if !errors.As(err, &urlErr) || !urlErr.Timeout() {
+		t.Errorf("error = %v, want a timeout", err)
+	}
+}
@@ -0,0 +1,32 @@
+package client_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/client"
+)
+
+func Example() {
+	// A stand-in for https://prices.bananobridge.org.
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"ban":0.00734,"eth":2512.85}`))
+	}))
+	defer api.Close()
+
+	c, err := client.New(api.URL, client.WithTimeout(5*time.Second))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	prices, err := c.Prices(context.Background(), "ban", "eth")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Printf("BAN is at $%g\n", prices["ban"])
+	// Output: BAN is at $0.00734
+}
@@ -0,0 +1,239 @@
+// Package cache holds the last known prices of the markets, keyed by symbol.
+package cache
+
+import (
+	"log/slog"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+)
+
+// Origin tells where a cached price comes from.
+type Origin struct {
+	Source      string // Price source, or the aggregation of several.
+	BelowQuorum bool   // Aggregated from fewer sources than the quorum.
+}
+
+// Entry is the cached state of a symbol.
+type Entry struct {
+	Ticker    provider.Ticker
+	Origin    Origin
+	UpdatedAt time.Time // Time of the last successful fetch, zero until there was one.
+	Err       error     // Error of the last fetch, nil if it succeeded.
+	FailedAt  time.Time // Time of the last failed fetch, zero since the last successful one.
+	Outliers  int       // Consecutive fetched prices rejected as implausible, the symbol is suspect while not zero.
+	Smoothed  float64   // Moving average of the fetched prices when smoothing, zero until seeded.
+	Restored  bool      // Restored from a snapshot at startup, expired until fetched again.
+}
+
+// Price returns the published price of e: the moving average of the fetched prices when smoothing, the last one otherwise.
+func (e Entry) Price() float64 {
+	if e.Smoothed != 0 {
+		return e.Smoothed
+	}
+	return e.Ticker.Last
+}
+
+// FailedRecently tells if the last fetch of e failed less than ttl before now.
+func (e Entry) FailedRecently(now time.Time, ttl time.Duration) bool {
+	return !e.FailedAt.IsZero() && now.Sub(e.FailedAt) < ttl
+}
+
+// Options configure a Cache.
+type Options struct {
+	OutlierThreshold   float64 // Change from the cached price, in percent, beyond which a fetched price is rejected. 0 accepts any.
+	OutlierAcceptAfter int     // Consecutive rejected prices accepted as the new level.
+	SmoothingAlpha     float64 // Weight of every fetched price in the moving average, 0 disables smoothing.
+
+	Log *slog.Logger     // slog.Default() by default.
+	Now func() time.Time // time.Now by default.
+}
+
+// Hooks are called by a Cache with it locked, so that they see its changes in order.
+type Hooks struct {
+	Changed  func(entries map[string]Entry) // After every change of the prices, with the cache itself, to be read only.
+	Stored   func(symbol string, e Entry)   // After a fetched price was cached.
+	Rejected func(symbol string)            // After a fetched price was rejected as an implausible jump.
+}
+
+// Cache is the cache of the prices, safe for concurrent use.
+type Cache struct {
+	opts  Options
+	hooks Hooks
+
+	mutex   sync.Mutex
+	entries map[string]Entry
+	ready   atomic.Bool // Set once a price was cached.
+}
+
+// New returns an empty cache.
+func New(opts Options) *Cache {
+	if opts.Log == nil {
+		opts.Log = slog.Default()
+	}
+	if opts.Now == nil {
+		opts.Now = time.Now
+	}
+	return &Cache{opts: opts, entries: make(map[string]Entry)}
+}
+
+// SetHooks sets the hooks of c, before it is used.
+func (c *Cache) SetHooks(hooks Hooks) {
+	c.hooks = hooks
+}
+
+// changed calls the Changed hook. c.mutex must be held.
+func (c *Cache) changed() {
+	if c.hooks.Changed != nil {
+		c.hooks.Changed(c.entries)
+	}
+}
+
+// stored marks c ready and calls the hooks of the price cached for symbol. c.mutex must be held.
+func (c *Cache) stored(symbol string, entry Entry) {
+	c.ready.Store(true)
+	c.changed()
+	if c.hooks.Stored != nil {
+		c.hooks.Stored(symbol, entry)
+	}
+}
+
+// smooth returns the moving average of price following the one of previous, zero without smoothing.
+func (c *Cache) smooth(previous Entry, price float64) float64 {
+	if c.opts.SmoothingAlpha == 0 {
+		return 0
+	}
+	if previous.Smoothed == 0 {
+		return price
+	}
+	return c.opts.SmoothingAlpha*price + (1-c.opts.SmoothingAlpha)*previous.Smoothed
+}
+
+// Ready tells if a price was cached since c was created.
+func (c *Cache) Ready() bool {
+	return c.ready.Load()
+}
+
+// Snapshot returns a copy of the entries.
+func (c *Cache) Snapshot() map[string]Entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entries := make(map[string]Entry, len(c.entries))
+	for symbol, entry := range c.entries {
+		entries[symbol] = entry
+	}
+	return entries
+}
+
+// Store caches a freshly fetched ticker of symbol, and returns the cached one.
+// A price jumping away from the cached one by more than the outlier threshold is rejected, keeping the cached ticker,
+// until enough consecutive prices confirm the jump.
+func (c *Cache) Store(symbol string, ticker provider.Ticker, origin Origin) provider.Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	previous, ok := c.entries[symbol]
+	if ok && !previous.UpdatedAt.IsZero() && !previous.Restored && c.opts.OutlierThreshold > 0 && previous.Ticker.Last > 0 {
+		deviation := math.Abs(ticker.Last-previous.Ticker.Last) / previous.Ticker.Last * 100
+		if deviation > c.opts.OutlierThreshold {
+			previous.Outliers++
+			if previous.Outliers < c.opts.OutlierAcceptAfter {
+				c.opts.Log.Warn("storePrice | implausible price jump rejected, keeping the previous price", "symbol", symbol, "previous", previous.Ticker.Last, "fetched", ticker.Last, "source", origin.Source, "outliers", previous.Outliers)
+				if c.hooks.Rejected != nil {
+					c.hooks.Rejected(symbol)
+				}
+				previous.FailedAt = time.Time{}
+				c.entries[symbol] = previous
+				return previous.Ticker
+			}
+			c.opts.Log.Warn("storePrice | price jump confirmed, accepting the new level", "symbol", symbol, "previous", previous.Ticker.Last, "fetched", ticker.Last, "source", origin.Source, "outliers", previous.Outliers)
+		}
+	}
+
+	entry := Entry{Ticker: ticker, Origin: origin, UpdatedAt: c.opts.Now(), Smoothed: c.smooth(previous, ticker.Last)}
+	c.entries[symbol] = entry
+	c.stored(symbol, entry)
+	return ticker
+}
+
+// StoreShared caches a ticker of symbol fetched by another instance at updatedAt, which already checked the price jumps.
+func (c *Cache) StoreShared(symbol string, ticker provider.Ticker, origin Origin, updatedAt time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := Entry{Ticker: ticker, Origin: origin, UpdatedAt: updatedAt, Smoothed: c.smooth(c.entries[symbol], ticker.Last)}
+	c.entries[symbol] = entry
+	c.stored(symbol, entry)
+}
+
+// Restore caches a ticker of symbol restored from a snapshot, fetched at updatedAt, unless symbol was fetched since.
+func (c *Cache) Restore(symbol string, ticker provider.Ticker, origin Origin, updatedAt time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.entries[symbol].UpdatedAt.IsZero() {
+		return
+	}
+	c.entries[symbol] = Entry{Ticker: ticker, Origin: origin, UpdatedAt: updatedAt, Restored: true}
+	c.changed()
+}
+
+// StoreError records a failed fetch of symbol, keeping its last known price.
+func (c *Cache) StoreError(symbol string, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry := c.entries[symbol]
+	entry.Err, entry.FailedAt = err, c.opts.Now()
+	c.entries[symbol] = entry
+}
+
+// Flush forgets every cached price.
+func (c *Cache) Flush() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	clear(c.entries)
+	c.changed()
+}
+
+// ResetSmoothing restarts the moving averages of all symbols from their next fetched price.
+func (c *Cache) ResetSmoothing() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for symbol, entry := range c.entries {
+		entry.Smoothed = 0
+		c.entries[symbol] = entry
+	}
+	c.changed()
+}
+
+// Forget removes the cached prices of symbols.
+func (c *Cache) Forget(symbols []string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, symbol := range symbols {
+		delete(c.entries, symbol)
+	}
+	c.changed()
+}
+
+// Tickers returns the cached tickers of symbols, leaving out the ones never fetched.
+func (c *Cache) Tickers(symbols []string) map[string]provider.Ticker {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	tickers := make(map[string]provider.Ticker, len(symbols))
+	for _, symbol := range symbols {
+		if entry, ok := c.entries[symbol]; ok && !entry.UpdatedAt.IsZero() {
+			tickers[symbol] = entry.Ticker
+		}
+	}
+	return tickers
+}
@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"io"
+	"log/slog"
+	"math"
+	"testing"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+)
+
+func TestEMAIgnoresOutliers(t *testing.T) {
+	c := New(Options{OutlierThreshold: 50, OutlierAcceptAfter: 3, SmoothingAlpha: 0.5, Log: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	rejected := 0
+	c.SetHooks(Hooks{Rejected: func(string) { rejected++ }})
+
+	c.Store("ban", provider.Ticker{Last: 1}, Origin{Source: "coinex"})
+	steps := []struct {
+		fetched  float64
+		smoothed float64
+		outliers int
+	}{
+		{10, 1, 1},     // Rejected, the average doesn't move.
+		{1.2, 1.1, 0},  // Plausible again, averaged in.
+		{10, 1.1, 1},   // Rejected.
+		{10, 1.1, 2},   // Rejected.
+		{10, 5.55, 0},  // The third one in a row is the new level.
+		{10, 7.775, 0}, // Converging to it.
+	}
+	for i, step := range steps {
+		c.Store("ban", provider.Ticker{Last: step.fetched}, Origin{Source: "coinex"})
+		entry := c.Snapshot()["ban"]
+		if math.Abs(entry.Price()-step.smoothed) > 1e-12 || entry.Outliers != step.outliers {
+			t.Errorf("step %d, fetched %g: smoothed = %g with %d outliers, want %g with %d", i, step.fetched, entry.Price(), entry.Outliers, step.smoothed, step.outliers)
+		}
+	}
+	if rejected != 3 {
+		t.Errorf("%d prices rejected, want 3", rejected)
+	}
+}
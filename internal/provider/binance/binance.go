@@ -0,0 +1,111 @@
+// Package binance fetches the last prices of the Binance API.
+package binance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+	"github.com/wBanano/wban-prices-api/internal/tracing"
+)
+
+// Name of Binance among the price sources.
+const NAME = "binance"
+
+const DEFAULT_API_URL = "https://api.binance.com/api/v3"
+const ERROR_BODY_LOG_SIZE = 200
+
+// Options configure a Client.
+type Options struct {
+	Log    *slog.Logger
+	Tracer *tracing.Tracer // Nil for no tracing.
+
+	// NewRequest, if set, creates the requests instead of http.NewRequestWithContext, e.g. to set their headers.
+	NewRequest func(ctx context.Context, method, url string, body io.Reader) (*http.Request, error)
+}
+
+// tickerPrice is the response of /ticker/price.
+type tickerPrice struct {
+	Symbol string `json:"symbol"`
+	Price  string `json:"price"`
+}
+
+// Client fetches prices from the Binance API.
+type Client struct {
+	baseURL string
+	client  *http.Client
+	opts    Options
+}
+
+// New returns the client of the Binance API at baseURL, without trailing slash.
+func New(baseURL string, client *http.Client, opts Options) *Client {
+	if opts.Log == nil {
+		opts.Log = slog.Default()
+	}
+	if opts.NewRequest == nil {
+		opts.NewRequest = http.NewRequestWithContext
+	}
+	return &Client{baseURL: strings.TrimSuffix(baseURL, "/"), client: client, opts: opts}
+}
+
+func (c *Client) Name() string { return NAME }
+
+func (c *Client) Fetch(ctx context.Context, symbols []string) (map[string]provider.Ticker, error) {
+	tickers := make(map[string]provider.Ticker, len(symbols))
+	for _, symbol := range symbols {
+		ticker, err := c.fetch(ctx, symbol)
+		if err != nil {
+			return nil, err
+		}
+		tickers[symbol] = ticker
+	}
+	return tickers, nil
+}
+
+// fetch fetches the last price of a Binance symbol, in a single attempt: falling back to Binance is the retry already.
+// Only the last price of the ticker is set.
+func (c *Client) fetch(ctx context.Context, symbol string) (ticker provider.Ticker, err error) {
+	start := time.Now()
+	defer func() {
+		c.opts.Log.DebugContext(ctx, "binance | fetched", "symbol", symbol, "duration_ms", time.Since(start).Milliseconds(), "error", err)
+	}()
+
+	ctx, span := c.opts.Tracer.Start(ctx, "binance "+symbol, tracing.KindClient)
+	span.SetString("binance.symbol", symbol)
+	defer func() { span.Finish(err) }()
+
+	req, err := c.opts.NewRequest(ctx, http.MethodGet, c.baseURL+"/ticker/price?symbol="+url.QueryEscape(symbol), nil)
+	if err != nil {
+		return provider.Ticker{}, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return provider.Ticker{}, err
+	}
+	defer resp.Body.Close()
+	span.SetInt("http.response.status_code", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, ERROR_BODY_LOG_SIZE))
+		c.opts.Log.WarnContext(ctx, "binance | Binance returned an error", "symbol", symbol, "status", resp.StatusCode, "body", string(snippet))
+		return provider.Ticker{}, fmt.Errorf("binance returned %d for %s", resp.StatusCode, symbol)
+	}
+
+	var price tickerPrice
+	if err := json.NewDecoder(resp.Body).Decode(&price); err != nil {
+		return provider.Ticker{}, fmt.Errorf("binance %s: %w", symbol, err)
+	}
+	last, err := strconv.ParseFloat(price.Price, 64)
+	if err != nil {
+		return provider.Ticker{}, fmt.Errorf("binance %s: %w", symbol, err)
+	}
+	return provider.Ticker{Last: last, RawLast: price.Price}, nil
+}
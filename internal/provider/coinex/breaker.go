@@ -0,0 +1,150 @@
+package coinex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breaker stops calling CoinEx for a market after consecutive failures.
+// Once the cooldown is over, a single probe request is let through: its success closes the circuit again.
+type breaker struct {
+	state    breakerState
+	failures int // Consecutive failures.
+	openedAt time.Time
+}
+
+// CircuitOpenError is returned instead of calling CoinEx while the circuit of a market is open.
+type CircuitOpenError struct {
+	Market  string
+	RetryIn time.Duration
+}
+
+func (e *CircuitOpenError) Error() string {
+	if e.RetryIn == 0 {
+		return fmt.Sprintf("circuit open for %s, probing CoinEx", e.Market)
+	}
+	return fmt.Sprintf("circuit open for %s, retrying in %s", e.Market, e.RetryIn.Round(100*time.Millisecond))
+}
+
+func (e *CircuitOpenError) RetryAfter() time.Duration { return e.RetryIn }
+
+// breakers are the circuit breakers of a client, keyed by market.
+type breakers struct {
+	threshold int // 0 disables them.
+	cooldown  time.Duration
+	log       *slog.Logger
+
+	mutex  sync.Mutex
+	states map[string]*breaker
+}
+
+// allow tells if a request for market may be sent to CoinEx.
+func (bs *breakers) allow(market string) error {
+	if bs.threshold == 0 {
+		return nil
+	}
+
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	b := bs.states[market]
+	if b == nil || b.state == breakerClosed {
+		return nil
+	}
+
+	if b.state == breakerOpen {
+		if elapsed := time.Since(b.openedAt); elapsed < bs.cooldown {
+			return &CircuitOpenError{Market: market, RetryIn: bs.cooldown - elapsed}
+		}
+		b.state = breakerHalfOpen
+		bs.log.Info("breaker | half-open, probing CoinEx", "market", market)
+		return nil
+	}
+
+	// Half-open: the probe is still running.
+	return &CircuitOpenError{Market: market}
+}
+
+// record updates the circuit of market with the outcome of a request.
+func (bs *breakers) record(market string, err error) {
+	if bs.threshold == 0 {
+		return
+	}
+
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	b := bs.states[market]
+	// Our own rate limit says nothing of the health of CoinEx, neither does a cancelled request,
+	// but an inconclusive probe must let the next request probe again, or the circuit would stay half-open for good.
+	var throttledErr *ThrottledError
+	if errors.As(err, &throttledErr) || errors.Is(err, context.Canceled) {
+		if b != nil && b.state == breakerHalfOpen {
+			b.state = breakerOpen
+			bs.log.Info("breaker | probe inconclusive, open again", "market", market, "error", err)
+		}
+		return
+	}
+	if b == nil {
+		b = &breaker{}
+		bs.states[market] = b
+	}
+
+	if err == nil {
+		if b.state != breakerClosed {
+			bs.log.Info("breaker | closed", "market", market, "failures", b.failures)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= bs.threshold) {
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+		bs.log.Warn("breaker | open", "market", market, "cooldown", bs.cooldown, "failures", b.failures, "error", err)
+	}
+}
+
+// BreakerStats is the state of a circuit breaker in /stats.
+type BreakerStats struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures"`
+}
+
+// BreakerStats returns the state of the circuit breakers of c, keyed by market.
+func (c *Client) BreakerStats() map[string]BreakerStats {
+	bs := &c.breakers
+	bs.mutex.Lock()
+	defer bs.mutex.Unlock()
+
+	snapshot := make(map[string]BreakerStats, len(bs.states))
+	for market, b := range bs.states {
+		snapshot[market] = BreakerStats{State: b.state.String(), Failures: b.failures}
+	}
+	return snapshot
+}
@@ -0,0 +1,85 @@
+package coinex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newBreakers returns circuit breakers opening after threshold failures.
+func newBreakers(threshold int) *breakers {
+	return &breakers{threshold: threshold, cooldown: testOptions.BreakerCooldown, log: testOptions.Log, states: make(map[string]*breaker)}
+}
+
+// openBreaker fails market until its circuit opens, then lets the cooldown elapse.
+func openBreaker(t *testing.T, bs *breakers, market string) {
+	t.Helper()
+	for range bs.threshold {
+		bs.record(market, errors.New("coinex returned 500"))
+	}
+	var openErr *CircuitOpenError
+	if err := bs.allow(market); !errors.As(err, &openErr) {
+		t.Fatalf("allow() = %v after %d failures, want a CircuitOpenError", err, bs.threshold)
+	}
+	bs.mutex.Lock()
+	bs.states[market].openedAt = time.Now().Add(-bs.cooldown)
+	bs.mutex.Unlock()
+}
+
+func TestBreakerOpensAndCloses(t *testing.T) {
+	bs := newBreakers(3)
+	openBreaker(t, bs, "BANANOUSDT")
+
+	if err := bs.allow("BANANOUSDT"); err != nil {
+		t.Fatalf("probe not allowed after the cooldown: %v", err)
+	}
+	if err := bs.allow("BANANOUSDT"); err == nil {
+		t.Fatal("second request allowed while the probe runs")
+	}
+	bs.record("BANANOUSDT", nil)
+	if err := bs.allow("BANANOUSDT"); err != nil {
+		t.Fatalf("request not allowed after a successful probe: %v", err)
+	}
+}
+
+func TestBreakerFailedProbeReopens(t *testing.T) {
+	bs := newBreakers(3)
+	openBreaker(t, bs, "BANANOUSDT")
+
+	if err := bs.allow("BANANOUSDT"); err != nil {
+		t.Fatalf("probe not allowed after the cooldown: %v", err)
+	}
+	bs.record("BANANOUSDT", errors.New("coinex returned 500"))
+	var openErr *CircuitOpenError
+	if err := bs.allow("BANANOUSDT"); !errors.As(err, &openErr) || openErr.RetryIn == 0 {
+		t.Fatalf("allow() = %v after a failed probe, want a new cooldown", err)
+	}
+}
+
+func TestBreakerInconclusiveProbeProbesAgain(t *testing.T) {
+	for _, err := range []error{context.Canceled, fmt.Errorf("fetch: %w", context.Canceled), &ThrottledError{Wait: time.Second}} {
+		t.Run(err.Error(), func(t *testing.T) {
+			bs := newBreakers(3)
+			openBreaker(t, bs, "BANANOUSDT")
+
+			if err := bs.allow("BANANOUSDT"); err != nil {
+				t.Fatalf("probe not allowed after the cooldown: %v", err)
+			}
+			bs.record("BANANOUSDT", err)
+			if err := bs.allow("BANANOUSDT"); err != nil {
+				t.Fatalf("allow() = %v after an inconclusive probe, want another probe", err)
+			}
+		})
+	}
+}
+
+func TestBreakerIgnoresInconclusiveRequestsWhenClosed(t *testing.T) {
+	bs := newBreakers(1)
+	bs.record("BANANOUSDT", context.Canceled)
+	bs.record("BANANOUSDT", &ThrottledError{Wait: time.Second})
+	if err := bs.allow("BANANOUSDT"); err != nil {
+		t.Fatalf("allow() = %v after a cancelled and a throttled request", err)
+	}
+}
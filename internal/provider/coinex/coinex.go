@@ -0,0 +1,435 @@
+// Package coinex fetches tickers and klines from the CoinEx REST API, retrying transient failures behind circuit breakers
+// and under a rate limit.
+package coinex
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+	"github.com/wBanano/wban-prices-api/internal/tracing"
+)
+
+// Name of CoinEx among the price sources.
+const NAME = "coinex"
+
+const DEFAULT_API_URL = "https://api.coinex.com/v1"
+
+// Versions of the CoinEx REST API, v1 until v2 has been validated in production.
+const (
+	API_V1 = 1
+	API_V2 = 2
+)
+
+const BATCH_BREAKER_KEY = "ticker/all"
+const RETRY_BASE_DELAY = 100 * time.Millisecond
+const RETRY_MAX_DELAY = 5 * time.Second
+const ERROR_BODY_LOG_SIZE = 200
+
+// ErrRateLimited matches errors caused by CoinEx rate limiting our requests.
+var ErrRateLimited = errors.New("coinex rate limit exceeded")
+
+// Options configure a Client.
+type Options struct {
+	Version int // API_V1 or API_V2.
+	Retries int // How many times a failed request is retried.
+
+	// Consecutive failures of a market opening its circuit breaker, 0 disables them, and how long it stays open.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Requests per second and at once sent to CoinEx, 0 for no limit, and how long the rate is tightened after CoinEx rate limited us anyway.
+	RateLimit    float64
+	RateBurst    int
+	RateCooldown time.Duration
+
+	Log    *slog.Logger
+	Tracer *tracing.Tracer // Nil for no tracing.
+
+	// NewRequest, if set, creates the requests instead of http.NewRequestWithContext, e.g. to set their headers.
+	NewRequest func(ctx context.Context, method, url string, body io.Reader) (*http.Request, error)
+	// Observe, if set, is called with the outcome of every request sent to CoinEx.
+	Observe func(market string, elapsed time.Duration, err error)
+	// Throttled, if set, is called when a request fails by our own rate limit.
+	Throttled func()
+}
+
+// Client fetches tickers from the CoinEx REST API, retrying transient failures behind circuit breakers.
+// Both versions of the API name the markets alike, the version only changes the requests and their responses.
+type Client struct {
+	baseURL string
+	client  *http.Client
+	opts    Options
+	log     *slog.Logger
+
+	// Every request takes a token from limiter, shared by all the requests of the client
+	// so that the refreshes, candles and self-tests bursting at once don't get our IP banned.
+	limiter  limiter
+	breakers breakers
+}
+
+// New returns the client of the CoinEx API at baseURL, without trailing slash.
+func New(baseURL string, client *http.Client, opts Options) *Client {
+	if opts.Version == 0 {
+		opts.Version = API_V1
+	}
+	if opts.Log == nil {
+		opts.Log = slog.Default()
+	}
+	if opts.NewRequest == nil {
+		opts.NewRequest = http.NewRequestWithContext
+	}
+	c := &Client{baseURL: strings.TrimSuffix(baseURL, "/"), client: client, opts: opts, log: opts.Log}
+	c.limiter = limiter{rateLimit: opts.RateLimit, burst: opts.RateBurst, cooldown: opts.RateCooldown, log: opts.Log, onThrottle: opts.Throttled}
+	c.breakers = breakers{threshold: opts.BreakerThreshold, cooldown: opts.BreakerCooldown, log: opts.Log, states: make(map[string]*breaker)}
+	return c
+}
+
+// Version returns the version of the CoinEx API called by c.
+func (c *Client) Version() int { return c.opts.Version }
+
+func (c *Client) Name() string { return NAME }
+
+// Fetch fetches a single market on its own, and several ones with the batch request returning all CoinEx markets.
+func (c *Client) Fetch(ctx context.Context, markets []string) (map[string]provider.Ticker, error) {
+	if len(markets) != 1 {
+		return c.AllTickers(ctx)
+	}
+	ticker, err := c.Ticker(ctx, markets[0])
+	if err != nil {
+		return nil, err
+	}
+	return map[string]provider.Ticker{markets[0]: ticker}, nil
+}
+
+// StatusError is returned when CoinEx answers with a non-200 HTTP status.
+type StatusError struct {
+	Market     string
+	StatusCode int
+	Wait       time.Duration // Delay requested by a 429 response, if any.
+}
+
+func (e *StatusError) Error() string {
+	if e.StatusCode == http.StatusTooManyRequests {
+		return fmt.Sprintf("coinex rate limited the request for %s (429)", e.Market)
+	}
+	return fmt.Sprintf("coinex returned %d for %s", e.StatusCode, e.Market)
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == ErrRateLimited && e.StatusCode == http.StatusTooManyRequests
+}
+
+func (e *StatusError) RetryAfter() time.Duration { return e.Wait }
+
+// APIError is returned when CoinEx answers with a non-zero code, e.g. for unknown markets or throttling.
+type APIError struct {
+	Market  string
+	Code    int
+	Message string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("coinex error %d: %s (%s)", e.Code, e.Message, e.Market)
+}
+
+func (e *APIError) Is(target error) bool {
+	return target == ErrRateLimited && RateLimited(e.Code)
+}
+
+// apiError returns the error of a CoinEx response with a non-zero code, tightening the rate limit when it is a rate limit error.
+func (c *Client) apiError(ctx context.Context, market string, code int, message string) error {
+	if RateLimited(code) {
+		c.limiter.tighten(ctx)
+	}
+	return &APIError{Market: market, Code: code, Message: message}
+}
+
+// Ticker fetches the ticker of market, unless its circuit breaker is open.
+func (c *Client) Ticker(ctx context.Context, market string) (provider.Ticker, error) {
+	if err := c.breakers.allow(market); err != nil {
+		return provider.Ticker{}, err
+	}
+
+	var ticker provider.Ticker
+	err := c.withRetries(ctx, market, func(ctx context.Context) (err error) {
+		ticker, err = c.fetchPrice(ctx, market)
+		return err
+	})
+	c.breakers.record(market, err)
+	return ticker, err
+}
+
+// AllTickers fetches the ticker of every CoinEx market in a single request, unless its circuit breaker is open.
+func (c *Client) AllTickers(ctx context.Context) (map[string]provider.Ticker, error) {
+	if err := c.breakers.allow(BATCH_BREAKER_KEY); err != nil {
+		return nil, err
+	}
+
+	var tickers map[string]provider.Ticker
+	err := c.withRetries(ctx, BATCH_BREAKER_KEY, func(ctx context.Context) (err error) {
+		tickers, err = c.fetchAllPrices(ctx)
+		return err
+	})
+	c.breakers.record(BATCH_BREAKER_KEY, err)
+	return tickers, err
+}
+
+// withRetries calls fetch until it succeeds, retrying transient failures with exponential backoff.
+// The attempts are traced as a single span.
+func (c *Client) withRetries(ctx context.Context, what string, fetch func(ctx context.Context) error) (err error) {
+	ctx, span := c.opts.Tracer.Start(ctx, "coinex "+what, tracing.KindClient)
+	span.SetString("coinex.market", what)
+	defer func() { span.Finish(err) }()
+
+	for attempt := 1; ; attempt++ {
+		span.SetInt("coinex.retries", attempt-1)
+		err = fetch(ctx)
+		if err == nil {
+			return nil
+		}
+		if attempt > c.opts.Retries || !isRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+
+		// Don't start a retry which can't complete before the request deadline.
+		delay := backoffDelay(attempt)
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) && statusErr.Wait > delay {
+			delay = statusErr.Wait
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return err
+		}
+
+		c.log.WarnContext(ctx, "withRetries | attempt failed, retrying", "market", what, "attempt", attempt, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isRetryable tells if a failed fetch is worth retrying: network errors, 5xx, 429 and malformed bodies are,
+// other client errors, CoinEx errors, our own rate limit and cancellations are not.
+func isRetryable(err error) bool {
+	var apiErr *APIError
+	var throttledErr *ThrottledError
+	if errors.Is(err, context.Canceled) || errors.As(err, &apiErr) || errors.As(err, &throttledErr) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+	}
+	return true
+}
+
+// backoffDelay returns the delay before the retry following attempt, doubling at each attempt up to RETRY_MAX_DELAY, with full jitter.
+func backoffDelay(attempt int) time.Duration {
+	ceiling := RETRY_BASE_DELAY
+	for i := 1; i < attempt && ceiling < RETRY_MAX_DELAY; i++ {
+		ceiling *= 2
+	}
+	ceiling = min(ceiling, RETRY_MAX_DELAY)
+	return time.Duration(rand.Int63n(int64(ceiling))) + 1
+}
+
+func (c *Client) fetchPrice(ctx context.Context, market string) (provider.Ticker, error) {
+	if c.opts.Version == API_V2 {
+		return c.fetchPriceV2(ctx, market)
+	}
+
+	var tickerResp TickerResponse
+	if err := c.fetch(ctx, "/market/ticker?market="+market, market, &tickerResp); err != nil {
+		return provider.Ticker{}, err
+	}
+	if tickerResp.Code != 0 {
+		return provider.Ticker{}, c.apiError(ctx, market, tickerResp.Code, tickerResp.Message)
+	}
+
+	return tickerResp.Data.Ticker.Parse()
+}
+
+// fetchAllPrices returns the tickers of all CoinEx markets, keyed by market.
+// Markets whose ticker can't be parsed are left out.
+func (c *Client) fetchAllPrices(ctx context.Context) (map[string]provider.Ticker, error) {
+	if c.opts.Version == API_V2 {
+		return c.fetchAllPricesV2(ctx)
+	}
+
+	var tickersResp AllTickersResponse
+	if err := c.fetch(ctx, "/market/ticker/all", BATCH_BREAKER_KEY, &tickersResp); err != nil {
+		return nil, err
+	}
+	if tickersResp.Code != 0 {
+		return nil, c.apiError(ctx, BATCH_BREAKER_KEY, tickersResp.Code, tickersResp.Message)
+	}
+
+	tickers := make(map[string]provider.Ticker, len(tickersResp.Data.Ticker))
+	for market, coinexTicker := range tickersResp.Data.Ticker {
+		if ticker, err := coinexTicker.Parse(); err == nil {
+			tickers[market] = ticker
+		}
+	}
+	return tickers, nil
+}
+
+// Candle is a kline of CoinEx, T being its start in Unix seconds.
+type Candle struct {
+	T      int64
+	Open   float64
+	High   float64
+	Low    float64
+	Close  float64
+	Volume float64
+}
+
+// Candles fetches the last limit candles of market, period being a v1 kline type.
+func (c *Client) Candles(ctx context.Context, market, period string, limit int) ([]Candle, error) {
+	if c.opts.Version == API_V2 {
+		return c.candlesV2(ctx, market, period, limit)
+	}
+
+	var klineResp KlineResponse
+	err := c.withRetries(ctx, market, func(ctx context.Context) error {
+		return c.fetch(ctx, fmt.Sprintf("/market/kline?market=%s&type=%s&limit=%d", market, period, limit), market, &klineResp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if klineResp.Code != 0 {
+		return nil, c.apiError(ctx, market, klineResp.Code, klineResp.Message)
+	}
+
+	// Each kline is [time, open, close, high, low, volume, amount, market].
+	candles := make([]Candle, 0, len(klineResp.Data))
+	for _, kline := range klineResp.Data {
+		if len(kline) < 6 {
+			return nil, fmt.Errorf("coinex returned a malformed kline for %s", market)
+		}
+		var candle Candle
+		if err := json.Unmarshal(kline[0], &candle.T); err != nil {
+			return nil, fmt.Errorf("kline time of %s: %w", market, err)
+		}
+		for i, field := range []*float64{&candle.Open, &candle.Close, &candle.High, &candle.Low, &candle.Volume} {
+			var value string
+			if err := json.Unmarshal(kline[i+1], &value); err != nil {
+				return nil, fmt.Errorf("kline of %s: %w", market, err)
+			}
+			if *field, err = strconv.ParseFloat(value, 64); err != nil {
+				return nil, fmt.Errorf("kline of %s: %w", market, err)
+			}
+		}
+		candles = append(candles, candle)
+	}
+	return candles, nil
+}
+
+// fetch sends a GET request to a CoinEx API path and decodes the JSON response into v, once the limiter lets it.
+// market names the request in errors, logs and metrics.
+func (c *Client) fetch(ctx context.Context, path string, market string, v any) (err error) {
+	if err := c.limiter.wait(ctx); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		if c.opts.Observe != nil {
+			c.opts.Observe(market, elapsed, err)
+		}
+		c.log.DebugContext(ctx, "coinex | fetched", "market", market, "duration_ms", elapsed.Milliseconds(), "error", err)
+	}()
+
+	url := fmt.Sprintf("%s%s", c.baseURL, path)
+	req, err := c.opts.NewRequest(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	span := tracing.FromContext(ctx)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	span.SetInt("http.response.status_code", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		// Error pages are not JSON, keep the beginning of the body in the logs to help debugging.
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, ERROR_BODY_LOG_SIZE))
+		c.log.WarnContext(ctx, "coinex | CoinEx returned an error", "market", market, "status", resp.StatusCode, "body", string(snippet))
+
+		statusErr := &StatusError{Market: market, StatusCode: resp.StatusCode}
+		if resp.StatusCode == http.StatusTooManyRequests {
+			c.limiter.tighten(ctx)
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+				statusErr.Wait = time.Duration(seconds) * time.Second
+			}
+		}
+		return statusErr
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// V1Ticker is a market of the v1 tickers.
+type V1Ticker struct {
+	Last string `json:"last"`
+	Open string `json:"open"`
+	High string `json:"high"`
+	Low  string `json:"low"`
+	Vol  string `json:"vol"`
+}
+
+// Parse converts the decimal strings of CoinEx. Only the last price is mandatory.
+func (t V1Ticker) Parse() (provider.Ticker, error) {
+	last, err := strconv.ParseFloat(t.Last, 64)
+	if err != nil {
+		return provider.Ticker{}, err
+	}
+
+	ticker := provider.Ticker{Last: last, RawLast: t.Last}
+	ticker.Open, _ = strconv.ParseFloat(t.Open, 64)
+	ticker.High, _ = strconv.ParseFloat(t.High, 64)
+	ticker.Low, _ = strconv.ParseFloat(t.Low, 64)
+	ticker.Volume, _ = strconv.ParseFloat(t.Vol, 64)
+	return ticker, nil
+}
+
+type TickerResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		Ticker V1Ticker `json:"ticker"`
+	} `json:"data"`
+}
+
+type AllTickersResponse struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+	Data    struct {
+		Ticker map[string]V1Ticker `json:"ticker"`
+	} `json:"data"`
+}
+
+type KlineResponse struct {
+	Code    int                 `json:"code"`
+	Message string              `json:"message"`
+	Data    [][]json.RawMessage `json:"data"`
+}
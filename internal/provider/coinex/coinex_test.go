@@ -0,0 +1,264 @@
+package coinex
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+)
+
+// testOptions are the options of the server by default.
+var testOptions = Options{
+	Retries:          3,
+	BreakerThreshold: 5,
+	BreakerCooldown:  30 * time.Second,
+	RateLimit:        DEFAULT_RATE_LIMIT,
+	RateBurst:        DEFAULT_RATE_BURST,
+	RateCooldown:     DEFAULT_RATE_COOLDOWN,
+	// The expected warnings of the tests would drown their output.
+	Log: slog.New(slog.NewTextHandler(io.Discard, nil)),
+}
+
+// newTestClient returns a client with opts of a fake CoinEx API served by handler.
+func newTestClient(t *testing.T, opts Options, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return New(server.URL, server.Client(), opts)
+}
+
+func TestBackoffDelayIsBounded(t *testing.T) {
+	for attempt := 1; attempt <= 200; attempt++ {
+		ceiling := min(RETRY_BASE_DELAY<<min(attempt-1, 20), RETRY_MAX_DELAY)
+		for range 20 {
+			if delay := backoffDelay(attempt); delay <= 0 || delay > ceiling {
+				t.Fatalf("backoffDelay(%d) = %s, want within (0, %s]", attempt, delay, ceiling)
+			}
+		}
+	}
+}
+
+// Canned CoinEx v1 responses.
+const (
+	tickerFixture        = `{"code": 0, "data": {"date": 1700000000000, "ticker": {"buy": "0.00733", "buy_amount": "1000", "high": "0.0075", "last": "0.00734", "low": "0.007", "open": "0.007", "sell": "0.00735", "sell_amount": "2000", "vol": "123456.78"}}, "message": "OK"}`
+	unknownMarketFixture = `{"code": 607, "data": {}, "message": "market not exist"}`
+	throttledFixture     = `{"code": 213, "data": {}, "message": "Too many requests"}`
+)
+
+func TestFetchPriceParsesTicker(t *testing.T) {
+	c := newTestClient(t, testOptions, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/market/ticker" || r.URL.Query().Get("market") != "BANANOUSDT" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		w.Write([]byte(tickerFixture))
+	})
+
+	ticker, err := c.fetchPrice(context.Background(), "BANANOUSDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := provider.Ticker{Last: 0.00734, RawLast: "0.00734", Open: 0.007, High: 0.0075, Low: 0.007, Volume: 123456.78}
+	if ticker != want {
+		t.Errorf("fetchPrice() = %+v, want %+v", ticker, want)
+	}
+}
+
+func TestTickerCoinexErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		want        string
+		rateLimited bool
+	}{
+		{"unknown market", unknownMarketFixture, "coinex error 607: market not exist (BANANOUSDT)", false},
+		{"throttled", throttledFixture, "coinex error 213: Too many requests (BANANOUSDT)", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			c := newTestClient(t, testOptions, func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				w.Write([]byte(tt.body))
+			})
+
+			_, err := c.Ticker(context.Background(), "BANANOUSDT")
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || err.Error() != tt.want {
+				t.Fatalf("Ticker() error = %v, want %q", err, tt.want)
+			}
+			if got := errors.Is(err, ErrRateLimited); got != tt.rateLimited {
+				t.Errorf("errors.Is(err, ErrRateLimited) = %t, want %t", got, tt.rateLimited)
+			}
+			if tightened := c.LimiterStats().TightenedUntil != nil; tightened != tt.rateLimited {
+				t.Errorf("limiter tightened = %t, want %t", tightened, tt.rateLimited)
+			}
+			// CoinEx errors are answers, retrying them would only get the same one.
+			if n := requests.Load(); n != 1 {
+				t.Errorf("CoinEx got %d requests, want 1", n)
+			}
+		})
+	}
+}
+
+func TestObserveAndNewRequest(t *testing.T) {
+	opts := testOptions
+	var observed []string
+	opts.Observe = func(market string, elapsed time.Duration, err error) {
+		observed = append(observed, market+" "+strconv.FormatBool(err == nil))
+	}
+	opts.NewRequest = func(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, method, url, body)
+		if err == nil {
+			req.Header.Set("User-Agent", "test")
+		}
+		return req, err
+	}
+	c := newTestClient(t, opts, func(w http.ResponseWriter, r *http.Request) {
+		if ua := r.Header.Get("User-Agent"); ua != "test" {
+			t.Errorf("User-Agent = %q, want the one set by NewRequest", ua)
+		}
+		w.Write([]byte(tickerFixture))
+	})
+
+	if _, err := c.Ticker(context.Background(), "BANANOUSDT"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(observed, []string{"BANANOUSDT true"}) {
+		t.Errorf("observed %q, want the single successful request", observed)
+	}
+}
+
+// Canned responses of both versions of the CoinEx API, for the same tickers and klines.
+var fixtures = map[int]map[string]string{
+	API_V1: {
+		"/market/ticker?market=BANANOUSDT": tickerFixture,
+		"/market/ticker/all": `{"code": 0, "data": {"date": 1700000000000, "ticker": {
+			"BANANOUSDT": {"buy": "0.00733", "high": "0.0075", "last": "0.00734", "low": "0.007", "open": "0.007", "sell": "0.00735", "vol": "123456.78"},
+			"ETHUSDC": {"buy": "2512.8", "high": "2533.33", "last": "2512.85", "low": "2450.1", "open": "2480", "sell": "2512.9", "vol": "4893.27"},
+			"BROKENUSDT": {"last": "", "vol": "1"}
+		}}, "message": "OK"}`,
+		"/market/kline?market=BANANOUSDT&type=1hour&limit=2": `{"code": 0, "data": [
+			[1700000000, "0.007", "0.0072", "0.0073", "0.0069", "1000", "7.1", "BANANOUSDT"],
+			[1700003600, "0.0072", "0.00734", "0.0075", "0.0071", "2000", "14.5", "BANANOUSDT"]
+		], "message": "OK"}`,
+	},
+	API_V2: {
+		"/spot/ticker?market=BANANOUSDT": `{"code": 0, "data": [
+			{"market": "BANANOUSDT", "last": "0.00734", "open": "0.007", "close": "0.00734", "high": "0.0075", "low": "0.007", "volume": "123456.78", "value": "905.67", "volume_sell": "1", "volume_buy": "2", "period": 86400}
+		], "message": "OK"}`,
+		"/spot/ticker": `{"code": 0, "data": [
+			{"market": "BANANOUSDT", "last": "0.00734", "open": "0.007", "high": "0.0075", "low": "0.007", "volume": "123456.78", "period": 86400},
+			{"market": "ETHUSDC", "last": "2512.85", "open": "2480", "high": "2533.33", "low": "2450.1", "volume": "4893.27", "period": 86400},
+			{"market": "BROKENUSDT", "last": "", "volume": "1", "period": 86400}
+		], "message": "OK"}`,
+		"/spot/kline?market=BANANOUSDT&period=1hour&limit=2": `{"code": 0, "data": [
+			{"market": "BANANOUSDT", "created_at": 1700000000000, "open": "0.007", "close": "0.0072", "high": "0.0073", "low": "0.0069", "volume": "1000", "value": "7.1"},
+			{"market": "BANANOUSDT", "created_at": 1700003600000, "open": "0.0072", "close": "0.00734", "high": "0.0075", "low": "0.0071", "volume": "2000", "value": "14.5"}
+		], "message": "OK"}`,
+	},
+}
+
+// newVersionClient returns a client of a version of the CoinEx API, served from its fixtures.
+func newVersionClient(t *testing.T, version int) *Client {
+	t.Helper()
+	opts := testOptions
+	opts.Version, opts.RateLimit = version, 0
+	return newTestClient(t, opts, func(w http.ResponseWriter, r *http.Request) {
+		body, ok := fixtures[version][r.URL.RequestURI()]
+		if !ok {
+			t.Errorf("unexpected request %s to v%d", r.URL.RequestURI(), version)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(body))
+	})
+}
+
+func TestVersions(t *testing.T) {
+	ban := provider.Ticker{Last: 0.00734, RawLast: "0.00734", Open: 0.007, High: 0.0075, Low: 0.007, Volume: 123456.78}
+	eth := provider.Ticker{Last: 2512.85, RawLast: "2512.85", Open: 2480, High: 2533.33, Low: 2450.1, Volume: 4893.27}
+	candles := []Candle{
+		{T: 1700000000, Open: 0.007, Close: 0.0072, High: 0.0073, Low: 0.0069, Volume: 1000},
+		{T: 1700003600, Open: 0.0072, Close: 0.00734, High: 0.0075, Low: 0.0071, Volume: 2000},
+	}
+
+	for _, version := range []int{API_V1, API_V2} {
+		t.Run("v"+strconv.Itoa(version), func(t *testing.T) {
+			c := newVersionClient(t, version)
+			ctx := context.Background()
+
+			if ticker, err := c.fetchPrice(ctx, "BANANOUSDT"); err != nil || ticker != ban {
+				t.Errorf("fetchPrice() = %+v, %v, want %+v", ticker, err, ban)
+			}
+			// The unparseable tickers are left out.
+			want := map[string]provider.Ticker{"BANANOUSDT": ban, "ETHUSDC": eth}
+			if tickers, err := c.fetchAllPrices(ctx); err != nil || !reflect.DeepEqual(tickers, want) {
+				t.Errorf("fetchAllPrices() = %+v, %v, want %+v", tickers, err, want)
+			}
+			if got, err := c.Candles(ctx, "BANANOUSDT", "1hour", 2); err != nil || !reflect.DeepEqual(got, candles) {
+				t.Errorf("Candles() = %+v, %v, want %+v", got, err, candles)
+			}
+		})
+	}
+}
+
+func TestV2Errors(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		want        string
+		rateLimited bool
+	}{
+		{"rate limited", `{"code": 4213, "data": {}, "message": "Rate limit triggered"}`, "coinex error 4213: Rate limit triggered (BANANOUSDT)", true},
+		{"unknown market", `{"code": 3639, "data": {}, "message": "market not found"}`, "coinex error 3639: market not found (BANANOUSDT)", false},
+		{"no ticker", `{"code": 0, "data": [], "message": "OK"}`, "coinex returned no ticker for BANANOUSDT", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := testOptions
+			opts.Version = API_V2
+			requests := 0
+			c := newTestClient(t, opts, func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				w.Write([]byte(tt.body))
+			})
+
+			_, err := c.Ticker(context.Background(), "BANANOUSDT")
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("Ticker() error = %v, want %q", err, tt.want)
+			}
+			if got := errors.Is(err, ErrRateLimited); got != tt.rateLimited {
+				t.Errorf("errors.Is(err, ErrRateLimited) = %t, want %t", got, tt.rateLimited)
+			}
+			if tightened := c.LimiterStats().TightenedUntil != nil; tightened != tt.rateLimited {
+				t.Errorf("limiter tightened = %t, want %t", tightened, tt.rateLimited)
+			}
+			if tt.rateLimited && requests != 1 {
+				t.Errorf("CoinEx got %d requests, want a single one", requests)
+			}
+		})
+	}
+}
+
+func TestV2KlineError(t *testing.T) {
+	opts := testOptions
+	opts.Version = API_V2
+	c := newTestClient(t, opts, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"code": 4213, "data": {}, "message": "Rate limit triggered"}`))
+	})
+
+	_, err := c.Candles(context.Background(), "BANANOUSDT", "1hour", 2)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != 4213 || !errors.Is(err, ErrRateLimited) {
+		t.Errorf("Candles() error = %v, want the rate limit error of CoinEx", err)
+	}
+}
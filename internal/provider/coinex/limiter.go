@@ -0,0 +1,172 @@
+package coinex
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+const (
+	// Well under the public API rate limit of CoinEx, which bans the IPs exceeding it for a while.
+	DEFAULT_RATE_LIMIT    = 10
+	DEFAULT_RATE_BURST    = 20
+	DEFAULT_RATE_COOLDOWN = time.Minute
+
+	// Share of the rate limit left for the cooldown after CoinEx rate limited us anyway.
+	TIGHTENED_RATE_FACTOR = 0.25
+
+	// Codes of the CoinEx errors answering too frequent requests, in the v1 and v2 APIs.
+	RATE_LIMITED_CODE    = 213
+	V2_RATE_LIMITED_CODE = 4213
+)
+
+// RateLimited tells if code is the one of a CoinEx error answering too frequent requests.
+func RateLimited(code int) bool {
+	return code == RATE_LIMITED_CODE || code == V2_RATE_LIMITED_CODE
+}
+
+// ThrottledError is returned when a request to CoinEx would wait for the limiter longer than its context allows.
+type ThrottledError struct {
+	Wait time.Duration
+}
+
+func (e *ThrottledError) Error() string {
+	return fmt.Sprintf("coinex request rate exceeded, next request in %s", e.Wait.Round(time.Millisecond))
+}
+func (e *ThrottledError) Is(target error) bool      { return target == ErrRateLimited }
+func (e *ThrottledError) RetryAfter() time.Duration { return e.Wait }
+
+// limiter is a token bucket whose tokens are reserved in turn: they go negative while requests wait for them.
+type limiter struct {
+	rateLimit  float64 // 0 for no limit.
+	burst      int
+	cooldown   time.Duration
+	log        *slog.Logger
+	onThrottle func()
+
+	mu             sync.Mutex
+	tokens         float64
+	last           time.Time // Of the last refill, zero until the first request.
+	tightenedUntil time.Time
+	waiting        int
+	throttled      int64
+}
+
+// rate returns the requests per second allowed at now. l.mu must be held.
+func (l *limiter) rate(now time.Time) float64 {
+	if now.Before(l.tightenedUntil) {
+		return l.rateLimit * TIGHTENED_RATE_FACTOR
+	}
+	return l.rateLimit
+}
+
+// refill adds the tokens earned since the last refill. l.mu must be held.
+func (l *limiter) refill(now time.Time) {
+	if l.last.IsZero() {
+		l.tokens = float64(l.burst)
+	} else {
+		l.tokens = min(float64(l.burst), l.tokens+now.Sub(l.last).Seconds()*l.rate(now))
+	}
+	l.last = now
+}
+
+// wait takes a token, waiting for it as long as ctx allows, and fails with a *ThrottledError when ctx doesn't.
+func (l *limiter) wait(ctx context.Context) error {
+	if l.rateLimit == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.refill(now)
+	l.tokens--
+	if l.tokens >= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	delay := time.Duration(-l.tokens / l.rate(now) * float64(time.Second))
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		l.tokens++
+		l.throttled++
+		l.mu.Unlock()
+		if l.onThrottle != nil {
+			l.onThrottle()
+		}
+		return &ThrottledError{Wait: delay}
+	}
+	l.waiting++
+	l.mu.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.waiting--
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	case <-timer.C:
+		l.mu.Lock()
+		l.waiting--
+		l.mu.Unlock()
+		return nil
+	}
+}
+
+// tighten lowers the rate for the cooldown, CoinEx having rate limited us anyway, and drops the burst left.
+func (l *limiter) tighten(ctx context.Context) {
+	if l.rateLimit == 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.refill(now)
+	tightened := now.Before(l.tightenedUntil)
+	l.tightenedUntil = now.Add(l.cooldown)
+	l.tokens = min(l.tokens, 0)
+	rate := l.rate(now)
+	l.mu.Unlock()
+
+	if !tightened {
+		l.log.WarnContext(ctx, "coinexLimiter | rate limited by CoinEx, tightening the rate limit", "rate", rate, "cooldown", l.cooldown)
+	}
+}
+
+// LimiterStats is the occupancy of the CoinEx rate limiter in /stats.
+type LimiterStats struct {
+	Rate           float64    `json:"rate"`                      // Requests per second, lowered while tightened.
+	Burst          int        `json:"burst"`                     // Requests which can be sent at once.
+	Available      float64    `json:"available"`                 // Requests which can be sent right away.
+	Waiting        int        `json:"waiting"`                   // Requests waiting for their turn.
+	Throttled      int64      `json:"throttled"`                 // Requests failed, their deadline not leaving time to wait for their turn.
+	TightenedUntil *time.Time `json:"tightened_until,omitempty"` // End of the cooldown after CoinEx rate limited us.
+}
+
+// LimiterStats returns the occupancy of the rate limiter of c, nil when CoinEx isn't rate limited.
+func (c *Client) LimiterStats() *LimiterStats {
+	l := &c.limiter
+	if l.rateLimit == 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.refill(now)
+	stats := &LimiterStats{
+		Rate:      l.rate(now),
+		Burst:     l.burst,
+		Available: max(l.tokens, 0),
+		Waiting:   l.waiting,
+		Throttled: l.throttled,
+	}
+	if now.Before(l.tightenedUntil) {
+		until := l.tightenedUntil
+		stats.TightenedUntil = &until
+	}
+	return stats
+}
@@ -0,0 +1,128 @@
+package coinex
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+)
+
+const DEFAULT_V2_API_URL = "https://api.coinex.com/v2"
+
+// V2Ticker is a market of the v2 spot tickers, their 24 hours volume being named volume rather than vol.
+type V2Ticker struct {
+	Market string `json:"market"`
+	Last   string `json:"last"`
+	Open   string `json:"open"`
+	High   string `json:"high"`
+	Low    string `json:"low"`
+	Volume string `json:"volume"`
+}
+
+// Parse converts the decimal strings of CoinEx, like V1Ticker.Parse.
+func (t V2Ticker) Parse() (provider.Ticker, error) {
+	return V1Ticker{Last: t.Last, Open: t.Open, High: t.High, Low: t.Low, Vol: t.Volume}.Parse()
+}
+
+// coinexV2List is the data of the v2 responses, which CoinEx sends as an empty object along with its errors.
+type coinexV2List[T any] []T
+
+func (l *coinexV2List[T]) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+		*l = nil
+		return nil
+	}
+	return json.Unmarshal(data, (*[]T)(l))
+}
+
+// The v2 responses list their markets, the market names being those of v1.
+type TickersV2Response struct {
+	Code    int                    `json:"code"`
+	Message string                 `json:"message"`
+	Data    coinexV2List[V2Ticker] `json:"data"`
+}
+
+type V2Kline struct {
+	CreatedAt int64  `json:"created_at"` // Unix milliseconds.
+	Open      string `json:"open"`
+	Close     string `json:"close"`
+	High      string `json:"high"`
+	Low       string `json:"low"`
+	Volume    string `json:"volume"`
+}
+
+type KlineV2Response struct {
+	Code    int                   `json:"code"`
+	Message string                `json:"message"`
+	Data    coinexV2List[V2Kline] `json:"data"`
+}
+
+func (c *Client) fetchPriceV2(ctx context.Context, market string) (provider.Ticker, error) {
+	var tickersResp TickersV2Response
+	if err := c.fetch(ctx, "/spot/ticker?market="+market, market, &tickersResp); err != nil {
+		return provider.Ticker{}, err
+	}
+	if tickersResp.Code != 0 {
+		return provider.Ticker{}, c.apiError(ctx, market, tickersResp.Code, tickersResp.Message)
+	}
+
+	for _, coinexTicker := range tickersResp.Data {
+		if coinexTicker.Market == market {
+			return coinexTicker.Parse()
+		}
+	}
+	return provider.Ticker{}, fmt.Errorf("coinex returned no ticker for %s", market)
+}
+
+// fetchAllPricesV2 returns the tickers of all CoinEx markets, the v2 ticker request without market listing them all.
+func (c *Client) fetchAllPricesV2(ctx context.Context) (map[string]provider.Ticker, error) {
+	var tickersResp TickersV2Response
+	if err := c.fetch(ctx, "/spot/ticker", BATCH_BREAKER_KEY, &tickersResp); err != nil {
+		return nil, err
+	}
+	if tickersResp.Code != 0 {
+		return nil, c.apiError(ctx, BATCH_BREAKER_KEY, tickersResp.Code, tickersResp.Message)
+	}
+
+	tickers := make(map[string]provider.Ticker, len(tickersResp.Data))
+	for _, coinexTicker := range tickersResp.Data {
+		if ticker, err := coinexTicker.Parse(); err == nil {
+			tickers[coinexTicker.Market] = ticker
+		}
+	}
+	return tickers, nil
+}
+
+// candlesV2 fetches the last limit candles of market from the v2 klines, whose periods are the v1 kline types.
+func (c *Client) candlesV2(ctx context.Context, market, period string, limit int) ([]Candle, error) {
+	var klineResp KlineV2Response
+	err := c.withRetries(ctx, market, func(ctx context.Context) error {
+		return c.fetch(ctx, fmt.Sprintf("/spot/kline?market=%s&period=%s&limit=%d", market, period, limit), market, &klineResp)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if klineResp.Code != 0 {
+		return nil, c.apiError(ctx, market, klineResp.Code, klineResp.Message)
+	}
+
+	candles := make([]Candle, 0, len(klineResp.Data))
+	for _, kline := range klineResp.Data {
+		candle := Candle{T: time.UnixMilli(kline.CreatedAt).Unix()}
+		for _, field := range []struct {
+			value string
+			to    *float64
+		}{{kline.Open, &candle.Open}, {kline.Close, &candle.Close}, {kline.High, &candle.High}, {kline.Low, &candle.Low}, {kline.Volume, &candle.Volume}} {
+			var err error
+			if *field.to, err = strconv.ParseFloat(field.value, 64); err != nil {
+				return nil, fmt.Errorf("kline of %s: %w", market, err)
+			}
+		}
+		candles = append(candles, candle)
+	}
+	return candles, nil
+}
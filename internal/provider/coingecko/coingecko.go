@@ -0,0 +1,203 @@
+// Package coingecko fetches tickers from the CoinGecko API.
+package coingecko
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+	"github.com/wBanano/wban-prices-api/internal/tracing"
+)
+
+// Name of CoinGecko among the price sources.
+const NAME = "coingecko"
+
+const (
+	DEFAULT_API_URL = "https://api.coingecko.com/api/v3"
+
+	// Header of the demo API keys, raising the rate limit of the public API.
+	API_KEY_HEADER = "x-cg-demo-api-key"
+
+	// How long CoinGecko isn't called after it rate limited us, unless it tells otherwise.
+	COOLDOWN = time.Minute
+
+	ERROR_BODY_LOG_SIZE = 200
+)
+
+// Options configure a Client.
+type Options struct {
+	APIKey string          // Sent along with the requests when set.
+	Coins  func() []string // IDs of the coins fetched along with the requested ones.
+
+	Log    *slog.Logger
+	Tracer *tracing.Tracer // Nil for no tracing.
+
+	// NewRequest, if set, creates the requests instead of http.NewRequestWithContext, e.g. to set their headers.
+	NewRequest func(ctx context.Context, method, url string, body io.Reader) (*http.Request, error)
+}
+
+// coinPrice is the market data of a coin in the /simple/price response.
+type coinPrice struct {
+	USD       float64 `json:"usd"`
+	Change24h float64 `json:"usd_24h_change"`
+	Volume24h float64 `json:"usd_24h_vol"`
+}
+
+// Client fetches prices from the CoinGecko API, holding off for the cooldown it imposes after rate limiting us.
+type Client struct {
+	baseURL string
+	client  *http.Client
+	opts    Options
+	flights singleflight.Group
+
+	mu            sync.Mutex
+	cooldownUntil time.Time
+}
+
+// New returns the client of the CoinGecko API at baseURL, without trailing slash.
+func New(baseURL string, client *http.Client, opts Options) *Client {
+	if opts.Log == nil {
+		opts.Log = slog.Default()
+	}
+	if opts.NewRequest == nil {
+		opts.NewRequest = http.NewRequestWithContext
+	}
+	if opts.Coins == nil {
+		opts.Coins = func() []string { return nil }
+	}
+	return &Client{baseURL: strings.TrimSuffix(baseURL, "/"), client: client, opts: opts}
+}
+
+// ErrRateLimited matches the errors of CoinGecko rate limiting us.
+var ErrRateLimited = errors.New("coingecko rate limit exceeded")
+
+// CooldownError is returned while CoinGecko rate limits us, for the wait left until the cooldown ends.
+type CooldownError struct {
+	Wait time.Duration
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("%v, cooling down for %s", ErrRateLimited, e.Wait.Round(time.Second))
+}
+func (e *CooldownError) Is(target error) bool      { return target == ErrRateLimited }
+func (e *CooldownError) RetryAfter() time.Duration { return e.Wait }
+
+func (c *Client) Name() string { return NAME }
+
+// Fetch fetches the requested coins along with all the ones of Options.Coins at once,
+// concurrent callers sharing that single request. The request outlives the callers giving up on it.
+func (c *Client) Fetch(ctx context.Context, ids []string) (map[string]provider.Ticker, error) {
+	if wait := c.cooldown(); wait > 0 {
+		return nil, &CooldownError{Wait: wait}
+	}
+
+	for _, id := range c.opts.Coins() {
+		if id != "" && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	fetched := c.flights.DoChan("all", func() (any, error) {
+		return c.fetch(context.WithoutCancel(ctx), ids)
+	})
+	select {
+	case result := <-fetched:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.(map[string]provider.Ticker), nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) cooldown() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return time.Until(c.cooldownUntil)
+}
+
+func (c *Client) coolDown(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.cooldownUntil = time.Now().Add(d)
+}
+
+// fetch returns the tickers of the given coin IDs, leaving out the unknown ones.
+func (c *Client) fetch(ctx context.Context, ids []string) (tickers map[string]provider.Ticker, err error) {
+	start := time.Now()
+	defer func() {
+		c.opts.Log.DebugContext(ctx, "coingecko | fetched", "coins", len(ids), "duration_ms", time.Since(start).Milliseconds(), "error", err)
+	}()
+
+	ctx, span := c.opts.Tracer.Start(ctx, "coingecko simple/price", tracing.KindClient)
+	span.SetInt("coingecko.coins", len(ids))
+	defer func() { span.Finish(err) }()
+
+	query := url.Values{"ids": {strings.Join(ids, ",")}, "vs_currencies": {"usd"}, "include_24hr_change": {"true"}, "include_24hr_vol": {"true"}}
+	req, err := c.opts.NewRequest(ctx, http.MethodGet, c.baseURL+"/simple/price?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.opts.APIKey != "" {
+		req.Header.Set(API_KEY_HEADER, c.opts.APIKey)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	span.SetInt("http.response.status_code", resp.StatusCode)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		cooldown := COOLDOWN
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			cooldown = time.Duration(seconds) * time.Second
+		}
+		c.coolDown(cooldown)
+		c.opts.Log.WarnContext(ctx, "coingecko | rate limited, cooling down", "cooldown", cooldown)
+		return nil, &CooldownError{Wait: cooldown}
+	}
+	if resp.StatusCode != http.StatusOK {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, ERROR_BODY_LOG_SIZE))
+		c.opts.Log.WarnContext(ctx, "coingecko | CoinGecko returned an error", "status", resp.StatusCode, "body", string(snippet))
+		return nil, fmt.Errorf("coingecko returned %d", resp.StatusCode)
+	}
+
+	var prices map[string]coinPrice
+	if err := json.NewDecoder(resp.Body).Decode(&prices); err != nil {
+		return nil, fmt.Errorf("coingecko: %w", err)
+	}
+	return tickersOf(prices), nil
+}
+
+// tickersOf converts the market data of CoinGecko, whose volume is in USD, into tickers.
+// Coins without a price are left out.
+func tickersOf(prices map[string]coinPrice) map[string]provider.Ticker {
+	tickers := make(map[string]provider.Ticker, len(prices))
+	for id, p := range prices {
+		if p.USD <= 0 {
+			continue
+		}
+		ticker := provider.Ticker{Last: p.USD, Volume: p.Volume24h / p.USD}
+		if p.Change24h > -100 {
+			ticker.Open = p.USD / (1 + p.Change24h/100)
+		}
+		tickers[id] = ticker
+	}
+	return tickers
+}
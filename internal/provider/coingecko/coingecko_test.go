@@ -0,0 +1,116 @@
+package coingecko
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Response of /simple/price for ids=banano,nano,no-such-coin: CoinGecko leaves the unknown coins out
+// and answers an empty object for the delisted ones.
+const priceFixture = `{
+	"banano": {"usd": 0.00734, "usd_24h_vol": 73400, "usd_24h_change": 25},
+	"nano": {"usd": 0.9, "usd_24h_vol": 0, "usd_24h_change": -100},
+	"delisted-coin": {}
+}`
+
+// newTestClient returns a client with opts of a fake CoinGecko API served by handler.
+func newTestClient(t *testing.T, opts Options, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	// The expected warnings of the tests would drown their output.
+	opts.Log = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return New(server.URL, server.Client(), opts)
+}
+
+func TestFetch(t *testing.T) {
+	coins := func() []string { return []string{"banano", "nano", "bitcoin"} }
+	c := newTestClient(t, Options{APIKey: "demo-key", Coins: coins}, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/simple/price" {
+			t.Errorf("path = %s, want /simple/price", r.URL.Path)
+		}
+		if ids := r.URL.Query().Get("ids"); ids != "no-such-coin,delisted-coin,banano,nano,bitcoin" {
+			t.Errorf("ids = %q, want the requested coins, then the other ones", ids)
+		}
+		if key := r.Header.Get(API_KEY_HEADER); key != "demo-key" {
+			t.Errorf("API key = %q, want demo-key", key)
+		}
+		w.Write([]byte(priceFixture))
+	})
+
+	tickers, err := c.Fetch(context.Background(), []string{"no-such-coin", "delisted-coin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tickers) != 2 {
+		t.Errorf("got tickers %v, want banano and nano only", tickers)
+	}
+	ban := tickers["banano"]
+	if ban.Last != 0.00734 || math.Abs(ban.Volume-1e7) > 1e-3 || math.Abs(ban.Change24h()-25) > 1e-9 {
+		t.Errorf("banano = %+v, want a last price of 0.00734, a volume of 1e7 BAN and a change of 25%%", ban)
+	}
+	if xno := tickers["nano"]; xno.Last != 0.9 || xno.Open != 0 {
+		t.Errorf("nano = %+v, want no open price for a change of -100%%", xno)
+	}
+	for _, id := range []string{"no-such-coin", "delisted-coin"} {
+		if _, ok := tickers[id]; ok {
+			t.Errorf("unknown coin %s has a ticker", id)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	requests := 0
+	c := newTestClient(t, Options{}, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"status": {"error_code": 429, "error_message": "You've exceeded the Rate Limit."}}`))
+	})
+
+	for range 2 {
+		_, err := c.Fetch(context.Background(), []string{"banano"})
+		if !errors.Is(err, ErrRateLimited) {
+			t.Fatalf("error = %v, want it to match ErrRateLimited", err)
+		}
+		var cooldown *CooldownError
+		if !errors.As(err, &cooldown) || cooldown.Wait <= 29*time.Second || cooldown.Wait > 30*time.Second {
+			t.Errorf("error = %v, want a cooldown of the 30s of Retry-After", err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("CoinGecko called %d times, want once before the cooldown", requests)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   string
+	}{
+		{"server error", http.StatusInternalServerError, `{"error": "internal"}`, "coingecko returned 500"},
+		{"malformed body", http.StatusOK, `{"banano": {"usd": "soon"}}`, "coingecko: json: cannot unmarshal string"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, Options{}, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+			_, err := c.Fetch(context.Background(), []string{"banano"})
+			if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+				t.Errorf("error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+// Package dex prices wBAN from the reserves of its Uniswap V2 liquidity pools, read with eth_call.
+package dex
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+	"github.com/wBanano/wban-prices-api/internal/tracing"
+)
+
+// NAME prices the on-chain markets from the reserves of their liquidity pool.
+// It isn't one of PRICE_SOURCES: no other market can use it, and the on-chain markets use nothing else.
+const NAME = "dex"
+
+// Chains of the liquidity pools, and their public JSON-RPC endpoints.
+const (
+	CHAIN_BSC     = "bsc"
+	CHAIN_POLYGON = "polygon"
+
+	DEFAULT_BSC_RPC_URL     = "https://bsc-dataseed.bnbchain.org"
+	DEFAULT_POLYGON_RPC_URL = "https://polygon-rpc.com"
+)
+
+// wBAN is deployed at the same address on every chain.
+const WBAN_TOKEN = "0xe20B9e246db5a0d21BF9209E4858Bc9A3ff7A034"
+
+// Selectors of the functions of the Uniswap V2 pairs called by eth_call.
+const (
+	SELECTOR_TOKEN0       = "0x0dfe1681" // token0()
+	SELECTOR_GET_RESERVES = "0x0902f1ac" // getReserves()
+)
+
+const ERROR_BODY_LOG_SIZE = 200
+
+// Pool is the Uniswap V2 liquidity pool an on-chain market is priced from,
+// pairing wBAN with a token whose USD price is the one of the Quote market.
+// Both tokens of the pool must have 18 decimals, like wBAN, WBNB and WETH.
+type Pool struct {
+	Chain string `json:"chain"` // bsc or polygon.
+	Pool  string `json:"pool"`  // Address of the pair contract.
+	Quote string `json:"quote"` // Symbol of the market pricing the paired token, e.g. bnb for WBNB.
+}
+
+// Options configure a Client.
+type Options struct {
+	FindPool   func(address string) (*Pool, bool)                        // Pool of the on-chain market priced from address.
+	RPCURL     func(chain string) string                                 // JSON-RPC endpoint of chain.
+	QuotePrice func(ctx context.Context, symbol string) (float64, error) // USD price of the paired token.
+
+	Log    *slog.Logger
+	Tracer *tracing.Tracer // Nil for no tracing.
+
+	// NewRequest, if set, creates the requests instead of http.NewRequestWithContext, e.g. to set their headers.
+	NewRequest func(ctx context.Context, method, url string, body io.Reader) (*http.Request, error)
+}
+
+// rpcError is the error of a JSON-RPC response.
+type rpcError struct {
+	Chain   string
+	Code    int
+	Message string
+}
+
+func (e *rpcError) Error() string {
+	return fmt.Sprintf("%s rpc error %d: %s", e.Chain, e.Code, e.Message)
+}
+
+// rpcResponse is the response of an eth_call.
+type rpcResponse struct {
+	Result string `json:"result"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// Client prices the on-chain markets from the reserves of their pools.
+type Client struct {
+	client *http.Client
+	opts   Options
+
+	token0Mutex sync.Mutex
+	token0      map[string]string // First token of every pool, which never changes.
+}
+
+// New returns the client reading the pools of opts with client.
+func New(client *http.Client, opts Options) *Client {
+	if opts.Log == nil {
+		opts.Log = slog.Default()
+	}
+	if opts.NewRequest == nil {
+		opts.NewRequest = http.NewRequestWithContext
+	}
+	return &Client{client: client, opts: opts}
+}
+
+func (c *Client) Name() string { return NAME }
+
+// Fetch fetches the USD price of wBAN in the pools, one after the other.
+func (c *Client) Fetch(ctx context.Context, pools []string) (map[string]provider.Ticker, error) {
+	tickers := make(map[string]provider.Ticker, len(pools))
+	for _, pool := range pools {
+		ticker, err := c.fetch(ctx, pool)
+		if err != nil {
+			return nil, err
+		}
+		tickers[pool] = ticker
+	}
+	return tickers, nil
+}
+
+// fetch computes the price of wBAN in the paired token of pool from its reserves, converted to USD with the price of the quote market.
+// Only the last price of the ticker is set.
+func (c *Client) fetch(ctx context.Context, pool string) (ticker provider.Ticker, err error) {
+	dex, ok := c.opts.FindPool(pool)
+	if !ok {
+		return provider.Ticker{}, fmt.Errorf("no on-chain market for pool %s", pool)
+	}
+
+	start := time.Now()
+	defer func() {
+		c.opts.Log.DebugContext(ctx, "dex | fetched", "chain", dex.Chain, "pool", pool, "duration_ms", time.Since(start).Milliseconds(), "error", err)
+	}()
+
+	ctx, span := c.opts.Tracer.Start(ctx, "dex "+dex.Chain, tracing.KindClient)
+	span.SetString("dex.chain", dex.Chain)
+	span.SetString("dex.pool", pool)
+	defer func() { span.Finish(err) }()
+
+	token0, err := c.firstToken(ctx, dex)
+	if err != nil {
+		return provider.Ticker{}, err
+	}
+	reserves, err := c.call(ctx, dex.Chain, pool, SELECTOR_GET_RESERVES)
+	if err != nil {
+		return provider.Ticker{}, err
+	}
+	if len(reserves) < 64 {
+		return provider.Ticker{}, fmt.Errorf("%s pool %s: malformed reserves", dex.Chain, pool)
+	}
+	wban, paired := word(reserves, 0), word(reserves, 1)
+	if !strings.EqualFold(token0, WBAN_TOKEN) {
+		wban, paired = paired, wban
+	}
+	if wban.Sign() == 0 {
+		return provider.Ticker{}, fmt.Errorf("%s pool %s has no liquidity", dex.Chain, pool)
+	}
+	priceInPaired, _ := new(big.Float).Quo(new(big.Float).SetInt(paired), new(big.Float).SetInt(wban)).Float64()
+
+	quotePrice, err := c.opts.QuotePrice(ctx, dex.Quote)
+	if err != nil {
+		return provider.Ticker{}, fmt.Errorf("%s pool %s: %w", dex.Chain, pool, err)
+	}
+	return provider.Ticker{Last: priceInPaired * quotePrice}, nil
+}
+
+// firstToken returns the address of token0 of the pool, read once.
+func (c *Client) firstToken(ctx context.Context, dex *Pool) (string, error) {
+	c.token0Mutex.Lock()
+	token0, ok := c.token0[dex.Pool]
+	c.token0Mutex.Unlock()
+	if ok {
+		return token0, nil
+	}
+
+	result, err := c.call(ctx, dex.Chain, dex.Pool, SELECTOR_TOKEN0)
+	if err != nil {
+		return "", err
+	}
+	if len(result) < 32 {
+		return "", fmt.Errorf("%s pool %s: malformed token0", dex.Chain, dex.Pool)
+	}
+	token0 = "0x" + hex.EncodeToString(result[12:32])
+
+	c.token0Mutex.Lock()
+	defer c.token0Mutex.Unlock()
+	if c.token0 == nil {
+		c.token0 = make(map[string]string)
+	}
+	c.token0[dex.Pool] = token0
+	return token0, nil
+}
+
+// call calls a function without arguments of the contract at address with eth_call, and returns its ABI-encoded result.
+func (c *Client) call(ctx context.Context, chain, address, selector string) ([]byte, error) {
+	body, err := json.Marshal(map[string]any{
+		"jsonrpc": "2.0",
+		"id":      1,
+		"method":  "eth_call",
+		"params":  []any{map[string]string{"to": address, "data": selector}, "latest"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := c.opts.NewRequest(ctx, http.MethodPost, c.opts.RPCURL(chain), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, ERROR_BODY_LOG_SIZE))
+		c.opts.Log.WarnContext(ctx, "dex | RPC endpoint returned an error", "chain", chain, "status", resp.StatusCode, "body", string(snippet))
+		return nil, fmt.Errorf("%s rpc returned %d", chain, resp.StatusCode)
+	}
+
+	var rpcResp rpcResponse
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return nil, fmt.Errorf("%s rpc: %w", chain, err)
+	}
+	if rpcResp.Error != nil {
+		return nil, &rpcError{Chain: chain, Code: rpcResp.Error.Code, Message: rpcResp.Error.Message}
+	}
+	result, err := hex.DecodeString(strings.TrimPrefix(rpcResp.Result, "0x"))
+	if err != nil {
+		return nil, fmt.Errorf("%s rpc: malformed result: %w", chain, err)
+	}
+	return result, nil
+}
+
+// word returns the i-th 32 bytes word of an ABI-encoded result as an unsigned integer.
+func word(data []byte, i int) *big.Int {
+	return new(big.Int).SetBytes(data[i*32 : (i+1)*32])
+}
@@ -0,0 +1,186 @@
+// Package kraken fetches tickers from the Kraken API.
+package kraken
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+	"github.com/wBanano/wban-prices-api/internal/tracing"
+)
+
+// Name of Kraken among the price sources.
+const NAME = "kraken"
+
+const DEFAULT_API_URL = "https://api.kraken.com/0/public"
+const ERROR_BODY_LOG_SIZE = 200
+
+// Error of the Kraken API for pairs it doesn't list.
+const UNKNOWN_PAIR = "EQuery:Unknown asset pair"
+
+// Options configure a Client.
+type Options struct {
+	Log    *slog.Logger
+	Tracer *tracing.Tracer // Nil for no tracing.
+
+	// NewRequest, if set, creates the requests instead of http.NewRequestWithContext, e.g. to set their headers.
+	NewRequest func(ctx context.Context, method, url string, body io.Reader) (*http.Request, error)
+}
+
+// legacyPairs maps the pair names accepted in Kraken requests to the ones of its responses,
+// which prefix the legacy assets with X and their fiat quotes with Z.
+var legacyPairs = map[string]string{
+	"ETHUSD": "XETHZUSD",
+	"XBTUSD": "XXBTZUSD",
+	"BTCUSD": "XXBTZUSD",
+	"ETHXBT": "XETHXXBT",
+}
+
+// apiError is returned when the error array of a Kraken response isn't empty.
+type apiError struct {
+	Pair     string
+	Messages []string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("kraken error: %s (%s)", strings.Join(e.Messages, ", "), e.Pair)
+}
+
+// unknownPair reports whether Kraken doesn't list the pair.
+func (e *apiError) unknownPair() bool {
+	for _, message := range e.Messages {
+		if message == UNKNOWN_PAIR {
+			return true
+		}
+	}
+	return false
+}
+
+// tickerResponse is the response of /Ticker.
+type tickerResponse struct {
+	Error  []string              `json:"error"`
+	Result map[string]pairTicker `json:"result"`
+}
+
+// pairTicker holds arrays of decimal strings: today's values first, then the ones of the last 24 hours.
+type pairTicker struct {
+	Close  []string `json:"c"` // Last trade closed: price and lot volume.
+	Open   string   `json:"o"` // Today's opening price.
+	High   []string `json:"h"`
+	Low    []string `json:"l"`
+	Volume []string `json:"v"`
+}
+
+// parse converts the last trade closed and the 24 hours values of t. Only the last price is mandatory.
+func (t pairTicker) parse() (provider.Ticker, error) {
+	if len(t.Close) == 0 {
+		return provider.Ticker{}, fmt.Errorf("kraken ticker without last trade")
+	}
+	last, err := strconv.ParseFloat(t.Close[0], 64)
+	if err != nil {
+		return provider.Ticker{}, err
+	}
+
+	ticker := provider.Ticker{Last: last, RawLast: t.Close[0]}
+	ticker.Open, _ = strconv.ParseFloat(t.Open, 64)
+	if len(t.High) > 1 {
+		ticker.High, _ = strconv.ParseFloat(t.High[1], 64)
+	}
+	if len(t.Low) > 1 {
+		ticker.Low, _ = strconv.ParseFloat(t.Low[1], 64)
+	}
+	if len(t.Volume) > 1 {
+		ticker.Volume, _ = strconv.ParseFloat(t.Volume[1], 64)
+	}
+	return ticker, nil
+}
+
+// Client fetches tickers from the Kraken API.
+type Client struct {
+	baseURL string
+	client  *http.Client
+	opts    Options
+}
+
+// New returns the client of the Kraken API at baseURL, without trailing slash.
+func New(baseURL string, client *http.Client, opts Options) *Client {
+	if opts.Log == nil {
+		opts.Log = slog.Default()
+	}
+	if opts.NewRequest == nil {
+		opts.NewRequest = http.NewRequestWithContext
+	}
+	return &Client{baseURL: strings.TrimSuffix(baseURL, "/"), client: client, opts: opts}
+}
+
+func (c *Client) Name() string { return NAME }
+
+// Fetch fetches the tickers of the pairs in a single request and attempt, like the other fallback sources.
+func (c *Client) Fetch(ctx context.Context, pairs []string) (tickers map[string]provider.Ticker, err error) {
+	list := strings.Join(pairs, ",")
+	start := time.Now()
+	defer func() {
+		c.opts.Log.DebugContext(ctx, "kraken | fetched", "pairs", list, "duration_ms", time.Since(start).Milliseconds(), "error", err)
+	}()
+
+	ctx, span := c.opts.Tracer.Start(ctx, "kraken "+list, tracing.KindClient)
+	span.SetString("kraken.pairs", list)
+	defer func() { span.Finish(err) }()
+
+	req, err := c.opts.NewRequest(ctx, http.MethodGet, c.baseURL+"/Ticker?pair="+url.QueryEscape(list), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	span.SetInt("http.response.status_code", resp.StatusCode)
+
+	if resp.StatusCode != http.StatusOK {
+		snippet, _ := io.ReadAll(io.LimitReader(resp.Body, ERROR_BODY_LOG_SIZE))
+		c.opts.Log.WarnContext(ctx, "kraken | Kraken returned an error", "pairs", list, "status", resp.StatusCode, "body", string(snippet))
+		return nil, fmt.Errorf("kraken returned %d for %s", resp.StatusCode, list)
+	}
+
+	var krakenResp tickerResponse
+	if err := json.NewDecoder(resp.Body).Decode(&krakenResp); err != nil {
+		return nil, fmt.Errorf("kraken %s: %w", list, err)
+	}
+	if len(krakenResp.Error) > 0 {
+		err := &apiError{Pair: list, Messages: krakenResp.Error}
+		if err.unknownPair() {
+			c.opts.Log.WarnContext(ctx, "kraken | Kraken doesn't list a pair, check the markets configuration", "pairs", list)
+		}
+		return nil, err
+	}
+
+	tickers = make(map[string]provider.Ticker, len(pairs))
+	for _, pair := range pairs {
+		if ticker, err := krakenResp.ticker(pair); err == nil {
+			tickers[pair] = ticker
+		}
+	}
+	return tickers, nil
+}
+
+// ticker returns the ticker of pair in the response, whose key may be the legacy name of the pair.
+func (r tickerResponse) ticker(pair string) (provider.Ticker, error) {
+	t, ok := r.Result[pair]
+	if !ok {
+		t, ok = r.Result[legacyPairs[pair]]
+	}
+	if !ok {
+		return provider.Ticker{}, fmt.Errorf("kraken response without %s", pair)
+	}
+	return t.parse()
+}
@@ -0,0 +1,91 @@
+package kraken
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+)
+
+// Recorded responses of /Ticker: the legacy pairs are keyed by their X/Z names, the newer ones by the requested name.
+const (
+	tickerFixture = `{"error": [], "result": {
+		"XETHZUSD": {"a": ["2512.86000", "1", "1.000"], "b": ["2512.85000", "3", "3.000"], "c": ["2512.85000", "0.01990000"],
+			"v": ["1523.13650429", "4893.27286353"], "p": ["2499.06420", "2490.21985"], "t": [5931, 16631],
+			"l": ["2465.00000", "2450.10000"], "h": ["2520.00000", "2533.33000"], "o": "2480.00000"},
+		"SOLUSD": {"c": ["151.2300", "2.5"], "v": ["100", "200"], "l": ["149", "148"], "h": ["152", "153"], "o": "150.0000"}
+	}}`
+	unknownPairFixture = `{"error": ["EQuery:Unknown asset pair"]}`
+)
+
+// newTestClient returns a client of a fake Kraken API served by handler.
+func newTestClient(t *testing.T, handler http.HandlerFunc) *Client {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	// The expected warnings of the tests would drown their output.
+	return New(server.URL, server.Client(), Options{Log: slog.New(slog.NewTextHandler(io.Discard, nil))})
+}
+
+func TestFetch(t *testing.T) {
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.URL.Query().Get("pair"); got != "ETHUSD,SOLUSD,DOTUSD" {
+			t.Errorf("pair = %q, want ETHUSD,SOLUSD,DOTUSD", got)
+		}
+		w.Write([]byte(tickerFixture))
+	})
+
+	tickers, err := c.Fetch(context.Background(), []string{"ETHUSD", "SOLUSD", "DOTUSD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]provider.Ticker{
+		"ETHUSD": {Last: 2512.85, RawLast: "2512.85000", Open: 2480, High: 2533.33, Low: 2450.1, Volume: 4893.27286353},
+		"SOLUSD": {Last: 151.23, RawLast: "151.2300", Open: 150, High: 153, Low: 148, Volume: 200},
+	}
+	if len(tickers) != len(want) {
+		t.Errorf("got tickers %v, want %v", tickers, want)
+	}
+	for pair, ticker := range want {
+		if tickers[pair] != ticker {
+			t.Errorf("%s = %+v, want %+v", pair, tickers[pair], ticker)
+		}
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		want    string
+		unknown bool
+	}{
+		{"unknown asset pair", http.StatusOK, unknownPairFixture, "kraken error: EQuery:Unknown asset pair (BANUSD)", true},
+		{"other error", http.StatusOK, `{"error": ["EService:Unavailable"]}`, "kraken error: EService:Unavailable (BANUSD)", false},
+		{"server error", http.StatusBadGateway, `<html>502 Bad Gateway</html>`, "kraken returned 502 for BANUSD", false},
+		{"malformed body", http.StatusOK, `{"error": [], "result": [`, "kraken BANUSD: unexpected EOF", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			})
+
+			_, err := c.Fetch(context.Background(), []string{"BANUSD"})
+			if err == nil || err.Error() != tt.want {
+				t.Fatalf("error = %v, want %q", err, tt.want)
+			}
+			var apiErr *apiError
+			if unknown := errors.As(err, &apiErr) && apiErr.unknownPair(); unknown != tt.unknown {
+				t.Errorf("unknown pair = %t, want %t", unknown, tt.unknown)
+			}
+		})
+	}
+}
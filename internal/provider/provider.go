@@ -0,0 +1,31 @@
+// Package provider defines the price sources the server fetches its tickers from.
+package provider
+
+import "context"
+
+// Ticker is the market data of a symbol over the last 24 hours.
+type Ticker struct {
+	Last    float64
+	RawLast string // Last price as the source sent it, empty when it sent a number or the price was computed.
+	Open    float64
+	High    float64
+	Low     float64
+	Volume  float64
+}
+
+// Change24h returns the price change over the last 24 hours, in percent.
+func (t Ticker) Change24h() float64 {
+	if t.Open == 0 {
+		return 0
+	}
+	return (t.Last - t.Open) / t.Open * 100
+}
+
+// PriceProvider fetches tickers from a price source.
+type PriceProvider interface {
+	// Name returns the name of the source in PRICE_SOURCES.
+	Name() string
+	// Fetch returns the tickers of symbols, named the way the source lists them, leaving out the ones without a price.
+	// The sources fetching all their markets at once return the other ones too.
+	Fetch(ctx context.Context, symbols []string) (map[string]Ticker, error)
+}
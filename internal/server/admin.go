@@ -0,0 +1,45 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"time"
+)
+
+const ADMIN_TOKEN_HEADER = "X-Admin-Token"
+
+// requireAdminToken answers with a 401 the requests to next without the admin token, and with a 403 the ones with a wrong one.
+func (s *Server) requireAdminToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.Header.Get(ADMIN_TOKEN_HEADER)
+		if token == "" {
+			s.writeJSONError(w, r, http.StatusUnauthorized, errorResponse{Error: "missing " + ADMIN_TOKEN_HEADER + " header"})
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.cfg.AdminToken)) != 1 {
+			s.writeJSONError(w, r, http.StatusForbidden, errorResponse{Error: "invalid admin token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cacheFlushResponse is the JSON body of /admin/cache/flush.
+type cacheFlushResponse struct {
+	Prices    map[string]float64 `json:"prices"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+// cacheFlushHandler empties the price cache and refreshes every market right away, answering with the fetched prices.
+// The flushed prices are gone for good, a failed refresh leaves nothing to serve as stale.
+func (s *Server) cacheFlushHandler(w http.ResponseWriter, r *http.Request) {
+	s.cache.Flush()
+	s.log.WarnContext(r.Context(), "admin | cache flushed, refreshing prices")
+
+	if _, err := s.refreshPrices(r.Context(), s.cfg.refreshedMarkets()); err != nil {
+		s.writeLookupError(w, r, err)
+		return
+	}
+	prices, _, _ := s.pricesFromCache(s.cache.Snapshot(), s.cfg.markets())
+	s.writeJSON(w, http.StatusOK, cacheFlushResponse{Prices: prices, UpdatedAt: s.now().UTC()})
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+	"github.com/wBanano/wban-prices-api/internal/provider"
+)
+
+// Aggregation modes: the price of a market is either the one of its first source which answers,
+// or the median of the ones of all its sources.
+const (
+	AGGREGATION_FIRST  = "first"
+	AGGREGATION_MEDIAN = "median"
+
+	DEFAULT_AGGREGATION            = AGGREGATION_FIRST
+	DEFAULT_QUORUM                 = 2
+	DEFAULT_DISAGREEMENT_THRESHOLD = 2.0
+)
+
+// sourceTicker is the ticker of a market fetched from one of its sources.
+type sourceTicker struct {
+	source string
+	ticker provider.Ticker
+	err    error
+}
+
+// fetchMedian fetches the ticker of m from all the sources listing it at once, and sets its last price to the median of theirs.
+// Below the quorum of answering sources, the ticker of the first one in order is kept as is.
+// The 24h data comes from the first source in order which answered.
+func (s *Server) fetchMedian(ctx context.Context, m Market) (provider.Ticker, cache.Origin, error) {
+	var sources []string
+	for _, source := range s.cfg.sourcesOf(m) {
+		if m.listedOn(source) != "" {
+			sources = append(sources, source)
+		}
+	}
+	if len(sources) == 0 {
+		return provider.Ticker{}, cache.Origin{}, s.errNotListed(m)
+	}
+
+	results := make([]sourceTicker, len(sources))
+	done := make(chan struct{}, len(sources))
+	for i, source := range sources {
+		go func(i int, source string) {
+			ticker, err := s.fetchFrom(ctx, source, m.listedOn(source))
+			results[i] = sourceTicker{source: source, ticker: ticker, err: err}
+			done <- struct{}{}
+		}(i, source)
+	}
+	for range sources {
+		<-done
+	}
+	if err := ctx.Err(); err != nil {
+		return provider.Ticker{}, cache.Origin{}, err
+	}
+
+	var answered []sourceTicker
+	var firstErr error
+	for _, result := range results {
+		if result.err != nil {
+			s.log.WarnContext(ctx, "fetchMedian | price source failed", "symbol", m.Symbol, "source", result.source, "error", result.err)
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			continue
+		}
+		answered = append(answered, result)
+	}
+	if len(answered) == 0 {
+		return provider.Ticker{}, cache.Origin{}, firstErr
+	}
+
+	ticker := answered[0].ticker
+	if len(answered) < s.cfg.Quorum {
+		s.log.WarnContext(ctx, "fetchMedian | below quorum, using a single source", "symbol", m.Symbol, "source", answered[0].source, "answered", len(answered), "quorum", s.cfg.Quorum)
+		return ticker, cache.Origin{Source: answered[0].source, BelowQuorum: true}, nil
+	}
+
+	prices := make([]float64, len(answered))
+	attrs := []any{"symbol", m.Symbol}
+	for i, result := range answered {
+		prices[i] = result.ticker.Last
+		attrs = append(attrs, result.source, result.ticker.Last)
+	}
+	ticker.Last, ticker.RawLast = median(prices), ""
+	attrs = append(attrs, "median", ticker.Last)
+	s.log.DebugContext(ctx, "fetchMedian | aggregated", attrs...)
+	if spread := (slices.Max(prices) - slices.Min(prices)) / ticker.Last * 100; spread > s.cfg.DisagreementThreshold {
+		s.log.WarnContext(ctx, "fetchMedian | price sources disagree", append(attrs, "spread_pct", fmt.Sprintf("%.2f", spread))...)
+	}
+	return ticker, cache.Origin{Source: AGGREGATION_MEDIAN}, nil
+}
+
+// median returns the median of values, the mean of the middle two for an even count.
+func median(values []float64) float64 {
+	sorted := slices.Clone(values)
+	slices.Sort(sorted)
+	middle := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[middle-1] + sorted[middle]) / 2
+	}
+	return sorted[middle]
+}
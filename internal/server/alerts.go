@@ -0,0 +1,334 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"time"
+)
+
+// Alert conditions: the price is above or below the value, or moved by the value in percent over the window.
+const (
+	ALERT_ABOVE = "above"
+	ALERT_BELOW = "below"
+	ALERT_MOVE  = "move"
+)
+
+const (
+	DEFAULT_ALERT_COOLDOWN = 15 * time.Minute
+
+	// Failed webhook deliveries are retried, the delay doubling from the first one.
+	ALERT_DELIVERY_RETRIES    = 3
+	ALERT_DELIVERY_RETRY_WAIT = time.Second
+
+	// Largest alert accepted by the admin API.
+	MAX_ALERT_BODY_SIZE = 4096
+)
+
+// Alert is a price alert of ALERTS_FILE or the admin API, POSTing to its webhook when its condition holds.
+type Alert struct {
+	ID        string    `json:"id"`
+	Symbol    string    `json:"symbol"`
+	Condition string    `json:"condition"`        // above, below or move.
+	Value     float64   `json:"value"`            // Price in USD, or move in percent.
+	Window    *Duration `json:"window,omitempty"` // Period of a move.
+	Webhook   string    `json:"webhook"`
+	Cooldown  Duration  `json:"cooldown,omitempty"` // Shortest time between two firings, DEFAULT_ALERT_COOLDOWN by default.
+}
+
+// alertState is an alert along with its firings.
+type alertState struct {
+	Alert
+	LastFiredAt *time.Time `json:"last_fired_at,omitempty"`
+	Fired       int        `json:"fired"`
+	LastError   string     `json:"last_error,omitempty"` // Of the last delivery, empty once delivered.
+}
+
+// alertPayload is the JSON body POSTed to the webhook of a fired alert.
+type alertPayload struct {
+	ID        string    `json:"id"`
+	Symbol    string    `json:"symbol"`
+	Condition string    `json:"condition"`
+	Price     float64   `json:"price"`
+	Threshold float64   `json:"threshold"`
+	ChangePct *float64  `json:"change_pct,omitempty"` // Move over the window, for move alerts.
+	Window    string    `json:"window,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// validate checks the alert against the markets of cfg and sets its defaults.
+func (a *Alert) validate(cfg *Config) error {
+	m, ok := cfg.findMarket(a.Symbol)
+	if !ok {
+		return fmt.Errorf("alert %s: unknown symbol %q", a.ID, a.Symbol)
+	}
+	a.Symbol = m.Symbol
+	switch a.Condition {
+	case ALERT_ABOVE, ALERT_BELOW:
+		if a.Value <= 0 {
+			return fmt.Errorf("alert %s: value must be a positive price", a.ID)
+		}
+	case ALERT_MOVE:
+		if a.Value <= 0 || a.Window == nil || a.Window.Duration <= 0 {
+			return fmt.Errorf("alert %s: move alerts need a positive value in percent and a window", a.ID)
+		}
+	default:
+		return fmt.Errorf("alert %s: unknown condition %q, expected %s, %s or %s", a.ID, a.Condition, ALERT_ABOVE, ALERT_BELOW, ALERT_MOVE)
+	}
+	if u, err := url.Parse(a.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("alert %s: invalid webhook URL %q", a.ID, a.Webhook)
+	}
+	if a.Cooldown.Duration < 0 {
+		return fmt.Errorf("alert %s: cooldown must not be negative", a.ID)
+	}
+	if a.Cooldown.Duration == 0 {
+		a.Cooldown.Duration = DEFAULT_ALERT_COOLDOWN
+	}
+	return nil
+}
+
+// setupAlerts loads the alerts of ALERTS_FILE, a {"alerts": [...]} JSON file.
+func (s *Server) setupAlerts() error {
+	if s.cfg.AlertsFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(s.cfg.AlertsFile)
+	if err != nil {
+		return err
+	}
+	var file struct {
+		Alerts []Alert `json:"alerts"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("alerts file %s: %w", s.cfg.AlertsFile, err)
+	}
+	for _, a := range file.Alerts {
+		if _, err := s.addAlert(a); err != nil {
+			return fmt.Errorf("alerts file %s: %w", s.cfg.AlertsFile, err)
+		}
+	}
+	if len(s.alerts) > 0 && !s.cfg.backgroundRefresh() {
+		s.log.Warn("alerts | alerts are only checked by the background refresher, none will fire with lazy refreshes", "alerts", len(s.alerts))
+	}
+	return nil
+}
+
+// addAlert validates a and adds it to the active alerts, with a random ID if it has none, and returns it with its defaults.
+func (s *Server) addAlert(a Alert) (Alert, error) {
+	if a.ID == "" {
+		id := make([]byte, 8)
+		rand.Read(id)
+		a.ID = hex.EncodeToString(id)
+	}
+	if err := a.validate(s.cfg); err != nil {
+		return Alert{}, err
+	}
+
+	s.alertsMutex.Lock()
+	defer s.alertsMutex.Unlock()
+
+	if slices.ContainsFunc(s.alerts, func(as *alertState) bool { return as.ID == a.ID }) {
+		return Alert{}, &duplicateAlertError{ID: a.ID}
+	}
+	s.alerts = append(s.alerts, &alertState{Alert: a})
+	return a, nil
+}
+
+type duplicateAlertError struct {
+	ID string
+}
+
+func (e *duplicateAlertError) Error() string {
+	return fmt.Sprintf("alert %s already exists", e.ID)
+}
+
+// removeAlert removes the alert with id, and reports whether there was one.
+func (s *Server) removeAlert(id string) bool {
+	s.alertsMutex.Lock()
+	defer s.alertsMutex.Unlock()
+
+	i := slices.IndexFunc(s.alerts, func(as *alertState) bool { return as.ID == id })
+	if i < 0 {
+		return false
+	}
+	s.alerts = slices.Delete(s.alerts, i, i+1)
+	return true
+}
+
+// alertsSnapshot returns a copy of the active alerts.
+func (s *Server) alertsSnapshot() []alertState {
+	s.alertsMutex.Lock()
+	defer s.alertsMutex.Unlock()
+
+	states := make([]alertState, len(s.alerts))
+	for i, as := range s.alerts {
+		states[i] = *as
+	}
+	return states
+}
+
+// checkAlerts fires the alerts whose condition holds for the cached prices, unless they fired less than their cooldown ago.
+func (s *Server) checkAlerts(ctx context.Context) {
+	s.alertsMutex.Lock()
+	active := slices.Clone(s.alerts)
+	s.alertsMutex.Unlock()
+	if len(active) == 0 {
+		return
+	}
+
+	entries := s.cache.Snapshot()
+	now := s.now()
+	for _, as := range active {
+		entry, ok := entries[as.Symbol]
+		if !ok || entry.UpdatedAt.IsZero() || entry.Restored {
+			continue
+		}
+		payload, ok := s.evaluateAlert(ctx, as.Alert, entry.Price(), now)
+		if !ok {
+			continue
+		}
+
+		s.alertsMutex.Lock()
+		due := as.LastFiredAt == nil || now.Sub(*as.LastFiredAt) >= as.Cooldown.Duration
+		if due {
+			firedAt := now
+			as.LastFiredAt = &firedAt
+			as.Fired++
+		}
+		s.alertsMutex.Unlock()
+		if due {
+			s.log.InfoContext(ctx, "alerts | alert fired", "id", as.ID, "symbol", as.Symbol, "condition", as.Condition, "price", payload.Price, "threshold", as.Value)
+			go s.deliverAlert(as, payload)
+		}
+	}
+}
+
+// evaluateAlert returns the payload of a when its condition holds at price.
+func (s *Server) evaluateAlert(ctx context.Context, a Alert, price float64, now time.Time) (alertPayload, bool) {
+	payload := alertPayload{ID: a.ID, Symbol: a.Symbol, Condition: a.Condition, Price: price, Threshold: a.Value, Timestamp: now.UTC()}
+	switch a.Condition {
+	case ALERT_ABOVE:
+		return payload, price >= a.Value
+	case ALERT_BELOW:
+		return payload, price <= a.Value
+	case ALERT_MOVE:
+		_, change, ok := s.priceMove(ctx, a.Symbol, price, a.Window.Duration, now)
+		if !ok {
+			return payload, false
+		}
+		payload.ChangePct, payload.Window = &change, a.Window.String()
+		return payload, math.Abs(change) >= a.Value
+	}
+	return payload, false
+}
+
+// priceMove returns the price of symbol at the start of the window ending now according to its history,
+// and its change in percent up to price. ok is false without history.
+func (s *Server) priceMove(ctx context.Context, symbol string, price float64, window time.Duration, now time.Time) (from, change float64, ok bool) {
+	points, _ := s.historyWindow(ctx, symbol, now.Add(-window))
+	if len(points) == 0 || points[0].Price == 0 {
+		return 0, 0, false
+	}
+	from = points[0].Price
+	return from, (price - from) / from * 100, true
+}
+
+// deliverAlert POSTs payload to the webhook of the alert, retrying ALERT_DELIVERY_RETRIES times.
+func (s *Server) deliverAlert(as *alertState, payload alertPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		s.log.Error("alerts | encoding failed", "id", as.ID, "error", err)
+		return
+	}
+
+	for attempt := 0; ; attempt++ {
+		err = s.postWebhook(s.shutdownCtx, as.Webhook, body)
+		if err == nil || attempt == ALERT_DELIVERY_RETRIES || s.shutdownCtx.Err() != nil {
+			break
+		}
+		delay := ALERT_DELIVERY_RETRY_WAIT << attempt
+		s.log.Warn("alerts | delivery failed, retrying", "id", as.ID, "attempt", attempt+1, "delay", delay, "error", err)
+		select {
+		case <-s.shutdownCtx.Done():
+		case <-time.After(delay):
+		}
+	}
+
+	s.alertsMutex.Lock()
+	defer s.alertsMutex.Unlock()
+	if err != nil {
+		as.LastError = err.Error()
+		s.log.Error("alerts | delivery failed, giving up", "id", as.ID, "attempts", ALERT_DELIVERY_RETRIES+1, "error", err)
+		return
+	}
+	as.LastError = ""
+	s.log.Info("alerts | alert delivered", "id", as.ID)
+}
+
+// postWebhook POSTs body to a webhook, failing on any status but 2xx.
+func (s *Server) postWebhook(ctx context.Context, webhook string, body []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.UpstreamTimeout)
+	defer cancel()
+	req, err := s.newUpstreamRequest(ctx, http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := s.upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, ERROR_BODY_LOG_SIZE))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// alertsHandler lists the active alerts, along with their firings.
+func (s *Server) alertsHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, s.alertsSnapshot())
+}
+
+// createAlertHandler adds the alert of the JSON body, answering with it.
+func (s *Server) createAlertHandler(w http.ResponseWriter, r *http.Request) {
+	var a Alert
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_ALERT_BODY_SIZE)).Decode(&a); err != nil {
+		s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: "malformed alert: " + err.Error()})
+		return
+	}
+	created, err := s.addAlert(a)
+	if err != nil {
+		status := http.StatusBadRequest
+		var duplicate *duplicateAlertError
+		if errors.As(err, &duplicate) {
+			status = http.StatusConflict
+		}
+		s.writeJSONError(w, r, status, errorResponse{Error: err.Error()})
+		return
+	}
+	s.log.InfoContext(r.Context(), "admin | alert created", "id", created.ID, "symbol", created.Symbol, "condition", created.Condition)
+	s.writeJSON(w, http.StatusCreated, alertState{Alert: created})
+}
+
+// deleteAlertHandler removes the alert of the path.
+func (s *Server) deleteAlertHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !s.removeAlert(id) {
+		s.writeJSONError(w, r, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("unknown alert %q", id)})
+		return
+	}
+	s.log.InfoContext(r.Context(), "admin | alert deleted", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
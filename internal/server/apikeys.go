@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// apiKey is a key known clients authenticate with, and the name they're logged and counted as.
+type apiKey struct {
+	key  []byte
+	name string
+}
+
+// Paths of the probes, served whatever the key they send, so that a stale key doesn't fail them.
+var authExempt = map[string]bool{"/health": true, "/ready": true}
+
+// loadAPIKeys parses the key=name pairs of keys, comma separated, along with the {"key": "name"} JSON object of path.
+func loadAPIKeys(keys, path string) ([]apiKey, error) {
+	names := make(map[string]string)
+	for _, pair := range strings.Split(keys, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, name, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, errors.New("API keys must be given as key=name pairs")
+		}
+		names[key] = name
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var fileNames map[string]string
+		if err := json.Unmarshal(data, &fileNames); err != nil {
+			return nil, fmt.Errorf("API keys file %s: %w", path, err)
+		}
+		for key, name := range fileNames {
+			names[key] = name
+		}
+	}
+
+	apiKeys := make([]apiKey, 0, len(names))
+	for _, key := range sortedKeys(names) {
+		if key == "" || names[key] == "" {
+			return nil, errors.New("API keys and their names must not be empty")
+		}
+		apiKeys = append(apiKeys, apiKey{key: []byte(key), name: names[key]})
+	}
+	return apiKeys, nil
+}
+
+// authenticate tags the requests to next with the name of their API key, sent as a bearer token or in X-API-Key.
+// Unknown keys are rejected with a 401, but on the probes, while requests without any are served anonymously.
+// Without keys configured, next is served as is.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	if len(s.cfg.apiKeys) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		if scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+			key = strings.TrimSpace(token)
+		}
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		name := s.apiKeyName(key)
+		if name == "" && authExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if name == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="wban-prices-api"`)
+			s.writeJSONError(w, r, http.StatusUnauthorized, errorResponse{Error: "unknown API key"})
+			return
+		}
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.client = name
+		}
+		apiKeyRequestsTotal.inc(name)
+		s.apiKeyRequestsMutex.Lock()
+		s.apiKeyRequests[name]++
+		s.apiKeyRequestsMutex.Unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiKeyName returns the name of key, empty if unknown.
+// Every configured key is compared in constant time, so that timing reveals nothing about them.
+func (s *Server) apiKeyName(key string) string {
+	name := ""
+	for _, k := range s.cfg.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), k.key) == 1 {
+			name = k.name
+		}
+	}
+	return name
+}
+
+// apiKeyRequestsSnapshot returns the number of requests by API key name.
+func (s *Server) apiKeyRequestsSnapshot() map[string]int64 {
+	s.apiKeyRequestsMutex.Lock()
+	defer s.apiKeyRequestsMutex.Unlock()
+
+	snapshot := make(map[string]int64, len(s.apiKeyRequests))
+	for name, count := range s.apiKeyRequests {
+		snapshot[name] = count
+	}
+	return snapshot
+}
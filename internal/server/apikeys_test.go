@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthenticate(t *testing.T) {
+	s := useConfig(t)
+	var err error
+	if s.cfg.apiKeys, err = loadAPIKeys("s3cret=tipbot", ""); err != nil {
+		t.Fatal(err)
+	}
+	var client string
+	handler := s.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client = requestInfoFrom(r.Context()).client
+	}))
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		value  string
+		status int
+		client string
+	}{
+		{"anonymous", "/prices", "", "", http.StatusOK, ""},
+		{"bearer token", "/prices", "Authorization", "Bearer s3cret", http.StatusOK, "tipbot"},
+		{"X-API-Key", "/prices", "X-API-Key", "s3cret", http.StatusOK, "tipbot"},
+		{"unknown key", "/prices", "X-API-Key", "stale", http.StatusUnauthorized, ""},
+		{"unknown bearer token", "/markets", "Authorization", "bearer stale", http.StatusUnauthorized, ""},
+		{"unknown key on /health", "/health", "X-API-Key", "stale", http.StatusOK, ""},
+		{"unknown key on /ready", "/ready", "Authorization", "Bearer stale", http.StatusOK, ""},
+		{"known key on /health", "/health", "X-API-Key", "s3cret", http.StatusOK, "tipbot"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client = ""
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			w := httptest.NewRecorder()
+			assignRequestIDs(handler).ServeHTTP(w, r)
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if client != tt.client {
+				t.Errorf("client = %q, want %q", client, tt.client)
+			}
+			if tt.status == http.StatusUnauthorized && decodeError(t, w).Code != ERROR_UNAUTHORIZED {
+				t.Errorf("error code = %q, want %s", decodeError(t, w).Code, ERROR_UNAUTHORIZED)
+			}
+		})
+	}
+}
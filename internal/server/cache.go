@@ -0,0 +1,529 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+	"github.com/wBanano/wban-prices-api/internal/provider"
+	"github.com/wBanano/wban-prices-api/internal/tracing"
+	"golang.org/x/sync/errgroup"
+)
+
+// encodedBody is a response body encoded once and served as is, along with its ETag.
+type encodedBody struct {
+	data []byte
+	etag string
+}
+
+// encodePrices encodes the cached prices of all markets under all their keys, sorted, for the requests to /prices which don't post-process them.
+// It is called by the cache whenever its entries change, with it locked.
+func (s *Server) encodePrices(entries map[string]cache.Entry) {
+	prices, _, _ := s.pricesFromCache(entries, s.cfg.markets())
+	data, err := json.Marshal(withAliases(prices, s.responseKeys("")))
+	if err != nil {
+		s.log.Error("encodePrices | encoding failed", "error", err)
+		s.encodedPrices.Store(nil)
+		return
+	}
+	data = append(data, '\n')
+	s.encodedPrices.Store(&encodedBody{data: data, etag: etagOf(data)})
+}
+
+// recentFailure returns the error of the first market of markets which failed less than NEGATIVE_CACHE_TTL ago, nil if none did.
+func (s *Server) recentFailure(entries map[string]cache.Entry, markets []Market) error {
+	for _, m := range markets {
+		if entry := entries[m.Symbol]; entry.FailedRecently(s.now(), s.cfg.NegativeCacheTTL) {
+			return entry.Err
+		}
+	}
+	return nil
+}
+
+// expiredMarkets returns the markets whose price is missing from entries, or older than limit(TTL of the market).
+func (s *Server) expiredMarkets(entries map[string]cache.Entry, markets []Market, limit func(time.Duration) time.Duration) []Market {
+	var expired []Market
+	for _, m := range markets {
+		entry, ok := entries[m.Symbol]
+		if !ok || entry.UpdatedAt.IsZero() || entry.Restored || s.now().Sub(entry.UpdatedAt) >= limit(s.cfg.ttl(m)) {
+			expired = append(expired, m)
+		}
+	}
+	return expired
+}
+
+// pricesFromCache returns the cached prices of markets along with the age of the oldest one.
+// complete is false when some markets were never fetched successfully, on-chain markets aside.
+func (s *Server) pricesFromCache(entries map[string]cache.Entry, markets []Market) (prices map[string]float64, age time.Duration, complete bool) {
+	prices = make(map[string]float64, len(markets))
+	complete = true
+	for _, m := range markets {
+		entry, ok := entries[m.Symbol]
+		if !ok || entry.UpdatedAt.IsZero() {
+			complete = complete && m.onChain()
+			continue
+		}
+		prices[m.Symbol] = entry.Price()
+		if entryAge := s.now().Sub(entry.UpdatedAt); entryAge > age {
+			age = entryAge
+		}
+	}
+	return prices, age, complete
+}
+
+// staleTooOldError is returned when a refresh failed and the cached prices are too old to be served instead.
+type staleTooOldError struct {
+	Age   time.Duration
+	Cause error
+}
+
+func (e *staleTooOldError) Error() string { return e.Cause.Error() }
+func (e *staleTooOldError) Unwrap() error { return e.Cause }
+
+// maxAgeError is returned when the cached prices are older than the max_age of a request and couldn't be fetched again.
+type maxAgeError struct {
+	Age    time.Duration
+	MaxAge time.Duration
+	Cause  error
+}
+
+func (e *maxAgeError) Error() string {
+	return fmt.Sprintf("prices are %s old, older than max_age %s: %v", e.Age.Round(time.Second), e.MaxAge, e.Cause)
+}
+func (e *maxAgeError) Unwrap() error { return e.Cause }
+
+// lookupFresherThan fetches again the prices of markets older than maxAge, for the requests which can't use older ones.
+// The markets which just failed aren't fetched again, like in lookupPrices.
+func (s *Server) lookupFresherThan(ctx context.Context, markets []Market, maxAge time.Duration) (map[string]float64, time.Duration, error) {
+	entries := s.cache.Snapshot()
+	tooOld := s.expiredMarkets(entries, markets, func(time.Duration) time.Duration { return maxAge })
+	if len(tooOld) > 0 {
+		err := s.recentFailure(entries, tooOld)
+		if err == nil {
+			s.log.DebugContext(ctx, "lookupFresherThan | prices older than max_age, fetching them", "max_age", maxAge, "expired", len(tooOld))
+			err = s.refreshWithinBudget(ctx, tooOld)
+		}
+		if err != nil {
+			_, age, _ := s.pricesFromCache(entries, markets)
+			return nil, age, &maxAgeError{Age: age, MaxAge: maxAge, Cause: err}
+		}
+		entries = s.cache.Snapshot()
+	}
+
+	prices, age, _ := s.pricesFromCache(entries, markets)
+	if age > maxAge {
+		// Pools failing to be read leave their previous price.
+		return nil, age, &maxAgeError{Age: age, MaxAge: maxAge, Cause: errors.New("some prices couldn't be fetched")}
+	}
+	return prices, age, nil
+}
+
+// lookupPrices returns the prices of markets from the cache, fetching the expired ones.
+// When refreshing fails, the expired prices are returned as stale until they get too old to be served.
+// age is the age of the oldest returned price.
+func (s *Server) lookupPrices(ctx context.Context, markets []Market) (prices map[string]float64, age time.Duration, stale bool, err error) {
+	// Check if we have a valid cached result, a zero TTL disables the cache.
+	entries := s.cache.Snapshot()
+	expired := s.expiredMarkets(entries, markets, s.freshnessLimit)
+	// The background refresher failing to read a pool only leaves its price out, like refreshPrices does.
+	if s.cfg.backgroundRefresh() && !slices.ContainsFunc(expired, func(m Market) bool { return !m.onChain() }) {
+		expired = nil
+	}
+	if len(expired) == 0 {
+		s.log.DebugContext(ctx, "lookupPrices | cache hit", "cache", "hit", "symbols", len(markets))
+		tracing.FromContext(ctx).SetString("cache", "hit")
+		cacheHitsTotal.inc()
+		cacheHits.Add(1)
+		prices, age, _ = s.pricesFromCache(entries, markets)
+		return prices, age, false, nil
+	}
+
+	// The background refresher is in charge of fetching, so expired prices mean it's failing.
+	// Only the very first requests, before everything was cached, have to wait for it.
+	if s.cfg.backgroundRefresh() {
+		if cached, age, complete := s.pricesFromCache(entries, markets); complete {
+			return s.staleFallback(ctx, cached, age, errors.New("background refresh is failing"))
+		}
+	}
+
+	// Past their TTL, prices younger than CACHE_HARD_TTL are served right away while they are refreshed in the background.
+	if !s.cfg.backgroundRefresh() && s.withinHardTTL(entries, expired) {
+		s.log.DebugContext(ctx, "lookupPrices | expired prices served while revalidated", "cache", "revalidate", "expired", len(expired))
+		tracing.FromContext(ctx).SetString("cache", "revalidate")
+		cacheHitsTotal.inc()
+		cacheHits.Add(1)
+		s.revalidate(expired)
+		prices, age, _ = s.pricesFromCache(entries, markets)
+		return prices, age, false, nil
+	}
+
+	// The markets which just failed aren't fetched again for a while, the requests falling back right away.
+	if err := s.recentFailure(entries, expired); err != nil {
+		s.log.DebugContext(ctx, "lookupPrices | recent failure, not fetching again", "cache", "negative", "error", err)
+		tracing.FromContext(ctx).SetString("cache", "negative")
+		suppressedFetchesTotal.inc()
+		suppressedFetches.Add(1)
+		// The other expired markets are fetched all the same, for lookupAvailablePrices to serve them.
+		others := slices.DeleteFunc(slices.Clone(expired), func(m Market) bool { return entries[m.Symbol].FailedRecently(s.now(), s.cfg.NegativeCacheTTL) })
+		if len(others) > 0 && s.refreshWithinBudget(ctx, others) == nil {
+			entries = s.cache.Snapshot()
+		}
+		if cached, age, complete := s.pricesFromCache(entries, markets); complete {
+			return s.staleFallback(ctx, cached, age, err)
+		}
+		return nil, 0, false, err
+	}
+
+	// Cache miss: log and continue fetching the expired prices only.
+	s.log.DebugContext(ctx, "lookupPrices | cache miss, fetching the expired markets", "cache", "miss", "expired", len(expired))
+	tracing.FromContext(ctx).SetString("cache", "miss")
+	cacheMissesTotal.inc()
+	cacheMisses.Add(1)
+	if err := s.refreshWithinBudget(ctx, expired); err != nil {
+		if ctx.Err() != nil {
+			return nil, 0, false, err
+		}
+
+		// Fall back to the last good prices.
+		if cached, age, complete := s.pricesFromCache(entries, markets); complete {
+			return s.staleFallback(ctx, cached, age, err)
+		}
+		return nil, 0, false, err
+	}
+
+	// The fetched prices are cached along with the fresh ones.
+	prices, age, _ = s.pricesFromCache(s.cache.Snapshot(), markets)
+	return prices, age, false, nil
+}
+
+// lookupAvailablePrices is lookupPrices serving what it can when some markets fail: the fresh prices,
+// along with the last cached prices of the failed markets while younger than STALE_MAX_AGE.
+// failed maps the failed markets to the reason, and it only fails when not a single price can be served.
+func (s *Server) lookupAvailablePrices(ctx context.Context, markets []Market) (prices map[string]float64, age time.Duration, stale bool, failed map[string]string, err error) {
+	prices, age, stale, err = s.lookupPrices(ctx, markets)
+	if err == nil || ctx.Err() != nil || errors.Is(err, errOverloaded) {
+		return prices, age, stale, nil, err
+	}
+
+	entries := s.cache.Snapshot()
+	expired := s.expiredMarkets(entries, markets, s.freshnessLimit)
+	var marketsErr *marketsError
+	errors.As(err, &marketsErr)
+	prices, age, stale, failed = make(map[string]float64), 0, false, make(map[string]string)
+	for _, m := range markets {
+		entry, ok := entries[m.Symbol]
+		if !slices.ContainsFunc(expired, func(e Market) bool { return e.Symbol == m.Symbol }) {
+			prices[m.Symbol] = entry.Price()
+			age = max(age, s.now().Sub(entry.UpdatedAt))
+			continue
+		}
+
+		switch {
+		case marketsErr != nil && marketsErr.failed[m.Symbol] != nil:
+			failed[m.Symbol] = marketsErr.failed[m.Symbol].Error()
+		case entry.Err != nil:
+			failed[m.Symbol] = entry.Err.Error()
+		default:
+			failed[m.Symbol] = err.Error()
+		}
+		if ok && !entry.UpdatedAt.IsZero() && s.now().Sub(entry.UpdatedAt) < s.cfg.StaleMaxAge {
+			prices[m.Symbol] = entry.Price()
+			age = max(age, s.now().Sub(entry.UpdatedAt))
+			stale = true
+		}
+	}
+	if len(prices) == 0 {
+		return nil, 0, false, nil, err
+	}
+
+	s.log.WarnContext(ctx, "lookupAvailablePrices | some markets failed, serving partial prices", "failed", len(failed), "served", len(prices), "error", err)
+	partialResponsesTotal.inc()
+	return prices, age, stale, failed, nil
+}
+
+// withinHardTTL reports whether all of the expired markets have a price younger than CACHE_HARD_TTL.
+func (s *Server) withinHardTTL(entries map[string]cache.Entry, expired []Market) bool {
+	if s.cfg.CacheHardTTL <= 0 {
+		return false
+	}
+	for _, m := range expired {
+		entry, ok := entries[m.Symbol]
+		if !ok || entry.UpdatedAt.IsZero() || entry.Restored || s.now().Sub(entry.UpdatedAt) >= s.cfg.CacheHardTTL {
+			return false
+		}
+	}
+	return true
+}
+
+// revalidate refreshes the prices of markets in the background, unless a revalidation is running already.
+// A failure keeps the cached prices as they are, so that the next request past their TTL tries again.
+func (s *Server) revalidate(markets []Market) {
+	if !s.revalidating.CompareAndSwap(false, true) {
+		return
+	}
+	go func() {
+		defer s.revalidating.Store(false)
+		if _, err := s.refreshPrices(s.shutdownCtx, markets); err != nil && s.shutdownCtx.Err() == nil {
+			s.log.Warn("revalidate | background refresh failed, serving the expired prices", "error", err)
+		}
+	}()
+}
+
+// freshnessLimit returns the age up to which cached prices with the given TTL are served as fresh.
+// The background refresher replaces them before they expire, so they may miss one refresh before being stale.
+func (s *Server) freshnessLimit(ttl time.Duration) time.Duration {
+	if s.cfg.backgroundRefresh() {
+		return ttl + s.cfg.refreshInterval()
+	}
+	return ttl
+}
+
+// staleFallback returns expired prices after a failed refresh, unless they are too old to be served.
+func (s *Server) staleFallback(ctx context.Context, cached map[string]float64, age time.Duration, cause error) (map[string]float64, time.Duration, bool, error) {
+	if age >= s.cfg.StaleMaxAge {
+		s.log.ErrorContext(ctx, "staleFallback | stale prices too old to be served", "age", age.Round(time.Second), "error", cause)
+		return nil, age, false, &staleTooOldError{Age: age, Cause: cause}
+	}
+
+	s.log.WarnContext(ctx, "staleFallback | degraded, serving stale prices", "age", age.Round(time.Second), "error", cause)
+	return cached, age, true, nil
+}
+
+// refreshPrices fetches the prices of markets and caches them, once for all the instances sharing a cache in Redis.
+// The cached prices are persisted to SNAPSHOT_FILE after every successful refresh.
+func (s *Server) refreshPrices(ctx context.Context, markets []Market) (prices map[string]float64, err error) {
+	defer func() {
+		if err == nil {
+			s.persistSnapshot()
+		}
+	}()
+	if s.sharedCache != nil {
+		return s.refreshShared(ctx, markets)
+	}
+	return s.refreshLocal(ctx, markets)
+}
+
+// refreshLocal fetches the prices of markets and caches them, failing with a *marketsError when some of them fail.
+// With FANOUT_MODE=lenient, the markets which didn't fail are fetched and cached all the same, and every failure is kept;
+// with strict, the first failure cancels the fetches of the others.
+// The on-chain markets only fail on their own: their RPC endpoints failing leaves their price out.
+// Several markets are fetched with a single batch request when possible, or in parallel otherwise.
+func (s *Server) refreshLocal(ctx context.Context, markets []Market) (map[string]float64, error) {
+	prices := make(map[string]float64)
+
+	// The batch request only serves the markets fetched from CoinEx first, the others are fetched market by market.
+	batched := 0
+	for _, m := range markets {
+		if s.cfg.primarySource(m) == SOURCE_COINEX {
+			batched++
+		}
+	}
+
+	// Aggregated prices need every source of every market.
+	remaining := markets
+	if !s.cfg.PerMarketFetch && s.cfg.Aggregation == AGGREGATION_FIRST && batched > 1 {
+		batch, err := s.refreshBatch(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			s.log.WarnContext(ctx, "refreshPrices | batch fetch failed, falling back to per-market fetches", "error", err)
+		} else {
+			remaining = nil
+			for _, m := range markets {
+				if s.cfg.primarySource(m) != SOURCE_COINEX {
+					remaining = append(remaining, m)
+					continue
+				}
+				ticker, ok := batch[m.Market]
+				if !ok {
+					s.log.WarnContext(ctx, "refreshPrices | market missing from batch, fetching it alone", "market", m.Market)
+					remaining = append(remaining, m)
+					continue
+				}
+				ticker = s.cache.Store(m.Symbol, ticker, cache.Origin{Source: SOURCE_COINEX})
+				prices[m.Symbol] = ticker.Last
+			}
+			if len(prices) > 0 {
+				s.priceUpdates.publish()
+			}
+		}
+	}
+
+	// Fetch every market in parallel, all of them are cancelled along with ctx.
+	// In strict mode, the first failure cancels the others too.
+	group, fetchCtx := &errgroup.Group{}, ctx
+	if s.cfg.FanoutMode == FANOUT_STRICT {
+		group, fetchCtx = errgroup.WithContext(ctx)
+	}
+	var (
+		mu     sync.Mutex
+		failed = &marketsError{failed: make(map[string]error)}
+	)
+	for _, m := range remaining {
+		group.Go(func() error {
+			ticker, err := s.refreshMarket(fetchCtx, m)
+			if err == nil {
+				mu.Lock()
+				prices[m.Symbol] = ticker.Last
+				mu.Unlock()
+				return nil
+			}
+			if fetchCtx.Err() != nil {
+				// Cancelled along with ctx, or by the failure of another market.
+				return err
+			}
+			if m.onChain() {
+				s.log.WarnContext(ctx, "refreshPrices | on-chain fetch failed, leaving its price out", "symbol", m.Symbol, "error", err)
+				return nil
+			}
+			s.log.ErrorContext(ctx, "refreshPrices | fetch failed", "symbol", m.Symbol, "error", err)
+			mu.Lock()
+			failed.add(m.Symbol, err)
+			mu.Unlock()
+			return err
+		})
+	}
+	if err := group.Wait(); err != nil {
+		if ctx.Err() != nil || len(failed.failed) == 0 {
+			return nil, err
+		}
+		return nil, failed
+	}
+
+	return prices, nil
+}
+
+// marketsError holds the errors of the markets which failed to be fetched, keyed by symbol.
+// It reads as the first one, and matches all of them.
+type marketsError struct {
+	first  error
+	failed map[string]error
+}
+
+func (e *marketsError) add(symbol string, err error) {
+	if e.first == nil {
+		e.first = err
+	}
+	e.failed[symbol] = err
+}
+
+func (e *marketsError) Error() string { return e.first.Error() }
+
+func (e *marketsError) Unwrap() []error {
+	errs := make([]error, 0, len(e.failed))
+	for _, err := range e.failed {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// refreshMarket fetches the ticker of m from its price sources and caches it, concurrent callers sharing a single upstream fetch.
+func (s *Server) refreshMarket(ctx context.Context, m Market) (provider.Ticker, error) {
+	ticker, err, joined := s.marketFlights.do(ctx, m.Symbol, func(ctx context.Context) (provider.Ticker, error) {
+		var ticker provider.Ticker
+		var origin cache.Origin
+		err := s.withFetchSlot(ctx, func(ctx context.Context) (err error) {
+			ticker, origin, err = s.fetchTicker(ctx, m)
+			return err
+		})
+		if err == nil {
+			ticker = s.cache.Store(m.Symbol, ticker, origin)
+			s.priceUpdates.publish()
+		} else if ctx.Err() == nil {
+			s.cache.StoreError(m.Symbol, err)
+		}
+		return ticker, err
+	})
+	if joined {
+		s.log.DebugContext(ctx, "refreshMarket | joined in-flight fetch", "symbol", m.Symbol, "coalesced", s.marketFlights.coalesced.Load())
+	}
+	return ticker, err
+}
+
+// batchProvider is a price source fetching the tickers of all its markets with a single request.
+type batchProvider interface {
+	AllTickers(ctx context.Context) (map[string]provider.Ticker, error)
+}
+
+// refreshBatch fetches the tickers of all CoinEx markets, concurrent callers sharing a single upstream fetch.
+func (s *Server) refreshBatch(ctx context.Context) (map[string]provider.Ticker, error) {
+	tickers, err, joined := s.batchFlights.do(ctx, "all", func(ctx context.Context) (map[string]provider.Ticker, error) {
+		var tickers map[string]provider.Ticker
+		err := s.withFetchSlot(ctx, func(ctx context.Context) (err error) {
+			start := s.now()
+			tickers, err = s.fetchBatch(ctx)
+			s.recordFetch(SOURCE_COINEX, s.now().Sub(start), err)
+			return err
+		})
+		return tickers, err
+	})
+	if joined {
+		s.log.DebugContext(ctx, "refreshBatch | joined in-flight batch fetch", "coalesced", s.batchFlights.coalesced.Load())
+	}
+	return tickers, err
+}
+
+// fetchBatch fetches the tickers of all CoinEx markets from the CoinEx provider,
+// asking it for the markets whose price comes from CoinEx first when it can't fetch all of its markets at once.
+func (s *Server) fetchBatch(ctx context.Context) (map[string]provider.Ticker, error) {
+	p := s.providers[SOURCE_COINEX]
+	if batch, ok := p.(batchProvider); ok {
+		return batch.AllTickers(ctx)
+	}
+	var markets []string
+	for _, m := range s.cfg.refreshedMarkets() {
+		if s.cfg.primarySource(m) == SOURCE_COINEX {
+			markets = append(markets, m.Market)
+		}
+	}
+	return p.Fetch(ctx, markets)
+}
+
+// runRefresher refreshes the expiring prices every refresh interval until ctx is done.
+// Failures are logged and the previous prices are kept in the cache.
+func (s *Server) runRefresher(ctx context.Context) {
+	interval := s.cfg.refreshInterval()
+	s.log.Info("refresher | refreshing prices", "interval", interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// Refresh the prices which would expire before the next tick.
+	threshold := func(ttl time.Duration) time.Duration { return ttl - interval }
+	// While CoinEx streams them, only the prices it stopped pushing are polled.
+	streamed := func(ttl time.Duration) time.Duration { return ttl }
+
+	for {
+		// A reload may have changed the TTLs.
+		if next := s.cfg.refreshInterval(); next != interval {
+			interval = next
+			ticker.Reset(interval)
+			s.log.Info("refresher | refresh interval changed", "interval", interval)
+		}
+
+		limit := threshold
+		if s.cfg.UpstreamMode == UPSTREAM_WS && s.coinexStream.active(s.now(), s.cfg.UpstreamWSFallback) {
+			limit = streamed
+		}
+		expired := s.expiredMarkets(s.cache.Snapshot(), s.cfg.refreshedMarkets(), limit)
+		if len(expired) > 0 {
+			if _, err := s.refreshPrices(ctx, expired); err != nil && ctx.Err() == nil {
+				s.log.Error("refresher | refresh failed, keeping previous prices", "error", err)
+			}
+		}
+		s.checkAlerts(ctx)
+		s.checkMoves(ctx)
+
+		select {
+		case <-ctx.Done():
+			s.log.Info("refresher | stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"testing"
+)
+
+func TestEMAConvergesToStep(t *testing.T) {
+	s := useConfig(t, "--smoothing", "ema", "--smoothing-alpha", "0.5", "--outlier-threshold", "0")
+	useMarkets(t, s, []Market{{Symbol: "ban", Market: "BANANOUSDT"}})
+
+	cachePrice(t, s, "ban", 1)
+	if smoothed := s.cache.Snapshot()["ban"].Price(); smoothed != 1 {
+		t.Fatalf("first price smoothed to %g, want it as fetched", smoothed)
+	}
+	// Every step halves the distance to the new level, with an alpha of 0.5.
+	for step := 1; step <= 20; step++ {
+		cachePrice(t, s, "ban", 2)
+		want := 2 - math.Pow(0.5, float64(step))
+		if smoothed := s.cache.Snapshot()["ban"].Price(); math.Abs(smoothed-want) > 1e-12 {
+			t.Fatalf("step %d: smoothed price = %g, want %g", step, smoothed, want)
+		}
+	}
+
+	w := serve(s.pricesHandler, http.MethodGet, "/prices?raw=true")
+	if w.Body.String() != `{"ban":2}`+"\n" {
+		t.Errorf("raw prices = %s, want the fetched price", w.Body)
+	}
+}
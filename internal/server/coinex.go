@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider/coinex"
+)
+
+// newCoinexClient returns the client of the CoinEx API at baseURL configured from cfg,
+// its requests identified like the other upstream ones and accounted for in the metrics.
+func (s *Server) newCoinexClient(baseURL string, client *http.Client) *coinex.Client {
+	return coinex.New(baseURL, client, coinex.Options{
+		Version:          s.cfg.CoinexAPIVersion,
+		Retries:          s.cfg.UpstreamRetries,
+		BreakerThreshold: s.cfg.BreakerThreshold,
+		BreakerCooldown:  s.cfg.BreakerCooldown,
+		RateLimit:        s.cfg.CoinexRateLimit,
+		RateBurst:        s.cfg.CoinexRateBurst,
+		RateCooldown:     s.cfg.CoinexRateCooldown,
+		Log:              s.log,
+		Tracer:           s.tracer,
+		NewRequest: func(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+			req, err := s.newUpstreamRequest(ctx, method, url, body)
+			if err != nil {
+				return nil, err
+			}
+			if id := requestID(ctx); id != "" {
+				req.Header.Set(REQUEST_ID_HEADER, id)
+			}
+			return req, nil
+		},
+		Observe: func(market string, elapsed time.Duration, err error) {
+			recordUpstreamFetch(elapsed, err)
+			upstreamRequestsTotal.inc(market)
+			upstreamDuration.observe(elapsed.Seconds(), market)
+			if err != nil {
+				upstreamFailuresTotal.inc(market)
+			}
+		},
+		Throttled: func() { coinexThrottledTotal.inc() },
+	})
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Canned CoinEx v1 responses.
+const (
+	coinexTickerFixture        = `{"code": 0, "data": {"date": 1700000000000, "ticker": {"buy": "0.00733", "buy_amount": "1000", "high": "0.0075", "last": "0.00734", "low": "0.007", "open": "0.007", "sell": "0.00735", "sell_amount": "2000", "vol": "123456.78"}}, "message": "OK"}`
+	coinexUnknownMarketFixture = `{"code": 607, "data": {}, "message": "market not exist"}`
+)
+
+// coinexReply is a canned response of the fake CoinEx API.
+type coinexReply struct {
+	status int
+	body   string
+}
+
+func TestPriceHandlerCoinexResponses(t *testing.T) {
+	var (
+		ok          = coinexReply{http.StatusOK, coinexTickerFixture}
+		unavailable = coinexReply{http.StatusServiceUnavailable, `<html><body>503 Service Temporarily Unavailable</body></html>`}
+		tooMany     = coinexReply{http.StatusTooManyRequests, `{"code": 429, "message": "Too Many Requests"}`}
+		malformed   = coinexReply{http.StatusOK, `{"code": 0, "data": {"ticker": {"last": "0.00`}
+		notFound    = coinexReply{http.StatusNotFound, `404 page not found`}
+	)
+	tests := []struct {
+		name     string
+		replies  []coinexReply // The last one answers the remaining requests.
+		status   int
+		code     string
+		requests int
+	}{
+		{"ok", []coinexReply{ok}, http.StatusOK, "", 1},
+		{"server error retried", []coinexReply{unavailable, ok}, http.StatusOK, "", 2},
+		{"server errors", []coinexReply{unavailable}, http.StatusBadGateway, ERROR_UPSTREAM_UNAVAILABLE, 3},
+		{"rate limit retried", []coinexReply{tooMany, ok}, http.StatusOK, "", 2},
+		{"rate limited", []coinexReply{tooMany}, http.StatusServiceUnavailable, ERROR_UPSTREAM_RATE_LIMITED, 3},
+		{"malformed body retried", []coinexReply{malformed, ok}, http.StatusOK, "", 2},
+		{"malformed bodies", []coinexReply{malformed}, http.StatusBadGateway, ERROR_UPSTREAM_UNAVAILABLE, 3},
+		{"client error not retried", []coinexReply{notFound}, http.StatusBadGateway, ERROR_UPSTREAM_UNAVAILABLE, 1},
+		{"unknown market not retried", []coinexReply{{http.StatusOK, coinexUnknownMarketFixture}}, http.StatusBadGateway, ERROR_UPSTREAM_UNAVAILABLE, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := useConfig(t, "--refresh-mode", "lazy", "--price-sources", "coinex", "--upstream-retries", "2", "--coinex-rate-limit", "0")
+			useMarkets(t, s, []Market{{Symbol: "ban", Market: "BANANOUSDT"}})
+			requests := 0
+			useCoinex(t, s, func(w http.ResponseWriter, r *http.Request) {
+				reply := tt.replies[min(requests, len(tt.replies)-1)]
+				requests++
+				w.WriteHeader(reply.status)
+				w.Write([]byte(reply.body))
+			})
+
+			w := httptest.NewRecorder()
+			s.publicMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/prices/ban", nil))
+			if w.Code != tt.status {
+				t.Errorf("status = %d, body = %s, want %d", w.Code, w.Body, tt.status)
+			}
+			if tt.code != "" {
+				if code := decodeError(t, w).Code; code != tt.code {
+					t.Errorf("error code = %s, want %s", code, tt.code)
+				}
+			}
+			if retryAfter := w.Header().Get("Retry-After"); (w.Code == http.StatusServiceUnavailable) != (retryAfter != "") {
+				t.Errorf("status %d with Retry-After %q", w.Code, retryAfter)
+			}
+			if requests != tt.requests {
+				t.Errorf("CoinEx got %d requests, want %d", requests, tt.requests)
+			}
+		})
+	}
+}
+
+func TestPriceHandlerHonorsCoinexRetryAfter(t *testing.T) {
+	s := useConfig(t, "--refresh-mode", "lazy", "--price-sources", "coinex", "--upstream-retries", "2", "--coinex-rate-limit", "0", "--fetch-timeout", "1s")
+	useMarkets(t, s, []Market{{Symbol: "ban", Market: "BANANOUSDT"}})
+	requests := 0
+	useCoinex(t, s, func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "7")
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+
+	// The retry isn't even started, CoinEx asking for a longer wait than the fetch timeout.
+	start := time.Now()
+	w := httptest.NewRecorder()
+	s.publicMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/prices/ban", nil))
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("answered in %s, want right away", elapsed)
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "7" {
+		t.Errorf("status = %d with Retry-After %q, want 503 with the 7s of CoinEx", w.Code, w.Header().Get("Retry-After"))
+	}
+	if requests != 1 {
+		t.Errorf("CoinEx got %d requests, want a single one", requests)
+	}
+}
+
+// The CoinEx client set up by default must keep serving the batches, candles and stats resolved from its provider.
+func TestCoinexProviderExtensions(t *testing.T) {
+	p := useConfig(t).providers[SOURCE_COINEX]
+	if _, ok := p.(batchProvider); !ok {
+		t.Error("no batch fetches")
+	}
+	if _, ok := p.(candleProvider); !ok {
+		t.Error("no candles")
+	}
+	if _, ok := p.(breakerReporter); !ok {
+		t.Error("no breaker stats")
+	}
+	if _, ok := p.(limiterReporter); !ok {
+		t.Error("no limiter stats")
+	}
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+	"github.com/wBanano/wban-prices-api/internal/provider/coinex"
+)
+
+const (
+	DEFAULT_COINEX_WS_URL = "wss://socket.coinex.com/"
+
+	// Largest message accepted from CoinEx.
+	COINEX_WS_MAX_MESSAGE_SIZE = 1 << 20
+
+	// CoinEx drops connections which stay silent, a ping every interval keeps them open.
+	COINEX_WS_PING_INTERVAL = 30 * time.Second
+
+	// Reconnection delays double from the first to the last, with full jitter.
+	COINEX_WS_RECONNECT_DELAY     = time.Second
+	COINEX_WS_MAX_RECONNECT_DELAY = 30 * time.Second
+)
+
+// coinexStreamState tracks whether the CoinEx stream is keeping the cache up to date.
+type coinexStreamState struct {
+	mu        sync.Mutex
+	connected bool
+	downSince time.Time
+	conn      io.Closer // Current connection, nil between connections.
+}
+
+func (s *coinexStreamState) setConnected(connected bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.connected && !connected || s.downSince.IsZero() {
+		s.downSince = now
+	}
+	s.connected = connected
+}
+
+func (s *coinexStreamState) setConn(conn io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.conn = conn
+}
+
+// resubscribe drops the current connection, so that the stream reconnects and subscribes to the refreshed markets again.
+func (s *coinexStreamState) resubscribe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+// active reports whether prices are streamed at now, giving the stream fallback to reconnect before REST takes over.
+func (s *coinexStreamState) active(now time.Time, fallback time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connected || now.Sub(s.downSince) < fallback
+}
+
+// coinexRequest is a JSON-RPC request of the CoinEx WebSocket API.
+type coinexRequest struct {
+	Method string `json:"method"`
+	Params []any  `json:"params"`
+	ID     int    `json:"id"`
+}
+
+// coinexMessage is a JSON-RPC response or notification of the CoinEx WebSocket API.
+type coinexMessage struct {
+	Method string            `json:"method"`
+	Params []json.RawMessage `json:"params"`
+	Error  *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+	ID *int `json:"id"`
+}
+
+// coinexStateTicker is a market of a state.update notification.
+type coinexStateTicker struct {
+	Last   string `json:"last"`
+	Open   string `json:"open"`
+	High   string `json:"high"`
+	Low    string `json:"low"`
+	Volume string `json:"volume"`
+}
+
+// runCoinexStream keeps the cache up to date with the tickers pushed by CoinEx until ctx is done,
+// reconnecting and subscribing again whenever the connection is lost.
+func (s *Server) runCoinexStream(ctx context.Context) {
+	s.log.Info("coinexStream | streaming tickers", "url", s.cfg.CoinexWSURL)
+	s.coinexStream.setConnected(false, s.now())
+
+	attempt := 0
+	for {
+		connectedAt := s.now()
+		err := s.streamTickers(ctx)
+		s.coinexStream.setConnected(false, s.now())
+		if ctx.Err() != nil {
+			s.log.Info("coinexStream | stopped")
+			return
+		}
+
+		// Start over from the shortest delay once a connection held for a while.
+		if s.now().Sub(connectedAt) > COINEX_WS_MAX_RECONNECT_DELAY {
+			attempt = 0
+		}
+		attempt++
+		ceiling := min(COINEX_WS_RECONNECT_DELAY<<(attempt-1), COINEX_WS_MAX_RECONNECT_DELAY)
+		delay := time.Duration(rand.Int63n(int64(ceiling))) + 1
+		s.log.Warn("coinexStream | disconnected, reconnecting", "delay", delay.Round(time.Millisecond), "error", err)
+
+		select {
+		case <-ctx.Done():
+			s.log.Info("coinexStream | stopped")
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// streamTickers subscribes to the tickers of the refreshed markets and caches them until the connection fails.
+func (s *Server) streamTickers(ctx context.Context) error {
+	ws, err := s.dialWebSocket(ctx, s.cfg.CoinexWSURL, COINEX_WS_MAX_MESSAGE_SIZE)
+	if err != nil {
+		return err
+	}
+	defer ws.conn.Close()
+	s.coinexStream.setConn(ws.conn)
+	defer s.coinexStream.setConn(nil)
+
+	// Closing the connection interrupts the read loop below.
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ping := time.NewTicker(COINEX_WS_PING_INTERVAL)
+		defer ping.Stop()
+		for id := 2; ; id++ {
+			select {
+			case <-ctx.Done():
+				ws.conn.Close()
+				return
+			case <-stop:
+				return
+			case <-ping.C:
+				if err := ws.writeJSON(coinexRequest{Method: "server.ping", Params: []any{}, ID: id}); err != nil {
+					ws.conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	symbolsByMarket := make(map[string][]string)
+	var params []any
+	for _, m := range s.cfg.refreshedMarkets() {
+		if m.Market == "" {
+			continue
+		}
+		if _, ok := symbolsByMarket[m.Market]; !ok {
+			params = append(params, m.Market)
+		}
+		symbolsByMarket[m.Market] = append(symbolsByMarket[m.Market], m.Symbol)
+	}
+	if err := ws.writeJSON(coinexRequest{Method: "state.subscribe", Params: params, ID: 1}); err != nil {
+		return err
+	}
+	s.coinexStream.setConnected(true, s.now())
+	s.log.Info("coinexStream | connected", "markets", len(params))
+
+	for {
+		// A connection silent for two pings is dead.
+		ws.conn.SetReadDeadline(time.Now().Add(2 * COINEX_WS_PING_INTERVAL))
+		opcode, message, err := ws.readMessage()
+		if err != nil {
+			return err
+		}
+		if opcode == wsOpBinary {
+			if message, err = gunzip(message); err != nil {
+				return err
+			}
+		}
+
+		var msg coinexMessage
+		if err := json.Unmarshal(message, &msg); err != nil {
+			return fmt.Errorf("malformed message: %w", err)
+		}
+		if msg.Error != nil {
+			return &coinex.APIError{Market: "websocket", Code: msg.Error.Code, Message: msg.Error.Message}
+		}
+		if msg.Method != "state.update" || len(msg.Params) == 0 {
+			continue
+		}
+
+		var update map[string]coinexStateTicker
+		if err := json.Unmarshal(msg.Params[0], &update); err != nil {
+			return fmt.Errorf("malformed state update: %w", err)
+		}
+		stored := false
+		for market, state := range update {
+			ticker, err := coinex.V1Ticker{Last: state.Last, Open: state.Open, High: state.High, Low: state.Low, Vol: state.Volume}.Parse()
+			if err != nil {
+				continue
+			}
+			for _, symbol := range symbolsByMarket[market] {
+				s.cache.Store(symbol, ticker, cache.Origin{Source: SOURCE_COINEX})
+				stored = true
+			}
+		}
+		if stored {
+			s.priceUpdates.publish()
+		}
+	}
+}
+
+// gunzip decompresses the binary messages of CoinEx.
+func gunzip(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(io.LimitReader(reader, COINEX_WS_MAX_MESSAGE_SIZE))
+}
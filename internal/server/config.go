@@ -0,0 +1,641 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider/coinex"
+	"github.com/wBanano/wban-prices-api/internal/provider/dex"
+)
+
+const DEFAULT_LISTEN_ADDR = ":3333"
+const DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+const DEFAULT_READ_HEADER_TIMEOUT = 5 * time.Second
+const DEFAULT_READ_TIMEOUT = 10 * time.Second
+const DEFAULT_WRITE_TIMEOUT = 20 * time.Second
+const DEFAULT_IDLE_TIMEOUT = 60 * time.Second
+const DEFAULT_CACHE_TTL = 10 * time.Second
+const DEFAULT_NEGATIVE_CACHE_TTL = 2 * time.Second
+const DEFAULT_REFRESH_MODE = REFRESH_BACKGROUND
+const DEFAULT_STALE_MAX_AGE = 5 * time.Minute
+const DEFAULT_SYMBOL_STALE_AFTER = time.Minute
+const DEFAULT_MAX_AGE_LIMIT = time.Hour
+const DEFAULT_UPSTREAM_TIMEOUT = 5 * time.Second
+const DEFAULT_UPSTREAM_RETRIES = 3
+const DEFAULT_BREAKER_THRESHOLD = 5
+const DEFAULT_BREAKER_COOLDOWN = 30 * time.Second
+const DEFAULT_UPSTREAM_MODE = UPSTREAM_REST
+const DEFAULT_FANOUT_MODE = FANOUT_LENIENT
+const DEFAULT_UPSTREAM_WS_FALLBACK = 30 * time.Second
+const DEFAULT_OUTLIER_THRESHOLD = 50.0
+const DEFAULT_OUTLIER_ACCEPT_AFTER = 3
+const DEFAULT_SMOOTHING_ALPHA = 0.3
+
+// Smoothing modes: the served prices are either the fetched ones, or their exponential moving average.
+const (
+	SMOOTHING_NONE = "none"
+	SMOOTHING_EMA  = "ema"
+)
+
+// Refresh modes: prices are either refreshed by a background loop, or by the request finding the cache expired.
+const (
+	REFRESH_BACKGROUND = "background"
+	REFRESH_LAZY       = "lazy"
+)
+
+// Upstream modes: prices are either polled from the CoinEx REST API, or streamed from its WebSocket API.
+const (
+	UPSTREAM_REST = "rest"
+	UPSTREAM_WS   = "ws"
+)
+
+// Fan-out modes: the first market failing to be fetched either cancels the fetches of the others,
+// or every market is fetched whatever the others do, so that partial responses can serve them.
+const (
+	FANOUT_STRICT  = "strict"
+	FANOUT_LENIENT = "lenient"
+)
+
+// Config holds the runtime settings of the server.
+// Every setting can be given as a command-line flag or through its environment variable,
+// the flag taking precedence.
+type Config struct {
+	ListenAddr       string
+	SocketMode       string
+	socketMode       os.FileMode // Parsed SocketMode.
+	MarketsFile      string
+	CacheTTL         time.Duration
+	CacheHardTTL     time.Duration
+	NegativeCacheTTL time.Duration
+	RefreshMode      string
+	StaleMaxAge      time.Duration
+	SymbolStaleAfter time.Duration
+	MaxAgeLimit      time.Duration
+
+	RedisURL       string   // Only read from the environment, like APIKeys, it may hold a password.
+	redisURL       *url.URL // Parsed RedisURL, nil without one.
+	RedisKeyPrefix string
+
+	AlertsFile string
+
+	NotifyMovePct     float64
+	NotifyWindow      time.Duration
+	NotifyCooldown    time.Duration
+	DiscordWebhookURL string // Only read from the environment, like APIKeys.
+	TelegramBotToken  string // Only read from the environment, like APIKeys.
+	TelegramChatID    string
+
+	SnapshotFile   string
+	SnapshotMaxAge time.Duration
+
+	NoWarmup      bool
+	WarmupRetries int
+	WarmupFailure string
+
+	TLSCertFile      string
+	TLSKeyFile       string
+	AutocertDomains  string
+	AutocertCacheDir string
+	HTTPAddr         string
+
+	Gzip              bool
+	ShutdownTimeout   time.Duration
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	TrustProxy        bool
+	CORSOrigins       string
+	CORSCredentials   bool
+	RateLimit         float64
+	RateBurst         int
+	MaxInFlight       int
+	MaxRefreshing     int
+	QueueTimeout      time.Duration
+	LogExclude        string
+	LogLevel          string
+	LogFormat         string
+	logLevel          slog.Level // Parsed LogLevel.
+
+	PriceSources          string
+	sources               []string // Parsed PriceSources.
+	Aggregation           string
+	Quorum                int
+	DisagreementThreshold float64
+	HealthWindow          int
+	HealthThreshold       float64
+	OutlierThreshold      float64
+	OutlierAcceptAfter    int
+	Smoothing             string
+	SmoothingAlpha        float64
+	CoinGeckoAPIKey       string // Only read from the environment, like APIKeys.
+
+	BSCRPCURL       string
+	PolygonRPCURL   string
+	WBANBSCPool     string
+	WBANPolygonPool string
+
+	CoinexAPIURL                string
+	CoinexAPIVersion            int
+	CoinexWSURL                 string
+	CoinexRateLimit             float64
+	CoinexRateBurst             int
+	CoinexRateCooldown          time.Duration
+	UpstreamTimeout             time.Duration
+	UpstreamUserAgent           string
+	UpstreamProxyURL            string
+	upstreamProxy               *url.URL // Parsed UpstreamProxyURL, nil without one.
+	UpstreamRetries             int
+	UpstreamMaxIdleConnsPerHost int
+	UpstreamIdleConnTimeout     time.Duration
+	UpstreamTLSHandshakeTimeout time.Duration
+	PerMarketFetch              bool
+	FanoutMode                  string
+	FetchConcurrency            int
+	FetchTimeout                time.Duration
+
+	UpstreamMode       string
+	UpstreamWSFallback time.Duration
+
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	ForexURL string
+	ForexTTL time.Duration
+
+	HistoryCapacity  int
+	HistoryDB        string
+	HistoryRetention time.Duration
+	TWAPMaxWindow    time.Duration
+
+	OTelEndpoint    string
+	OTelServiceName string
+
+	AdminAddr   string
+	AdminToken  string // Only read from the environment, like APIKeys.
+	EnablePprof bool
+	PprofAddr   string
+
+	WSHeartbeat     time.Duration
+	LongPollMaxWait time.Duration
+
+	APIKeys     string // Only read from the environment, to keep the keys out of the command line.
+	APIKeysFile string
+	apiKeys     []apiKey // Parsed from APIKeys and APIKeysFile.
+
+	reloadable atomic.Pointer[marketConfig] // Read from MarketsFile, swapped on reload.
+
+	build BuildInfo // The running build, identified to the clients on /version and to the price sources.
+}
+
+// parseConfig reads the configuration of the build info from the flags of fs, parsed from args, and from the environment.
+func parseConfig(fs *flag.FlagSet, args []string, info BuildInfo) (*Config, error) {
+	cfg := &Config{build: info}
+	env := &envReader{}
+
+	fs.StringVar(&cfg.ListenAddr, "listen", envString("LISTEN_ADDR", DEFAULT_LISTEN_ADDR), "address to listen on, e.g. 127.0.0.1:9000, :0 for an ephemeral port or unix:/run/wban-prices.sock for a Unix domain socket (env LISTEN_ADDR)")
+	fs.StringVar(&cfg.SocketMode, "socket-mode", envString("SOCKET_MODE", DEFAULT_SOCKET_MODE), "octal permissions of the Unix domain socket, when listening on unix:/path (env SOCKET_MODE)")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert", envString("TLS_CERT_FILE", ""), "path of the PEM certificate to serve HTTPS with, along with its key (env TLS_CERT_FILE)")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key", envString("TLS_KEY_FILE", ""), "path of the PEM key of the TLS certificate (env TLS_KEY_FILE)")
+	fs.StringVar(&cfg.AutocertDomains, "autocert-domains", envString("AUTOCERT_DOMAINS", ""), "comma separated domains to serve HTTPS for with Let's Encrypt certificates (env AUTOCERT_DOMAINS)")
+	fs.StringVar(&cfg.AutocertCacheDir, "autocert-cache", envString("AUTOCERT_CACHE_DIR", DEFAULT_AUTOCERT_CACHE_DIR), "directory the Let's Encrypt certificates are kept in across restarts (env AUTOCERT_CACHE_DIR)")
+	fs.StringVar(&cfg.HTTPAddr, "http-addr", envString("HTTP_ADDR", ""), "address of the plain HTTP listener redirecting to HTTPS, :80 by default with autocert where it answers the ACME challenges (env HTTP_ADDR)")
+	fs.BoolVar(&cfg.Gzip, "gzip", env.bool("GZIP", true), "compress responses for the clients accepting gzip, false to disable it when debugging (env GZIP)")
+	fs.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", env.duration("SHUTDOWN_TIMEOUT", DEFAULT_SHUTDOWN_TIMEOUT), "how long open requests may take to complete on SIGINT or SIGTERM (env SHUTDOWN_TIMEOUT)")
+	fs.DurationVar(&cfg.ReadHeaderTimeout, "read-header-timeout", env.duration("READ_HEADER_TIMEOUT", DEFAULT_READ_HEADER_TIMEOUT), "how long clients may take to send request headers, 0 for no limit (env READ_HEADER_TIMEOUT)")
+	fs.DurationVar(&cfg.ReadTimeout, "read-timeout", env.duration("READ_TIMEOUT", DEFAULT_READ_TIMEOUT), "how long clients may take to send whole requests, 0 for no limit (env READ_TIMEOUT)")
+	fs.DurationVar(&cfg.WriteTimeout, "write-timeout", env.duration("WRITE_TIMEOUT", DEFAULT_WRITE_TIMEOUT), "how long responses may take to be written, extended for streams and long polls, 0 for no limit (env WRITE_TIMEOUT)")
+	fs.DurationVar(&cfg.IdleTimeout, "idle-timeout", env.duration("IDLE_TIMEOUT", DEFAULT_IDLE_TIMEOUT), "how long idle keep-alive connections are kept open, 0 for no limit (env IDLE_TIMEOUT)")
+	fs.BoolVar(&cfg.TrustProxy, "trust-proxy", env.bool("TRUST_PROXY", false), "take the client address from X-Forwarded-For, when running behind a reverse proxy (env TRUST_PROXY)")
+	fs.StringVar(&cfg.CORSOrigins, "cors-origins", envString("CORS_ORIGINS", DEFAULT_CORS_ORIGINS), "comma separated origins allowed to call the API from browsers, * for any (env CORS_ORIGINS)")
+	fs.BoolVar(&cfg.CORSCredentials, "cors-credentials", env.bool("CORS_CREDENTIALS", false), "allow credentialed CORS requests from the allowed origins (env CORS_CREDENTIALS)")
+	fs.Float64Var(&cfg.RateLimit, "rate-limit", env.float("RATE_LIMIT", DEFAULT_RATE_LIMIT), "requests per second allowed to every client IP, 0 disables rate limiting (env RATE_LIMIT)")
+	fs.IntVar(&cfg.RateBurst, "rate-burst", env.int("RATE_BURST", DEFAULT_RATE_BURST), "requests a client IP may send at once above the rate limit (env RATE_BURST)")
+	fs.IntVar(&cfg.MaxInFlight, "max-in-flight", env.int("MAX_IN_FLIGHT", DEFAULT_MAX_IN_FLIGHT), "requests processed at once before shedding load with 503s, 0 for no limit (env MAX_IN_FLIGHT)")
+	fs.IntVar(&cfg.MaxRefreshing, "max-refreshing", env.int("MAX_REFRESHING", DEFAULT_MAX_REFRESHING), "requests waiting on CoinEx to refresh expired prices at once, 0 for no limit (env MAX_REFRESHING)")
+	fs.DurationVar(&cfg.QueueTimeout, "queue-timeout", env.duration("QUEUE_TIMEOUT", DEFAULT_QUEUE_TIMEOUT), "how long requests beyond the limits wait for a slot before being shed, 0 sheds them right away (env QUEUE_TIMEOUT)")
+	fs.StringVar(&cfg.LogExclude, "log-exclude", envString("LOG_EXCLUDE", DEFAULT_LOG_EXCLUDE), "comma separated paths whose requests aren't logged (env LOG_EXCLUDE)")
+	fs.StringVar(&cfg.LogLevel, "log-level", envString("LOG_LEVEL", "info"), "minimum level of the logged messages: debug, info, warn or error (env LOG_LEVEL)")
+	fs.StringVar(&cfg.LogFormat, "log-format", envString("LOG_FORMAT", LOG_TEXT), "text or json (env LOG_FORMAT)")
+	fs.StringVar(&cfg.MarketsFile, "config", envString("MARKETS_FILE", ""), "path of the JSON file defining the markets, reloaded on SIGHUP, built-in markets are used when missing (env MARKETS_FILE)")
+	fs.DurationVar(&cfg.CacheTTL, "cache-ttl", env.duration("CACHE_TTL", DEFAULT_CACHE_TTL), "how long fetched prices are cached, 0 disables caching (env CACHE_TTL)")
+	fs.DurationVar(&cfg.CacheHardTTL, "cache-hard-ttl", env.duration("CACHE_HARD_TTL", 0), "with lazy refreshes, how old cached prices past the cache TTL are served while refreshed in the background, 0 to always wait for fresh prices (env CACHE_HARD_TTL)")
+	fs.DurationVar(&cfg.NegativeCacheTTL, "negative-cache-ttl", env.duration("NEGATIVE_CACHE_TTL", DEFAULT_NEGATIVE_CACHE_TTL), "how long the requests don't fetch a market again after it failed, 0 to always fetch it (env NEGATIVE_CACHE_TTL)")
+	fs.StringVar(&cfg.RefreshMode, "refresh-mode", envString("REFRESH_MODE", DEFAULT_REFRESH_MODE), "background to refresh prices every cache TTL, lazy to refresh them when a request finds the cache expired (env REFRESH_MODE)")
+	fs.DurationVar(&cfg.StaleMaxAge, "stale-max-age", env.duration("STALE_MAX_AGE", DEFAULT_STALE_MAX_AGE), "how old cached prices may be served when CoinEx fails, 0 disables stale prices (env STALE_MAX_AGE)")
+	fs.DurationVar(&cfg.SymbolStaleAfter, "symbol-stale-after", env.duration("SYMBOL_STALE_AFTER", DEFAULT_SYMBOL_STALE_AFTER), "how long after its last successful fetch a symbol is flagged stale by /prices/age (env SYMBOL_STALE_AFTER)")
+	fs.DurationVar(&cfg.MaxAgeLimit, "max-age-limit", env.duration("MAX_AGE_LIMIT", DEFAULT_MAX_AGE_LIMIT), "largest max_age accepted by /prices, larger ones are capped to it (env MAX_AGE_LIMIT)")
+	fs.StringVar(&cfg.RedisKeyPrefix, "redis-key-prefix", envString("REDIS_KEY_PREFIX", DEFAULT_REDIS_KEY_PREFIX), "prefix of the keys of the shared cache in Redis (env REDIS_KEY_PREFIX)")
+	fs.StringVar(&cfg.AlertsFile, "alerts-file", envString("ALERTS_FILE", ""), `path of a {"alerts": [...]} JSON file of price alerts, more can be added with the admin API (env ALERTS_FILE)`)
+	fs.Float64Var(&cfg.NotifyMovePct, "notify-move-pct", env.float("NOTIFY_MOVE_PCT", 0), "move in percent over the notify window notified to DISCORD_WEBHOOK_URL and the TELEGRAM_BOT_TOKEN chat by the background refresher, 0 disables it (env NOTIFY_MOVE_PCT)")
+	fs.DurationVar(&cfg.NotifyWindow, "notify-window", env.duration("NOTIFY_WINDOW", DEFAULT_NOTIFY_WINDOW), "period the notified moves are computed over, from the history (env NOTIFY_WINDOW)")
+	fs.DurationVar(&cfg.NotifyCooldown, "notify-cooldown", env.duration("NOTIFY_COOLDOWN", DEFAULT_NOTIFY_COOLDOWN), "shortest time between two notified moves of a symbol (env NOTIFY_COOLDOWN)")
+	fs.StringVar(&cfg.TelegramChatID, "telegram-chat-id", envString("TELEGRAM_CHAT_ID", ""), "chat the Telegram bot posts the notified moves to (env TELEGRAM_CHAT_ID)")
+	fs.StringVar(&cfg.SnapshotFile, "snapshot-file", envString("SNAPSHOT_FILE", ""), "path of the JSON file the prices are persisted to after every refresh and restored from at startup as stale prices, empty to disable it (env SNAPSHOT_FILE)")
+	fs.DurationVar(&cfg.SnapshotMaxAge, "snapshot-max-age", env.duration("SNAPSHOT_MAX_AGE", DEFAULT_SNAPSHOT_MAX_AGE), "how old the restored prices may be (env SNAPSHOT_MAX_AGE)")
+	fs.BoolVar(&cfg.NoWarmup, "no-warmup", env.bool("NO_WARMUP", false), "start listening without fetching the prices first, for development (env NO_WARMUP)")
+	fs.IntVar(&cfg.WarmupRetries, "warmup-retries", env.int("WARMUP_RETRIES", DEFAULT_WARMUP_RETRIES), "retries of the startup fetch when it fails (env WARMUP_RETRIES)")
+	fs.StringVar(&cfg.WarmupFailure, "warmup-failure", envString("WARMUP_FAILURE", DEFAULT_WARMUP_FAILURE), "serve to start anyway when the startup fetch keeps failing, exit to exit with an error (env WARMUP_FAILURE)")
+	fs.StringVar(&cfg.PriceSources, "price-sources", envString("PRICE_SOURCES", DEFAULT_PRICE_SOURCES), "comma separated price sources, tried in order for every market until one answers: coinex, binance, coingecko or kraken, markets may have their own order (env PRICE_SOURCES)")
+	fs.StringVar(&cfg.Aggregation, "aggregation", envString("AGGREGATION", DEFAULT_AGGREGATION), "first to serve the price of the first source answering, median to serve the median of all the sources of a market (env AGGREGATION)")
+	fs.IntVar(&cfg.Quorum, "quorum", env.int("QUORUM", DEFAULT_QUORUM), "sources which must answer to take the median, a single one is used below (env QUORUM)")
+	fs.Float64Var(&cfg.DisagreementThreshold, "disagreement-threshold", env.float("DISAGREEMENT_THRESHOLD", DEFAULT_DISAGREEMENT_THRESHOLD), "spread between the aggregated prices of a market logged as a disagreement, in percent (env DISAGREEMENT_THRESHOLD)")
+	fs.IntVar(&cfg.HealthWindow, "health-window", env.int("HEALTH_WINDOW", DEFAULT_HEALTH_WINDOW), "last fetches of every price source its health is computed from (env HEALTH_WINDOW)")
+	fs.Float64Var(&cfg.HealthThreshold, "health-threshold", env.float("HEALTH_THRESHOLD", DEFAULT_HEALTH_THRESHOLD), "success rate below which a price source is tried after the others, in percent (env HEALTH_THRESHOLD)")
+	fs.Float64Var(&cfg.OutlierThreshold, "outlier-threshold", env.float("OUTLIER_THRESHOLD", DEFAULT_OUTLIER_THRESHOLD), "change from the cached price, in percent, beyond which a fetched price is rejected as implausible, 0 accepts any (env OUTLIER_THRESHOLD)")
+	fs.IntVar(&cfg.OutlierAcceptAfter, "outlier-accept-after", env.int("OUTLIER_ACCEPT_AFTER", DEFAULT_OUTLIER_ACCEPT_AFTER), "consecutive implausible prices accepted as the new level (env OUTLIER_ACCEPT_AFTER)")
+	fs.StringVar(&cfg.Smoothing, "smoothing", envString("SMOOTHING", SMOOTHING_NONE), "none to serve the fetched prices, ema to serve their exponential moving average, the fetched ones staying available with ?raw=true (env SMOOTHING)")
+	fs.Float64Var(&cfg.SmoothingAlpha, "smoothing-alpha", env.float("SMOOTHING_ALPHA", DEFAULT_SMOOTHING_ALPHA), "weight of every fetched price in the moving average, from 0 excluded to 1 (env SMOOTHING_ALPHA)")
+	fs.StringVar(&cfg.BSCRPCURL, "bsc-rpc-url", envString("BSC_RPC_URL", dex.DEFAULT_BSC_RPC_URL), "JSON-RPC endpoint the BSC pools are read from (env BSC_RPC_URL)")
+	fs.StringVar(&cfg.PolygonRPCURL, "polygon-rpc-url", envString("POLYGON_RPC_URL", dex.DEFAULT_POLYGON_RPC_URL), "JSON-RPC endpoint the Polygon pools are read from (env POLYGON_RPC_URL)")
+	fs.StringVar(&cfg.WBANBSCPool, "wban-bsc-pool", envString("WBAN_BSC_POOL", ""), "address of the wBAN/WBNB pool served as wban_bsc along with the built-in markets (env WBAN_BSC_POOL)")
+	fs.StringVar(&cfg.WBANPolygonPool, "wban-polygon-pool", envString("WBAN_POLYGON_POOL", ""), "address of the wBAN/WETH pool served as wban_polygon along with the built-in markets (env WBAN_POLYGON_POOL)")
+	fs.StringVar(&cfg.CoinexAPIURL, "coinex-api-url", envString("COINEX_API_URL", coinex.DEFAULT_API_URL), "base URL of the CoinEx REST API, for its alternative domains (env COINEX_API_URL)")
+	fs.IntVar(&cfg.CoinexAPIVersion, "coinex-api-version", env.int("COINEX_API_VERSION", coinex.API_V1), "version of the CoinEx REST API, 1 or 2, the default CoinEx API URL following it (env COINEX_API_VERSION)")
+	fs.StringVar(&cfg.CoinexWSURL, "coinex-ws-url", envString("COINEX_WS_URL", DEFAULT_COINEX_WS_URL), "URL of the CoinEx WebSocket API (env COINEX_WS_URL)")
+	fs.Float64Var(&cfg.CoinexRateLimit, "coinex-rate-limit", env.float("COINEX_RATE_LIMIT", coinex.DEFAULT_RATE_LIMIT), "requests per second sent to the CoinEx REST API, 0 for no limit (env COINEX_RATE_LIMIT)")
+	fs.IntVar(&cfg.CoinexRateBurst, "coinex-rate-burst", env.int("COINEX_RATE_BURST", coinex.DEFAULT_RATE_BURST), "requests sent to CoinEx at once above its rate limit (env COINEX_RATE_BURST)")
+	fs.DurationVar(&cfg.CoinexRateCooldown, "coinex-rate-cooldown", env.duration("COINEX_RATE_COOLDOWN", coinex.DEFAULT_RATE_COOLDOWN), "how long the CoinEx rate limit is tightened after CoinEx rate limited us anyway (env COINEX_RATE_COOLDOWN)")
+	fs.DurationVar(&cfg.UpstreamTimeout, "upstream-timeout", env.duration("UPSTREAM_TIMEOUT", DEFAULT_UPSTREAM_TIMEOUT), "timeout of requests to CoinEx (env UPSTREAM_TIMEOUT)")
+	fs.IntVar(&cfg.UpstreamRetries, "upstream-retries", env.int("UPSTREAM_RETRIES", DEFAULT_UPSTREAM_RETRIES), "how many times a failed CoinEx request is retried (env UPSTREAM_RETRIES)")
+	fs.StringVar(&cfg.UpstreamUserAgent, "upstream-user-agent", envString("UPSTREAM_USER_AGENT", defaultUserAgent(info)), "User-Agent of the requests to the price sources, for forks to identify their own traffic (env UPSTREAM_USER_AGENT)")
+	fs.StringVar(&cfg.UpstreamProxyURL, "upstream-proxy-url", envString("UPSTREAM_PROXY_URL", ""), "proxy of the REST requests to the price sources, overriding HTTP_PROXY, HTTPS_PROXY and NO_PROXY, the WebSocket stream connects directly (env UPSTREAM_PROXY_URL)")
+	fs.IntVar(&cfg.UpstreamMaxIdleConnsPerHost, "upstream-max-idle-conns-per-host", env.int("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", DEFAULT_UPSTREAM_MAX_IDLE_CONNS_PER_HOST), "idle connections kept alive per price source (env UPSTREAM_MAX_IDLE_CONNS_PER_HOST)")
+	fs.DurationVar(&cfg.UpstreamIdleConnTimeout, "upstream-idle-conn-timeout", env.duration("UPSTREAM_IDLE_CONN_TIMEOUT", DEFAULT_UPSTREAM_IDLE_CONN_TIMEOUT), "how long idle connections to the price sources are kept alive, 0 for no limit (env UPSTREAM_IDLE_CONN_TIMEOUT)")
+	fs.DurationVar(&cfg.UpstreamTLSHandshakeTimeout, "upstream-tls-handshake-timeout", env.duration("UPSTREAM_TLS_HANDSHAKE_TIMEOUT", DEFAULT_UPSTREAM_TLS_HANDSHAKE_TIMEOUT), "timeout of the TLS handshakes with the price sources (env UPSTREAM_TLS_HANDSHAKE_TIMEOUT)")
+	fs.BoolVar(&cfg.PerMarketFetch, "per-market-fetch", env.bool("PER_MARKET_FETCH", false), "fetch every market with its own request instead of a single batch request (env PER_MARKET_FETCH)")
+	fs.StringVar(&cfg.FanoutMode, "fanout-mode", envString("FANOUT_MODE", DEFAULT_FANOUT_MODE), "strict to cancel the fetches of the other markets once one failed, lenient to fetch all of them for partial responses (env FANOUT_MODE)")
+	fs.IntVar(&cfg.FetchConcurrency, "fetch-concurrency", env.int("FETCH_CONCURRENCY", DEFAULT_FETCH_CONCURRENCY), "markets fetched from the price sources at once, the others waiting for their turn, 0 for no limit (env FETCH_CONCURRENCY)")
+	fs.DurationVar(&cfg.FetchTimeout, "fetch-timeout", env.duration("FETCH_TIMEOUT", DEFAULT_FETCH_TIMEOUT), "how long fetching a market may take, retries and fallback sources included, before its turn is given to the next one (env FETCH_TIMEOUT)")
+	fs.StringVar(&cfg.UpstreamMode, "upstream-mode", envString("UPSTREAM_MODE", DEFAULT_UPSTREAM_MODE), "rest to poll prices from CoinEx, ws to stream them from its WebSocket API (env UPSTREAM_MODE)")
+	fs.DurationVar(&cfg.UpstreamWSFallback, "upstream-ws-fallback", env.duration("UPSTREAM_WS_FALLBACK", DEFAULT_UPSTREAM_WS_FALLBACK), "how long the WebSocket stream may be down before prices are polled again (env UPSTREAM_WS_FALLBACK)")
+	fs.IntVar(&cfg.BreakerThreshold, "breaker-threshold", env.int("BREAKER_THRESHOLD", DEFAULT_BREAKER_THRESHOLD), "consecutive failures of a market opening its circuit breaker, 0 disables it (env BREAKER_THRESHOLD)")
+	fs.DurationVar(&cfg.BreakerCooldown, "breaker-cooldown", env.duration("BREAKER_COOLDOWN", DEFAULT_BREAKER_COOLDOWN), "how long an open circuit breaker rejects requests before probing CoinEx (env BREAKER_COOLDOWN)")
+	fs.StringVar(&cfg.ForexURL, "forex-url", envString("FOREX_URL", DEFAULT_FOREX_URL), "URL of the ECB-formatted exchange rates feed used by ?vs= (env FOREX_URL)")
+	fs.DurationVar(&cfg.ForexTTL, "forex-ttl", env.duration("FOREX_TTL", DEFAULT_FOREX_TTL), "how long exchange rates are cached (env FOREX_TTL)")
+	fs.IntVar(&cfg.HistoryCapacity, "history-capacity", env.int("HISTORY_CAPACITY", DEFAULT_HISTORY_CAPACITY), "how many prices per symbol are kept for /prices/history, 0 disables the history (env HISTORY_CAPACITY)")
+	fs.StringVar(&cfg.HistoryDB, "history-db", envString("HISTORY_DB", ""), "path of the SQLite database the history is recorded to and served from, empty to keep it in memory only (env HISTORY_DB)")
+	fs.DurationVar(&cfg.HistoryRetention, "history-retention", env.duration("HISTORY_RETENTION", DEFAULT_HISTORY_RETENTION), "how long the prices are kept in the history database (env HISTORY_RETENTION)")
+	fs.DurationVar(&cfg.TWAPMaxWindow, "twap-max-window", env.duration("TWAP_MAX_WINDOW", DEFAULT_TWAP_MAX_WINDOW), "longest ?window= of /twap (env TWAP_MAX_WINDOW)")
+	fs.DurationVar(&cfg.WSHeartbeat, "ws-heartbeat", env.duration("WS_HEARTBEAT", DEFAULT_WS_HEARTBEAT), "interval of the WebSocket heartbeats, clients missing two of them are dropped (env WS_HEARTBEAT)")
+	fs.DurationVar(&cfg.LongPollMaxWait, "long-poll-max-wait", env.duration("LONG_POLL_MAX_WAIT", DEFAULT_LONG_POLL_MAX_WAIT), "longest ?wait= of long-polling requests to /prices, and their default (env LONG_POLL_MAX_WAIT)")
+	fs.StringVar(&cfg.OTelEndpoint, "otel-endpoint", envString("OTEL_EXPORTER_OTLP_ENDPOINT", ""), "base URL of the OTLP/HTTP collector the traces are exported to, tracing is disabled when empty (env OTEL_EXPORTER_OTLP_ENDPOINT)")
+	fs.StringVar(&cfg.OTelServiceName, "otel-service-name", envString("OTEL_SERVICE_NAME", DEFAULT_OTEL_SERVICE_NAME), "service name of the exported traces (env OTEL_SERVICE_NAME)")
+	fs.StringVar(&cfg.AdminAddr, "admin-addr", envString("ADMIN_ADDR", ""), "private address serving /metrics, /stats, pprof and the admin routes instead of the public listener, e.g. 127.0.0.1:9090 (env ADMIN_ADDR)")
+	fs.BoolVar(&cfg.EnablePprof, "pprof", env.bool("ENABLE_PPROF", false), "serve the net/http/pprof profiles on the admin address, or on the pprof one without it (env ENABLE_PPROF)")
+	fs.StringVar(&cfg.PprofAddr, "pprof-addr", envString("PPROF_ADDR", DEFAULT_PPROF_ADDR), "address the pprof profiles are served on without an admin address, keep it private (env PPROF_ADDR)")
+	fs.StringVar(&cfg.APIKeysFile, "api-keys-file", envString("API_KEYS_FILE", ""), `path of a {"key": "name"} JSON file of API keys, added to the key=name pairs of the API_KEYS env var (env API_KEYS_FILE)`)
+	cfg.APIKeys = os.Getenv("API_KEYS")
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.CoinGeckoAPIKey = os.Getenv("COINGECKO_API_KEY")
+	cfg.RedisURL = os.Getenv("REDIS_URL")
+	cfg.DiscordWebhookURL = os.Getenv("DISCORD_WEBHOOK_URL")
+	cfg.TelegramBotToken = os.Getenv("TELEGRAM_BOT_TOKEN")
+	if env.err != nil {
+		return nil, env.err
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	markets, err := loadMarkets(cfg.MarketsFile, cfg.CacheTTL, cfg.dexMarkets())
+	if err != nil {
+		return nil, err
+	}
+	cfg.reloadable.Store(markets)
+
+	if cfg.apiKeys, err = loadAPIKeys(cfg.APIKeys, cfg.APIKeysFile); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (cfg *Config) validate() error {
+	mode, err := strconv.ParseUint(cfg.SocketMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return fmt.Errorf("invalid socket mode %q, expected octal permissions like 0660", cfg.SocketMode)
+	}
+	cfg.socketMode = os.FileMode(mode)
+	if (cfg.TLSCertFile == "") != (cfg.TLSKeyFile == "") {
+		return errors.New("TLS certificate and key files must be given together")
+	}
+	if cfg.TLSCertFile != "" && cfg.AutocertDomains != "" {
+		return errors.New("TLS certificate files and autocert domains are mutually exclusive")
+	}
+	if cfg.AdminAddr != "" && cfg.AdminAddr == cfg.ListenAddr {
+		return errors.New("the admin address must differ from the listen address")
+	}
+	if cfg.HTTPAddr != "" && cfg.TLSCertFile == "" && cfg.AutocertDomains == "" {
+		return errors.New("the plain HTTP listener redirects to HTTPS, which requires TLS")
+	}
+	if cfg.CacheTTL < 0 {
+		return errors.New("cache TTL must not be negative")
+	}
+	if cfg.CacheHardTTL < 0 {
+		return errors.New("cache hard TTL must not be negative")
+	}
+	if cfg.NegativeCacheTTL < 0 {
+		return errors.New("negative cache TTL must not be negative")
+	}
+	if cfg.RefreshMode != REFRESH_BACKGROUND && cfg.RefreshMode != REFRESH_LAZY {
+		return fmt.Errorf("unknown refresh mode %q, expected %s or %s", cfg.RefreshMode, REFRESH_BACKGROUND, REFRESH_LAZY)
+	}
+	if cfg.SymbolStaleAfter <= 0 {
+		return errors.New("symbol stale after must be positive")
+	}
+	if cfg.MaxAgeLimit <= 0 {
+		return errors.New("max age limit must be positive")
+	}
+	if cfg.StaleMaxAge < 0 {
+		return errors.New("stale max age must not be negative")
+	}
+	if cfg.RedisURL != "" {
+		redisURL, err := url.Parse(cfg.RedisURL)
+		if err != nil || redisURL.Host == "" || (redisURL.Scheme != "redis" && redisURL.Scheme != "rediss") {
+			return errors.New("invalid REDIS_URL, expected redis:// or rediss://[[user]:password@]host[:port][/db]")
+		}
+		cfg.redisURL = redisURL
+	}
+	if cfg.NotifyMovePct < 0 {
+		return errors.New("notify move must not be negative")
+	}
+	if cfg.NotifyWindow <= 0 || cfg.NotifyCooldown <= 0 {
+		return errors.New("notify window and cooldown must be positive")
+	}
+	if cfg.DiscordWebhookURL != "" {
+		if u, err := url.Parse(cfg.DiscordWebhookURL); err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.New("invalid DISCORD_WEBHOOK_URL, expected an https:// URL")
+		}
+	}
+	if cfg.TelegramBotToken != "" && cfg.TelegramChatID == "" {
+		return errors.New("TELEGRAM_BOT_TOKEN needs a Telegram chat ID")
+	}
+	if cfg.SnapshotMaxAge <= 0 {
+		return errors.New("snapshot max age must be positive")
+	}
+	if cfg.WarmupRetries < 0 {
+		return errors.New("warmup retries must not be negative")
+	}
+	if cfg.WarmupFailure != WARMUP_SERVE && cfg.WarmupFailure != WARMUP_EXIT {
+		return fmt.Errorf("unknown warmup failure %q, expected %s or %s", cfg.WarmupFailure, WARMUP_SERVE, WARMUP_EXIT)
+	}
+	if cfg.sources, err = parseSources(cfg.PriceSources); err != nil {
+		return err
+	}
+	if cfg.Aggregation != AGGREGATION_FIRST && cfg.Aggregation != AGGREGATION_MEDIAN {
+		return fmt.Errorf("unknown aggregation %q, expected %s or %s", cfg.Aggregation, AGGREGATION_FIRST, AGGREGATION_MEDIAN)
+	}
+	if cfg.Aggregation == AGGREGATION_MEDIAN && cfg.UpstreamMode == UPSTREAM_WS {
+		return errors.New("median aggregation polls every source, it can't be used with the WebSocket upstream mode")
+	}
+	if cfg.CoinexRateLimit < 0 {
+		return errors.New("CoinEx rate limit must not be negative")
+	}
+	if cfg.CoinexRateLimit > 0 && cfg.CoinexRateBurst < 1 {
+		return errors.New("CoinEx rate burst must be at least 1")
+	}
+	if cfg.CoinexRateCooldown <= 0 {
+		return errors.New("CoinEx rate cooldown must be positive")
+	}
+	if cfg.CoinexAPIVersion != coinex.API_V1 && cfg.CoinexAPIVersion != coinex.API_V2 {
+		return fmt.Errorf("unknown CoinEx API version %d, expected %d or %d", cfg.CoinexAPIVersion, coinex.API_V1, coinex.API_V2)
+	}
+	if cfg.CoinexAPIVersion == coinex.API_V2 && cfg.CoinexAPIURL == coinex.DEFAULT_API_URL {
+		cfg.CoinexAPIURL = coinex.DEFAULT_V2_API_URL
+	}
+	if u, err := url.Parse(cfg.CoinexAPIURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid CoinEx API URL %q, expected an absolute http or https URL", cfg.CoinexAPIURL)
+	}
+	if u, err := url.Parse(cfg.CoinexWSURL); err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return fmt.Errorf("invalid CoinEx WebSocket URL %q, expected an absolute ws or wss URL", cfg.CoinexWSURL)
+	}
+	if cfg.Quorum < 1 {
+		return errors.New("quorum must be at least 1")
+	}
+	if cfg.DisagreementThreshold < 0 {
+		return errors.New("disagreement threshold must not be negative")
+	}
+	if cfg.HealthWindow < 1 {
+		return errors.New("health window must be at least 1")
+	}
+	if cfg.HealthThreshold < 0 || cfg.HealthThreshold > 100 {
+		return errors.New("health threshold must be a percentage")
+	}
+	if cfg.OutlierThreshold < 0 {
+		return errors.New("outlier threshold must not be negative")
+	}
+	if cfg.OutlierAcceptAfter < 1 {
+		return errors.New("outlier accept after must be at least 1")
+	}
+	if cfg.Smoothing != SMOOTHING_NONE && cfg.Smoothing != SMOOTHING_EMA {
+		return fmt.Errorf("unknown smoothing %q, expected %s or %s", cfg.Smoothing, SMOOTHING_NONE, SMOOTHING_EMA)
+	}
+	if cfg.SmoothingAlpha <= 0 || cfg.SmoothingAlpha > 1 {
+		return errors.New("smoothing alpha must be between 0 excluded and 1")
+	}
+	if cfg.UpstreamTimeout <= 0 {
+		return errors.New("upstream timeout must be positive")
+	}
+	if cfg.UpstreamRetries < 0 {
+		return errors.New("upstream retries must not be negative")
+	}
+	if cfg.UpstreamProxyURL != "" {
+		proxy, err := url.Parse(cfg.UpstreamProxyURL)
+		if err != nil || proxy.Host == "" || (proxy.Scheme != "http" && proxy.Scheme != "https" && proxy.Scheme != "socks5") {
+			return fmt.Errorf("invalid upstream proxy URL %q, expected http://, https:// or socks5://host:port", cfg.UpstreamProxyURL)
+		}
+		cfg.upstreamProxy = proxy
+	}
+	if cfg.UpstreamMaxIdleConnsPerHost < 1 {
+		return errors.New("upstream max idle connections per host must be at least 1")
+	}
+	if cfg.UpstreamIdleConnTimeout < 0 {
+		return errors.New("upstream idle connection timeout must not be negative")
+	}
+	if cfg.UpstreamTLSHandshakeTimeout <= 0 {
+		return errors.New("upstream TLS handshake timeout must be positive")
+	}
+	if cfg.BreakerThreshold < 0 {
+		return errors.New("breaker threshold must not be negative")
+	}
+	if cfg.BreakerCooldown <= 0 {
+		return errors.New("breaker cooldown must be positive")
+	}
+	if cfg.FetchConcurrency < 0 {
+		return errors.New("fetch concurrency must not be negative")
+	}
+	if cfg.FetchTimeout <= 0 {
+		return errors.New("fetch timeout must be positive")
+	}
+	if cfg.FanoutMode != FANOUT_STRICT && cfg.FanoutMode != FANOUT_LENIENT {
+		return fmt.Errorf("unknown fan-out mode %q, expected %s or %s", cfg.FanoutMode, FANOUT_STRICT, FANOUT_LENIENT)
+	}
+	if cfg.UpstreamMode != UPSTREAM_REST && cfg.UpstreamMode != UPSTREAM_WS {
+		return fmt.Errorf("unknown upstream mode %q, expected %s or %s", cfg.UpstreamMode, UPSTREAM_REST, UPSTREAM_WS)
+	}
+	if cfg.UpstreamWSFallback <= 0 {
+		return errors.New("upstream WebSocket fallback must be positive")
+	}
+	if err := cfg.logLevel.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return fmt.Errorf("unknown log level %q, expected debug, info, warn or error", cfg.LogLevel)
+	}
+	if cfg.LogFormat != LOG_TEXT && cfg.LogFormat != LOG_JSON {
+		return fmt.Errorf("unknown log format %q, expected %s or %s", cfg.LogFormat, LOG_TEXT, LOG_JSON)
+	}
+	if cfg.ReadHeaderTimeout < 0 || cfg.ReadTimeout < 0 || cfg.WriteTimeout < 0 || cfg.IdleTimeout < 0 {
+		return errors.New("server timeouts must not be negative")
+	}
+	if cfg.CORSCredentials && strings.Contains(cfg.CORSOrigins, "*") {
+		return errors.New("credentialed CORS requests require explicit origins, not *")
+	}
+	if cfg.RateLimit < 0 {
+		return errors.New("rate limit must not be negative")
+	}
+	if cfg.RateLimit > 0 && cfg.RateBurst < 1 {
+		return errors.New("rate burst must be at least 1")
+	}
+	if cfg.MaxInFlight < 0 || cfg.MaxRefreshing < 0 {
+		return errors.New("concurrency limits must not be negative")
+	}
+	if cfg.QueueTimeout < 0 {
+		return errors.New("queue timeout must not be negative")
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		return errors.New("shutdown timeout must be positive")
+	}
+	if cfg.LongPollMaxWait <= 0 {
+		return errors.New("long-poll max wait must be positive")
+	}
+	if cfg.WSHeartbeat <= 0 {
+		return errors.New("websocket heartbeat must be positive")
+	}
+	if cfg.HistoryRetention <= 0 {
+		return errors.New("history retention must be positive")
+	}
+	if cfg.HistoryCapacity < 0 {
+		return errors.New("history capacity must not be negative")
+	}
+	if cfg.TWAPMaxWindow <= 0 {
+		return errors.New("TWAP max window must be positive")
+	}
+	if cfg.OTelEndpoint != "" {
+		if u, err := url.Parse(cfg.OTelEndpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid OTLP endpoint %q, expected an http or https URL", cfg.OTelEndpoint)
+		}
+	}
+	if cfg.ForexTTL <= 0 {
+		return errors.New("forex TTL must be positive")
+	}
+	return nil
+}
+
+// markets returns the configured markets.
+func (cfg *Config) markets() []Market {
+	return cfg.reloadable.Load().markets
+}
+
+// cacheTTL returns how long fetched prices are cached, the one of the configuration file if it sets one.
+func (cfg *Config) cacheTTL() time.Duration {
+	return cfg.reloadable.Load().cacheTTL
+}
+
+// backgroundRefresh tells if prices are refreshed by the background loop.
+// Without a cache there is nothing to refresh ahead of time, so a zero TTL implies lazy refreshes.
+func (cfg *Config) backgroundRefresh() bool {
+	return cfg.RefreshMode == REFRESH_BACKGROUND && cfg.cacheTTL() > 0
+}
+
+// refreshInterval returns how often the background refresher runs: as often as the shortest TTL.
+func (cfg *Config) refreshInterval() time.Duration {
+	interval := cfg.cacheTTL()
+	for _, m := range cfg.markets() {
+		if m.TTL.Duration > 0 && m.TTL.Duration < interval {
+			interval = m.TTL.Duration
+		}
+	}
+	return interval
+}
+
+// envString returns the value of the environment variable key, or fallback when it is unset or empty.
+func envString(key, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// envReader parses typed environment variables, remembering the first parsing error.
+type envReader struct {
+	err error
+}
+
+func (e *envReader) duration(key string, fallback time.Duration) time.Duration {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return d
+}
+
+func (e *envReader) int(key string, fallback int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return i
+}
+
+func (e *envReader) float(key string, fallback float64) float64 {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return f
+}
+
+func (e *envReader) bool(key string, fallback bool) bool {
+	value := os.Getenv(key)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return b
+}
+
+func (e *envReader) fail(key string, err error) {
+	if e.err == nil {
+		e.err = fmt.Errorf("invalid %s: %w", key, err)
+	}
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const DEFAULT_CORS_ORIGINS = "*"
+
+// Methods of the read-only routes.
+const ALLOWED_METHODS = "GET, HEAD, OPTIONS"
+
+// How long browsers may cache preflight responses, in seconds.
+const CORS_MAX_AGE = "86400"
+
+// cors sets the CORS headers of the responses of next to the requests from the allowed origins,
+// and answers the OPTIONS requests, preflights included, to all the routes of mux.
+// Requests from other origins get no CORS header at all, and browsers deny them the response.
+func (s *Server) cors(mux *http.ServeMux, next http.Handler) http.Handler {
+	allowed := make(map[string]bool)
+	for _, origin := range strings.Split(s.cfg.CORSOrigins, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			allowed[strings.ToLower(origin)] = true
+		}
+	}
+	// Responses to anyone don't depend on the origin, but credentialed ones must name it.
+	public := allowed["*"] && !s.cfg.CORSCredentials
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		origin := r.Header.Get("Origin")
+		allow := public || origin != "" && (allowed["*"] || allowed[strings.ToLower(origin)])
+		switch {
+		case public:
+			h.Set("Access-Control-Allow-Origin", "*")
+		case allow:
+			h.Add("Vary", "Origin")
+			h.Set("Access-Control-Allow-Origin", origin)
+			if s.cfg.CORSCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+		default:
+			h.Add("Vary", "Origin")
+		}
+
+		if r.Method != http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if _, pattern := mux.Handler(r); pattern == "" || pattern == "/" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Allow", ALLOWED_METHODS)
+		if allow && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", ALLOWED_METHODS)
+			if headers := r.Header.Get("Access-Control-Request-Headers"); headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			h.Set("Access-Control-Max-Age", CORS_MAX_AGE)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// allowMethods answers with a 405 the requests to the routes of mux with another method than ALLOWED_METHODS.
+// Routes registered along with their method, like the admin ones, are left to mux.
+func (s *Server) allowMethods(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			if _, pattern := mux.Handler(r); pattern != "" && pattern != "/" && !strings.Contains(pattern, " ") {
+				w.Header().Set("Allow", ALLOWED_METHODS)
+				s.writeJSONError(w, r, http.StatusMethodNotAllowed, errorResponse{Error: fmt.Sprintf("method %s not allowed, expected one of %s", r.Method, ALLOWED_METHODS)})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
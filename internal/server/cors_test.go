@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Read-only routes, with the parameters they need to answer.
+var readRoutes = []string{
+	"/prices",
+	"/prices/ban",
+	"/prices/history?symbol=ban",
+	"/prices/age",
+	"/twap?symbol=ban&window=1m",
+	"/prices/stream",
+	"/markets",
+	"/convert?from=ban&to=usd&amount=1",
+	"/ohlc?symbol=ban&interval=1h",
+	"/ws",
+	"/health",
+	"/ready",
+	"/version",
+	"/metrics",
+	"/stats",
+}
+
+// serveRoutes serves the public and admin routes behind the method checks, as main does.
+func serveRoutes(t *testing.T, s *Server) *httptest.Server {
+	mux := s.publicMux()
+	s.registerAdminRoutes(mux)
+	server := httptest.NewServer(s.cors(mux, s.allowMethods(mux, mux)))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// serveRoute sends a request to server and records the response, giving the streams a while to send their first bytes.
+func serveRoute(t *testing.T, server *httptest.Server, method, target string) *httptest.ResponseRecorder {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, server.URL+target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := server.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, target, err)
+	}
+	defer resp.Body.Close()
+	w := httptest.NewRecorder()
+	w.Code = resp.StatusCode
+	maps.Copy(w.Header(), resp.Header)
+	io.Copy(w.Body, resp.Body)
+	return w
+}
+
+func TestRouteMethods(t *testing.T) {
+	s := useConfig(t)
+	useMarkets(t, s, baselineMarkets)
+	useCoinex(t, s, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"code": 0, "data": [[1700000000, "0.007", "0.0073", "0.0075", "0.0069", "1000", "7", "BANANOUSDT"]], "message": "OK"}`))
+	})
+	for symbol, price := range baselinePrices {
+		cachePrice(t, s, symbol, price)
+	}
+	server := serveRoutes(t, s)
+
+	for _, route := range readRoutes {
+		t.Run(route, func(t *testing.T) {
+			for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete} {
+				w := serveRoute(t, server, method, route)
+				if w.Code != http.StatusMethodNotAllowed {
+					t.Errorf("%s: status = %d, want 405", method, w.Code)
+					continue
+				}
+				if allow := w.Header().Get("Allow"); allow != ALLOWED_METHODS {
+					t.Errorf("%s: Allow = %q, want %q", method, allow, ALLOWED_METHODS)
+				}
+				if code := decodeError(t, w).Code; code != ERROR_METHOD_NOT_ALLOWED {
+					t.Errorf("%s: error code = %q, want %s", method, code, ERROR_METHOD_NOT_ALLOWED)
+				}
+			}
+
+			w := serveRoute(t, server, http.MethodOptions, route)
+			if w.Code != http.StatusNoContent || w.Header().Get("Allow") != ALLOWED_METHODS {
+				t.Errorf("OPTIONS: status = %d with Allow %q, want 204 with %q", w.Code, w.Header().Get("Allow"), ALLOWED_METHODS)
+			}
+
+			get := serveRoute(t, server, http.MethodGet, route)
+			if get.Code == http.StatusMethodNotAllowed {
+				t.Errorf("GET: status = 405")
+			}
+			head := serveRoute(t, server, http.MethodHead, route)
+			if head.Code != get.Code {
+				t.Errorf("HEAD: status = %d, GET got %d", head.Code, get.Code)
+			}
+			if head.Body.Len() != 0 {
+				t.Errorf("HEAD: %d bytes of body", head.Body.Len())
+			}
+		})
+	}
+}
+
+func TestHeadMatchesGet(t *testing.T) {
+	s := useConfig(t)
+	cacheBaselinePrices(t, s)
+	server := serveRoutes(t, s)
+
+	for _, route := range []string{"/prices", "/prices?symbols=ban,eth", "/prices/ban", "/markets"} {
+		get := serveRoute(t, server, http.MethodGet, route)
+		head := serveRoute(t, server, http.MethodHead, route)
+		for _, header := range []string{"Content-Type", "ETag", "Content-Length", "Cache-Control"} {
+			if got, want := head.Header().Get(header), get.Header().Get(header); got != want {
+				t.Errorf("%s: HEAD %s = %q, GET sent %q", route, header, got, want)
+			}
+		}
+	}
+}
+
+func TestUnknownRoutesAreLeftToTheMux(t *testing.T) {
+	s := useConfig(t)
+	server := serveRoutes(t, s)
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		if w := serveRoute(t, server, method, "/nope"); w.Code != http.StatusNotFound {
+			t.Errorf("%s /nope: status = %d, want 404", method, w.Code)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/wBanano/wban-prices-api/internal/provider/dex"
+)
+
+// SOURCE_DEX prices the on-chain markets from the reserves of their liquidity pool.
+// It isn't one of PRICE_SOURCES: no other market can use it, and the on-chain markets use nothing else.
+const SOURCE_DEX = dex.NAME
+
+var addressPattern = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+
+// onChain reports whether m is priced from a liquidity pool.
+func (m Market) onChain() bool {
+	return m.DEX != nil
+}
+
+// dexMarkets returns the on-chain markets of the pools set by WBAN_BSC_POOL and WBAN_POLYGON_POOL.
+func (cfg *Config) dexMarkets() []Market {
+	var markets []Market
+	if cfg.WBANBSCPool != "" {
+		markets = append(markets, Market{Symbol: "wban_bsc", DEX: &dex.Pool{Chain: dex.CHAIN_BSC, Pool: cfg.WBANBSCPool, Quote: "bnb"}})
+	}
+	if cfg.WBANPolygonPool != "" {
+		markets = append(markets, Market{Symbol: "wban_polygon", DEX: &dex.Pool{Chain: dex.CHAIN_POLYGON, Pool: cfg.WBANPolygonPool, Quote: "eth"}})
+	}
+	return markets
+}
+
+// validatePool checks the pool of the on-chain market at index i, whose quote must be one of the symbols.
+func validatePool(i int, m Market, symbols map[string]bool) error {
+	if m.Market != "" || m.Binance != "" || m.CoinGecko != "" || m.Kraken != "" || len(m.Sources) > 0 {
+		return fmt.Errorf("markets[%d] (%s): on-chain markets have no other price source", i, m.Symbol)
+	}
+	if m.DEX.Chain != dex.CHAIN_BSC && m.DEX.Chain != dex.CHAIN_POLYGON {
+		return fmt.Errorf("markets[%d] (%s): unknown chain %q, expected %s or %s", i, m.Symbol, m.DEX.Chain, dex.CHAIN_BSC, dex.CHAIN_POLYGON)
+	}
+	if !addressPattern.MatchString(m.DEX.Pool) {
+		return fmt.Errorf("markets[%d] (%s): invalid pool address %q", i, m.Symbol, m.DEX.Pool)
+	}
+	if !symbols[m.DEX.Quote] {
+		return fmt.Errorf("markets[%d] (%s): unknown quote market %q", i, m.Symbol, m.DEX.Quote)
+	}
+	return nil
+}
+
+// rpcURL returns the JSON-RPC endpoint of chain, empty for unknown chains.
+func (cfg *Config) rpcURL(chain string) string {
+	switch chain {
+	case dex.CHAIN_BSC:
+		return cfg.BSCRPCURL
+	case dex.CHAIN_POLYGON:
+		return cfg.PolygonRPCURL
+	}
+	return ""
+}
+
+// findPool returns the pool of the on-chain market priced from the pool at address.
+func (cfg *Config) findPool(address string) (*dex.Pool, bool) {
+	for _, m := range cfg.markets() {
+		if m.onChain() && strings.EqualFold(m.DEX.Pool, address) {
+			return m.DEX, true
+		}
+	}
+	return nil, false
+}
+
+// pairedTokenPrice returns the USD price of the token paired with wBAN from the cache, fetching it if it was never cached.
+func (s *Server) pairedTokenPrice(ctx context.Context, symbol string) (float64, error) {
+	if ticker, ok := s.cache.Tickers([]string{symbol})[symbol]; ok {
+		return ticker.Last, nil
+	}
+	m, ok := s.cfg.findMarket(symbol)
+	if !ok {
+		return 0, fmt.Errorf("unknown quote market %q", symbol)
+	}
+	ticker, err := s.refreshMarket(ctx, m)
+	if err != nil {
+		return 0, fmt.Errorf("price of %s: %w", symbol, err)
+	}
+	return ticker.Last, nil
+}
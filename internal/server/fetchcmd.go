@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/wBanano/wban-prices-api/internal/provider"
+)
+
+// COMMAND_FETCH is the first argument running a single fetch of the prices instead of the server.
+const COMMAND_FETCH = "fetch"
+
+// Exit codes of the fetch command.
+const (
+	EXIT_FETCH_FAILED = 1
+	EXIT_USAGE        = 2
+)
+
+// fetchOptions are the flags of the fetch command, along with the ones of the server.
+type fetchOptions struct {
+	symbols string
+	format  string
+}
+
+func registerFetchFlags() *fetchOptions {
+	opts := &fetchOptions{}
+	flag.StringVar(&opts.symbols, "symbols", "", "comma separated symbols to fetch, all of them by default")
+	flag.StringVar(&opts.format, "format", FORMAT_JSON, "json, csv or txt")
+	return opts
+}
+
+// runFetch fetches the prices once for cron jobs and checks, prints them on stdout, and returns the exit code of the process.
+// The symbols which failed are logged and left out, making the command fail.
+func (s *Server) runFetch(opts *fetchOptions) int {
+	if opts.format != FORMAT_JSON && opts.format != FORMAT_CSV && opts.format != FORMAT_TXT {
+		fmt.Fprintf(os.Stderr, "unsupported format %q, expected %s, %s or %s\n", opts.format, FORMAT_JSON, FORMAT_CSV, FORMAT_TXT)
+		return EXIT_USAGE
+	}
+	markets := s.cfg.markets()
+	if opts.symbols != "" {
+		markets = nil
+		for _, symbol := range strings.Split(opts.symbols, ",") {
+			m, ok := s.cfg.findMarket(symbol)
+			if !ok {
+				fmt.Fprintf(os.Stderr, "unknown symbol %q, expected one of %s\n", symbol, strings.Join(s.marketSymbols(), ", "))
+				return EXIT_USAGE
+			}
+			markets = append(markets, m)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	type result struct {
+		symbol string
+		ticker provider.Ticker
+		err    error
+	}
+	results := make(chan result, len(markets))
+	for _, m := range markets {
+		go func(m Market) {
+			ticker, err := s.refreshMarket(ctx, m)
+			results <- result{m.Symbol, ticker, err}
+		}(m)
+	}
+
+	prices := make(map[string]float64, len(markets))
+	failed := 0
+	for range markets {
+		res := <-results
+		if res.err != nil {
+			s.log.Error("fetch | fetch failed", "symbol", res.symbol, "error", res.err)
+			failed++
+			continue
+		}
+		prices[res.symbol] = s.cachedPrice(res.symbol, res.ticker)
+	}
+
+	var out bytes.Buffer
+	switch opts.format {
+	case FORMAT_JSON:
+		data, _ := json.Marshal(prices)
+		out.Write(append(data, '\n'))
+	case FORMAT_CSV:
+		writer := csv.NewWriter(&out)
+		writer.Write([]string{"symbol", "price"})
+		writer.WriteAll(priceRows(prices, nil))
+	case FORMAT_TXT:
+		for _, row := range priceRows(prices, nil) {
+			out.WriteString(strings.Join(row, " ") + "\n")
+		}
+	}
+	os.Stdout.Write(out.Bytes())
+
+	if failed > 0 {
+		return EXIT_FETCH_FAILED
+	}
+	return 0
+}
+
+// cachedPrice returns the published price of symbol, smoothed if configured, falling back to the fetched ticker.
+func (s *Server) cachedPrice(symbol string, ticker provider.Ticker) float64 {
+	if entry, ok := s.cache.Snapshot()[symbol]; ok && !entry.UpdatedAt.IsZero() {
+		return entry.Price()
+	}
+	return ticker.Last
+}
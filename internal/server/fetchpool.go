@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	// Markets fetched at once, so that large market lists are fetched in waves rather than in a single burst.
+	DEFAULT_FETCH_CONCURRENCY = 5
+	DEFAULT_FETCH_TIMEOUT     = 30 * time.Second
+)
+
+// fetchSlotKey marks the contexts of the fetches holding a slot already.
+type fetchSlotKey struct{}
+
+// withFetchSlot calls fetch once a slot of fetchSlots is free, waiting for it as long as ctx allows.
+// fetch gets FETCH_TIMEOUT, so that a stuck fetch frees its slot in time.
+// The fetches made by a fetch, like the on-chain ones pricing their paired token, use the slot of their parent,
+// lest they wait for slots held by their parents.
+func (s *Server) withFetchSlot(ctx context.Context, fetch func(ctx context.Context) error) error {
+	if ctx.Value(fetchSlotKey{}) != nil {
+		return fetch(ctx)
+	}
+	if s.fetchSlots != nil {
+		s.fetchWaiting.Add(1)
+		select {
+		case s.fetchSlots <- struct{}{}:
+			s.fetchWaiting.Add(-1)
+		case <-ctx.Done():
+			s.fetchWaiting.Add(-1)
+			return ctx.Err()
+		}
+		defer s.fetchSlots.release()
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithValue(ctx, fetchSlotKey{}, true), s.cfg.FetchTimeout)
+	defer cancel()
+	return fetch(ctx)
+}
+
+// poolStats is the usage of the fetch slots in /stats.
+type poolStats struct {
+	Size    int   `json:"size"`
+	Busy    int   `json:"busy"`
+	Waiting int64 `json:"waiting"`
+}
+
+// fetchPoolStats returns the usage of the fetch slots, nil when the fetches aren't bounded.
+func (s *Server) fetchPoolStats() *poolStats {
+	if s.fetchSlots == nil {
+		return nil
+	}
+	return &poolStats{Size: cap(s.fetchSlots), Busy: len(s.fetchSlots), Waiting: s.fetchWaiting.Load()}
+}
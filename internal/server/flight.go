@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+)
+
+// flightGroup coalesces concurrent calls sharing the same key into a single execution.
+// The execution outlives the caller starting it, and is cancelled once all callers gave up waiting.
+type flightGroup[T any] struct {
+	mutex     sync.Mutex
+	calls     map[string]*flightCall[T]
+	coalesced atomic.Int64 // Number of calls which joined an in-flight execution.
+}
+
+type flightCall[T any] struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	value   T
+	err     error
+}
+
+// do runs fn, or waits for the in-flight execution of key. joined tells if an execution was already in flight.
+func (g *flightGroup[T]) do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (value T, err error, joined bool) {
+	g.mutex.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall[T])
+	}
+	call := g.calls[key]
+	if call != nil {
+		call.waiters++
+		g.mutex.Unlock()
+		g.coalesced.Add(1)
+		joined = true
+	} else {
+		// The execution must outlive the caller starting it, as others may be waiting on it.
+		fnCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		call = &flightCall[T]{done: make(chan struct{}), cancel: cancel, waiters: 1}
+		g.calls[key] = call
+		g.mutex.Unlock()
+
+		go func() {
+			defer cancel()
+			value, err := g.run(fnCtx, key, fn)
+			g.finish(key, call, value, err)
+		}()
+	}
+
+	select {
+	case <-call.done:
+		return call.value, call.err, joined
+	case <-ctx.Done():
+		g.mutex.Lock()
+		call.waiters--
+		if call.waiters == 0 {
+			// Nobody is interested anymore, abort the execution and let the next caller start a new one.
+			call.cancel()
+			g.forget(key, call)
+		}
+		g.mutex.Unlock()
+		return value, ctx.Err(), joined
+	}
+}
+
+// run calls fn, a panic being returned as an error so that it can neither crash the server nor leave the waiters hanging.
+func (g *flightGroup[T]) run(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (value T, err error) {
+	defer recoverError(ctx, "flight "+key, &err)
+	return fn(ctx)
+}
+
+// finish hands the result of the execution of key over to its waiters.
+func (g *flightGroup[T]) finish(key string, call *flightCall[T], value T, err error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	call.value, call.err = value, err
+	g.forget(key, call)
+	close(call.done)
+}
+
+// forget removes call from the in-flight executions, unless it was already replaced. The mutex must be held.
+func (g *flightGroup[T]) forget(key string, call *flightCall[T]) {
+	if g.calls[key] == call {
+		delete(g.calls, key)
+	}
+}
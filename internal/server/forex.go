@@ -0,0 +1,127 @@
+package server
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DEFAULT_FOREX_URL = "https://www.ecb.europa.eu/stats/eurofxref/eurofxref-daily.xml"
+const DEFAULT_FOREX_TTL = 6 * time.Hour
+
+// unsupportedCurrencyError is returned for currencies missing from the exchange rates.
+type unsupportedCurrencyError struct {
+	Currency  string
+	Supported []string
+}
+
+func (e *unsupportedCurrencyError) Error() string {
+	return fmt.Sprintf("unsupported currency %q", e.Currency)
+}
+
+func (s *Server) cachedForexRates() (map[string]float64, time.Time) {
+	s.forexMutex.Lock()
+	defer s.forexMutex.Unlock()
+
+	return s.forexRates, s.forexFetchedAt
+}
+
+func (s *Server) storeForexRates(rates map[string]float64) {
+	s.forexMutex.Lock()
+	defer s.forexMutex.Unlock()
+
+	s.forexRates, s.forexFetchedAt = rates, s.now()
+}
+
+// forexRate returns the exchange rate of currency, in units per USD.
+// Rates are refreshed once older than the forex TTL, the last known ones being kept as stale when it fails.
+func (s *Server) forexRate(ctx context.Context, currency string) (rate float64, stale bool, err error) {
+	rates, fetchedAt := s.cachedForexRates()
+
+	if rates == nil || s.now().Sub(fetchedAt) >= s.cfg.ForexTTL {
+		fresh, err, _ := s.forexFlights.do(ctx, "rates", s.fetchForexRates)
+		switch {
+		case err == nil:
+			rates = fresh
+		case rates != nil && ctx.Err() == nil:
+			s.log.WarnContext(ctx, "forexRate | refresh failed, using previous rates", "age", s.now().Sub(fetchedAt).Round(time.Second), "error", err)
+			stale = true
+		default:
+			return 0, false, err
+		}
+	}
+
+	rate, ok := rates[currency]
+	if !ok {
+		supported := make([]string, 0, len(rates))
+		for code := range rates {
+			supported = append(supported, code)
+		}
+		sort.Strings(supported)
+		return 0, false, &unsupportedCurrencyError{Currency: currency, Supported: supported}
+	}
+	return rate, stale, nil
+}
+
+// ecbEnvelope is the daily reference rates feed of the European Central Bank, quoted per EUR.
+type ecbEnvelope struct {
+	Cube struct {
+		Cube struct {
+			Time  string `xml:"time,attr"`
+			Rates []struct {
+				Currency string  `xml:"currency,attr"`
+				Rate     float64 `xml:"rate,attr"`
+			} `xml:"Cube"`
+		} `xml:"Cube"`
+	} `xml:"Cube"`
+}
+
+// fetchForexRates downloads the ECB feed and caches the rates converted to units per USD.
+func (s *Server) fetchForexRates(ctx context.Context) (map[string]float64, error) {
+	req, err := s.newUpstreamRequest(ctx, http.MethodGet, s.cfg.ForexURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.upstreamClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("forex source returned %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var envelope ecbEnvelope
+	if err := xml.Unmarshal(body, &envelope); err != nil {
+		return nil, fmt.Errorf("forex source: %w", err)
+	}
+
+	perEUR := map[string]float64{"eur": 1}
+	for _, r := range envelope.Cube.Cube.Rates {
+		perEUR[strings.ToLower(r.Currency)] = r.Rate
+	}
+	usdPerEUR := perEUR[USD_SYMBOL]
+	if usdPerEUR <= 0 {
+		return nil, fmt.Errorf("forex source has no USD rate")
+	}
+
+	rates := make(map[string]float64, len(perEUR))
+	for currency, rate := range perEUR {
+		rates[currency] = rate / usdPerEUR
+	}
+
+	s.storeForexRates(rates)
+
+	s.log.Info("fetchForexRates | fetched exchange rates", "currencies", len(rates), "date", envelope.Cube.Cube.Time)
+	return rates, nil
+}
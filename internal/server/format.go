@@ -0,0 +1,241 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+)
+
+// Response formats, selected with ?format= or by the Accept header.
+const (
+	FORMAT_JSON    = "json"
+	FORMAT_CSV     = "csv"
+	FORMAT_TXT     = "txt"
+	FORMAT_MSGPACK = "msgpack"
+)
+
+// Media types of the Accept header, and the formats they select.
+var formatMediaTypes = map[string]string{
+	"application/json": FORMAT_JSON,
+	"text/csv":         FORMAT_CSV,
+	"text/plain":       FORMAT_TXT,
+
+	"application/msgpack":   FORMAT_MSGPACK,
+	"application/x-msgpack": FORMAT_MSGPACK,
+}
+
+// negotiateFormat returns the format of the response to r among the supported ones, JSON by default.
+// An unsupported ?format= is answered with a 400 and ok false.
+func (s *Server) negotiateFormat(w http.ResponseWriter, r *http.Request, supported ...string) (format string, ok bool) {
+	w.Header().Add("Vary", "Accept")
+
+	format, err := requestedFormat(r, supported...)
+	if err != nil {
+		s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return "", false
+	}
+	return format, true
+}
+
+// textRequested reports whether the client of r expects plain text, errors included.
+func textRequested(r *http.Request) bool {
+	format, _ := requestedFormat(r, FORMAT_TXT)
+	return format == FORMAT_TXT
+}
+
+// requestedFormat returns the format requested by r among the supported ones, with ?format= or by the Accept header.
+// An unsupported ?format= is an error, while the Accept header falls back to JSON.
+func requestedFormat(r *http.Request, supported ...string) (string, error) {
+	if format := strings.ToLower(r.URL.Query().Get("format")); format != "" {
+		for _, s := range supported {
+			if format == s {
+				return format, nil
+			}
+		}
+		return "", fmt.Errorf("unsupported format %q, expected one of %s", format, strings.Join(supported, ", "))
+	}
+
+	// Pick the supported format the client prefers.
+	format, best := FORMAT_JSON, 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(accepted)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(value, 64); err != nil {
+				continue
+			}
+		}
+		candidate, known := formatMediaTypes[mediaType]
+		if !known || q <= best {
+			continue
+		}
+		for _, s := range supported {
+			if candidate == s {
+				format, best = candidate, q
+			}
+		}
+	}
+	return format, nil
+}
+
+// Callbacks of JSONP responses, restricted to names which can't inject any script.
+var jsonpCallbackPattern = regexp.MustCompile(`^[A-Za-z0-9_.]{1,64}$`)
+
+// jsonpCallback returns the ?callback= of a JSONP request, empty for plain JSON and for other methods than GET.
+// An invalid callback is answered with a 400 and ok false.
+func (s *Server) jsonpCallback(w http.ResponseWriter, r *http.Request) (callback string, ok bool) {
+	callback = r.URL.Query().Get("callback")
+	if r.Method != http.MethodGet || callback == "" {
+		return "", true
+	}
+	if !jsonpCallbackPattern.MatchString(callback) {
+		s.writeError(w, r, http.StatusBadRequest, errorResponse{Error: "callback must only contain letters, digits, underscores and dots"})
+		return "", false
+	}
+	return callback, true
+}
+
+// writeJSONP sends body encoded as JSON wrapped in a call to callback, along with its ETag.
+// The leading comment keeps the response from being sniffed as anything else than script.
+func (s *Server) writeJSONP(w http.ResponseWriter, r *http.Request, callback string, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "writeJSONP | encoding failed", "error", err)
+		s.writeJSONError(w, r, http.StatusInternalServerError, errorResponse{Error: "encoding failed"})
+		return
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeWithETag(w, r, "application/javascript; charset=utf-8", []byte("/**/"+callback+"("+string(data)+");\n"))
+}
+
+// formatNumber formats v in plain decimal notation, without exponent however small or big it is.
+func formatNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// decimal is a price encoded in JSON as a decimal string with ?strings=true, without exponent:
+// the one its source sent when set, the shortest decimal parsing back to the price otherwise.
+type decimal struct {
+	price    float64
+	upstream string
+}
+
+func (d decimal) MarshalJSON() ([]byte, error) {
+	if d.upstream != "" {
+		return strconv.AppendQuote(nil, d.upstream), nil
+	}
+	return strconv.AppendQuote(nil, formatNumber(d.price)), nil
+}
+
+// decimalOf returns price as a decimal, the last price of entry as its source sent it when price is that one, untouched.
+// Rounded prices are formatted from their value, the trailing zeros of the source could exceed the precision.
+func decimalOf(price float64, entry cache.Entry, precision int) decimal {
+	if precision < 0 && entry.Ticker.RawLast != "" && entry.Ticker.Last == price {
+		return decimal{price: price, upstream: entry.Ticker.RawLast}
+	}
+	return decimal{price: price}
+}
+
+// decimalPrices returns the prices as decimal strings, the ones served as fetched as their sources sent them.
+func decimalPrices(prices map[string]float64, entries map[string]cache.Entry, precision int) map[string]decimal {
+	decimals := make(map[string]decimal, len(prices))
+	for symbol, price := range prices {
+		decimals[symbol] = decimalOf(price, entries[symbol], precision)
+	}
+	return decimals
+}
+
+// Decimal places accepted by ?precision=.
+const MAX_PRECISION = 12
+
+// requestedPrecision returns the decimal places of ?precision=, -1 without one for full precision.
+func requestedPrecision(r *http.Request) (int, error) {
+	value := r.URL.Query().Get("precision")
+	if value == "" {
+		return -1, nil
+	}
+	precision, err := strconv.Atoi(value)
+	if err != nil || precision < 0 || precision > MAX_PRECISION {
+		return 0, fmt.Errorf("precision must be an integer from 0 to %d", MAX_PRECISION)
+	}
+	return precision, nil
+}
+
+// roundHalfUp rounds v to the given decimal places, halves away from zero. Negative places keep v as is.
+func roundHalfUp(v float64, places int) float64 {
+	if places < 0 {
+		return v
+	}
+	scale := math.Pow10(places)
+	scaled := v * scale
+	// Beyond 2^53, float64 has no decimals left to round.
+	if math.Abs(scaled) >= 1<<53 || math.IsNaN(scaled) || math.IsInf(scaled, 0) {
+		return v
+	}
+	return math.Round(scaled) / scale
+}
+
+// roundPrices rounds the prices in place, which must be a copy of the cached ones.
+func roundPrices(prices map[string]float64, places int) {
+	for symbol, price := range prices {
+		prices[symbol] = roundHalfUp(price, places)
+	}
+}
+
+// writeCSV sends the header and rows as a CSV attachment named filename.
+func writeCSV(w http.ResponseWriter, r *http.Request, filename string, header []string, rows [][]string) {
+	var buf bytes.Buffer
+	writer := csv.NewWriter(&buf)
+	writer.Write(header)
+	writer.WriteAll(rows)
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	writeWithETag(w, r, "text/csv; charset=utf-8", buf.Bytes())
+}
+
+// writeText sends the prices as plain text, one symbol and its price per line sorted by symbol.
+func writeText(w http.ResponseWriter, r *http.Request, prices map[string]float64) {
+	var buf bytes.Buffer
+	for _, row := range priceRows(prices, nil) {
+		buf.WriteString(strings.Join(row, " ") + "\n")
+	}
+	writeWithETag(w, r, "text/plain; charset=utf-8", buf.Bytes())
+}
+
+// sortedKeys returns the keys of m in increasing order.
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// priceRows returns the CSV rows of prices, sorted by symbol, detailed with their 24h change and volume if given.
+func priceRows(prices map[string]float64, details map[string]priceDetail) [][]string {
+	symbols := sortedKeys(prices)
+
+	rows := make([][]string, 0, len(symbols))
+	for _, symbol := range symbols {
+		row := []string{symbol, formatNumber(prices[symbol])}
+		if details != nil {
+			row = append(row, formatNumber(details[symbol].Change24hPct), formatNumber(details[symbol].Volume24h))
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
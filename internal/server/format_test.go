@@ -0,0 +1,119 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+	"github.com/wBanano/wban-prices-api/internal/provider"
+)
+
+// cacheExtremePrices returns a server caching prices small and big enough for encoding/json to write them with an exponent.
+func cacheExtremePrices(t *testing.T) *Server {
+	t.Helper()
+	s := useConfig(t)
+	useMarkets(t, s, []Market{{Symbol: "ban", Market: "BANANOUSDT"}, {Symbol: "eth", Market: "ETHUSDC"}, {Symbol: "shib", Market: "SHIBUSDT"}})
+	cachePrice(t, s, "ban", 0.00000012)
+	cachePrice(t, s, "eth", 2512.85)
+	cachePrice(t, s, "shib", 1.5e21)
+	return s
+}
+
+func TestPricesFormats(t *testing.T) {
+	s := cacheExtremePrices(t)
+	tests := []struct {
+		target string
+		accept string
+		want   string
+	}{
+		{"/prices", "", `{"ban":1.2e-7,"eth":2512.85,"shib":1.5e+21}` + "\n"},
+		{"/prices?strings=true", "", `{"ban":"0.00000012","eth":"2512.85","shib":"1500000000000000000000"}` + "\n"},
+		{"/prices?strings=true&precision=7", "", `{"ban":"0.0000001","eth":"2512.85","shib":"1500000000000000000000"}` + "\n"},
+		{"/prices", "text/csv", "symbol,price\nban,0.00000012\neth,2512.85\nshib,1500000000000000000000\n"},
+		{"/prices?precision=2", "text/csv", "symbol,price\nban,0\neth,2512.85\nshib,1500000000000000000000\n"},
+		{"/prices", "text/plain", "ban 0.00000012\neth 2512.85\nshib 1500000000000000000000\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target+" "+tt.accept, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			s.pricesHandler(w, r)
+			if w.Code != http.StatusOK || w.Body.String() != tt.want {
+				t.Errorf("status = %d, body = %q, want %q", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestPricesUpstreamDecimals(t *testing.T) {
+	s := useConfig(t, "--smoothing", "ema")
+	useMarkets(t, s, []Market{{Symbol: "ban", Market: "BANANOUSDT"}, {Symbol: "eth", Market: "ETHUSDC"}})
+	s.cache.Store("ban", provider.Ticker{Last: 0.0073, RawLast: "0.007300"}, cache.Origin{Source: SOURCE_COINEX})
+	s.cache.Store("eth", provider.Ticker{Last: 2512.85, RawLast: "2512.85000"}, cache.Origin{Source: SOURCE_KRAKEN})
+	s.cache.Store("eth", provider.Ticker{Last: 2612.85, RawLast: "2612.850"}, cache.Origin{Source: SOURCE_KRAKEN})
+
+	tests := []struct {
+		target string
+		want   string
+	}{
+		// The smoothed price of eth is computed, the fetched one is served as sent with ?raw=true.
+		{"/prices?strings=true", `{"ban":"0.007300","eth":"2542.85"}`},
+		{"/prices?strings=true&raw=true", `{"ban":"0.007300","eth":"2612.850"}`},
+		{"/prices?strings=true&precision=4", `{"ban":"0.0073","eth":"2542.85"}`},
+		{"/prices?strings=true&invert=true&symbols=ban", `{"ban":"136.986301369863"}`},
+		{"/prices/ban?strings=true", `{"ban":"0.007300"}`},
+		{"/prices/ban?strings=true&value_only=true", `"0.007300"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.publicMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+			if w.Code != http.StatusOK || w.Body.String() != tt.want+"\n" {
+				t.Errorf("status = %d, body = %q, want %q", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricExposition(t *testing.T) {
+	counter := newMetricVec("test_requests_total", "Requests.", "counter", "path", "status")
+	counter.inc("/prices", "200")
+	counter.inc("/prices", "200")
+	counter.inc(`/a"b\c`, "404")
+	histogram := newMetricVec("test_duration_seconds", "Durations.", "histogram")
+	histogram.observe(0.02)
+	histogram.observe(3)
+
+	var buf bytes.Buffer
+	counter.write(&buf)
+	histogram.write(&buf)
+	want := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{path="/a\"b\\c",status="404"} 1
+test_requests_total{path="/prices",status="200"} 2
+# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.005"} 0
+test_duration_seconds_bucket{le="0.01"} 0
+test_duration_seconds_bucket{le="0.025"} 1
+test_duration_seconds_bucket{le="0.05"} 1
+test_duration_seconds_bucket{le="0.1"} 1
+test_duration_seconds_bucket{le="0.25"} 1
+test_duration_seconds_bucket{le="0.5"} 1
+test_duration_seconds_bucket{le="1"} 1
+test_duration_seconds_bucket{le="2.5"} 1
+test_duration_seconds_bucket{le="5"} 2
+test_duration_seconds_bucket{le="10"} 2
+test_duration_seconds_bucket{le="+Inf"} 2
+test_duration_seconds_sum 3.02
+test_duration_seconds_count 2
+`
+	if buf.String() != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,911 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+	"github.com/wBanano/wban-prices-api/internal/provider/coinex"
+	"github.com/wBanano/wban-prices-api/internal/provider/coingecko"
+	"github.com/wBanano/wban-prices-api/internal/provider/dex"
+)
+
+// errorResponse is the JSON body of error responses.
+type errorResponse struct {
+	Error      string   `json:"error"`
+	Symbols    []string `json:"symbols,omitempty"`     // Supported symbols, when an unknown one was requested.
+	Currencies []string `json:"currencies,omitempty"`  // Supported currencies, when an unknown one was requested.
+	RequestID  string   `json:"request_id,omitempty"`  // To be quoted when reporting the error.
+	AgeSeconds *float64 `json:"age_seconds,omitempty"` // Age of the cached prices, when they are older than the requested max_age.
+	Code       string   `json:"code"`                  // Stable code of the error, which clients can branch on, see errorCode.
+}
+
+// Codes of the error responses. Their values are stable, clients branch on them.
+const (
+	ERROR_BAD_REQUEST           = "bad_request"
+	ERROR_UNAUTHORIZED          = "unauthorized"
+	ERROR_FORBIDDEN             = "forbidden"
+	ERROR_NOT_FOUND             = "not_found"
+	ERROR_METHOD_NOT_ALLOWED    = "method_not_allowed"
+	ERROR_NOT_ACCEPTABLE        = "not_acceptable"
+	ERROR_CONFLICT              = "conflict"
+	ERROR_RATE_LIMITED          = "rate_limited" // By our own rate limit.
+	ERROR_INTERNAL              = "internal_error"
+	ERROR_UPSTREAM_UNAVAILABLE  = "upstream_unavailable" // The price sources failed or timed out.
+	ERROR_UPSTREAM_RATE_LIMITED = "upstream_rate_limited"
+	ERROR_CIRCUIT_OPEN          = "circuit_open"   // The price source failed too often, it isn't called until its cooldown ends.
+	ERROR_OVERLOADED            = "overloaded"     // Requests were shed, too many of them at once.
+	ERROR_PRICES_TOO_OLD        = "prices_too_old" // The refresh failed and the cached prices are older than STALE_MAX_AGE.
+	ERROR_MAX_AGE_EXCEEDED      = "max_age_exceeded"
+	ERROR_UNAVAILABLE           = "unavailable"
+)
+
+// errorCode returns the code of the errors answered with status whose cause doesn't have a code of its own.
+func errorCode(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return ERROR_BAD_REQUEST
+	case http.StatusUnauthorized:
+		return ERROR_UNAUTHORIZED
+	case http.StatusForbidden:
+		return ERROR_FORBIDDEN
+	case http.StatusNotFound:
+		return ERROR_NOT_FOUND
+	case http.StatusMethodNotAllowed:
+		return ERROR_METHOD_NOT_ALLOWED
+	case http.StatusNotAcceptable:
+		return ERROR_NOT_ACCEPTABLE
+	case http.StatusConflict:
+		return ERROR_CONFLICT
+	case http.StatusTooManyRequests:
+		return ERROR_RATE_LIMITED
+	case http.StatusBadGateway:
+		return ERROR_UPSTREAM_UNAVAILABLE
+	case http.StatusServiceUnavailable:
+		return ERROR_UNAVAILABLE
+	}
+	if status >= 500 {
+		return ERROR_INTERNAL
+	}
+	return ERROR_BAD_REQUEST
+}
+
+// The responses are encoded in full before anything is written, so that failures are answered with a proper error.
+func (s *Server) pricesHandler(w http.ResponseWriter, r *http.Request) {
+	// Only serve the requested symbols, if any, keyed as requested.
+	symbols := r.URL.Query().Get("symbols")
+	markets := s.selectMarkets(symbols)
+	if len(markets) == 0 {
+		s.writeError(w, r, http.StatusBadRequest, errorResponse{Error: "no supported symbol requested", Symbols: s.marketSymbols()})
+		return
+	}
+	s.warnDeprecated(w, symbols)
+	format, ok := s.negotiateFormat(w, r, FORMAT_JSON, FORMAT_CSV, FORMAT_TXT, FORMAT_MSGPACK)
+	if !ok {
+		return
+	}
+	callback, ok := s.jsonpCallback(w, r)
+	if !ok {
+		return
+	}
+
+	base, ok := s.baseMarket(w, r)
+	if !ok {
+		return
+	}
+	precision, err := requestedPrecision(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	maxAge, err := s.requestedMaxAge(w, r, markets)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	// Long-polling clients wait for prices newer than the ones they have.
+	if r.URL.Query().Has("since") && !s.waitForRefresh(w, r, markets) {
+		return
+	}
+
+	// The base price is looked up along with the others, so that all the cross rates come from the same cache snapshot.
+	lookup := markets
+	baseRequested := base == nil || slices.ContainsFunc(markets, func(m Market) bool { return m.Symbol == base.Symbol })
+	if !baseRequested {
+		lookup = append(markets[:len(markets):len(markets)], *base)
+	}
+	prices, age, stale, failed, err := s.lookupAvailablePrices(r.Context(), lookup)
+	if err == nil && maxAge > 0 && age > maxAge {
+		// Rather than older prices than asked for, the client gets an error.
+		prices, age, err = s.lookupFresherThan(r.Context(), lookup, maxAge)
+		stale, failed = false, nil
+	}
+	if err != nil {
+		s.writeLookupError(w, r, err)
+		return
+	}
+	if stale {
+		w.Header().Set("X-Stale", "true")
+	}
+	// The failed markets are left out, or served at their stale price, along with the reason with ?meta=true.
+	if len(failed) > 0 {
+		w.Header().Set("X-Partial", "true")
+	}
+	var raw map[string]float64
+	if s.cfg.Smoothing != SMOOTHING_NONE {
+		raw = rawPrices(s.cache.Snapshot(), prices)
+		if useRaw, _ := strconv.ParseBool(r.URL.Query().Get("raw")); useRaw {
+			prices = raw
+		}
+	}
+	updatedAt := lastRefresh(s.cache.Snapshot(), markets)
+	w.Header().Set("X-Updated-At", formatTimestamp(updatedAt))
+	// The price in satoshis is left out without a BTC price, rather than being zero.
+	sats, withSats := 0.0, false
+	if extraRequested(r, SATS_SYMBOL) {
+		sats, withSats = s.banSats(prices)
+	}
+	if base != nil {
+		if !s.rebasePrices(w, r, prices, base.Symbol) {
+			return
+		}
+		if !baseRequested {
+			delete(prices, base.Symbol)
+			delete(raw, base.Symbol)
+		}
+	}
+	if !s.quotePrices(w, r, prices) {
+		return
+	}
+	if invert, _ := strconv.ParseBool(r.URL.Query().Get("invert")); invert {
+		s.invertPrices(r.Context(), prices)
+	}
+	if withSats {
+		prices[BAN_SATS_KEY] = sats
+	}
+	roundPrices(prices, precision)
+	remaining := s.setFreshnessHeaders(w, markets, age)
+
+	var details map[string]priceDetail
+	if detail, _ := strconv.ParseBool(r.URL.Query().Get("detail")); detail {
+		details = s.priceDetails(prices)
+	}
+	keys := s.responseKeys(symbols)
+	prices, details, raw, failed = withAliases(prices, keys), withAliases(details, keys), withAliases(raw, keys), withAliases(failed, keys)
+
+	if format == FORMAT_CSV {
+		header := []string{"symbol", "price"}
+		if details != nil {
+			header = append(header, "change_24h_pct", "volume_24h")
+		}
+		writeCSV(w, r, "prices.csv", header, priceRows(prices, details))
+		return
+	}
+	if format == FORMAT_TXT {
+		writeText(w, r, prices)
+		return
+	}
+	if format == FORMAT_MSGPACK {
+		if details != nil {
+			writeWithETag(w, r, "application/msgpack", appendMsgpackDetails(nil, details))
+		} else {
+			writeWithETag(w, r, "application/msgpack", appendMsgpackPrices(nil, prices))
+		}
+		return
+	}
+
+	// Encode and send the prices as JSON, unless the client has them already.
+	var body any = prices
+	if details != nil {
+		body = details
+	} else if asStrings, _ := strconv.ParseBool(r.URL.Query().Get("strings")); asStrings {
+		body = decimalPrices(prices, withAliases(s.cache.Snapshot(), keys), precision)
+	}
+	if meta, _ := strconv.ParseBool(r.URL.Query().Get("meta")); meta {
+		entries := s.cache.Snapshot()
+		source := s.cfg.sources[0]
+		if s.cfg.Aggregation == AGGREGATION_MEDIAN {
+			source = AGGREGATION_MEDIAN
+		}
+		body = pricesEnvelope{
+			Prices:         body,
+			UpdatedAt:      updatedAt,
+			Source:         source,
+			Sources:        withAliases(priceSources(entries, markets), keys),
+			BelowQuorum:    belowQuorum(entries, markets),
+			Suspect:        suspectSymbols(entries, markets),
+			Raw:            raw,
+			Stale:          w.Header().Get("X-Stale") != "",
+			TTLRemainingMs: remaining.Milliseconds(),
+			AgeMs:          age.Milliseconds(),
+			Partial:        len(failed) > 0,
+			Errors:         failed,
+		}
+	}
+	if callback != "" {
+		s.writeJSONP(w, r, callback, body)
+		return
+	}
+	// The prices of all markets, as cached, have been encoded already.
+	if encoded := s.encodedPrices.Load(); encoded != nil && plainPricesRequest(r) && len(failed) == 0 {
+		writeTagged(w, r, "application/json", encoded.data, encoded.etag)
+		return
+	}
+	s.writeJSONWithETag(w, r, body)
+}
+
+// plainPricesRequest reports whether r asks for the prices of all markets in JSON, without any parameter changing them.
+func plainPricesRequest(r *http.Request) bool {
+	for key := range r.URL.Query() {
+		if key != "format" {
+			return false
+		}
+	}
+	return true
+}
+
+// pricesEnvelope wraps the prices along with their freshness with ?meta=true.
+type pricesEnvelope struct {
+	Prices         any                `json:"prices"`
+	UpdatedAt      time.Time          `json:"updated_at"`
+	Source         string             `json:"source"`                 // Primary price source, or median.
+	Sources        map[string]string  `json:"sources"`                // Source each price comes from, the primary one, a fallback or median.
+	BelowQuorum    []string           `json:"below_quorum,omitempty"` // Symbols priced by a single source, too few answered to take the median.
+	Suspect        []string           `json:"suspect,omitempty"`      // Symbols whose fetched prices jumped implausibly, served at their previous price.
+	Raw            map[string]float64 `json:"raw,omitempty"`          // Last fetched prices, when the served ones are smoothed.
+	Stale          bool               `json:"stale"`
+	TTLRemainingMs int64              `json:"ttl_remaining_ms"`
+	AgeMs          int64              `json:"age_ms"`           // Age of the oldest price, like the Age header.
+	Partial        bool               `json:"partial"`          // Some markets failed, their prices are stale or missing.
+	Errors         map[string]string  `json:"errors,omitempty"` // Reason every failed market failed.
+}
+
+// priceSources returns the source of the cached price of every market.
+func priceSources(entries map[string]cache.Entry, markets []Market) map[string]string {
+	sources := make(map[string]string, len(markets))
+	for _, m := range markets {
+		if entry, ok := entries[m.Symbol]; ok && entry.Origin.Source != "" {
+			sources[m.Symbol] = entry.Origin.Source
+		}
+	}
+	return sources
+}
+
+// rawPrices returns the last fetched prices of the symbols of prices, unsmoothed.
+func rawPrices(entries map[string]cache.Entry, prices map[string]float64) map[string]float64 {
+	raw := make(map[string]float64, len(prices))
+	for symbol, price := range prices {
+		raw[symbol] = price
+		if entry, ok := entries[symbol]; ok && !entry.UpdatedAt.IsZero() {
+			raw[symbol] = entry.Ticker.Last
+		}
+	}
+	return raw
+}
+
+// suspectSymbols returns the symbols of markets whose last fetched prices were rejected as implausible.
+func suspectSymbols(entries map[string]cache.Entry, markets []Market) []string {
+	var symbols []string
+	for _, m := range markets {
+		if entries[m.Symbol].Outliers > 0 {
+			symbols = append(symbols, m.Symbol)
+		}
+	}
+	return symbols
+}
+
+// belowQuorum returns the symbols of markets whose cached price was aggregated from fewer sources than the quorum.
+func belowQuorum(entries map[string]cache.Entry, markets []Market) []string {
+	var symbols []string
+	for _, m := range markets {
+		if entries[m.Symbol].Origin.BelowQuorum {
+			symbols = append(symbols, m.Symbol)
+		}
+	}
+	return symbols
+}
+
+// priceDetail is the detailed market data of a symbol served with ?detail=true.
+type priceDetail struct {
+	Price        float64 `json:"price"`
+	Change24hPct float64 `json:"change_24h_pct"`
+	Volume24h    float64 `json:"volume_24h"`
+}
+
+// priceDetails adds the 24h change and volume of the cached tickers to the quoted prices.
+// The volume is in units of the symbol itself, whatever the quote currency.
+func (s *Server) priceDetails(prices map[string]float64) map[string]priceDetail {
+	symbols := make([]string, 0, len(prices))
+	for symbol := range prices {
+		symbols = append(symbols, symbol)
+	}
+	tickers := s.cache.Tickers(symbols)
+
+	details := make(map[string]priceDetail, len(prices))
+	for symbol, price := range prices {
+		ticker := tickers[symbol]
+		details[symbol] = priceDetail{Price: price, Change24hPct: ticker.Change24h(), Volume24h: ticker.Volume}
+	}
+	return details
+}
+
+// priceHandler serves the price of a single symbol, as {"symbol": price}, as a bare number with ?value_only=true
+// or as plain text with ?format=txt.
+func (s *Server) priceHandler(w http.ResponseWriter, r *http.Request) {
+	symbol := r.PathValue("symbol")
+	m, ok := s.cfg.findMarket(symbol)
+	if !ok {
+		s.writeError(w, r, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("unknown symbol %q", symbol), Symbols: s.marketSymbols()})
+		return
+	}
+	s.warnDeprecated(w, symbol)
+	// An alias is answered under its own key.
+	key := strings.ToLower(strings.TrimSpace(symbol))
+	valueOnly, _ := strconv.ParseBool(r.URL.Query().Get("value_only"))
+	format, ok := s.negotiateFormat(w, r, FORMAT_JSON, FORMAT_TXT)
+	if !ok {
+		return
+	}
+	precision, err := requestedPrecision(r)
+	if err != nil {
+		s.writeError(w, r, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+	callback, ok := s.jsonpCallback(w, r)
+	if !ok {
+		return
+	}
+
+	prices, _, stale, err := s.lookupPrices(r.Context(), []Market{m})
+	if err != nil {
+		s.writeLookupError(w, r, err)
+		return
+	}
+	if stale {
+		w.Header().Set("X-Stale", "true")
+	}
+	if useRaw, _ := strconv.ParseBool(r.URL.Query().Get("raw")); useRaw && s.cfg.Smoothing != SMOOTHING_NONE {
+		prices = rawPrices(s.cache.Snapshot(), prices)
+	}
+	if !s.quotePrices(w, r, prices) {
+		return
+	}
+	if invert, _ := strconv.ParseBool(r.URL.Query().Get("invert")); invert {
+		if s.invertPrices(r.Context(), prices); len(prices) == 0 {
+			s.writeError(w, r, http.StatusServiceUnavailable, errorResponse{Error: fmt.Sprintf("%s has no price to invert", m.Symbol)})
+			return
+		}
+	}
+	roundPrices(prices, precision)
+	keys := s.responseKeys(key)
+	prices = withAliases(prices, keys)
+
+	if format == FORMAT_TXT {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, formatNumber(prices[key]))
+		return
+	}
+
+	var body any = prices
+	asStrings, _ := strconv.ParseBool(r.URL.Query().Get("strings"))
+	switch {
+	case valueOnly && asStrings:
+		body = decimalOf(prices[key], withAliases(s.cache.Snapshot(), keys)[key], precision)
+	case valueOnly:
+		body = prices[key]
+	case asStrings:
+		body = decimalPrices(prices, withAliases(s.cache.Snapshot(), keys), precision)
+	}
+	if callback != "" {
+		s.writeJSONP(w, r, callback, body)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, body)
+}
+
+// USD legs of /convert, every price being quoted in USD.
+const USD_SYMBOL = "usd"
+
+// Quote currency of ?vs=btc.
+const BTC_SYMBOL = "btc"
+
+// Satoshis, the unit the Banano community quotes BAN in, with ?vs=sats or as the ban_sats key of ?extras=sats.
+const (
+	SATS_SYMBOL   = "sats"
+	SATS_PER_BTC  = 1e8
+	SATS_DECIMALS = 2
+
+	BAN_SYMBOL   = "ban"
+	BAN_SATS_KEY = "ban_sats"
+)
+
+type convertResponse struct {
+	From   string  `json:"from"`
+	To     string  `json:"to"`
+	Amount float64 `json:"amount"`
+	Result float64 `json:"result"`
+	Rate   float64 `json:"rate"`
+}
+
+// convertHandler converts an amount between two supported assets, or USD, through their USD prices.
+func (s *Server) convertHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	from := strings.ToLower(strings.TrimSpace(query.Get("from")))
+	to := strings.ToLower(strings.TrimSpace(query.Get("to")))
+
+	// Collect the markets of both legs, USD needing none.
+	var markets []Market
+	for _, symbol := range []string{from, to} {
+		if symbol == USD_SYMBOL {
+			continue
+		}
+		m, ok := s.cfg.findMarket(symbol)
+		if !ok {
+			s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("unknown symbol %q", symbol), Symbols: append(s.marketSymbols(), USD_SYMBOL)})
+			return
+		}
+		markets = append(markets, m)
+	}
+	s.warnDeprecated(w, from+","+to)
+
+	amount, err := strconv.ParseFloat(query.Get("amount"), 64)
+	if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) || amount <= 0 {
+		s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: "amount must be a positive number"})
+		return
+	}
+	precision, err := requestedPrecision(r)
+	if err != nil {
+		s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: err.Error()})
+		return
+	}
+
+	prices, _, stale, err := s.lookupPrices(r.Context(), markets)
+	if err != nil {
+		s.writeLookupError(w, r, err)
+		return
+	}
+	prices = withAliases(prices, s.responseKeys(from+","+to))
+	prices[USD_SYMBOL] = 1
+
+	// The markets left out of the cached prices, like the pools failing to be read, have no rate to convert with.
+	for _, symbol := range []string{from, to} {
+		if prices[symbol] == 0 {
+			setRetryAfter(w, s.cfg.refreshInterval())
+			s.writeJSONError(w, r, http.StatusServiceUnavailable, errorResponse{Error: fmt.Sprintf("no price available for %s", symbol), Code: ERROR_UPSTREAM_UNAVAILABLE})
+			return
+		}
+	}
+	if stale {
+		w.Header().Set("X-Stale", "true")
+	}
+
+	rate := prices[from] / prices[to]
+	s.writeJSON(w, http.StatusOK, convertResponse{From: from, To: to, Amount: amount, Result: roundHalfUp(amount*rate, precision), Rate: roundHalfUp(rate, precision)})
+}
+
+// marketInfo describes a supported symbol in /markets.
+type marketInfo struct {
+	Symbol    string    `json:"symbol"`
+	Market    string    `json:"market"`
+	Source    string    `json:"source"`
+	Binance   string    `json:"binance,omitempty"`   // Symbol of the Binance fallback.
+	CoinGecko string    `json:"coingecko,omitempty"` // Coin ID of the CoinGecko fallback.
+	Kraken    string    `json:"kraken,omitempty"`    // Kraken pair.
+	DEX       *dex.Pool `json:"dex,omitempty"`       // Liquidity pool of an on-chain market.
+	Quote     string    `json:"quote,omitempty"`
+	Aliases   []Alias   `json:"aliases,omitempty"` // Other keys answered with the price of the market, the deprecated ones to be replaced by its symbol.
+}
+
+// marketsHandler lists the supported symbols, as currently configured.
+func (s *Server) marketsHandler(w http.ResponseWriter, r *http.Request) {
+	markets := make([]marketInfo, 0, len(s.cfg.markets()))
+	for _, m := range s.cfg.markets() {
+		markets = append(markets, marketInfo{Symbol: m.Symbol, Market: m.Market, Source: s.cfg.primarySource(m), Binance: m.Binance, CoinGecko: m.CoinGecko, Kraken: m.Kraken, DEX: m.DEX, Quote: m.quote(), Aliases: m.Aliases})
+	}
+
+	// The market list only changes with the configuration.
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	s.writeJSON(w, http.StatusOK, markets)
+}
+
+// symbolAge is the freshness of the cached price of a symbol in /prices/age.
+type symbolAge struct {
+	UpdatedAt  *time.Time `json:"updated_at"`  // Of the last successful fetch, null if there was none.
+	AgeSeconds *float64   `json:"age_seconds"` // Since the last successful fetch, null if there was none.
+	Stale      bool       `json:"stale"`       // Not fetched successfully for SYMBOL_STALE_AFTER, or never.
+}
+
+// ageHandler tells how long ago the price of every symbol was fetched, so that the markets which stopped updating stand out.
+func (s *Server) ageHandler(w http.ResponseWriter, r *http.Request) {
+	entries := s.cache.Snapshot()
+	now := s.now()
+	ages := make(map[string]symbolAge, len(s.cfg.markets()))
+	for _, m := range s.cfg.markets() {
+		entry := entries[m.Symbol]
+		if entry.UpdatedAt.IsZero() {
+			ages[m.Symbol] = symbolAge{Stale: true}
+			continue
+		}
+		updatedAt := entry.UpdatedAt.UTC()
+		age := now.Sub(entry.UpdatedAt)
+		seconds := math.Round(age.Seconds()*1000) / 1000
+		ages[m.Symbol] = symbolAge{UpdatedAt: &updatedAt, AgeSeconds: &seconds, Stale: age >= s.cfg.SymbolStaleAfter}
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	s.writeJSON(w, http.StatusOK, ages)
+}
+
+// healthResponse is the JSON body of /health and /ready.
+type healthResponse struct {
+	Status string `json:"status"`
+	Uptime string `json:"uptime"`
+}
+
+// healthHandler tells the server is alive.
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+	s.writeJSON(w, http.StatusOK, healthResponse{Status: "ok", Uptime: s.now().Sub(s.startTime).Round(time.Second).String()})
+}
+
+// readyHandler tells the server is ready to serve prices, which is once a price has been fetched since startup.
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	uptime := s.now().Sub(s.startTime).Round(time.Second).String()
+	if !s.cache.Ready() {
+		s.writeJSON(w, http.StatusServiceUnavailable, healthResponse{Status: "not ready", Uptime: uptime})
+		return
+	}
+	s.writeJSON(w, http.StatusOK, healthResponse{Status: "ok", Uptime: uptime})
+}
+
+// quotePrices converts USD prices in place into the currency requested with ?vs=, if any.
+// It answers the request and returns false when the conversion isn't possible.
+func (s *Server) quotePrices(w http.ResponseWriter, r *http.Request, prices map[string]float64) bool {
+	vs := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("vs")))
+	if vs == "" || vs == USD_SYMBOL {
+		return true
+	}
+	if vs == BTC_SYMBOL {
+		return s.quoteBTC(w, r, prices, 1)
+	}
+	if vs == SATS_SYMBOL {
+		if !s.quoteBTC(w, r, prices, SATS_PER_BTC) {
+			return false
+		}
+		for symbol, price := range prices {
+			prices[symbol] = roundSats(price)
+		}
+		return true
+	}
+
+	rate, stale, err := s.forexRate(r.Context(), vs)
+	if err != nil {
+		var currencyErr *unsupportedCurrencyError
+		if errors.As(err, &currencyErr) {
+			s.writeError(w, r, http.StatusBadRequest, errorResponse{Error: err.Error(), Currencies: currencyErr.Supported})
+			return false
+		}
+		if r.Context().Err() == nil {
+			s.log.ErrorContext(r.Context(), "quotePrices | exchange rates unavailable", "path", r.URL.Path, "error", err)
+			s.writeError(w, r, http.StatusBadGateway, errorResponse{Error: "exchange rates unavailable"})
+		}
+		return false
+	}
+	if stale {
+		w.Header().Set("X-Forex-Stale", "true")
+	}
+
+	for symbol, price := range prices {
+		prices[symbol] = price * rate
+	}
+	return true
+}
+
+// quoteBTC divides USD prices in place by the cached BTC price, split in units per BTC.
+func (s *Server) quoteBTC(w http.ResponseWriter, r *http.Request, prices map[string]float64, perBTC float64) bool {
+	btc := s.cfg.quoteBTCMarket()
+	btcPrices, _, stale, err := s.lookupPrices(r.Context(), []Market{btc})
+	if err != nil {
+		s.writeLookupError(w, r, err)
+		return false
+	}
+	btcPrice := btcPrices[btc.Symbol]
+	if btcPrice <= 0 || math.IsNaN(btcPrice) || math.IsInf(btcPrice, 0) {
+		s.writeError(w, r, http.StatusServiceUnavailable, errorResponse{Error: "no BTC price available"})
+		return false
+	}
+	if stale {
+		w.Header().Set("X-Stale", "true")
+	}
+
+	for symbol, price := range prices {
+		prices[symbol] = price / btcPrice * perBTC
+	}
+	return true
+}
+
+// baseMarket returns the market of ?base=, nil without one. An unknown base, or one along with ?vs=, is answered with a 400.
+func (s *Server) baseMarket(w http.ResponseWriter, r *http.Request) (*Market, bool) {
+	symbol := r.URL.Query().Get("base")
+	if symbol == "" {
+		return nil, true
+	}
+	m, ok := s.cfg.findMarket(symbol)
+	if !ok {
+		s.writeError(w, r, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("unknown base %q", symbol), Symbols: s.marketSymbols()})
+		return nil, false
+	}
+	if r.URL.Query().Get("vs") != "" {
+		s.writeError(w, r, http.StatusBadRequest, errorResponse{Error: "base and vs can't be used together"})
+		return nil, false
+	}
+	return &m, true
+}
+
+// rebasePrices divides USD prices in place by the price of the base symbol, which must be among them.
+func (s *Server) rebasePrices(w http.ResponseWriter, r *http.Request, prices map[string]float64, base string) bool {
+	basePrice, ok := prices[base]
+	if !ok || basePrice <= 0 || math.IsNaN(basePrice) || math.IsInf(basePrice, 0) {
+		s.writeError(w, r, http.StatusServiceUnavailable, errorResponse{Error: fmt.Sprintf("no %s price available", base)})
+		return false
+	}
+
+	for symbol, price := range prices {
+		prices[symbol] = price / basePrice
+	}
+	prices[base] = 1
+	return true
+}
+
+// invertPrices replaces the prices in place by their inverse, the units of every symbol per unit of the quote currency.
+// Zero prices have no inverse and are left out.
+func (s *Server) invertPrices(ctx context.Context, prices map[string]float64) {
+	for symbol, price := range prices {
+		if price == 0 || math.IsNaN(price) || math.IsInf(price, 0) {
+			s.log.WarnContext(ctx, "invertPrices | price can't be inverted, leaving it out", "symbol", symbol, "price", price)
+			delete(prices, symbol)
+			continue
+		}
+		prices[symbol] = 1 / price
+	}
+}
+
+// banSats returns the price of BAN in satoshis from its USD price in prices and the cached BTC price,
+// false when either is unavailable.
+func (s *Server) banSats(prices map[string]float64) (float64, bool) {
+	ban, ok := prices[BAN_SYMBOL]
+	btc := s.cfg.quoteBTCMarket()
+	btcPrices, _, _ := s.pricesFromCache(s.cache.Snapshot(), []Market{btc})
+	btcPrice := btcPrices[btc.Symbol]
+	if !ok || btcPrice <= 0 || math.IsNaN(btcPrice) || math.IsInf(btcPrice, 0) {
+		return 0, false
+	}
+	return roundSats(ban / btcPrice * SATS_PER_BTC), true
+}
+
+// roundSats rounds a price in satoshis to SATS_DECIMALS.
+func roundSats(sats float64) float64 {
+	scale := math.Pow10(SATS_DECIMALS)
+	return math.Round(sats*scale) / scale
+}
+
+// extraRequested reports whether the comma separated ?extras= of r include extra.
+func extraRequested(r *http.Request, extra string) bool {
+	for _, requested := range strings.Split(r.URL.Query().Get("extras"), ",") {
+		if strings.EqualFold(strings.TrimSpace(requested), extra) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON sends body encoded as JSON with the given status.
+func (s *Server) writeJSON(w http.ResponseWriter, status int, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		s.log.Error("writeJSON | encoding failed", "error", err)
+		status = http.StatusInternalServerError
+		data, _ = json.Marshal(errorResponse{Error: "encoding failed"})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)+1))
+	w.WriteHeader(status)
+	w.Write(append(data, '\n'))
+}
+
+// warnDeprecated adds a Warning header for every deprecated alias in a comma-separated list of symbols.
+func (s *Server) warnDeprecated(w http.ResponseWriter, list string) {
+	for _, symbol := range strings.Split(list, ",") {
+		if m, alias, ok := s.cfg.findSymbol(symbol); ok && alias != nil && alias.Deprecated {
+			w.Header().Add("Warning", fmt.Sprintf(`299 - "%s is deprecated, use %s"`, alias.Symbol, m.Symbol))
+		}
+	}
+}
+
+// setFreshnessHeaders lets downstream caches keep the response until the oldest of its prices expires,
+// and returns how long that is.
+// Stale and partial responses, including the ones quoted with stale BTC prices or exchange rates, must be revalidated right away.
+func (s *Server) setFreshnessHeaders(w http.ResponseWriter, markets []Market, age time.Duration) time.Duration {
+	ttl := s.cfg.ttl(markets[0])
+	for _, m := range markets[1:] {
+		ttl = min(ttl, s.cfg.ttl(m))
+	}
+
+	maxAge := max(ttl-age, 0)
+	if w.Header().Get("X-Stale") != "" || w.Header().Get("X-Forex-Stale") != "" || w.Header().Get("X-Partial") != "" {
+		maxAge = 0
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+	return maxAge
+}
+
+// requestedMaxAge returns how old the prices may be with the max_age parameter, capped at MAX_AGE_LIMIT, 0 without one.
+// A max_age below the TTL of markets can't be met between two refreshes: it is ignored, with a Warning header.
+func (s *Server) requestedMaxAge(w http.ResponseWriter, r *http.Request, markets []Market) (time.Duration, error) {
+	value := r.URL.Query().Get("max_age")
+	if value == "" {
+		return 0, nil
+	}
+	maxAge, err := time.ParseDuration(value)
+	if err != nil || maxAge <= 0 {
+		return 0, errors.New("max_age must be a positive duration, like 30s")
+	}
+	maxAge = min(maxAge, s.cfg.MaxAgeLimit)
+
+	var ttl time.Duration
+	for _, m := range markets {
+		ttl = max(ttl, s.cfg.ttl(m))
+	}
+	if maxAge < ttl {
+		w.Header().Add("Warning", fmt.Sprintf(`299 - "max_age below the %s refresh interval, ignored"`, ttl))
+		return 0, nil
+	}
+	return maxAge, nil
+}
+
+// writeJSONWithETag sends body encoded as JSON along with its ETag, see writeWithETag.
+func (s *Server) writeJSONWithETag(w http.ResponseWriter, r *http.Request, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "writeJSONWithETag | encoding failed", "error", err)
+		s.writeJSONError(w, r, http.StatusInternalServerError, errorResponse{Error: "encoding failed"})
+		return
+	}
+	writeWithETag(w, r, "application/json", append(data, '\n'))
+}
+
+// writeWithETag sends data along with a strong ETag hashed from it,
+// or an empty 304 when the client's If-None-Match matches it.
+// Every variant of a response has its own body, so its own ETag, and identical prices keep the same one.
+func writeWithETag(w http.ResponseWriter, r *http.Request, contentType string, data []byte) {
+	writeTagged(w, r, contentType, data, etagOf(data))
+}
+
+// etagOf returns the strong ETag of a response body.
+func etagOf(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// writeTagged sends data along with its precomputed ETag, see writeWithETag.
+func writeTagged(w http.ResponseWriter, r *http.Request, contentType string, data []byte, etag string) {
+	w.Header().Set("ETag", etag)
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method != http.MethodHead {
+		w.Write(data)
+	}
+}
+
+// etagMatches reports whether the If-None-Match header matches etag, using the weak comparison it calls for.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// extendWriteDeadline gives the response to a long-lived request d more than the server's write timeout to be written.
+func (s *Server) extendWriteDeadline(w http.ResponseWriter, d time.Duration) {
+	if s.cfg.WriteTimeout > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(d + s.cfg.WriteTimeout))
+	}
+}
+
+// writeError answers r with an error, as plain text when the client expects text and as JSON otherwise.
+func (s *Server) writeError(w http.ResponseWriter, r *http.Request, status int, body errorResponse) {
+	if textRequested(r) {
+		http.Error(w, body.Error, status)
+		return
+	}
+	s.writeJSONError(w, r, status, body)
+}
+
+// writeJSONError answers r with an error as JSON.
+func (s *Server) writeJSONError(w http.ResponseWriter, r *http.Request, status int, body errorResponse) {
+	body.RequestID = requestID(r.Context())
+	if body.Code == "" {
+		body.Code = errorCode(status)
+	}
+	s.writeJSON(w, status, body)
+}
+
+// writeLookupError answers a request whose prices couldn't be looked up.
+func (s *Server) writeLookupError(w http.ResponseWriter, r *http.Request, err error) {
+	if r.Context().Err() != nil {
+		// Nobody is left to read the response.
+		s.log.InfoContext(r.Context(), "writeLookupError | client disconnected, fetch cancelled", "path", r.URL.Path)
+		return
+	}
+	status, code, retryAfter := upstreamFailure(err)
+	if status == http.StatusServiceUnavailable {
+		// Without a hint, the prices are fetched again by the next refresh.
+		if retryAfter <= 0 {
+			retryAfter = s.cfg.refreshInterval()
+		}
+		setRetryAfter(w, retryAfter)
+	}
+	body := errorResponse{Error: err.Error(), Code: code}
+	var maxAgeErr *maxAgeError
+	if errors.As(err, &maxAgeErr) {
+		seconds := maxAgeErr.Age.Seconds()
+		body.AgeSeconds = &seconds
+	}
+	s.writeError(w, r, status, body)
+}
+
+// retryHinter is implemented by the errors of price sources which tell when to call them again.
+type retryHinter interface {
+	RetryAfter() time.Duration
+}
+
+// upstreamFailure returns the status and code answering a failed refresh, along with how long to wait before retrying, if known.
+// The price sources being down or slow is a 502, the ones rate limiting us or cooling down a 503, and our own bugs a 500.
+func upstreamFailure(err error) (status int, code string, retryAfter time.Duration) {
+	var hinter retryHinter
+	if errors.As(err, &hinter) {
+		retryAfter = hinter.RetryAfter()
+	}
+
+	var maxAgeErr *maxAgeError
+	var circuitErr *coinex.CircuitOpenError
+	var staleErr *staleTooOldError
+	switch {
+	case errors.Is(err, errPanicked):
+		return http.StatusInternalServerError, ERROR_INTERNAL, 0
+	case errors.As(err, &maxAgeErr):
+		return http.StatusServiceUnavailable, ERROR_MAX_AGE_EXCEEDED, retryAfter
+	case errors.Is(err, errOverloaded):
+		return http.StatusServiceUnavailable, ERROR_OVERLOADED, SHED_RETRY_AFTER
+	case errors.As(err, &circuitErr):
+		return http.StatusServiceUnavailable, ERROR_CIRCUIT_OPEN, retryAfter
+	case errors.Is(err, coinex.ErrRateLimited) || errors.Is(err, coingecko.ErrRateLimited):
+		return http.StatusServiceUnavailable, ERROR_UPSTREAM_RATE_LIMITED, retryAfter
+	case errors.As(err, &staleErr):
+		return http.StatusServiceUnavailable, ERROR_PRICES_TOO_OLD, retryAfter
+	}
+	return http.StatusBadGateway, ERROR_UPSTREAM_UNAVAILABLE, 0
+}
+
+// setRetryAfter asks the client to wait d before retrying, in whole seconds rounded up.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(max(int(math.Ceil(d.Seconds())), 1)))
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+	"github.com/wBanano/wban-prices-api/internal/provider"
+	"github.com/wBanano/wban-prices-api/internal/provider/coinex"
+	"github.com/wBanano/wban-prices-api/internal/provider/dex"
+)
+
+// serve sends a request to handler and returns the recorded response.
+func serve(handler http.HandlerFunc, method, target string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest(method, target, nil))
+	return w
+}
+
+// decodeError decodes the JSON error of a response.
+func decodeError(t *testing.T, w *httptest.ResponseRecorder) errorResponse {
+	t.Helper()
+	var body errorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("error body %q: %v", w.Body, err)
+	}
+	return body
+}
+
+func TestConvert(t *testing.T) {
+	s := useConfig(t)
+	useMarkets(t, s, []Market{{Symbol: "ban", Market: "BANANOUSDT"}, {Symbol: "eth", Market: "ETHUSDC"}})
+	cachePrice(t, s, "ban", 0.005)
+	cachePrice(t, s, "eth", 2500)
+
+	w := serve(s.convertHandler, http.MethodGet, "/convert?from=eth&to=ban&amount=0.01")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	if want := `{"from":"eth","to":"ban","amount":0.01,"result":5000,"rate":500000}` + "\n"; w.Body.String() != want {
+		t.Errorf("body = %s, want %s", w.Body, want)
+	}
+
+	w = serve(s.convertHandler, http.MethodGet, "/convert?from=usd&to=ban&amount=1")
+	if want := `{"from":"usd","to":"ban","amount":1,"result":200,"rate":200}` + "\n"; w.Body.String() != want {
+		t.Errorf("usd leg body = %s, want %s", w.Body, want)
+	}
+}
+
+func TestConvertRejectsInvalidRequests(t *testing.T) {
+	s := useConfig(t)
+	for _, target := range []string{
+		"/convert?from=doge&to=ban&amount=1",
+		"/convert?from=eth&to=ban&amount=0",
+		"/convert?from=eth&to=ban&amount=-1",
+		"/convert?from=eth&to=ban&amount=abc",
+		"/convert?from=eth&to=ban",
+	} {
+		if w := serve(s.convertHandler, http.MethodGet, target); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status = %d, want 400", target, w.Code)
+		}
+	}
+}
+
+func TestConvertWithoutPrice(t *testing.T) {
+	// The pool is never read, the background refresher leaves its price out.
+	pool := Market{Symbol: "wban_bsc", DEX: &dex.Pool{Chain: dex.CHAIN_BSC, Pool: "0x0000000000000000000000000000000000000001", Quote: "ban"}}
+	for _, target := range []string{"/convert?from=wban_bsc&to=ban&amount=1", "/convert?from=ban&to=wban_bsc&amount=1"} {
+		t.Run(target, func(t *testing.T) {
+			s := useConfig(t)
+			useMarkets(t, s, []Market{{Symbol: "ban", Market: "BANANOUSDT"}, pool})
+			cachePrice(t, s, "ban", 0.005)
+
+			w := serve(s.convertHandler, http.MethodGet, target)
+			if w.Code != http.StatusServiceUnavailable {
+				t.Fatalf("status = %d, want 503, body %s", w.Code, w.Body)
+			}
+			if body := decodeError(t, w); body.Code != ERROR_UPSTREAM_UNAVAILABLE || body.Error != "no price available for wban_bsc" {
+				t.Errorf("error = %+v", body)
+			}
+			if w.Header().Get("Retry-After") == "" {
+				t.Error("no Retry-After header")
+			}
+		})
+	}
+}
+
+// Markets and prices of the baseline /prices, before any query parameter existed.
+var baselineMarkets = []Market{
+	{Symbol: "ban", Market: "BANANOUSDT"},
+	{Symbol: "bnb", Market: "BNBUSDC"},
+	{Symbol: "eth", Market: "ETHUSDC"},
+	{Symbol: "matic", Market: "POLUSDC"},
+	{Symbol: "ftm", Market: "SUSDC"},
+}
+
+var baselinePrices = map[string]float64{"ban": 0.00734, "bnb": 612.3, "eth": 2512.85, "matic": 0.2371, "ftm": 0.4876}
+
+func cacheBaselinePrices(t *testing.T, s *Server) {
+	t.Helper()
+	useMarkets(t, s, baselineMarkets)
+	for symbol, price := range baselinePrices {
+		cachePrice(t, s, symbol, price)
+	}
+}
+
+func TestPricesDefaultShape(t *testing.T) {
+	s := useConfig(t)
+	cacheBaselinePrices(t, s)
+
+	// The baseline encoded the price map with a json.Encoder.
+	var baseline bytes.Buffer
+	if err := json.NewEncoder(&baseline).Encode(baselinePrices); err != nil {
+		t.Fatal(err)
+	}
+	// Whether the prices are served pre-encoded or encoded for the request.
+	for _, target := range []string{"/prices", "/prices?symbols=ban,bnb,eth,matic,ftm"} {
+		w := serve(s.pricesHandler, http.MethodGet, target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status = %d, body %s", target, w.Code, w.Body)
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("%s: Content-Type = %q, want application/json", target, contentType)
+		}
+		if !bytes.Equal(w.Body.Bytes(), baseline.Bytes()) {
+			t.Errorf("%s: body = %q, want the baseline %q", target, w.Body, baseline.Bytes())
+		}
+		assertGolden(t, "prices.golden", w.Body.Bytes())
+	}
+}
+
+func TestPricesDetail(t *testing.T) {
+	s := useConfig(t)
+	useMarkets(t, s, baselineMarkets[:1])
+	s.cache.Store("ban", provider.Ticker{Last: 0.0075, Open: 0.006, Volume: 123456}, cache.Origin{Source: SOURCE_COINEX})
+
+	w := serve(s.pricesHandler, http.MethodGet, "/prices?detail=true")
+	assertGolden(t, "prices_detail.golden", w.Body.Bytes())
+}
+
+func TestPricesETag(t *testing.T) {
+	s := useConfig(t)
+	cacheBaselinePrices(t, s)
+
+	etag := serve(s.pricesHandler, http.MethodGet, "/prices").Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag")
+	}
+
+	// A refresh fetching identical prices keeps the ETag.
+	for symbol, price := range baselinePrices {
+		cachePrice(t, s, symbol, price)
+	}
+	if again := serve(s.pricesHandler, http.MethodGet, "/prices").Header().Get("ETag"); again != etag {
+		t.Errorf("ETag after a refresh with identical prices = %s, want %s", again, etag)
+	}
+
+	for _, ifNoneMatch := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		r := httptest.NewRequest(http.MethodGet, "/prices", nil)
+		r.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+		s.pricesHandler(w, r)
+		if w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: status = %d with %d bytes, want an empty 304", ifNoneMatch, w.Code, w.Body.Len())
+		}
+		if w.Header().Get("ETag") != etag {
+			t.Errorf("If-None-Match %s: ETag = %q, want %s", ifNoneMatch, w.Header().Get("ETag"), etag)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/prices", nil)
+	r.Header.Set("If-None-Match", `"stale"`)
+	w := httptest.NewRecorder()
+	s.pricesHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("non-matching If-None-Match: status = %d, want 200", w.Code)
+	}
+
+	// Every variant has its own ETag.
+	cachePrice(t, s, "btc", 60000)
+	seen := map[string]string{etag: "/prices"}
+	for _, target := range []string{"/prices?symbols=ban", "/prices?symbols=ban,eth", "/prices?vs=btc", "/prices?strings=true"} {
+		variant := serve(s.pricesHandler, http.MethodGet, target).Header().Get("ETag")
+		if other, ok := seen[variant]; ok {
+			t.Errorf("%s has the ETag of %s", target, other)
+		}
+		seen[variant] = target
+	}
+
+	// And a price change changes it.
+	cachePrice(t, s, "ban", 0.0075)
+	if changed := serve(s.pricesHandler, http.MethodGet, "/prices").Header().Get("ETag"); changed == etag {
+		t.Error("ETag unchanged after a price change")
+	}
+}
+
+// useLazyPrices returns a server whose requests fetch ban and eth from a fake CoinEx, market by market, when their cached price expired,
+// along with the clock it runs on.
+func useLazyPrices(t *testing.T) (*Server, *fakeProvider, *fakeClock) {
+	t.Helper()
+	coinex, clock := &fakeProvider{name: SOURCE_COINEX}, newFakeClock()
+	s := useServer(t, Options{Now: clock.now, Providers: []provider.PriceProvider{coinex}},
+		"--refresh-mode", "lazy", "--price-sources", "coinex", "--per-market-fetch", "--cache-ttl", "1m")
+	useMarkets(t, s, []Market{{Symbol: "ban", Market: "BANANOUSDT"}, {Symbol: "eth", Market: "ETHUSDC"}})
+	return s, coinex, clock
+}
+
+var fakeTickers = map[string]provider.Ticker{"BANANOUSDT": {Last: 0.00734}, "ETHUSDC": {Last: 2512.85}}
+
+func TestPricesFetchedThenCached(t *testing.T) {
+	s, coinex, _ := useLazyPrices(t)
+	coinex.answer(fakeTickers, nil)
+
+	for range 2 {
+		w := serve(s.pricesHandler, http.MethodGet, "/prices")
+		if w.Code != http.StatusOK || w.Body.String() != `{"ban":0.00734,"eth":2512.85}`+"\n" {
+			t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+		}
+		if w.Header().Get("X-Stale") != "" {
+			t.Error("fresh prices served as stale")
+		}
+	}
+	if n := coinex.fetches(); n != 2 {
+		t.Errorf("fetched %d symbols, want ban and eth once, the second request hitting the cache", n)
+	}
+}
+
+func TestPricesStaleFallback(t *testing.T) {
+	s, coinex, clock := useLazyPrices(t)
+	coinex.answer(fakeTickers, nil)
+	serve(s.pricesHandler, http.MethodGet, "/prices")
+	coinex.answer(nil, errors.New("connection reset by peer"))
+
+	clock.advance(2 * time.Minute)
+	w := serve(s.pricesHandler, http.MethodGet, "/prices")
+	if w.Code != http.StatusOK || w.Body.String() != `{"ban":0.00734,"eth":2512.85}`+"\n" {
+		t.Fatalf("status = %d, body = %s, want the cached prices", w.Code, w.Body)
+	}
+	if w.Header().Get("X-Stale") != "true" {
+		t.Error("expired prices served without X-Stale")
+	}
+
+	// Past STALE_MAX_AGE, the cached prices aren't served anymore.
+	clock.advance(s.cfg.StaleMaxAge)
+	w = serve(s.pricesHandler, http.MethodGet, "/prices")
+	if w.Code != http.StatusServiceUnavailable || decodeError(t, w).Code != ERROR_PRICES_TOO_OLD {
+		t.Errorf("status = %d, body = %s, want 503 %s", w.Code, w.Body, ERROR_PRICES_TOO_OLD)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After")
+	}
+}
+
+// batchFakeProvider is a fake CoinEx fetching all its markets with a single request, counting these requests.
+type batchFakeProvider struct {
+	fakeProvider
+	batches atomic.Int32
+}
+
+func (p *batchFakeProvider) AllTickers(ctx context.Context) (map[string]provider.Ticker, error) {
+	p.batches.Add(1)
+	return p.Fetch(ctx, nil)
+}
+
+func TestPricesBatchFetched(t *testing.T) {
+	coinex := &batchFakeProvider{fakeProvider: fakeProvider{name: SOURCE_COINEX}}
+	coinex.answer(fakeTickers, nil)
+	s := useServer(t, Options{Providers: []provider.PriceProvider{coinex}},
+		"--refresh-mode", "lazy", "--price-sources", "coinex", "--cache-ttl", "1m")
+	useMarkets(t, s, []Market{{Symbol: "ban", Market: "BANANOUSDT"}, {Symbol: "eth", Market: "ETHUSDC"}})
+
+	w := serve(s.pricesHandler, http.MethodGet, "/prices")
+	if w.Code != http.StatusOK || w.Body.String() != `{"ban":0.00734,"eth":2512.85}`+"\n" {
+		t.Fatalf("status = %d, body = %s", w.Code, w.Body)
+	}
+	if n := coinex.batches.Load(); n != 1 {
+		t.Errorf("%d batch fetches, want a single one for ban and eth", n)
+	}
+	if n := coinex.fetches(); n != 0 {
+		t.Errorf("fetched %d symbols one by one, want all of them in the batch", n)
+	}
+}
+
+func TestPricesUpstreamFailure(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		status     int
+		code       string
+		retryAfter string
+	}{
+		{"source down", errors.New("connection reset by peer"), http.StatusBadGateway, ERROR_UPSTREAM_UNAVAILABLE, ""},
+		{"rate limited", &coinex.ThrottledError{Wait: 7 * time.Second}, http.StatusServiceUnavailable, ERROR_UPSTREAM_RATE_LIMITED, "7"},
+		// Without a hint, the client is told to wait for the next refresh, a cache TTL away with lazy refreshes.
+		{"rate limited without hint", coinex.ErrRateLimited, http.StatusServiceUnavailable, ERROR_UPSTREAM_RATE_LIMITED, "60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, coinex, _ := useLazyPrices(t)
+			coinex.answer(nil, tt.err)
+
+			w := serve(s.pricesHandler, http.MethodGet, "/prices")
+			if w.Code != tt.status || decodeError(t, w).Code != tt.code {
+				t.Errorf("status = %d, body = %s, want %d %s", w.Code, w.Body, tt.status, tt.code)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
+
+// BenchmarkEncodePrices compares serving the prices encoded once per change, to encoding them for every request.
+func BenchmarkEncodePrices(b *testing.B) {
+	s := useConfig(b)
+	markets := make([]Market, 50)
+	for i := range markets {
+		markets[i] = Market{Symbol: fmt.Sprintf("coin%02d", i), Market: fmt.Sprintf("COIN%02dUSDT", i)}
+	}
+	useMarkets(b, s, markets)
+	for i, m := range markets {
+		cachePrice(b, s, m.Symbol, 1/float64(i+7))
+	}
+	encoded := s.encodedPrices.Load()
+
+	run := func(b *testing.B) {
+		r := httptest.NewRequest(http.MethodGet, "/prices", nil)
+		b.ReportAllocs()
+		for range b.N {
+			w := httptest.NewRecorder()
+			s.pricesHandler(w, r)
+			if w.Code != http.StatusOK {
+				b.Fatalf("status = %d", w.Code)
+			}
+		}
+	}
+	b.Run("cached", run)
+	s.encodedPrices.Store(nil)
+	b.Cleanup(func() { s.encodedPrices.Store(encoded) })
+	b.Run("uncached", run)
+}
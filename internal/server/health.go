@@ -0,0 +1,155 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"time"
+)
+
+const (
+	DEFAULT_HEALTH_WINDOW    = 20
+	DEFAULT_HEALTH_THRESHOLD = 50.0
+
+	// A demoted source keeps its place in the order once in a while, so that its successes can promote it again.
+	HEALTH_PROBE_INTERVAL = 30 * time.Second
+)
+
+// sourceHealth holds the outcomes of the last fetches from a price source, HEALTH_WINDOW at most.
+type sourceHealth struct {
+	outcomes    []fetchOutcome // Ring buffer, next overwrites the oldest once full.
+	next        int
+	lastTry     time.Time
+	lastSuccess time.Time
+	lastErr     error
+}
+
+type fetchOutcome struct {
+	ok       bool
+	duration time.Duration
+}
+
+// recordFetch accounts for a fetch from source in its health. Cancelled fetches tell nothing about it.
+func (s *Server) recordFetch(source string, duration time.Duration, err error) {
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	s.healthMutex.Lock()
+	defer s.healthMutex.Unlock()
+
+	h := s.health[source]
+	if h == nil {
+		h = &sourceHealth{}
+		s.health[source] = h
+	}
+	wasDemoted := h.demoted(s.cfg.HealthThreshold)
+	outcome := fetchOutcome{ok: err == nil, duration: duration}
+	if len(h.outcomes) < s.cfg.HealthWindow {
+		h.outcomes = append(h.outcomes, outcome)
+	} else {
+		h.outcomes[h.next] = outcome
+		h.next = (h.next + 1) % len(h.outcomes)
+	}
+	h.lastTry = s.now()
+	if err == nil {
+		h.lastSuccess = h.lastTry
+	} else {
+		h.lastErr = err
+	}
+
+	switch demoted := h.demoted(s.cfg.HealthThreshold); {
+	case demoted && !wasDemoted:
+		s.log.Warn("health | price source demoted", "source", source, "success_pct", h.successRate(), "error", err)
+	case !demoted && wasDemoted:
+		s.log.Info("health | price source promoted again", "source", source, "success_pct", h.successRate())
+	}
+}
+
+// successRate returns the percentage of successful fetches in the window, 100 without any.
+func (h *sourceHealth) successRate() float64 {
+	if len(h.outcomes) == 0 {
+		return 100
+	}
+	ok := 0
+	for _, outcome := range h.outcomes {
+		if outcome.ok {
+			ok++
+		}
+	}
+	return float64(ok) / float64(len(h.outcomes)) * 100
+}
+
+func (h *sourceHealth) demoted(threshold float64) bool {
+	return h.successRate() < threshold
+}
+
+// orderByHealth returns sources with the demoted ones moved last, the least healthy last, unless they are due for a probe.
+// The others keep their configured order.
+func (s *Server) orderByHealth(sources []string) []string {
+	s.healthMutex.Lock()
+	defer s.healthMutex.Unlock()
+
+	rate := func(source string) float64 {
+		h := s.health[source]
+		if h == nil || !h.demoted(s.cfg.HealthThreshold) || s.now().Sub(h.lastTry) >= HEALTH_PROBE_INTERVAL {
+			return 100
+		}
+		return h.successRate()
+	}
+	ordered := slices.Clone(sources)
+	slices.SortStableFunc(ordered, func(a, b string) int {
+		rateA, rateB := rate(a), rate(b)
+		demotedA, demotedB := rateA < s.cfg.HealthThreshold, rateB < s.cfg.HealthThreshold
+		switch {
+		case demotedA && !demotedB:
+			return 1
+		case !demotedA && demotedB:
+			return -1
+		case demotedA && demotedB && rateA != rateB:
+			if rateA > rateB {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	})
+	return ordered
+}
+
+// providerStats is the health of a price source in /stats.
+type providerStats struct {
+	SuccessPct   float64    `json:"success_pct"`
+	AvgLatencyMs float64    `json:"avg_latency_ms"`
+	Samples      int        `json:"samples"`
+	Demoted      bool       `json:"demoted"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+}
+
+// healthSnapshot returns the health of the price sources fetched from since startup.
+func (s *Server) healthSnapshot() map[string]providerStats {
+	s.healthMutex.Lock()
+	defer s.healthMutex.Unlock()
+
+	stats := make(map[string]providerStats, len(s.health))
+	for source, h := range s.health {
+		ps := providerStats{SuccessPct: h.successRate(), Samples: len(h.outcomes), Demoted: h.demoted(s.cfg.HealthThreshold)}
+		var total time.Duration
+		for _, outcome := range h.outcomes {
+			total += outcome.duration
+		}
+		if len(h.outcomes) > 0 {
+			ps.AvgLatencyMs = float64(total) / float64(len(h.outcomes)) / float64(time.Millisecond)
+		}
+		if !h.lastSuccess.IsZero() {
+			lastSuccess := h.lastSuccess
+			ps.LastSuccess = &lastSuccess
+		}
+		if h.lastErr != nil {
+			ps.LastError = h.lastErr.Error()
+		}
+		stats[source] = ps
+	}
+	return stats
+}
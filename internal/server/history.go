@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const DEFAULT_HISTORY_CAPACITY = 8640 // 24h of prices refreshed every 10s.
+
+// pricePoint is a price at a given time, in Unix seconds.
+type pricePoint struct {
+	T     int64   `json:"t"`
+	Price float64 `json:"price"`
+}
+
+// ringBuffer keeps the last points recorded, overwriting the oldest ones once full.
+type ringBuffer struct {
+	points []pricePoint
+	next   int
+	full   bool
+}
+
+func (b *ringBuffer) add(p pricePoint) {
+	b.points[b.next] = p
+	b.next = (b.next + 1) % len(b.points)
+	if b.next == 0 {
+		b.full = true
+	}
+}
+
+// ordered returns the recorded points, oldest first.
+func (b *ringBuffer) ordered() []pricePoint {
+	if b.full {
+		return append(append([]pricePoint{}, b.points[b.next:]...), b.points[:b.next]...)
+	}
+	return b.points[:b.next]
+}
+
+// since returns the points recorded at or after t, oldest first.
+func (b *ringBuffer) since(t int64) []pricePoint {
+	points := []pricePoint{}
+	for _, p := range b.ordered() {
+		if p.T >= t {
+			points = append(points, p)
+		}
+	}
+	return points
+}
+
+// recordHistory adds a fetched price to the history of symbol, and queues it for the history database.
+func (s *Server) recordHistory(symbol string, price float64, source string, at time.Time) {
+	if s.historyDB != nil {
+		s.queueHistory(historyRow{t: at.Unix(), symbol: symbol, price: price, source: source})
+	}
+	if s.cfg.HistoryCapacity == 0 {
+		return
+	}
+
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	b := s.priceHistory[symbol]
+	if b == nil {
+		b = &ringBuffer{points: make([]pricePoint, s.cfg.HistoryCapacity)}
+		s.priceHistory[symbol] = b
+	}
+	b.add(pricePoint{T: at.Unix(), Price: price})
+}
+
+// historySince returns the recorded prices of symbol since t, oldest first,
+// from the history database if there is one, or from memory when there isn't or it fails.
+func (s *Server) historySince(ctx context.Context, symbol string, t time.Time) []pricePoint {
+	if s.historyDB != nil {
+		points, _, err := s.queryHistory(ctx, symbol, t, false)
+		if err == nil {
+			return points
+		}
+		s.log.WarnContext(ctx, "historySince | history database failed, reading the memory history", "symbol", symbol, "error", err)
+	}
+	return s.memoryHistorySince(symbol, t)
+}
+
+// memoryHistorySince returns the prices of symbol recorded in memory since t, oldest first.
+func (s *Server) memoryHistorySince(symbol string, t time.Time) []pricePoint {
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	b := s.priceHistory[symbol]
+	if b == nil {
+		return []pricePoint{}
+	}
+	return b.since(t.Unix())
+}
+
+// historyHandler serves the recorded prices of a symbol over the last period, 24h by default.
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	symbol := query.Get("symbol")
+	m, ok := s.cfg.findMarket(symbol)
+	if !ok {
+		s.writeJSONError(w, r, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("unknown symbol %q", symbol), Symbols: s.marketSymbols()})
+		return
+	}
+
+	period := 24 * time.Hour
+	if value := query.Get("period"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: "period must be a positive duration like 1h"})
+			return
+		}
+		period = parsed
+	}
+
+	format, ok := s.negotiateFormat(w, r, FORMAT_JSON, FORMAT_CSV)
+	if !ok {
+		return
+	}
+
+	points := s.historySince(r.Context(), m.Symbol, s.now().Add(-period))
+	if format == FORMAT_CSV {
+		rows := make([][]string, len(points))
+		for i, p := range points {
+			rows[i] = []string{strconv.FormatInt(p.T, 10), m.Symbol, formatNumber(p.Price)}
+		}
+		writeCSV(w, r, m.Symbol+"-history.csv", []string{"timestamp", "symbol", "price"}, rows)
+		return
+	}
+	s.writeJSON(w, http.StatusOK, points)
+}
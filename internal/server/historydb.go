@@ -0,0 +1,212 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const DEFAULT_HISTORY_RETENTION = 30 * 24 * time.Hour
+
+const (
+	// The rows recorded by the refreshes are written in a single transaction every interval.
+	HISTORY_FLUSH_INTERVAL = time.Second
+	// Rows waiting to be written, the next ones are dropped while the disk is too slow to keep up.
+	HISTORY_QUEUE_SIZE = 4096
+	// How often the rows older than HISTORY_RETENTION are deleted.
+	HISTORY_PRUNE_INTERVAL = time.Hour
+)
+
+// Migrations of the history database, applied in order from its PRAGMA user_version at startup.
+var historyMigrations = []string{
+	`CREATE TABLE prices (
+		t      INTEGER NOT NULL, -- Unix seconds.
+		symbol TEXT    NOT NULL,
+		price  REAL    NOT NULL,
+		source TEXT    NOT NULL
+	);
+	CREATE INDEX prices_symbol_t ON prices (symbol, t);`,
+}
+
+// historyRow is a fetched price waiting to be written to the history database.
+type historyRow struct {
+	t      int64
+	symbol string
+	price  float64
+	source string
+}
+
+// openHistoryDB opens the history database of HISTORY_DB, creating or migrating its schema.
+func (s *Server) openHistoryDB() error {
+	if s.cfg.HistoryDB == "" {
+		return nil
+	}
+	db, err := sql.Open("sqlite", "file:"+s.cfg.HistoryDB+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return err
+	}
+	// SQLite has a single writer, and the reads of WAL databases don't need more connections than the handlers using them.
+	db.SetMaxOpenConns(4)
+
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		db.Close()
+		return fmt.Errorf("history database %s: %w", s.cfg.HistoryDB, err)
+	}
+	for ; version < len(historyMigrations); version++ {
+		if err := migrateHistoryDB(db, version); err != nil {
+			db.Close()
+			return fmt.Errorf("history database %s: migration %d: %w", s.cfg.HistoryDB, version+1, err)
+		}
+		s.log.Info("historyDB | schema migrated", "version", version+1)
+	}
+	s.historyDB = db
+	return nil
+}
+
+func migrateHistoryDB(db *sql.DB, version int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(historyMigrations[version]); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// queueHistory queues a fetched price for the history database, dropping it when the queue is full.
+func (s *Server) queueHistory(row historyRow) {
+	select {
+	case s.historyQueue <- row:
+	default:
+		historyDroppedTotal.inc()
+	}
+}
+
+// runHistoryWriter writes the queued prices every HISTORY_FLUSH_INTERVAL and prunes the old ones until ctx is done,
+// then writes the prices left in the queue and closes the database.
+func (s *Server) runHistoryWriter(ctx context.Context) {
+	defer close(s.historyWriterDone)
+	defer s.historyDB.Close()
+
+	s.log.Info("historyDB | recording prices", "path", s.cfg.HistoryDB, "retention", s.cfg.HistoryRetention)
+	flush := time.NewTicker(HISTORY_FLUSH_INTERVAL)
+	defer flush.Stop()
+	prune := time.NewTicker(HISTORY_PRUNE_INTERVAL)
+	defer prune.Stop()
+	s.pruneHistory()
+
+	var rows []historyRow
+	for {
+		select {
+		case row := <-s.historyQueue:
+			rows = append(rows, row)
+			continue
+		case <-flush.C:
+		case <-prune.C:
+			s.pruneHistory()
+			continue
+		case <-ctx.Done():
+			for len(s.historyQueue) > 0 {
+				rows = append(rows, <-s.historyQueue)
+			}
+			s.writeHistory(rows)
+			s.log.Info("historyDB | stopped")
+			return
+		}
+		s.writeHistory(rows)
+		rows = rows[:0]
+	}
+}
+
+// writeHistory inserts rows in a single transaction. The failed writes are logged and lost.
+func (s *Server) writeHistory(rows []historyRow) {
+	if len(rows) == 0 {
+		return
+	}
+	err := func() error {
+		tx, err := s.historyDB.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		insert, err := tx.Prepare("INSERT INTO prices (t, symbol, price, source) VALUES (?, ?, ?, ?)")
+		if err != nil {
+			return err
+		}
+		defer insert.Close()
+		for _, row := range rows {
+			if _, err := insert.Exec(row.t, row.symbol, row.price, row.source); err != nil {
+				return err
+			}
+		}
+		return tx.Commit()
+	}()
+	if err != nil {
+		s.log.Error("historyDB | write failed, prices lost", "rows", len(rows), "error", err)
+	}
+}
+
+// pruneHistory deletes the prices older than HISTORY_RETENTION.
+func (s *Server) pruneHistory() {
+	result, err := s.historyDB.Exec("DELETE FROM prices WHERE t < ?", s.now().Add(-s.cfg.HistoryRetention).Unix())
+	if err != nil {
+		s.log.Error("historyDB | pruning failed", "error", err)
+		return
+	}
+	if deleted, _ := result.RowsAffected(); deleted > 0 {
+		s.log.Info("historyDB | old prices pruned", "rows", deleted)
+	}
+}
+
+// queryHistory returns the prices of symbol recorded in the database since t, oldest first,
+// preceded by the last one before t when withPrevious is set. The prices of the memory history not written yet are appended.
+func (s *Server) queryHistory(ctx context.Context, symbol string, t time.Time, withPrevious bool) (points []pricePoint, fromStart bool, err error) {
+	points = []pricePoint{}
+	if withPrevious {
+		var p pricePoint
+		err := s.historyDB.QueryRowContext(ctx, "SELECT t, price FROM prices WHERE symbol = ? AND t < ? ORDER BY t DESC LIMIT 1", symbol, t.Unix()).Scan(&p.T, &p.Price)
+		switch {
+		case err == nil:
+			points, fromStart = append(points, p), true
+		case err != sql.ErrNoRows:
+			return nil, false, err
+		}
+	}
+
+	rows, err := s.historyDB.QueryContext(ctx, "SELECT t, price FROM prices WHERE symbol = ? AND t >= ? ORDER BY t", symbol, t.Unix())
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p pricePoint
+		if err := rows.Scan(&p.T, &p.Price); err != nil {
+			return nil, false, err
+		}
+		points = append(points, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	// The prices recorded since the last write are only in memory yet.
+	last := t.Unix() - 1
+	if len(points) > 0 {
+		last = points[len(points)-1].T
+	}
+	for _, p := range s.memoryHistorySince(symbol, t) {
+		if p.T > last {
+			points = append(points, p)
+		}
+	}
+	return points, fromStart, nil
+}
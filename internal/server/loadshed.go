@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const (
+	// Requests processed at once, and among them the ones waiting on CoinEx to refresh expired prices.
+	DEFAULT_MAX_IN_FLIGHT  = 1000
+	DEFAULT_MAX_REFRESHING = 100
+
+	// How long a request waits for a slot before being shed.
+	DEFAULT_QUEUE_TIMEOUT = 100 * time.Millisecond
+
+	// How long shed clients are asked to wait before retrying.
+	SHED_RETRY_AFTER = time.Second
+)
+
+// errOverloaded is returned when too many requests are refreshing prices already.
+var errOverloaded = errors.New("too many requests refreshing prices, try again shortly")
+
+// semaphore bounds concurrent work, a nil one bounding nothing.
+type semaphore chan struct{}
+
+func newSemaphore(size int) semaphore {
+	if size == 0 {
+		return nil
+	}
+	return make(semaphore, size)
+}
+
+// acquire takes a slot, waiting up to timeout for one to free up. It reports whether it got one.
+func (s semaphore) acquire(ctx context.Context, timeout time.Duration) bool {
+	if s == nil {
+		return true
+	}
+	select {
+	case s <- struct{}{}:
+		return true
+	default:
+	}
+	if timeout == 0 {
+		return false
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (s semaphore) release() {
+	if s != nil {
+		<-s
+	}
+}
+
+// limitConcurrency sheds the requests to next with a 503 when too many are processed already.
+// Probes, and the streams and long polls which mostly wait, don't count.
+func (s *Server) limitConcurrency(next http.Handler) http.Handler {
+	slots := newSemaphore(s.cfg.MaxInFlight)
+	if slots == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rateLimitExempt[r.URL.Path] || r.URL.Path == "/prices/stream" || r.URL.Path == "/ws" || r.URL.Query().Has("since") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !slots.acquire(r.Context(), s.cfg.QueueTimeout) {
+			recordShed("requests")
+			setRetryAfter(w, SHED_RETRY_AFTER)
+			s.writeJSONError(w, r, http.StatusServiceUnavailable, errorResponse{Error: "server overloaded, try again shortly", Code: ERROR_OVERLOADED})
+			return
+		}
+		inFlightGauge.set(float64(inFlight.Add(1)))
+		defer func() {
+			inFlightGauge.set(float64(inFlight.Add(-1)))
+			slots.release()
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// refreshWithinBudget refreshes the prices of markets, unless too many requests are refreshing already.
+func (s *Server) refreshWithinBudget(ctx context.Context, markets []Market) error {
+	if !s.refreshSlots.acquire(ctx, s.cfg.QueueTimeout) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		recordShed("refreshes")
+		return errOverloaded
+	}
+	defer s.refreshSlots.release()
+
+	_, err := s.refreshPrices(ctx, markets)
+	return err
+}
+
+// recordShed counts a request shed because the budget was exhausted.
+func recordShed(budget string) {
+	shedTotal.inc(budget)
+	shed.Add(1)
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Log formats: text for humans in local development, JSON lines for log aggregation.
+const (
+	LOG_TEXT = "text"
+	LOG_JSON = "json"
+)
+
+// NewLogger returns a logger writing at the level and in the format of cfg, along with the information of the requests.
+func NewLogger(cfg *Config) *slog.Logger {
+	options := &slog.HandlerOptions{
+		Level: cfg.logLevel,
+		// JSON would otherwise log durations as nanoseconds.
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Value.Kind() == slog.KindDuration {
+				a.Value = slog.StringValue(a.Value.Duration().String())
+			}
+			return a
+		},
+	}
+	var handler slog.Handler = slog.NewTextHandler(os.Stderr, options)
+	if cfg.LogFormat == LOG_JSON {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	}
+	return slog.New(requestInfoHandler{handler})
+}
+
+// fatal logs err and exits.
+func (s *Server) fatal(msg string, err error) {
+	s.log.Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// Paths of the probes and scrapes excluded from the request log by default.
+const DEFAULT_LOG_EXCLUDE = "/health,/ready,/metrics"
+
+// logRequests logs a line per request handled by next, but the ones to the excluded paths.
+func (s *Server) logRequests(next http.Handler) http.Handler {
+	excluded := make(map[string]bool)
+	for _, path := range strings.Split(s.cfg.LogExclude, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			excluded[path] = true
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if excluded[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := s.now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		target := r.URL.Path
+		if r.URL.RawQuery != "" {
+			target += "?" + r.URL.RawQuery
+		}
+		s.log.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"query", r.URL.RawQuery,
+			"status", recorder.status,
+			"size", recorder.size,
+			"duration_ms", float64(s.now().Sub(start).Microseconds())/1000,
+			"remote", s.clientIP(r),
+		)
+	})
+}
+
+// clientIP returns the address of the client of r. Behind a trusted proxy, it is the first one of X-Forwarded-For.
+func (s *Server) clientIP(r *http.Request) string {
+	if s.cfg.TrustProxy {
+		if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+			first, _, _ := strings.Cut(forwarded, ",")
+			return strings.TrimSpace(first)
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+)
+
+const DEFAULT_LONG_POLL_MAX_WAIT = 30 * time.Second
+
+// lastRefresh returns when the most recently refreshed of markets was cached, zero if none ever was.
+func lastRefresh(entries map[string]cache.Entry, markets []Market) time.Time {
+	var last time.Time
+	for _, m := range markets {
+		if updatedAt := entries[m.Symbol].UpdatedAt; updatedAt.After(last) {
+			last = updatedAt
+		}
+	}
+	return last
+}
+
+// formatTimestamp formats t as unix seconds with millisecond precision, as accepted back by ?since=.
+func formatTimestamp(t time.Time) string {
+	return strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', 3, 64)
+}
+
+// waitForRefresh holds a ?since= long-polling request until markets get refreshed after the given timestamp,
+// or until ?wait=, clamped to LONG_POLL_MAX_WAIT, elapses or the server shuts down.
+// It returns false when the request was answered already, because of invalid parameters or a client gone.
+func (s *Server) waitForRefresh(w http.ResponseWriter, r *http.Request, markets []Market) bool {
+	since, err := strconv.ParseFloat(r.URL.Query().Get("since"), 64)
+	if err != nil || since < 0 {
+		s.writeError(w, r, http.StatusBadRequest, errorResponse{Error: "since must be a unix timestamp"})
+		return false
+	}
+	wait := s.cfg.LongPollMaxWait
+	if param := r.URL.Query().Get("wait"); param != "" {
+		if wait, err = time.ParseDuration(param); err != nil || wait < 0 {
+			s.writeError(w, r, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("invalid wait %q, expected a duration such as 25s", param)})
+			return false
+		}
+		wait = min(wait, s.cfg.LongPollMaxWait)
+	}
+	// Timestamps are compared with the millisecond precision they are served with.
+	sinceMilli := int64(math.Round(since * 1000))
+
+	// Subscribe before checking the cache so that no refresh is missed in between.
+	updates := s.priceUpdates.subscribe()
+	defer s.priceUpdates.unsubscribe(updates)
+
+	s.extendWriteDeadline(w, wait)
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+	for lastRefresh(s.cache.Snapshot(), markets).UnixMilli() <= sinceMilli {
+		select {
+		case <-updates:
+		case <-deadline.C:
+			return true
+		case <-s.shutdownCtx.Done():
+			return true
+		case <-r.Context().Done():
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Command is what the process runs: serving the prices, unless it is a one-off.
+type Command struct {
+	fetch    *fetchOptions // wban-prices-api fetch [flags] prints the prices once instead of serving them.
+	selfTest *selfTestOptions
+}
+
+// ParseCommandLine reads the command and the configuration of the build from the command line arguments and the environment.
+func ParseCommandLine(args []string, info BuildInfo) (*Config, Command, error) {
+	var cmd Command
+	if len(args) > 0 && args[0] == COMMAND_FETCH {
+		args = args[1:]
+		cmd.fetch = registerFetchFlags()
+	}
+	cmd.selfTest = registerSelfTestFlags()
+	cfg, err := parseConfig(flag.CommandLine, args, info)
+	return cfg, cmd, err
+}
+
+// Run runs cmd and returns the exit code of the process.
+func (s *Server) Run(cmd Command) int {
+	if cmd.fetch != nil {
+		return s.runFetch(cmd.fetch)
+	}
+	if cmd.selfTest != nil && cmd.selfTest.enabled {
+		return s.runSelfTest(cmd.selfTest)
+	}
+	s.listenAndServe()
+	return 0
+}
+
+// listenAndServe serves the prices until SIGINT or SIGTERM, exiting the process when it can't.
+func (s *Server) listenAndServe() {
+	// The metrics and admin routes are kept off the public listener when the admin one is configured.
+	mux := s.publicMux()
+	admin := mux
+	if s.cfg.AdminAddr != "" {
+		admin = http.NewServeMux()
+	}
+	s.registerAdminRoutes(admin)
+	switch {
+	case !s.cfg.EnablePprof:
+		s.log.Info("pprof | disabled")
+	case s.cfg.AdminAddr != "":
+		registerPprof(admin)
+	default:
+		s.servePprof()
+	}
+
+	tlsConfig, redirect, err := s.setupTLS()
+	if err != nil {
+		s.fatal("TLS setup failed", err)
+	}
+
+	s.restoreSnapshot()
+	if err := s.openHistoryDB(); err != nil {
+		s.fatal("History database failed", err)
+	}
+	if s.historyDB != nil {
+		go s.runHistoryWriter(s.shutdownCtx)
+	}
+
+	// Fetch the prices before accepting traffic, so that the first requests don't wait on the price sources.
+	if !s.cfg.NoWarmup && !s.warmup(s.shutdownCtx) && s.cfg.WarmupFailure == WARMUP_EXIT {
+		s.fatal("Warmup failed", errWarmupFailed)
+	}
+
+	// Listen first so that the actual bound address is known, even for ephemeral ports.
+	listener, err := s.listen(s.cfg.ListenAddr)
+	if err != nil {
+		s.fatal("Listening failed", err)
+	}
+	var redirectListener, adminListener net.Listener
+	if redirect != nil {
+		if redirectListener, err = s.listen(s.cfg.httpAddr()); err != nil {
+			s.fatal("Listening failed", err)
+		}
+	}
+	if s.cfg.AdminAddr != "" {
+		if adminListener, err = s.listen(s.cfg.AdminAddr); err != nil {
+			s.fatal("Listening failed", err)
+		}
+	}
+
+	// Keep the cache warm in the background, unless refreshes are done on demand.
+	if s.cfg.backgroundRefresh() {
+		go s.runRefresher(s.shutdownCtx)
+	}
+	if s.cfg.UpstreamMode == UPSTREAM_WS {
+		go s.runCoinexStream(s.shutdownCtx)
+	}
+	if s.tracer != nil {
+		go s.tracer.Run(s.shutdownCtx)
+	}
+	go s.runReloader(s.shutdownCtx)
+
+	// Middlewares, from the innermost.
+	var handler http.Handler = s.recoverPanics(mux)
+	handler = s.instrument(mux, handler)
+	handler = s.traceRequests(mux, handler)
+	handler = s.limitConcurrency(handler)
+	handler = s.limitRate(handler)
+	handler = s.authenticate(handler)
+	handler = s.allowMethods(mux, handler)
+	handler = s.cors(mux, handler)
+	handler = s.logRequests(handler)
+	handler = assignRequestIDs(handler)
+	if s.cfg.Gzip {
+		handler = compress(handler)
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: s.cfg.ReadHeaderTimeout,
+		ReadTimeout:       s.cfg.ReadTimeout,
+		WriteTimeout:      s.cfg.WriteTimeout,
+		IdleTimeout:       s.cfg.IdleTimeout,
+		TLSConfig:         tlsConfig,
+	}
+
+	// Serve until SIGINT or SIGTERM, then let the open requests complete.
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	serveErr := make(chan error, 3)
+	scheme := "http"
+	if tlsConfig != nil {
+		scheme = "https"
+		go func() { serveErr <- server.ServeTLS(listener, "", "") }()
+	} else {
+		go func() { serveErr <- server.Serve(listener) }()
+	}
+	// Servers sharing the lifecycle of the main one.
+	var secondary []*http.Server
+	if redirectListener != nil {
+		redirectServer := &http.Server{Handler: redirect, ReadHeaderTimeout: s.cfg.ReadHeaderTimeout, IdleTimeout: s.cfg.IdleTimeout}
+		secondary = append(secondary, redirectServer)
+		go func() { serveErr <- redirectServer.Serve(redirectListener) }()
+		s.log.Info("Redirecting plain HTTP to HTTPS", "url", listenerURL("http", redirectListener))
+	}
+	if adminListener != nil {
+		// No write timeout, CPU profiles and traces take as long as requested.
+		adminServer := &http.Server{Handler: assignRequestIDs(s.logRequests(s.recoverPanics(admin))), ReadHeaderTimeout: s.cfg.ReadHeaderTimeout, IdleTimeout: s.cfg.IdleTimeout}
+		secondary = append(secondary, adminServer)
+		go func() { serveErr <- adminServer.Serve(adminListener) }()
+		s.log.Info("Admin server starting", "url", listenerURL("http", adminListener), "pprof", s.cfg.EnablePprof)
+	}
+
+	s.log.Info("Server starting", "version", s.cfg.build.Version, "commit", s.cfg.build.Commit, "built", s.cfg.build.BuildDate, "go", s.cfg.build.GoVersion, "url", listenerURL(scheme, listener))
+	select {
+	case err := <-serveErr:
+		s.shutdown()
+		s.fatal("Serving failed", err)
+	case <-signalCtx.Done():
+	}
+
+	s.log.Info("Server shutting down, draining requests", "timeout", s.cfg.ShutdownTimeout)
+	start := s.now()
+	// Stop the background work first, which also releases the held long-polling and streaming requests.
+	s.shutdown()
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+	defer cancelDrain()
+	for _, srv := range secondary {
+		srv.Shutdown(drainCtx)
+	}
+	err = server.Shutdown(drainCtx)
+	if s.tracer != nil {
+		s.tracer.Export(drainCtx)
+	}
+	if s.historyDB != nil {
+		select {
+		case <-s.historyWriterDone:
+		case <-drainCtx.Done():
+		}
+	}
+	if err != nil {
+		s.log.Error("Server shutdown incomplete", "duration", s.now().Sub(start).Round(time.Millisecond), "error", err)
+		return
+	}
+	s.log.Info("Server shutdown complete", "duration", s.now().Sub(start).Round(time.Millisecond))
+}
+
+// publicMux returns the mux of the public routes. They get their own mux, the net/http/pprof package registering its handlers on the default one.
+func (s *Server) publicMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Register the /prices routes.
+	mux.HandleFunc("/prices", s.pricesHandler)
+	mux.HandleFunc("/prices/{symbol}", s.priceHandler)
+	mux.HandleFunc("/prices/history", s.historyHandler)
+	mux.HandleFunc("/prices/age", s.ageHandler)
+	mux.HandleFunc("/twap", s.twapHandler)
+	mux.HandleFunc("/prices/stream", s.streamHandler)
+	mux.HandleFunc("/markets", s.marketsHandler)
+	mux.HandleFunc("/convert", s.convertHandler)
+	mux.HandleFunc("/ohlc", s.ohlcHandler)
+	mux.HandleFunc("/ws", s.wsHandler)
+
+	// Liveness and readiness probes, both answered without any upstream call.
+	mux.HandleFunc("/health", s.healthHandler)
+	mux.HandleFunc("/ready", s.readyHandler)
+
+	mux.HandleFunc("/version", s.versionHandler)
+
+	// Catch-all handler for other paths.
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.Error(w, "404", http.StatusNotFound)
+	})
+	return mux
+}
+
+// registerAdminRoutes registers the metrics and admin routes on admin, the admin API only with ADMIN_TOKEN.
+func (s *Server) registerAdminRoutes(admin *http.ServeMux) {
+	admin.HandleFunc("/metrics", metricsHandler)
+	admin.HandleFunc("/stats", s.statsHandler)
+	if s.cfg.AdminToken != "" {
+		admin.Handle("POST /admin/cache/flush", s.requireAdminToken(http.HandlerFunc(s.cacheFlushHandler)))
+		admin.Handle("GET /admin/alerts", s.requireAdminToken(http.HandlerFunc(s.alertsHandler)))
+		admin.Handle("POST /admin/alerts", s.requireAdminToken(http.HandlerFunc(s.createAlertHandler)))
+		admin.Handle("DELETE /admin/alerts/{id}", s.requireAdminToken(http.HandlerFunc(s.deleteAlertHandler)))
+	}
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+	"github.com/wBanano/wban-prices-api/internal/provider"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of the tests with their actual output")
+
+func TestMain(m *testing.M) {
+	// The expected warnings of the tests would drown their output.
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// useConfig creates a server configured with the defaults, overridden by the flags of args, shut down at the end of the test.
+func useConfig(t testing.TB, args ...string) *Server {
+	t.Helper()
+	return useServer(t, Options{}, args...)
+}
+
+// useServer is useConfig creating the server with the dependencies of opts.
+func useServer(t testing.TB, opts Options, args ...string) *Server {
+	t.Helper()
+	cfg, err := parseConfig(flag.NewFlagSet(t.Name(), flag.ContinueOnError), append([]string{"--no-warmup"}, args...), ReadBuildInfo("", "", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(cfg, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(s.shutdown)
+	return s
+}
+
+// cachePrice caches a price of symbol fetched from CoinEx just now.
+func cachePrice(t testing.TB, s *Server, symbol string, price float64) {
+	t.Helper()
+	s.cache.Store(symbol, provider.Ticker{Last: price}, cache.Origin{Source: SOURCE_COINEX})
+}
+
+// useMarkets replaces the markets of the configuration set by useConfig.
+func useMarkets(t testing.TB, s *Server, markets []Market) {
+	t.Helper()
+	s.cfg.reloadable.Store(&marketConfig{markets: markets, cacheTTL: s.cfg.CacheTTL})
+}
+
+// useCoinex points the CoinEx provider set up by useConfig at a fake CoinEx API served by handler.
+func useCoinex(t *testing.T, s *Server, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	s.providers[SOURCE_COINEX] = s.newCoinexClient(server.URL, server.Client())
+	return server
+}
+
+// assertGolden compares got with the content of testdata/name, rewritten with -update.
+func assertGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs:\n got: %q\nwant: %q", name, got, want)
+	}
+}
+
+// fakeProvider is a price source answering tickers, or err, and counting the symbols it was asked for.
+type fakeProvider struct {
+	name string
+
+	mu      sync.Mutex
+	tickers map[string]provider.Ticker
+	err     error
+	fetched []string
+}
+
+func (p *fakeProvider) Name() string { return p.name }
+
+func (p *fakeProvider) Fetch(ctx context.Context, symbols []string) (map[string]provider.Ticker, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.fetched = append(p.fetched, symbols...)
+	return p.tickers, p.err
+}
+
+// answer makes p answer with tickers, or fail with err.
+func (p *fakeProvider) answer(tickers map[string]provider.Ticker, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.tickers, p.err = tickers, err
+}
+
+// fetches returns how many symbols p was asked for.
+func (p *fakeProvider) fetches() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.fetched)
+}
+
+// useProvider replaces the provider of source set up by useConfig with a fake one.
+func useProvider(t *testing.T, s *Server, source string) *fakeProvider {
+	t.Helper()
+	p := &fakeProvider{name: source}
+	s.providers[source] = p
+	return p
+}
+
+// fakeClock is a clock standing still until advanced.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{t: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.t
+}
+
+// advance moves c forward by d.
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.t = c.t.Add(d)
+}
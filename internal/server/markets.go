@@ -0,0 +1,341 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider/dex"
+)
+
+// Market maps a response key of /prices to a CoinEx market, and to its symbols on the fallback price sources.
+// Coins not listed on CoinEx have no CoinEx market, and the on-chain markets are only priced from their liquidity pool.
+type Market struct {
+	Symbol    string    `json:"symbol"`
+	Market    string    `json:"market"`
+	Binance   string    `json:"binance,omitempty"`   // Symbol of the Binance fallback, if Binance lists the market.
+	CoinGecko string    `json:"coingecko,omitempty"` // Coin ID of the CoinGecko fallback, quoted in USD.
+	Kraken    string    `json:"kraken,omitempty"`    // Kraken pair, e.g. XETHZUSD.
+	DEX       *dex.Pool `json:"dex,omitempty"`       // Liquidity pool of an on-chain market.
+	Sources   []string  `json:"sources,omitempty"`   // Overrides the order of PRICE_SOURCES for this market.
+	TTL       Duration  `json:"ttl,omitempty"`       // Overrides the cache TTL for this market.
+	Aliases   []Alias   `json:"aliases,omitempty"`   // Other response keys of the market, e.g. after the coin was renamed.
+}
+
+// Alias is another response key of a market, answered with its price wherever its symbol is.
+type Alias struct {
+	Symbol     string `json:"symbol"`
+	Deprecated bool   `json:"deprecated,omitempty"` // Kept for the existing clients, a Warning header points the new ones to the market symbol.
+}
+
+// ttl returns how long the price of m is cached.
+func (cfg *Config) ttl(m Market) time.Duration {
+	if m.TTL.Duration > 0 {
+		return m.TTL.Duration
+	}
+	return cfg.cacheTTL()
+}
+
+// Duration is a time.Duration written as a string like "30s" in the configuration file.
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Built-in markets, used when no configuration file is available.
+var defaultMarkets = []Market{
+	{Symbol: "ban", Market: "BANANOUSDT", CoinGecko: "banano"},
+	{Symbol: "bnb", Market: "BNBUSDC", Binance: "BNBUSDC", CoinGecko: "binancecoin"},
+	{Symbol: "eth", Market: "ETHUSDC", Binance: "ETHUSDC", CoinGecko: "ethereum", Kraken: "XETHZUSD"},
+	{Symbol: "matic", Market: "POLUSDC", Binance: "POLUSDC", CoinGecko: "polygon-ecosystem-token", Kraken: "POLUSD"},
+	// Fantom migrated to Sonic, ftm is still answered for the clients which predate the migration.
+	{Symbol: "s", Market: "SUSDC", CoinGecko: "sonic-3", Aliases: []Alias{{Symbol: "ftm", Deprecated: true}}},
+}
+
+// Quote currencies recognized at the end of CoinEx market names.
+var knownQuotes = []string{"USDT", "USDC", "BTC", "ETH"}
+
+// quote returns the quote currency of m, or an empty string if it can't be told from the market name.
+func (m Market) quote() string {
+	for _, quote := range knownQuotes {
+		if strings.HasSuffix(m.Market, quote) && len(m.Market) > len(quote) {
+			return quote
+		}
+	}
+	return ""
+}
+
+// findMarket returns the configured market of symbol or of one of its aliases, ignoring case.
+func (cfg *Config) findMarket(symbol string) (Market, bool) {
+	m, _, ok := cfg.findSymbol(symbol)
+	return m, ok
+}
+
+// findSymbol returns the configured market of symbol, ignoring case, along with the alias of the market symbol is, if it is one.
+func (cfg *Config) findSymbol(symbol string) (Market, *Alias, bool) {
+	symbol = strings.ToLower(strings.TrimSpace(symbol))
+	for _, m := range cfg.markets() {
+		if m.Symbol == symbol {
+			return m, nil, true
+		}
+		for i := range m.Aliases {
+			if m.Aliases[i].Symbol == symbol {
+				return m, &m.Aliases[i], true
+			}
+		}
+	}
+	return Market{}, nil, false
+}
+
+// responseKeys returns the keys answering the markets with aliases, keyed by market symbol: those requested
+// in a comma-separated list of symbols, or the symbols and aliases of every market when the list is empty.
+func (s *Server) responseKeys(list string) map[string][]string {
+	keys := make(map[string][]string)
+	if strings.TrimSpace(list) == "" {
+		for _, m := range s.cfg.markets() {
+			for _, alias := range m.Aliases {
+				if len(keys[m.Symbol]) == 0 {
+					keys[m.Symbol] = []string{m.Symbol}
+				}
+				keys[m.Symbol] = append(keys[m.Symbol], alias.Symbol)
+			}
+		}
+		return keys
+	}
+
+	for _, symbol := range strings.Split(list, ",") {
+		m, _, ok := s.cfg.findSymbol(symbol)
+		key := strings.ToLower(strings.TrimSpace(symbol))
+		if ok && len(m.Aliases) > 0 && !slices.Contains(keys[m.Symbol], key) {
+			keys[m.Symbol] = append(keys[m.Symbol], key)
+		}
+	}
+	return keys
+}
+
+// withAliases returns values keyed by the response keys of their market symbol, the symbols without keys left as they are.
+func withAliases[V any](values map[string]V, keys map[string][]string) map[string]V {
+	if values == nil || len(keys) == 0 {
+		return values
+	}
+	aliased := make(map[string]V, len(values))
+	for symbol, value := range values {
+		symbolKeys, ok := keys[symbol]
+		if !ok {
+			aliased[symbol] = value
+			continue
+		}
+		for _, key := range symbolKeys {
+			aliased[key] = value
+		}
+	}
+	return aliased
+}
+
+// selectMarkets returns the markets of a comma-separated list of symbols, ignoring case, whitespace,
+// duplicates and unknown symbols. An empty list selects all markets.
+func (s *Server) selectMarkets(list string) []Market {
+	if strings.TrimSpace(list) == "" {
+		return s.cfg.markets()
+	}
+
+	var markets []Market
+	selected := make(map[string]bool)
+	for _, symbol := range strings.Split(list, ",") {
+		m, ok := s.cfg.findMarket(symbol)
+		if !ok || selected[m.Symbol] {
+			continue
+		}
+		selected[m.Symbol] = true
+		markets = append(markets, m)
+	}
+	return markets
+}
+
+// marketSymbols returns the configured symbols, along with their aliases.
+func (s *Server) marketSymbols() []string {
+	markets := s.cfg.markets()
+	symbols := make([]string, 0, len(markets))
+	for _, m := range markets {
+		symbols = append(symbols, m.Symbol)
+		for _, alias := range m.Aliases {
+			symbols = append(symbols, alias.Symbol)
+		}
+	}
+	return symbols
+}
+
+// BTC market, fetched alongside the configured markets to quote prices in BTC.
+var btcMarket = Market{Symbol: "btc", Market: "BTCUSDT", Binance: "BTCUSDT", CoinGecko: "bitcoin"}
+
+// quoteBTCMarket returns the market giving the USD price of BTC, the configured one if any.
+func (cfg *Config) quoteBTCMarket() Market {
+	for _, m := range cfg.markets() {
+		if m.Market == btcMarket.Market {
+			return m
+		}
+	}
+	return btcMarket
+}
+
+// refreshedMarkets returns the markets kept in the cache: the configured ones along with the BTC market.
+func (cfg *Config) refreshedMarkets() []Market {
+	markets := cfg.markets()
+	btc := cfg.quoteBTCMarket()
+	for _, m := range markets {
+		if m.Symbol == btc.Symbol && m.Market == btc.Market {
+			return markets
+		}
+	}
+	return append(markets[:len(markets):len(markets)], btc)
+}
+
+// fileConfig is the content of the JSON configuration file.
+type fileConfig struct {
+	Markets  []Market  `json:"markets"`
+	CacheTTL *Duration `json:"cache_ttl,omitempty"` // Overrides the cache-ttl flag, so that a reload can change it.
+}
+
+// marketConfig is the part of the configuration read from the file, swapped as a whole on reload.
+type marketConfig struct {
+	markets  []Market
+	cacheTTL time.Duration
+}
+
+// loadMarkets reads the markets from the configuration file at path, cached for cacheTTL unless the file sets another TTL.
+// The built-in markets, followed by the on-chain ones, are returned when path is empty or the file does not exist.
+func loadMarkets(path string, cacheTTL time.Duration, onChain []Market) (*marketConfig, error) {
+	builtIn := &marketConfig{markets: append(defaultMarkets[:len(defaultMarkets):len(defaultMarkets)], onChain...), cacheTTL: cacheTTL}
+	if path == "" {
+		return builtIn, nil
+	}
+
+	markets, err := readMarkets(path, cacheTTL)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Config file not found, using built-in markets", "path", path)
+		return builtIn, nil
+	}
+	return markets, err
+}
+
+// readMarkets reads the configuration file at path, which must exist.
+func readMarkets(path string, cacheTTL time.Duration) (*marketConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fc fileConfig
+	if err := json.Unmarshal(data, &fc); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	normalizeSymbols(fc.Markets)
+	if err := validateMarkets(fc.Markets); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	if fc.CacheTTL != nil {
+		if fc.CacheTTL.Duration < 0 {
+			return nil, fmt.Errorf("config file %s: negative cache_ttl", path)
+		}
+		cacheTTL = fc.CacheTTL.Duration
+	}
+
+	return &marketConfig{markets: fc.Markets, cacheTTL: cacheTTL}, nil
+}
+
+// normalizeSymbols lowercases the symbols of markets, their aliases and pool quotes, the requested symbols being looked up in lowercase.
+func normalizeSymbols(markets []Market) {
+	for i := range markets {
+		m := &markets[i]
+		m.Symbol = strings.ToLower(strings.TrimSpace(m.Symbol))
+		for j := range m.Aliases {
+			m.Aliases[j].Symbol = strings.ToLower(strings.TrimSpace(m.Aliases[j].Symbol))
+		}
+		if m.DEX != nil {
+			m.DEX.Quote = strings.ToLower(strings.TrimSpace(m.DEX.Quote))
+		}
+	}
+}
+
+func validateMarkets(markets []Market) error {
+	if len(markets) == 0 {
+		return errors.New("no markets defined")
+	}
+
+	symbols := make(map[string]bool)
+	aliasOf := make(map[string]string)
+	usedBy := make(map[string]string)
+	for i, m := range markets {
+		if m.Symbol == "" {
+			return fmt.Errorf("markets[%d]: empty symbol", i)
+		}
+		if m.Market == "" && m.Binance == "" && m.CoinGecko == "" && m.Kraken == "" && !m.onChain() {
+			return fmt.Errorf("markets[%d] (%s): no market on any price source", i, m.Symbol)
+		}
+		if len(m.Sources) > 0 {
+			if _, err := parseSources(strings.Join(m.Sources, ",")); err != nil {
+				return fmt.Errorf("markets[%d] (%s): %w", i, m.Symbol, err)
+			}
+		}
+		if symbols[m.Symbol] {
+			return fmt.Errorf("markets[%d]: duplicate symbol %q", i, m.Symbol)
+		}
+		for _, alias := range m.Aliases {
+			if alias.Symbol == "" {
+				return fmt.Errorf("markets[%d] (%s): empty alias", i, m.Symbol)
+			}
+			if aliasOf[alias.Symbol] != "" {
+				return fmt.Errorf("markets[%d] (%s): duplicate alias %q", i, m.Symbol, alias.Symbol)
+			}
+			aliasOf[alias.Symbol] = m.Symbol
+		}
+		if m.TTL.Duration < 0 {
+			return fmt.Errorf("markets[%d] (%s): negative ttl", i, m.Symbol)
+		}
+		if other, ok := usedBy[m.Market]; ok && m.Market != "" {
+			return fmt.Errorf("markets[%d] (%s): market %s is already used by %q", i, m.Symbol, m.Market, other)
+		}
+		symbols[m.Symbol] = true
+		usedBy[m.Market] = m.Symbol
+	}
+
+	// The aliases may come before the market using their symbol.
+	for alias, symbol := range aliasOf {
+		if symbols[alias] {
+			return fmt.Errorf("alias %q of %q is also a market symbol", alias, symbol)
+		}
+	}
+
+	// The quote markets of the pools may come after them.
+	for i, m := range markets {
+		if m.onChain() {
+			if err := validatePool(i, m, symbols); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeMarketsFile writes a configuration file in a temporary directory and returns its path.
+func writeMarketsFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "markets.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadMarketsLowercasesSymbols(t *testing.T) {
+	path := writeMarketsFile(t, `{"markets": [
+		{"symbol": "BAN", "market": "BANANOUSDT", "aliases": [{"symbol": " Banano "}]},
+		{"symbol": "Wban_BSC", "dex": {"chain": "bsc", "pool": "0x0000000000000000000000000000000000000001", "quote": "BAN"}}
+	]}`)
+	config, err := readMarkets(path, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := useConfig(t)
+	useMarkets(t, s, config.markets)
+
+	for _, symbol := range []string{"ban", "BAN", "banano", "wban_bsc"} {
+		if _, ok := s.cfg.findMarket(symbol); !ok {
+			t.Errorf("findMarket(%q) found no market", symbol)
+		}
+	}
+	if quote := config.markets[1].DEX.Quote; quote != "ban" {
+		t.Errorf("pool quote = %q, want ban", quote)
+	}
+}
+
+func TestReadMarketsRejectsInvalidEntries(t *testing.T) {
+	tests := []struct {
+		name    string
+		markets string
+		want    string
+	}{
+		{"empty symbol", `[{"symbol": "", "market": "BANANOUSDT"}]`, "markets[0]: empty symbol"},
+		{"duplicate symbol ignoring case", `[{"symbol": "ban", "market": "BANANOUSDT"}, {"symbol": "BAN", "market": "BANANOUSDC"}]`, `markets[1]: duplicate symbol "ban"`},
+		{"duplicate market", `[{"symbol": "ban", "market": "BANANOUSDT"}, {"symbol": "banano", "market": "BANANOUSDT"}]`, "market BANANOUSDT is already used"},
+		{"no source", `[{"symbol": "ban"}]`, "no market on any price source"},
+		{"alias of another market", `[{"symbol": "ban", "market": "BANANOUSDT", "aliases": [{"symbol": "ETH"}]}, {"symbol": "eth", "market": "ETHUSDC"}]`, `alias "eth" of "ban" is also a market symbol`},
+		{"duplicate alias", `[{"symbol": "ban", "market": "BANANOUSDT", "aliases": [{"symbol": "banano"}]}, {"symbol": "eth", "market": "ETHUSDC", "aliases": [{"symbol": "banano"}]}]`, `duplicate alias "banano"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readMarkets(writeMarketsFile(t, `{"markets": `+tt.markets+`}`), time.Minute)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("readMarkets() error = %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadMarketsFallsBackToBuiltIn(t *testing.T) {
+	config, err := loadMarkets(filepath.Join(t.TempDir(), "missing.json"), time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.markets) != len(defaultMarkets) {
+		t.Errorf("loaded %d markets, want the %d built-in ones", len(config.markets), len(defaultMarkets))
+	}
+}
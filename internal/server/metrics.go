@@ -0,0 +1,244 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default histogram buckets, in seconds.
+var defaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Metrics exposed at /metrics in the Prometheus text format. Their names are stable, dashboards rely on them.
+var (
+	httpRequestsTotal = newMetricVec("wban_http_requests_total", "HTTP requests by route and status.", "counter", "path", "status")
+	httpDuration      = newMetricVec("wban_http_request_duration_seconds", "HTTP request handling duration by route.", "histogram", "path")
+
+	cacheHitsTotal   = newMetricVec("wban_cache_hits_total", "Price lookups served from the cache.", "counter")
+	cacheMissesTotal = newMetricVec("wban_cache_misses_total", "Price lookups which had to fetch expired prices.", "counter")
+
+	suppressedFetchesTotal = newMetricVec("wban_suppressed_fetches_total", "Price lookups which didn't fetch expired prices failing less than the negative cache TTL ago.", "counter")
+	partialResponsesTotal  = newMetricVec("wban_partial_responses_total", "Price lookups served without the prices of some failed markets, or with their stale ones.", "counter")
+
+	upstreamRequestsTotal = newMetricVec("wban_upstream_requests_total", "Upstream fetch attempts by market.", "counter", "market")
+	upstreamFailuresTotal = newMetricVec("wban_upstream_failures_total", "Failed upstream fetch attempts by market.", "counter", "market")
+	upstreamDuration      = newMetricVec("wban_upstream_request_duration_seconds", "Upstream fetch attempt duration by market.", "histogram", "market")
+
+	coinexThrottledTotal = newMetricVec("wban_coinex_throttled_total", "Requests to CoinEx failed by our own rate limit, their deadline not leaving time to wait for their turn.", "counter")
+
+	upstreamConnectionsTotal = newMetricVec("wban_upstream_connections_total", "Connections used by upstream requests, by host and whether they were reused.", "counter", "host", "reused")
+
+	panicsTotal      = newMetricVec("wban_panics_total", "Panics recovered from handlers and upstream fetches.", "counter")
+	rateLimitedTotal = newMetricVec("wban_rate_limited_total", "Requests rejected by the per-IP rate limit.", "counter")
+
+	apiKeyRequestsTotal = newMetricVec("wban_api_key_requests_total", "Requests authenticated with an API key, by key name.", "counter", "client")
+
+	inFlightGauge = newMetricVec("wban_in_flight_requests", "Requests being processed, streams and long polls excluded.", "gauge")
+	shedTotal     = newMetricVec("wban_shed_requests_total", "Requests shed by exhausted budget: requests or refreshes.", "counter", "budget")
+
+	wsClientsGauge = newMetricVec("wban_websocket_clients", "Connected WebSocket clients.", "gauge")
+
+	historyDroppedTotal = newMetricVec("wban_history_dropped_total", "Prices not written to the history database, the disk not keeping up.", "counter")
+
+	outlierPricesTotal = newMetricVec("wban_outlier_prices_total", "Fetched prices rejected as implausible jumps, by symbol.", "counter", "symbol")
+)
+
+var allMetrics = []*metricVec{
+	httpRequestsTotal, httpDuration,
+	cacheHitsTotal, cacheMissesTotal, suppressedFetchesTotal, partialResponsesTotal,
+	upstreamRequestsTotal, upstreamFailuresTotal, upstreamDuration, upstreamConnectionsTotal, coinexThrottledTotal,
+	panicsTotal, rateLimitedTotal, apiKeyRequestsTotal, inFlightGauge, shedTotal, wsClientsGauge,
+	outlierPricesTotal, historyDroppedTotal,
+}
+
+// metricVec is a counter, gauge or histogram, with one series per combination of label values.
+type metricVec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mutex  sync.Mutex
+	series map[string]*metricSeries
+}
+
+type metricSeries struct {
+	labelValues []string
+	value       float64  // Counter or gauge value, or sum of the observations of a histogram.
+	count       uint64   // Number of observations of a histogram.
+	buckets     []uint64 // Observations per bucket of a histogram, not cumulative.
+}
+
+func newMetricVec(name, help, kind string, labels ...string) *metricVec {
+	return &metricVec{name: name, help: help, kind: kind, labels: labels, series: make(map[string]*metricSeries)}
+}
+
+// with returns the series of labelValues, creating it if needed. The mutex must be held.
+func (m *metricVec) with(labelValues []string) *metricSeries {
+	key := strings.Join(labelValues, "\xff")
+	s := m.series[key]
+	if s == nil {
+		s = &metricSeries{labelValues: labelValues}
+		if m.kind == "histogram" {
+			s.buckets = make([]uint64, len(defaultBuckets))
+		}
+		m.series[key] = s
+	}
+	return s
+}
+
+// inc increments a counter.
+func (m *metricVec) inc(labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.with(labelValues).value++
+}
+
+// set sets a gauge.
+func (m *metricVec) set(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.with(labelValues).value = value
+}
+
+// observe records a value in a histogram.
+func (m *metricVec) observe(value float64, labelValues ...string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	s := m.with(labelValues)
+	s.value += value
+	s.count++
+	for i, bound := range defaultBuckets {
+		if value <= bound {
+			s.buckets[i]++
+			break
+		}
+	}
+}
+
+// write writes the metric in the Prometheus text exposition format.
+func (m *metricVec) write(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 && len(m.labels) == 0 {
+		// Unlabelled metrics always exist.
+		m.with(nil)
+		keys = append(keys, "")
+	}
+
+	for _, key := range keys {
+		s := m.series[key]
+		labels := formatLabels(m.labels, s.labelValues)
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, wrapLabels(labels), formatValue(s.value))
+			continue
+		}
+
+		var cumulative uint64
+		for i, bound := range defaultBuckets {
+			cumulative += s.buckets[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, wrapLabels(joinLabels(labels, `le="`+formatValue(bound)+`"`)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, wrapLabels(joinLabels(labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, wrapLabels(labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, wrapLabels(labels), s.count)
+	}
+}
+
+func formatLabels(names, values []string) string {
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(values[i])
+		pairs[i] = name + `="` + value + `"`
+	}
+	return strings.Join(pairs, ",")
+}
+
+func joinLabels(labels, extra string) string {
+	if labels == "" {
+		return extra
+	}
+	return labels + "," + extra
+}
+
+func wrapLabels(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+// statusRecorder captures the status and body size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// instrument counts the requests handled by next, and measures their duration, labelled by the route pattern of mux.
+func (s *Server) instrument(mux *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+
+		requestsTotal.Add(1)
+		start := s.now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		httpRequestsTotal.inc(pattern, strconv.Itoa(recorder.status))
+		httpDuration.observe(s.now().Sub(start).Seconds(), pattern)
+	})
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// appendMsgpackPrices appends prices as a MessagePack map of symbols to float64 prices, sorted by symbol
+// so that identical prices are always encoded identically.
+func appendMsgpackPrices(b []byte, prices map[string]float64) []byte {
+	symbols := sortedKeys(prices)
+	b = appendMsgpackMapHeader(b, len(symbols))
+	for _, symbol := range symbols {
+		b = appendMsgpackString(b, symbol)
+		b = appendMsgpackFloat(b, prices[symbol])
+	}
+	return b
+}
+
+// appendMsgpackDetails appends details as a MessagePack map of symbols to maps named like the JSON fields.
+func appendMsgpackDetails(b []byte, details map[string]priceDetail) []byte {
+	symbols := sortedKeys(details)
+	b = appendMsgpackMapHeader(b, len(symbols))
+	for _, symbol := range symbols {
+		detail := details[symbol]
+		b = appendMsgpackString(b, symbol)
+		b = appendMsgpackMapHeader(b, 3)
+		b = appendMsgpackFloat(appendMsgpackString(b, "price"), detail.Price)
+		b = appendMsgpackFloat(appendMsgpackString(b, "change_24h_pct"), detail.Change24hPct)
+		b = appendMsgpackFloat(appendMsgpackString(b, "volume_24h"), detail.Volume24h)
+	}
+	return b
+}
+
+func appendMsgpackMapHeader(b []byte, n int) []byte {
+	switch {
+	case n < 16:
+		return append(b, 0x80|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xde), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, 0xdf), uint32(n))
+	}
+}
+
+func appendMsgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func appendMsgpackFloat(b []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+}
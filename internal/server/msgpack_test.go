@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// decodeMsgpack decodes the maps, strings and float64s written by the encoder, failing on anything else or trailing bytes.
+func decodeMsgpack(t *testing.T, b []byte) any {
+	t.Helper()
+	value, rest, err := decodeMsgpackValue(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) > 0 {
+		t.Fatalf("%d trailing bytes", len(rest))
+	}
+	return value
+}
+
+func decodeMsgpackValue(b []byte) (any, []byte, error) {
+	if len(b) == 0 {
+		return nil, nil, fmt.Errorf("truncated value")
+	}
+	tag, b := b[0], b[1:]
+	var n int
+	switch {
+	case tag&0xf0 == 0x80:
+		return decodeMsgpackMap(b, int(tag&0x0f))
+	case tag == 0xde && len(b) >= 2:
+		return decodeMsgpackMap(b[2:], int(binary.BigEndian.Uint16(b)))
+	case tag == 0xdf && len(b) >= 4:
+		return decodeMsgpackMap(b[4:], int(binary.BigEndian.Uint32(b)))
+	case tag&0xe0 == 0xa0:
+		n = int(tag & 0x1f)
+	case tag == 0xd9 && len(b) >= 1:
+		n, b = int(b[0]), b[1:]
+	case tag == 0xda && len(b) >= 2:
+		n, b = int(binary.BigEndian.Uint16(b)), b[2:]
+	case tag == 0xdb && len(b) >= 4:
+		n, b = int(binary.BigEndian.Uint32(b)), b[4:]
+	case tag == 0xcb && len(b) >= 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+	default:
+		return nil, nil, fmt.Errorf("unexpected tag %#x", tag)
+	}
+	if len(b) < n {
+		return nil, nil, fmt.Errorf("truncated string")
+	}
+	return string(b[:n]), b[n:], nil
+}
+
+func decodeMsgpackMap(b []byte, n int) (any, []byte, error) {
+	m := make(map[string]any, n)
+	for range n {
+		key, rest, err := decodeMsgpackValue(b)
+		if err != nil {
+			return nil, nil, err
+		}
+		s, ok := key.(string)
+		if !ok {
+			return nil, nil, fmt.Errorf("map key %v is not a string", key)
+		}
+		if m[s], b, err = decodeMsgpackValue(rest); err != nil {
+			return nil, nil, err
+		}
+	}
+	return m, b, nil
+}
+
+// msgpackPrices returns n prices whose symbols have the lengths of lengths in turn.
+func msgpackPrices(n int, lengths ...int) map[string]float64 {
+	prices := make(map[string]float64, n)
+	for i := range n {
+		symbol := fmt.Sprintf("s%03d", i)
+		symbol += strings.Repeat("x", max(lengths[i%len(lengths)]-len(symbol), 0))
+		prices[symbol] = float64(i) + 0.00734
+	}
+	return prices
+}
+
+func TestMsgpackPricesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		prices map[string]float64
+		mapTag byte
+		keyTag byte // Tag of the first symbol.
+	}{
+		{"empty fixmap", map[string]float64{}, 0x80, 0},
+		{"largest fixmap", msgpackPrices(15, 4), 0x8f, 0xa4},
+		{"smallest map16", msgpackPrices(16, 4), 0xde, 0xa4},
+		{"smallest map32", msgpackPrices(math.MaxUint16+1, 4), 0xdf, 0xa4},
+		{"largest fixstr", msgpackPrices(1, 31), 0x81, 0xbf},
+		{"smallest str8", msgpackPrices(1, 32), 0x81, 0xd9},
+		{"largest str8", msgpackPrices(1, 255), 0x81, 0xd9},
+		{"smallest str16", msgpackPrices(1, 256), 0x81, 0xda},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := appendMsgpackPrices(nil, tt.prices)
+			if b[0] != tt.mapTag {
+				t.Errorf("map tag = %#x, want %#x", b[0], tt.mapTag)
+			}
+			// The first symbol follows the map header.
+			offset := 1
+			switch b[0] {
+			case 0xde:
+				offset = 3
+			case 0xdf:
+				offset = 5
+			}
+			if len(tt.prices) > 0 && b[offset] != tt.keyTag {
+				t.Errorf("symbol tag = %#x, want %#x", b[offset], tt.keyTag)
+			}
+
+			want := make(map[string]any, len(tt.prices))
+			for symbol, price := range tt.prices {
+				want[symbol] = price
+			}
+			if got := decodeMsgpack(t, b); !reflect.DeepEqual(got, want) {
+				t.Error("decoded prices differ from the encoded ones")
+			}
+		})
+	}
+}
+
+func TestMsgpackDetailsRoundTrip(t *testing.T) {
+	details := map[string]priceDetail{
+		"ban": {Price: 0.00734, Change24hPct: -1.5, Volume24h: 123456},
+		"eth": {Price: 2512.85, Change24hPct: 2.25, Volume24h: 42},
+	}
+	want := map[string]any{
+		"ban": map[string]any{"price": 0.00734, "change_24h_pct": -1.5, "volume_24h": 123456.0},
+		"eth": map[string]any{"price": 2512.85, "change_24h_pct": 2.25, "volume_24h": 42.0},
+	}
+	if got := decodeMsgpack(t, appendMsgpackDetails(nil, details)); !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded details = %v, want %v", got, want)
+	}
+}
+
+func TestPricesMsgpack(t *testing.T) {
+	s := useConfig(t)
+	cacheBaselinePrices(t, s)
+
+	r := httptest.NewRequest(http.MethodGet, "/prices", nil)
+	r.Header.Set("Accept", "application/msgpack")
+	w := httptest.NewRecorder()
+	s.pricesHandler(w, r)
+	if contentType := w.Header().Get("Content-Type"); contentType != "application/msgpack" {
+		t.Fatalf("Content-Type = %q, want application/msgpack", contentType)
+	}
+	want := make(map[string]any, len(baselinePrices))
+	for symbol, price := range baselinePrices {
+		want[symbol] = price
+	}
+	if got := decodeMsgpack(t, w.Body.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Errorf("decoded prices = %v, want %v", got, want)
+	}
+}
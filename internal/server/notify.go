@@ -0,0 +1,104 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	DEFAULT_NOTIFY_WINDOW   = time.Hour
+	DEFAULT_NOTIFY_COOLDOWN = time.Hour
+
+	TELEGRAM_API_URL = "https://api.telegram.org"
+)
+
+// notifyEnabled reports whether large moves are notified: with NOTIFY_MOVE_PCT, to Discord, Telegram or both.
+func (cfg *Config) notifyEnabled() bool {
+	return cfg.NotifyMovePct > 0 && (cfg.DiscordWebhookURL != "" || cfg.TelegramBotToken != "")
+}
+
+// checkMoves notifies the chats of the markets whose price moved by NOTIFY_MOVE_PCT or more over NOTIFY_WINDOW,
+// once per NOTIFY_COOLDOWN at most. The messages are sent in the background, the chats failing is only logged.
+func (s *Server) checkMoves(ctx context.Context) {
+	if !s.cfg.notifyEnabled() {
+		return
+	}
+
+	entries := s.cache.Snapshot()
+	now := s.now()
+	for _, m := range s.cfg.markets() {
+		entry, ok := entries[m.Symbol]
+		if !ok || entry.UpdatedAt.IsZero() || entry.Restored {
+			continue
+		}
+		price := entry.Price()
+		from, change, ok := s.priceMove(ctx, m.Symbol, price, s.cfg.NotifyWindow, now)
+		if !ok || math.Abs(change) < s.cfg.NotifyMovePct {
+			continue
+		}
+
+		s.notifiedMutex.Lock()
+		due := now.Sub(s.notifiedAt[m.Symbol]) >= s.cfg.NotifyCooldown
+		if due {
+			s.notifiedAt[m.Symbol] = now
+		}
+		s.notifiedMutex.Unlock()
+		if due {
+			message := moveMessage(m.Symbol, from, price, change, s.cfg.NotifyWindow)
+			s.log.InfoContext(ctx, "notify | large move", "symbol", m.Symbol, "from", from, "to", price, "change_pct", change)
+			go s.sendNotifications(message)
+		}
+	}
+}
+
+// moveMessage formats a move like "BAN up 20.31% in 1h: $0.0061 → $0.00734".
+func moveMessage(symbol string, from, to, change float64, window time.Duration) string {
+	direction := "up"
+	if change < 0 {
+		direction = "down"
+	}
+	return fmt.Sprintf("%s %s %.2f%% in %s: $%s → $%s", strings.ToUpper(symbol), direction, math.Abs(change), formatWindow(window), formatNumber(from), formatNumber(to))
+}
+
+// formatWindow writes whole hours and minutes without their zero units, 1h rather than 1h0m0s.
+func formatWindow(window time.Duration) string {
+	s := window.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// sendNotifications posts message to the configured chats.
+func (s *Server) sendNotifications(message string) {
+	if s.cfg.DiscordWebhookURL != "" {
+		body, _ := json.Marshal(map[string]string{"content": message})
+		if err := s.postWebhook(s.shutdownCtx, s.cfg.DiscordWebhookURL, body); err != nil {
+			s.log.Warn("notify | Discord notification failed", "error", redactURL(err))
+		}
+	}
+	if s.cfg.TelegramBotToken != "" {
+		body, _ := json.Marshal(map[string]string{"chat_id": s.cfg.TelegramChatID, "text": message})
+		if err := s.postWebhook(s.shutdownCtx, TELEGRAM_API_URL+"/bot"+s.cfg.TelegramBotToken+"/sendMessage", body); err != nil {
+			s.log.Warn("notify | Telegram notification failed", "error", redactURL(err))
+		}
+	}
+}
+
+// redactURL leaves the URL out of the errors of requests, the webhook and bot URLs holding their secret.
+func redactURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider/coinex"
+)
+
+const DEFAULT_OHLC_LIMIT = 100
+const MAX_OHLC_LIMIT = 1000
+
+// Candle intervals, mapped to CoinEx kline types, the periods of the v2 API.
+var klineIntervals = map[string]struct {
+	kline    string
+	duration time.Duration
+}{
+	"1m":  {"1min", time.Minute},
+	"3m":  {"3min", 3 * time.Minute},
+	"5m":  {"5min", 5 * time.Minute},
+	"15m": {"15min", 15 * time.Minute},
+	"30m": {"30min", 30 * time.Minute},
+	"1h":  {"1hour", time.Hour},
+	"2h":  {"2hour", 2 * time.Hour},
+	"4h":  {"4hour", 4 * time.Hour},
+	"6h":  {"6hour", 6 * time.Hour},
+	"12h": {"12hour", 12 * time.Hour},
+	"1d":  {"1day", 24 * time.Hour},
+	"3d":  {"3day", 3 * 24 * time.Hour},
+	"1w":  {"1week", 7 * 24 * time.Hour},
+}
+
+// candle is an OHLC candle starting at T, in Unix seconds.
+type candle struct {
+	T      int64   `json:"t"`
+	Open   float64 `json:"open"`
+	High   float64 `json:"high"`
+	Low    float64 `json:"low"`
+	Close  float64 `json:"close"`
+	Volume float64 `json:"volume"`
+}
+
+// candleProvider is a price source serving the candles of its markets, as CoinEx does.
+type candleProvider interface {
+	Candles(ctx context.Context, market, period string, limit int) ([]coinex.Candle, error)
+}
+
+// ohlcEntry is the cached candles of a symbol and interval.
+type ohlcEntry struct {
+	candles   []candle
+	limit     int // How many candles were requested from CoinEx.
+	fetchedAt time.Time
+}
+
+// ohlcTTL returns how long candles of the given interval are cached: the shorter the interval, the sooner they change.
+func (s *Server) ohlcTTL(interval time.Duration) time.Duration {
+	return max(interval/60, s.cfg.cacheTTL())
+}
+
+func (s *Server) cachedCandles(key string) (ohlcEntry, bool) {
+	s.ohlcMutex.Lock()
+	defer s.ohlcMutex.Unlock()
+
+	entry, ok := s.ohlcCache[key]
+	return entry, ok
+}
+
+func (s *Server) storeCandles(key string, entry ohlcEntry) {
+	s.ohlcMutex.Lock()
+	defer s.ohlcMutex.Unlock()
+
+	s.ohlcCache[key] = entry
+}
+
+// getCandles returns the last limit candles of m, from the cache or from CoinEx.
+func (s *Server) getCandles(ctx context.Context, m Market, interval string, limit int) ([]candle, error) {
+	key := m.Symbol + "/" + interval
+	entry, ok := s.cachedCandles(key)
+
+	if !ok || entry.limit < limit || s.now().Sub(entry.fetchedAt) >= s.ohlcTTL(klineIntervals[interval].duration) {
+		// Fetch enough candles for this request and the previous ones.
+		fetchLimit := max(limit, entry.limit)
+		candles, err, _ := s.ohlcFlights.do(ctx, fmt.Sprintf("%s/%d", key, fetchLimit), func(ctx context.Context) ([]candle, error) {
+			return s.fetchCandles(ctx, m.Market, klineIntervals[interval].kline, fetchLimit)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		entry = ohlcEntry{candles: candles, limit: fetchLimit, fetchedAt: s.now()}
+		s.storeCandles(key, entry)
+	}
+
+	candles := entry.candles
+	if len(candles) > limit {
+		candles = candles[len(candles)-limit:]
+	}
+	return candles, nil
+}
+
+// fetchCandles fetches the last limit candles of market from CoinEx.
+func (s *Server) fetchCandles(ctx context.Context, market, kline string, limit int) ([]candle, error) {
+	p, ok := s.providers[SOURCE_COINEX].(candleProvider)
+	if !ok {
+		return nil, fmt.Errorf("%s serves no candles", SOURCE_COINEX)
+	}
+	klines, err := p.Candles(ctx, market, kline, limit)
+	if err != nil {
+		return nil, err
+	}
+	candles := make([]candle, len(klines))
+	for i, k := range klines {
+		candles[i] = candle(k)
+	}
+	return candles, nil
+}
+
+// ohlcHandler serves the candles of a symbol, proxied from CoinEx klines.
+func (s *Server) ohlcHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	symbol := query.Get("symbol")
+	m, ok := s.cfg.findMarket(symbol)
+	if !ok {
+		s.writeJSONError(w, r, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("unknown symbol %q", symbol), Symbols: s.marketSymbols()})
+		return
+	}
+
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "1h"
+	}
+	if _, ok := klineIntervals[interval]; !ok {
+		s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("unsupported interval %q, expected one of 1m, 3m, 5m, 15m, 30m, 1h, 2h, 4h, 6h, 12h, 1d, 3d or 1w", interval)})
+		return
+	}
+
+	limit := DEFAULT_OHLC_LIMIT
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > MAX_OHLC_LIMIT {
+			s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("limit must be an integer between 1 and %d", MAX_OHLC_LIMIT)})
+			return
+		}
+		limit = parsed
+	}
+
+	candles, err := s.getCandles(r.Context(), m, interval, limit)
+	if err != nil {
+		if r.Context().Err() == nil {
+			s.writeJSONError(w, r, http.StatusBadGateway, errorResponse{Error: err.Error()})
+		}
+		return
+	}
+	s.writeJSON(w, http.StatusOK, candles)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Profiles are only served on the loopback interface by default, never along with the public routes.
+const DEFAULT_PPROF_ADDR = "127.0.0.1:6060"
+
+// registerPprof registers the net/http/pprof profiles on mux.
+// The profiles are listed by /debug/pprof/, e.g. /debug/pprof/heap, /debug/pprof/goroutine?debug=2
+// and /debug/pprof/profile?seconds=30 for the CPU.
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// servePprof serves the pprof profiles on their own listener in the background, when there is no admin listener.
+func (s *Server) servePprof() {
+	mux := http.NewServeMux()
+	registerPprof(mux)
+
+	listener, err := net.Listen("tcp", s.cfg.PprofAddr)
+	if err != nil {
+		s.fatal("pprof | listening failed", err)
+	}
+	s.log.Info("pprof | serving profiles", "url", "http://"+listener.Addr().String()+"/debug/pprof/")
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+		s.log.Warn("pprof | profiles reachable beyond localhost, make sure the address is private", "addr", s.cfg.PprofAddr)
+	}
+
+	// No write timeout, CPU profiles and traces take as long as requested.
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: s.cfg.ReadHeaderTimeout}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			s.log.Error("pprof | serving failed", "error", err)
+		}
+	}()
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net/http"
+	"time"
+)
+
+// Requests per second and burst allowed to every client IP.
+const (
+	DEFAULT_RATE_LIMIT = 10
+	DEFAULT_RATE_BURST = 30
+)
+
+// Most client IPs tracked at once. Idle clients are forgotten first, their buckets being full again anyway.
+const MAX_RATE_LIMITED_CLIENTS = 10000
+
+// Paths of the probes and scrapes, never rate limited.
+var rateLimitExempt = map[string]bool{"/health": true, "/ready": true, "/metrics": true}
+
+// tokenBucket holds the requests a client may still send right away.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limitRate answers with a 429 the clients sending requests to next faster than the configured rate.
+// Preflights and probes are exempt.
+func (s *Server) limitRate(next http.Handler) http.Handler {
+	if s.cfg.RateLimit == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || rateLimitExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if wait := s.takeToken(s.clientIP(r), s.now()); wait > 0 {
+			rateLimitedTotal.inc()
+			setRetryAfter(w, wait)
+			s.writeJSONError(w, r, http.StatusTooManyRequests, errorResponse{Error: "rate limit exceeded, slow down"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// takeToken takes a token from the bucket of ip, or returns how long until one is available.
+func (s *Server) takeToken(ip string, now time.Time) time.Duration {
+	s.rateLimitMutex.Lock()
+	defer s.rateLimitMutex.Unlock()
+
+	b := s.rateLimitBuckets[ip]
+	if b == nil {
+		if len(s.rateLimitBuckets) >= MAX_RATE_LIMITED_CLIENTS {
+			s.evictIdleBuckets(now)
+		}
+		b = &tokenBucket{tokens: float64(s.cfg.RateBurst), last: now}
+		s.rateLimitBuckets[ip] = b
+	}
+
+	b.tokens = min(float64(s.cfg.RateBurst), b.tokens+now.Sub(b.last).Seconds()*s.cfg.RateLimit)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / s.cfg.RateLimit * float64(time.Second))
+	}
+	b.tokens--
+	return 0
+}
+
+// evictIdleBuckets forgets the clients whose bucket is full again, or every other client when all are active.
+// The mutex must be held.
+func (s *Server) evictIdleBuckets(now time.Time) {
+	refill := time.Duration(float64(s.cfg.RateBurst) / s.cfg.RateLimit * float64(time.Second))
+	for ip, b := range s.rateLimitBuckets {
+		if now.Sub(b.last) >= refill {
+			delete(s.rateLimitBuckets, ip)
+		}
+	}
+	if len(s.rateLimitBuckets) < MAX_RATE_LIMITED_CLIENTS {
+		return
+	}
+	evict := true
+	for ip := range s.rateLimitBuckets {
+		if evict {
+			delete(s.rateLimitBuckets, ip)
+		}
+		evict = !evict
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverPanics answers the requests whose handler panicked with a 500, instead of dropping their connection,
+// unless their response was started already.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// Deliberate abort of the response, which net/http handles silently.
+				panic(p)
+			}
+
+			recordPanic(r.Context(), r.URL.Path, p)
+			if recorder.status != 0 {
+				// An error appended to a response already started would corrupt it, the connection is dropped instead.
+				panic(http.ErrAbortHandler)
+			}
+			s.writeJSONError(w, r, http.StatusInternalServerError, errorResponse{Error: "internal server error"})
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
+
+// errPanicked matches the errors of the goroutines recovered from a panic, internal errors rather than upstream ones.
+var errPanicked = errors.New("panic")
+
+// recoverError turns a panic of the calling goroutine into *err, for goroutines nothing else would recover.
+// It must be deferred.
+func recoverError(ctx context.Context, where string, err *error) {
+	if p := recover(); p != nil {
+		recordPanic(ctx, where, p)
+		*err = fmt.Errorf("%w: %v", errPanicked, p)
+	}
+}
+
+// recordPanic logs a recovered panic along with its stack trace, and counts it.
+func recordPanic(ctx context.Context, where string, p any) {
+	slog.ErrorContext(ctx, "panic recovered", "where", where, "panic", p, "stack", string(debug.Stack()))
+	panicsTotal.inc()
+	panics.Add(1)
+}
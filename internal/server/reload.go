@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// reloadStatus is the outcome of a configuration reload.
+type reloadStatus struct {
+	At       time.Time `json:"at"`
+	Accepted bool      `json:"accepted"`
+	Error    string    `json:"error,omitempty"`
+	Added    []string  `json:"added,omitempty"`
+	Removed  []string  `json:"removed,omitempty"`
+	Changed  []string  `json:"changed,omitempty"`   // Symbols whose markets, sources or TTL changed.
+	CacheTTL string    `json:"cache_ttl,omitempty"` // New cache TTL, when it changed.
+}
+
+func (s *Server) lastReloadStatus() *reloadStatus {
+	s.lastReloadMutex.Lock()
+	defer s.lastReloadMutex.Unlock()
+
+	return s.lastReload
+}
+
+// runReloader reloads the configuration file on every SIGHUP until ctx is done.
+func (s *Server) runReloader(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			status := s.reloadMarkets()
+			s.lastReloadMutex.Lock()
+			s.lastReload = status
+			s.lastReloadMutex.Unlock()
+		}
+	}
+}
+
+// reloadMarkets reads the configuration file again and swaps the markets and cache TTL for its ones.
+// An invalid file is rejected, keeping the current configuration.
+// Added markets are fetched by the next refresh, the cached prices of the removed ones are dropped
+// and the moving averages start over.
+func (s *Server) reloadMarkets() *reloadStatus {
+	status := &reloadStatus{At: s.now().UTC()}
+	current := s.cfg.reloadable.Load()
+
+	var next *marketConfig
+	err := errors.New("no configuration file to reload, the built-in markets are used")
+	if s.cfg.MarketsFile != "" {
+		next, err = readMarkets(s.cfg.MarketsFile, s.cfg.CacheTTL)
+	}
+	if err == nil && (next.cacheTTL == 0) != (current.cacheTTL == 0) {
+		err = errors.New("enabling or disabling the cache requires a restart")
+	}
+	if err != nil {
+		status.Error = err.Error()
+		s.log.Error("reload | configuration rejected, keeping the current one", "path", s.cfg.MarketsFile, "error", err)
+		return status
+	}
+
+	previous := make(map[string]Market, len(current.markets))
+	for _, m := range current.markets {
+		previous[m.Symbol] = m
+	}
+	var forgotten []string
+	for _, m := range next.markets {
+		old, ok := previous[m.Symbol]
+		delete(previous, m.Symbol)
+		switch {
+		case !ok:
+			status.Added = append(status.Added, m.Symbol)
+		case old.Market != m.Market:
+			status.Changed = append(status.Changed, m.Symbol)
+			forgotten = append(forgotten, m.Symbol)
+		case !reflect.DeepEqual(old, m):
+			status.Changed = append(status.Changed, m.Symbol)
+		}
+	}
+	for _, m := range current.markets {
+		if _, ok := previous[m.Symbol]; ok {
+			status.Removed = append(status.Removed, m.Symbol)
+			forgotten = append(forgotten, m.Symbol)
+		}
+	}
+	if next.cacheTTL != current.cacheTTL {
+		status.CacheTTL = next.cacheTTL.String()
+	}
+
+	s.cfg.reloadable.Store(next)
+	status.Accepted = true
+	s.cache.Forget(forgotten)
+	s.cache.ResetSmoothing()
+	if s.cfg.UpstreamMode == UPSTREAM_WS && (len(status.Added) > 0 || len(forgotten) > 0) {
+		s.coinexStream.resubscribe()
+	}
+	// Let the streaming clients see the new markets.
+	s.priceUpdates.publish()
+
+	s.log.Info("reload | configuration reloaded", "path", s.cfg.MarketsFile, "added", status.Added, "removed", status.Removed, "changed", status.Changed, "cache_ttl", next.cacheTTL)
+	return status
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+)
+
+const (
+	REQUEST_ID_HEADER = "X-Request-ID"
+
+	// Longest request ID accepted from a reverse proxy, longer ones are replaced.
+	MAX_REQUEST_ID_LENGTH = 128
+)
+
+// requestInfo identifies the request a context belongs to, completed by the middlewares it goes through.
+type requestInfo struct {
+	id     string
+	client string // Name of the API key of the request, empty for anonymous ones.
+}
+
+type requestInfoKey struct{}
+
+// assignRequestIDs gives every request handled by next an ID, the one set by the reverse proxy if any,
+// attached to its context and echoed back in the response headers.
+func assignRequestIDs(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(REQUEST_ID_HEADER)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(REQUEST_ID_HEADER, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{id: id})))
+	})
+}
+
+// requestInfoFrom returns the request ctx belongs to, nil outside of requests.
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestID returns the ID of the request ctx belongs to, empty outside of requests.
+func requestID(ctx context.Context) string {
+	if info := requestInfoFrom(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID reports whether id is short and made of visible ASCII characters only,
+// so that a client can't forge log lines with it.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > MAX_REQUEST_ID_LENGTH {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestInfoHandler adds the request ID and API client of their context to the records logged with one.
+type requestInfoHandler struct {
+	slog.Handler
+}
+
+func (h requestInfoHandler) Handle(ctx context.Context, record slog.Record) error {
+	if info := requestInfoFrom(ctx); info != nil {
+		record.AddAttrs(slog.String("request_id", info.id))
+		if info.client != "" {
+			record.AddAttrs(slog.String("client", info.client))
+		}
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h requestInfoHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestInfoHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestInfoHandler) WithGroup(name string) slog.Handler {
+	return requestInfoHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// selfTestOptions are the flags checking the configuration against the price sources before serving it.
+type selfTestOptions struct {
+	enabled      bool
+	allowPartial bool
+}
+
+func registerSelfTestFlags() *selfTestOptions {
+	opts := &selfTestOptions{}
+	flag.BoolVar(&opts.enabled, "selftest", false, "fetch every market from every one of its price sources, print the results and exit instead of serving")
+	flag.BoolVar(&opts.allowPartial, "allow-partial", false, "make --selftest pass when every market got a price from at least one of its sources")
+	return opts
+}
+
+// selfTestCheck is the fetch of a market from one of its price sources.
+type selfTestCheck struct {
+	symbol   string
+	source   string
+	listedAs string
+	price    float64
+	duration time.Duration
+	err      error
+}
+
+// runSelfTest fetches every market from every price source listing it, concurrently, prints a table of the results on stdout,
+// and returns the exit code of the process: 0 when all of them passed, or with allowPartial when every market passed once.
+// Every fetch is bounded by the upstream timeout of each of its attempts, so a hung source can't stall the test.
+func (s *Server) runSelfTest(opts *selfTestOptions) int {
+	var checks []*selfTestCheck
+	for _, m := range s.cfg.markets() {
+		listed := false
+		for _, source := range s.cfg.sourcesOf(m) {
+			if symbol := m.listedOn(source); symbol != "" {
+				checks = append(checks, &selfTestCheck{symbol: m.Symbol, source: source, listedAs: symbol})
+				listed = true
+			}
+		}
+		if !listed {
+			checks = append(checks, &selfTestCheck{symbol: m.Symbol, err: s.errNotListed(m)})
+		}
+	}
+
+	timeout := time.Duration(s.cfg.UpstreamRetries+1) * s.cfg.UpstreamTimeout
+	var wg sync.WaitGroup
+	for _, check := range checks {
+		if check.err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(check *selfTestCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+
+			start := s.now()
+			tickers, err := s.providers[check.source].Fetch(ctx, []string{check.listedAs})
+			check.duration = s.now().Sub(start)
+			ticker, ok := tickers[check.listedAs]
+			switch {
+			case err != nil:
+				check.err = err
+			case !ok:
+				check.err = fmt.Errorf("%s has no price for %s", check.source, check.listedAs)
+			default:
+				check.price = ticker.Last
+			}
+		}(check)
+	}
+	wg.Wait()
+
+	sort.SliceStable(checks, func(i, j int) bool { return checks[i].symbol < checks[j].symbol })
+	passed := make(map[string]bool)
+	failed := 0
+	table := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "SYMBOL\tSOURCE\tMARKET\tRESULT\tDURATION\tDETAIL")
+	for _, check := range checks {
+		result, detail := "pass", formatNumber(check.price)
+		if check.err != nil {
+			result, detail = "FAIL", check.err.Error()
+			failed++
+		} else {
+			passed[check.symbol] = true
+		}
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", check.symbol, check.source, check.listedAs, result, check.duration.Round(time.Millisecond), detail)
+	}
+	table.Flush()
+
+	if failed == 0 {
+		return 0
+	}
+	if opts.allowPartial && len(passed) == len(s.cfg.markets()) {
+		fmt.Fprintf(os.Stderr, "selftest passed partially, %d of %d fetches failed\n", failed, len(checks))
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "selftest failed, %d of %d fetches failed\n", failed, len(checks))
+	return EXIT_FETCH_FAILED
+}
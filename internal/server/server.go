@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+	"github.com/wBanano/wban-prices-api/internal/provider"
+	"github.com/wBanano/wban-prices-api/internal/tracing"
+)
+
+// Server serves the prices of the configured markets, and holds their cache and the state of the background work.
+type Server struct {
+	cfg *Config
+	log *slog.Logger
+	now func() time.Time
+
+	// Done when the server shuts down, stopping the background work and releasing the held requests.
+	shutdownCtx context.Context
+	shutdown    context.CancelFunc
+	startTime   time.Time
+
+	// Cached prices, keyed by symbol.
+	cache *cache.Cache
+
+	// JSON of the cached prices of all markets, encoded again whenever the cache changes.
+	encodedPrices atomic.Pointer[encodedBody]
+
+	// Set while a background revalidation is running, a single one runs at a time.
+	revalidating atomic.Bool
+
+	// In-flight upstream fetches, shared by the requests needing them.
+	marketFlights flightGroup[provider.Ticker]
+	batchFlights  flightGroup[map[string]provider.Ticker]
+
+	// The providers of the price sources and of the on-chain markets, sharing upstreamClient.
+	providers map[string]provider.PriceProvider
+
+	// HTTP client used for all the requests to the price sources, configured by configureUpstreamClient.
+	// Its connections are kept alive between refreshes, sparing a TLS handshake per request.
+	upstreamClient *http.Client
+
+	coinexStream coinexStreamState
+	priceUpdates priceHub
+
+	// Traces the requests and their upstream calls, nil when tracing is disabled.
+	tracer *tracing.Tracer
+
+	// fetchSlots bounds the fetches from the price sources, of the refresher and the requests alike.
+	fetchSlots   semaphore
+	fetchWaiting atomic.Int64 // Fetches waiting for their turn.
+
+	// refreshSlots bounds the requests refreshing expired prices, the cache hits being cheap.
+	refreshSlots semaphore
+
+	healthMutex sync.Mutex
+	health      map[string]*sourceHealth
+
+	// Exchange rates in units of currency per USD, keyed by lower-case currency code.
+	forexRates     map[string]float64
+	forexFetchedAt time.Time
+	forexMutex     sync.Mutex
+	forexFlights   flightGroup[map[string]float64]
+
+	// Price history, keyed by symbol. It is independent of the cache, so it survives flushes.
+	priceHistory map[string]*ringBuffer
+	historyMutex sync.Mutex
+
+	// The history database with HISTORY_DB, nil without it. The refreshes queue their prices, written by runHistoryWriter.
+	historyDB         *sql.DB
+	historyQueue      chan historyRow
+	historyWriterDone chan struct{}
+
+	// Candles cache, keyed by symbol and interval.
+	ohlcCache   map[string]ohlcEntry
+	ohlcMutex   sync.Mutex
+	ohlcFlights flightGroup[[]candle]
+
+	// The prices shared by the instances through Redis with REDIS_URL, nil without it.
+	// The instances read the snapshot before fetching, and the one holding the refresh lock fetches the prices for all of them.
+	// Redis failing only leaves every instance with its own cache.
+	sharedCache    *redisClient
+	sharedDown     atomic.Bool // Set while Redis is failing, so that the failures are logged once.
+	sharedInstance string      // Holder of the refresh lock.
+
+	// The active alerts, checked by the background refresher after every refresh.
+	alertsMutex sync.Mutex
+	alerts      []*alertState
+
+	// Last notified move of every symbol, for the cooldowns.
+	notifiedMutex sync.Mutex
+	notifiedAt    map[string]time.Time
+
+	rateLimitMutex   sync.Mutex
+	rateLimitBuckets map[string]*tokenBucket
+
+	apiKeyRequestsMutex sync.Mutex
+	apiKeyRequests      map[string]int64 // Requests by API key name, for /stats.
+
+	lastReloadMutex sync.Mutex
+	lastReload      *reloadStatus
+}
+
+// Options are the dependencies of a Server, the ones left out created from its configuration.
+type Options struct {
+	Log       *slog.Logger             // slog.Default() by default.
+	Now       func() time.Time         // time.Now by default.
+	Providers []provider.PriceProvider // Replace the configured providers of their price source.
+	Cache     *cache.Cache             // Created from the configuration by default.
+}
+
+// New creates the server of cfg, ready to Run.
+func New(cfg *Config, opts Options) (*Server, error) {
+	s := &Server{
+		cfg:               cfg,
+		log:               opts.Log,
+		now:               opts.Now,
+		upstreamClient:    &http.Client{Timeout: DEFAULT_UPSTREAM_TIMEOUT},
+		health:            make(map[string]*sourceHealth),
+		priceHistory:      make(map[string]*ringBuffer),
+		historyQueue:      make(chan historyRow, HISTORY_QUEUE_SIZE),
+		historyWriterDone: make(chan struct{}),
+		ohlcCache:         make(map[string]ohlcEntry),
+		notifiedAt:        make(map[string]time.Time),
+		rateLimitBuckets:  make(map[string]*tokenBucket),
+		apiKeyRequests:    make(map[string]int64),
+	}
+	if s.log == nil {
+		s.log = slog.Default()
+	}
+	if s.now == nil {
+		s.now = time.Now
+	}
+	s.startTime = s.now()
+	s.shutdownCtx, s.shutdown = context.WithCancel(context.Background())
+	s.cache = opts.Cache
+	if s.cache == nil {
+		s.cache = cache.New(s.cacheOptions())
+	}
+	s.cache.SetHooks(cache.Hooks{
+		Changed: s.encodePrices,
+		Stored: func(symbol string, e cache.Entry) {
+			s.recordHistory(symbol, e.Ticker.Last, e.Origin.Source, e.UpdatedAt)
+		},
+		Rejected: func(symbol string) { outlierPricesTotal.inc(symbol) },
+	})
+	s.tracer = tracing.New(cfg.OTelEndpoint, cfg.OTelServiceName, cfg.build.Version, s.log)
+
+	s.configureUpstreamClient()
+	s.setupProviders()
+	for _, p := range opts.Providers {
+		s.providers[p.Name()] = p
+	}
+	if err := s.setupSharedCache(); err != nil {
+		return nil, err
+	}
+	if err := s.setupAlerts(); err != nil {
+		return nil, err
+	}
+	s.refreshSlots = newSemaphore(cfg.MaxRefreshing)
+	s.fetchSlots = newSemaphore(cfg.FetchConcurrency)
+	return s, nil
+}
+
+// cacheOptions returns the options of the price cache configured by s.cfg.
+func (s *Server) cacheOptions() cache.Options {
+	opts := cache.Options{
+		OutlierThreshold:   s.cfg.OutlierThreshold,
+		OutlierAcceptAfter: s.cfg.OutlierAcceptAfter,
+		Log:                s.log,
+		Now:                s.now,
+	}
+	if s.cfg.Smoothing == SMOOTHING_EMA {
+		opts.SmoothingAlpha = s.cfg.SmoothingAlpha
+	}
+	return opts
+}
@@ -0,0 +1,174 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+)
+
+const DEFAULT_REDIS_KEY_PREFIX = "wban-prices:"
+
+// How often an instance waiting on the refresh of another one checks whether the prices were shared.
+const SHARED_REFRESH_POLL_INTERVAL = 100 * time.Millisecond
+
+// Releases the refresh lock only if it is still held by this instance.
+const REDIS_UNLOCK_SCRIPT = `if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) end return 0`
+
+// setupSharedCache creates the Redis client of the shared cache when configured.
+func (s *Server) setupSharedCache() error {
+	if s.cfg.redisURL == nil {
+		return nil
+	}
+	client, err := newRedisClient(s.cfg.redisURL)
+	if err != nil {
+		return err
+	}
+	s.sharedCache = client
+
+	hostname, _ := os.Hostname()
+	id := make([]byte, 4)
+	rand.Read(id)
+	s.sharedInstance = hostname + "-" + strconv.Itoa(os.Getpid()) + "-" + hex.EncodeToString(id)
+	s.log.Info("sharedCache | sharing prices through Redis", "addr", client.addr, "prefix", s.cfg.RedisKeyPrefix)
+	return nil
+}
+
+func (s *Server) sharedKey(name string) string {
+	return s.cfg.RedisKeyPrefix + name
+}
+
+// sharedFailed logs that Redis failed, once until it answers again.
+func (s *Server) sharedFailed(ctx context.Context, op string, err error) {
+	if !s.sharedDown.Swap(true) {
+		s.log.WarnContext(ctx, "sharedCache | Redis unavailable, falling back to the local cache", "op", op, "error", err)
+	}
+}
+
+func (s *Server) sharedRecovered(ctx context.Context) {
+	if s.sharedDown.Swap(false) {
+		s.log.InfoContext(ctx, "sharedCache | Redis available again")
+	}
+}
+
+// readShared returns the snapshot of the shared prices, nil when there is none or Redis fails.
+func (s *Server) readShared(ctx context.Context) map[string]snapshotEntry {
+	reply, err := s.sharedCache.do(ctx, "GET", s.sharedKey("snapshot"))
+	if err != nil {
+		s.sharedFailed(ctx, "read", err)
+		return nil
+	}
+	s.sharedRecovered(ctx)
+	data, ok := reply.(string)
+	if !ok {
+		return nil
+	}
+	var entries map[string]snapshotEntry
+	if err := json.Unmarshal([]byte(data), &entries); err != nil {
+		s.log.WarnContext(ctx, "sharedCache | malformed snapshot, ignoring it", "error", err)
+		return nil
+	}
+	return entries
+}
+
+// adoptShared caches the shared prices of markets which are more recent than the cached ones and not expired,
+// and returns them along with the markets left to fetch.
+func (s *Server) adoptShared(ctx context.Context, markets []Market) (map[string]float64, []Market) {
+	shared := s.readShared(ctx)
+	if len(shared) == 0 {
+		return nil, markets
+	}
+
+	entries := s.cache.Snapshot()
+	prices := make(map[string]float64)
+	var remaining []Market
+	for _, m := range markets {
+		entry, ok := shared[m.Symbol]
+		if !ok || s.now().Sub(entry.UpdatedAt) >= s.cfg.ttl(m) || !entry.UpdatedAt.After(entries[m.Symbol].UpdatedAt) {
+			remaining = append(remaining, m)
+			continue
+		}
+		s.cache.StoreShared(m.Symbol, entry.Ticker, entry.origin(), entry.UpdatedAt)
+		prices[m.Symbol] = entry.Ticker.Last
+	}
+	if len(prices) > 0 {
+		s.log.DebugContext(ctx, "sharedCache | prices fetched by another instance", "symbols", len(prices), "remaining", len(remaining))
+		s.priceUpdates.publish()
+	}
+	return prices, remaining
+}
+
+// writeShared writes the cached prices to the shared snapshot.
+func (s *Server) writeShared(ctx context.Context) {
+	data, err := json.Marshal(snapshotOf(s.cache.Snapshot()))
+	if err != nil {
+		s.log.ErrorContext(ctx, "sharedCache | encoding failed", "error", err)
+		return
+	}
+	if _, err := s.sharedCache.do(ctx, "SET", s.sharedKey("snapshot"), string(data)); err != nil {
+		s.sharedFailed(ctx, "write", err)
+		return
+	}
+	s.sharedRecovered(ctx)
+}
+
+// lockSharedRefresh takes the refresh lock for as long as a refresh may take, and reports whether it got it.
+// When Redis fails, every instance refreshes on its own.
+func (s *Server) lockSharedRefresh(ctx context.Context) bool {
+	ttl := time.Duration(s.cfg.UpstreamRetries+1) * s.cfg.UpstreamTimeout
+	reply, err := s.sharedCache.do(ctx, "SET", s.sharedKey("lock"), s.sharedInstance, "NX", "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		s.sharedFailed(ctx, "lock", err)
+		return true
+	}
+	s.sharedRecovered(ctx)
+	return reply == "OK"
+}
+
+func (s *Server) unlockSharedRefresh(ctx context.Context) {
+	if _, err := s.sharedCache.do(ctx, "EVAL", REDIS_UNLOCK_SCRIPT, "1", s.sharedKey("lock"), s.sharedInstance); err != nil {
+		s.sharedFailed(ctx, "unlock", err)
+	}
+}
+
+// refreshShared fetches the prices of markets once for all the instances: the prices shared recently are used as they are,
+// the instance holding the refresh lock fetches the other ones and shares them, and the other instances wait for them,
+// fetching the ones still missing once the lock expires.
+func (s *Server) refreshShared(ctx context.Context, markets []Market) (map[string]float64, error) {
+	prices, remaining := s.adoptShared(ctx, markets)
+	for len(remaining) > 0 && !s.lockSharedRefresh(ctx) {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(SHARED_REFRESH_POLL_INTERVAL):
+		}
+		var adopted map[string]float64
+		adopted, remaining = s.adoptShared(ctx, remaining)
+		if prices == nil {
+			prices = make(map[string]float64)
+		}
+		for symbol, price := range adopted {
+			prices[symbol] = price
+		}
+	}
+	if len(remaining) == 0 {
+		return prices, nil
+	}
+	defer s.unlockSharedRefresh(context.WithoutCancel(ctx))
+
+	fetched, err := s.refreshLocal(ctx, remaining)
+	if err != nil {
+		return nil, err
+	}
+	s.writeShared(ctx)
+	if prices == nil {
+		return fetched, nil
+	}
+	for symbol, price := range fetched {
+		prices[symbol] = price
+	}
+	return prices, nil
+}
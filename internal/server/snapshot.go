@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+	"github.com/wBanano/wban-prices-api/internal/provider"
+)
+
+const DEFAULT_SNAPSHOT_MAX_AGE = 24 * time.Hour
+
+// snapshotEntry is a cached price as fetched, in the snapshots shared through Redis or persisted to SNAPSHOT_FILE.
+type snapshotEntry struct {
+	Ticker      provider.Ticker `json:"ticker"`
+	Source      string          `json:"source"`
+	BelowQuorum bool            `json:"below_quorum,omitempty"`
+	UpdatedAt   time.Time       `json:"updated_at"`
+}
+
+// origin returns the origin of the cached price of e.
+func (e snapshotEntry) origin() cache.Origin {
+	return cache.Origin{Source: e.Source, BelowQuorum: e.BelowQuorum}
+}
+
+// snapshotOf returns the snapshot of the fetched prices of entries.
+func snapshotOf(entries map[string]cache.Entry) map[string]snapshotEntry {
+	snapshot := make(map[string]snapshotEntry, len(entries))
+	for symbol, entry := range entries {
+		if !entry.UpdatedAt.IsZero() {
+			snapshot[symbol] = snapshotEntry{Ticker: entry.Ticker, Source: entry.Origin.Source, BelowQuorum: entry.Origin.BelowQuorum, UpdatedAt: entry.UpdatedAt}
+		}
+	}
+	return snapshot
+}
+
+// persistSnapshot writes the cached prices to SNAPSHOT_FILE, through a temporary file renamed over it
+// so that a crash never leaves it half written.
+func (s *Server) persistSnapshot() {
+	if s.cfg.SnapshotFile == "" {
+		return
+	}
+	data, err := json.Marshal(snapshotOf(s.cache.Snapshot()))
+	if err != nil {
+		s.log.Error("snapshot | encoding failed", "error", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.cfg.SnapshotFile), "."+filepath.Base(s.cfg.SnapshotFile)+".*")
+	if err != nil {
+		s.log.Warn("snapshot | write failed", "path", s.cfg.SnapshotFile, "error", err)
+		return
+	}
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.cfg.SnapshotFile)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		s.log.Warn("snapshot | write failed", "path", s.cfg.SnapshotFile, "error", err)
+	}
+}
+
+// restoreSnapshot caches the prices of SNAPSHOT_FILE at startup, as stale prices: they are only served
+// when refreshing fails, as long as they aren't older than STALE_MAX_AGE, until they are fetched again.
+// Prices older than SNAPSHOT_MAX_AGE, and an unreadable file, are ignored.
+func (s *Server) restoreSnapshot() {
+	if s.cfg.SnapshotFile == "" {
+		return
+	}
+	data, err := os.ReadFile(s.cfg.SnapshotFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		s.log.Warn("snapshot | read failed, ignoring it", "path", s.cfg.SnapshotFile, "error", err)
+		return
+	}
+	var snapshot map[string]snapshotEntry
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		s.log.Warn("snapshot | corrupt file, ignoring it", "path", s.cfg.SnapshotFile, "error", err)
+		return
+	}
+
+	restored, ancient := 0, 0
+	for _, m := range s.cfg.markets() {
+		entry, ok := snapshot[m.Symbol]
+		if !ok || entry.UpdatedAt.IsZero() {
+			continue
+		}
+		if s.now().Sub(entry.UpdatedAt) >= s.cfg.SnapshotMaxAge {
+			ancient++
+			continue
+		}
+		s.cache.Restore(m.Symbol, entry.Ticker, entry.origin(), entry.UpdatedAt)
+		restored++
+	}
+	if ancient > 0 {
+		s.log.Warn("snapshot | prices too old, ignoring them", "path", s.cfg.SnapshotFile, "symbols", ancient, "max_age", s.cfg.SnapshotMaxAge)
+	}
+	s.log.Info("snapshot | prices restored", "path", s.cfg.SnapshotFile, "symbols", restored)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Prefix of the listen addresses which are Unix domain socket paths.
+const UNIX_SOCKET_PREFIX = "unix:"
+
+// Permissions of the Unix domain socket, letting a reverse proxy of the same group connect.
+const DEFAULT_SOCKET_MODE = "0660"
+
+// listen listens on a TCP address, or on the Unix domain socket of an unix:/path address.
+// A stale socket file left by a previous run is replaced, and removed again once the listener is closed.
+func (s *Server) listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, UNIX_SOCKET_PREFIX)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+
+	if _, err := os.Stat(filepath.Dir(path)); err != nil {
+		return nil, fmt.Errorf("socket directory: %w", err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, s.cfg.socketMode); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket file at path, unless a server still accepts connections on it.
+// Other kinds of files are never removed.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	return os.Remove(path)
+}
+
+// listenerURL returns the URL of listener for the logs.
+func listenerURL(scheme string, listener net.Listener) string {
+	if listener.Addr().Network() == "unix" {
+		return UNIX_SOCKET_PREFIX + listener.Addr().String()
+	}
+	return scheme + "://" + listener.Addr().String()
+}
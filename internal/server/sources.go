@@ -0,0 +1,182 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/wBanano/wban-prices-api/internal/cache"
+	"github.com/wBanano/wban-prices-api/internal/provider"
+	"github.com/wBanano/wban-prices-api/internal/provider/binance"
+	"github.com/wBanano/wban-prices-api/internal/provider/coinex"
+	"github.com/wBanano/wban-prices-api/internal/provider/coingecko"
+	"github.com/wBanano/wban-prices-api/internal/provider/dex"
+	"github.com/wBanano/wban-prices-api/internal/provider/kraken"
+)
+
+// Price sources, tried in the order of PRICE_SOURCES for every market.
+const (
+	SOURCE_COINEX    = coinex.NAME
+	SOURCE_BINANCE   = binance.NAME
+	SOURCE_COINGECKO = coingecko.NAME
+	SOURCE_KRAKEN    = kraken.NAME
+
+	DEFAULT_PRICE_SOURCES = SOURCE_COINEX + "," + SOURCE_BINANCE + "," + SOURCE_COINGECKO
+)
+
+// Kraken is left out of the default order, the markets trusting it more select it with their own sources.
+var knownSources = []string{SOURCE_COINEX, SOURCE_BINANCE, SOURCE_COINGECKO, SOURCE_KRAKEN}
+
+// setupProviders creates the providers from the configuration.
+func (s *Server) setupProviders() {
+	s.providers = map[string]provider.PriceProvider{
+		SOURCE_COINEX: s.newCoinexClient(s.cfg.CoinexAPIURL, s.upstreamClient),
+		SOURCE_BINANCE: binance.New(binance.DEFAULT_API_URL, s.upstreamClient, binance.Options{
+			Log: s.log, Tracer: s.tracer, NewRequest: s.newUpstreamRequest,
+		}),
+		SOURCE_COINGECKO: coingecko.New(coingecko.DEFAULT_API_URL, s.upstreamClient, coingecko.Options{
+			APIKey: s.cfg.CoinGeckoAPIKey, Coins: s.cfg.coingeckoCoins,
+			Log: s.log, Tracer: s.tracer, NewRequest: s.newUpstreamRequest,
+		}),
+		SOURCE_KRAKEN: kraken.New(kraken.DEFAULT_API_URL, s.upstreamClient, kraken.Options{
+			Log: s.log, Tracer: s.tracer, NewRequest: s.newUpstreamRequest,
+		}),
+		SOURCE_DEX: dex.New(s.upstreamClient, dex.Options{
+			FindPool: s.cfg.findPool, RPCURL: s.cfg.rpcURL, QuotePrice: s.pairedTokenPrice,
+			Log: s.log, Tracer: s.tracer, NewRequest: s.newUpstreamRequest,
+		}),
+	}
+}
+
+// coingeckoCoins returns the CoinGecko coins of the refreshed markets, fetched all at once.
+func (cfg *Config) coingeckoCoins() []string {
+	var coins []string
+	for _, m := range cfg.refreshedMarkets() {
+		if m.CoinGecko != "" {
+			coins = append(coins, m.CoinGecko)
+		}
+	}
+	return coins
+}
+
+// parseSources returns the comma separated price sources of list, in order.
+func parseSources(list string) ([]string, error) {
+	var sources []string
+	seen := make(map[string]bool)
+	for _, source := range strings.Split(list, ",") {
+		source = strings.ToLower(strings.TrimSpace(source))
+		if !slices.Contains(knownSources, source) {
+			return nil, fmt.Errorf("unknown price source %q, expected one of %s", source, strings.Join(knownSources, ", "))
+		}
+		if seen[source] {
+			return nil, fmt.Errorf("duplicate price source %q", source)
+		}
+		seen[source] = true
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// listedOn returns the symbol of m on source, empty if source doesn't list it.
+func (m Market) listedOn(source string) string {
+	switch source {
+	case SOURCE_COINEX:
+		return m.Market
+	case SOURCE_BINANCE:
+		return m.Binance
+	case SOURCE_COINGECKO:
+		return m.CoinGecko
+	case SOURCE_KRAKEN:
+		return m.Kraken
+	case SOURCE_DEX:
+		if m.onChain() {
+			return m.DEX.Pool
+		}
+	}
+	return ""
+}
+
+// sourcesOf returns the price sources of m in the order they are tried, its own ones if it has any.
+func (cfg *Config) sourcesOf(m Market) []string {
+	if m.onChain() {
+		return []string{SOURCE_DEX}
+	}
+	if len(m.Sources) > 0 {
+		return m.Sources
+	}
+	return cfg.sources
+}
+
+// primarySource returns the first price source listing m.
+func (cfg *Config) primarySource(m Market) string {
+	for _, source := range cfg.sourcesOf(m) {
+		if m.listedOn(source) != "" {
+			return source
+		}
+	}
+	return ""
+}
+
+// fetchTicker fetches the ticker of m as configured by AGGREGATION, and returns where it comes from.
+// The on-chain markets have a single source, there is nothing to aggregate.
+func (s *Server) fetchTicker(ctx context.Context, m Market) (provider.Ticker, cache.Origin, error) {
+	if s.cfg.Aggregation == AGGREGATION_MEDIAN && !m.onChain() {
+		return s.fetchMedian(ctx, m)
+	}
+	ticker, source, err := s.fetchFirst(ctx, m)
+	return ticker, cache.Origin{Source: source}, err
+}
+
+// fetchFrom fetches the ticker of symbol from source, accounting for it in the health of source.
+func (s *Server) fetchFrom(ctx context.Context, source, symbol string) (provider.Ticker, error) {
+	p := s.providers[source]
+	start := s.now()
+	tickers, err := p.Fetch(ctx, []string{symbol})
+	s.recordFetch(source, s.now().Sub(start), err)
+	if err != nil {
+		return provider.Ticker{}, err
+	}
+	ticker, ok := tickers[symbol]
+	if !ok {
+		return provider.Ticker{}, fmt.Errorf("%s has no price for %s", p.Name(), symbol)
+	}
+	return ticker, nil
+}
+
+// fetchFirst fetches the ticker of m from the first source listing it which answers, the healthy sources first,
+// and returns which one it is. The error of the first failed source is returned when all of them fail.
+func (s *Server) fetchFirst(ctx context.Context, m Market) (provider.Ticker, string, error) {
+	var firstErr error
+	for _, source := range s.orderByHealth(s.cfg.sourcesOf(m)) {
+		symbol := m.listedOn(source)
+		if symbol == "" {
+			continue
+		}
+
+		ticker, err := s.fetchFrom(ctx, source, symbol)
+		if err == nil {
+			if firstErr != nil {
+				s.log.WarnContext(ctx, "fetchTicker | fell back to another price source", "symbol", m.Symbol, "source", source, "error", firstErr)
+			}
+			return ticker, source, nil
+		}
+		if ctx.Err() != nil {
+			return provider.Ticker{}, "", err
+		}
+		if firstErr == nil {
+			firstErr = err
+		} else {
+			s.log.WarnContext(ctx, "fetchTicker | fallback price source failed", "symbol", m.Symbol, "source", source, "error", err)
+		}
+	}
+
+	if firstErr == nil {
+		firstErr = s.errNotListed(m)
+	}
+	return provider.Ticker{}, "", firstErr
+}
+
+func (s *Server) errNotListed(m Market) error {
+	return fmt.Errorf("%s is listed on none of the price sources %s", m.Symbol, strings.Join(s.cfg.sourcesOf(m), ","))
+}
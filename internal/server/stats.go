@@ -0,0 +1,139 @@
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/provider/coinex"
+)
+
+// Counters of /stats, reset only on restart.
+var (
+	requestsTotal      atomic.Int64
+	cacheHits          atomic.Int64
+	cacheMisses        atomic.Int64
+	suppressedFetches  atomic.Int64 // Lookups not fetching the markets which just failed.
+	upstreamFetches    atomic.Int64
+	upstreamFailures   atomic.Int64
+	upstreamFetchNanos atomic.Int64 // Total duration of upstream fetches.
+	panics             atomic.Int64
+	shed               atomic.Int64 // Requests shed by the concurrency limits.
+
+	// Requests being processed, streams and long polls excluded.
+	inFlight atomic.Int64
+
+	// Currently connected WebSocket clients.
+	wsClients atomic.Int64
+)
+
+// breakerReporter is a price source reporting the state of its circuit breakers.
+type breakerReporter interface {
+	BreakerStats() map[string]coinex.BreakerStats
+}
+
+// limiterReporter is a price source reporting the state of its rate limiter.
+type limiterReporter interface {
+	LimiterStats() *coinex.LimiterStats
+}
+
+type statsResponse struct {
+	Uptime        string                         `json:"uptime"`
+	RequestsTotal int64                          `json:"requests_total"`
+	WSClients     int64                          `json:"websocket_clients"`
+	Panics        int64                          `json:"panics"`
+	InFlight      int64                          `json:"in_flight"`
+	Shed          int64                          `json:"shed"`
+	Cache         cacheStats                     `json:"cache"`
+	Upstream      upstreamStats                  `json:"upstream"`
+	Symbols       map[string]symbolStats         `json:"symbols"`
+	Breakers      map[string]coinex.BreakerStats `json:"breakers,omitempty"`
+	APIKeys       map[string]int64               `json:"api_keys,omitempty"`  // Requests by API key name.
+	Reload        *reloadStatus                  `json:"reload,omitempty"`    // Outcome of the last SIGHUP.
+	Providers     map[string]providerStats       `json:"providers,omitempty"` // Health of the price sources.
+	CoinexLimiter *coinex.LimiterStats           `json:"coinex_limiter,omitempty"`
+	FetchPool     *poolStats                     `json:"fetch_pool,omitempty"` // Markets being fetched, bounded by FETCH_CONCURRENCY.
+}
+
+type cacheStats struct {
+	Hits       int64 `json:"hits"`
+	Misses     int64 `json:"misses"`
+	Coalesced  int64 `json:"coalesced"`
+	Suppressed int64 `json:"suppressed"`
+}
+
+type upstreamStats struct {
+	Fetches      int64   `json:"fetches"`
+	Failures     int64   `json:"failures"`
+	AvgFetchTime float64 `json:"avg_fetch_ms"`
+}
+
+type symbolStats struct {
+	Price       *float64   `json:"price,omitempty"`
+	LastRefresh *time.Time `json:"last_refresh,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	Source      string     `json:"source,omitempty"`  // Price source of the cached price.
+	Suspect     bool       `json:"suspect,omitempty"` // The last fetched prices were rejected as implausible.
+}
+
+// recordUpstreamFetch accounts for an upstream fetch attempt in the stats.
+func recordUpstreamFetch(duration time.Duration, err error) {
+	upstreamFetches.Add(1)
+	upstreamFetchNanos.Add(int64(duration))
+	if err != nil {
+		upstreamFailures.Add(1)
+	}
+}
+
+func (s *Server) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := statsResponse{
+		Uptime:        s.now().Sub(s.startTime).Round(time.Second).String(),
+		RequestsTotal: requestsTotal.Load(),
+		WSClients:     wsClients.Load(),
+		Panics:        panics.Load(),
+		InFlight:      inFlight.Load(),
+		Shed:          shed.Load(),
+		Cache: cacheStats{
+			Hits:       cacheHits.Load(),
+			Misses:     cacheMisses.Load(),
+			Coalesced:  s.marketFlights.coalesced.Load() + s.batchFlights.coalesced.Load(),
+			Suppressed: suppressedFetches.Load(),
+		},
+		Upstream: upstreamStats{
+			Fetches:  upstreamFetches.Load(),
+			Failures: upstreamFailures.Load(),
+		},
+		Symbols:   make(map[string]symbolStats),
+		APIKeys:   s.apiKeyRequestsSnapshot(),
+		Reload:    s.lastReloadStatus(),
+		Providers: s.healthSnapshot(),
+		FetchPool: s.fetchPoolStats(),
+	}
+	if p, ok := s.providers[SOURCE_COINEX].(breakerReporter); ok {
+		stats.Breakers = p.BreakerStats()
+	}
+	if p, ok := s.providers[SOURCE_COINEX].(limiterReporter); ok {
+		stats.CoinexLimiter = p.LimiterStats()
+	}
+	if stats.Upstream.Fetches > 0 {
+		stats.Upstream.AvgFetchTime = float64(upstreamFetchNanos.Load()) / float64(stats.Upstream.Fetches) / float64(time.Millisecond)
+	}
+
+	entries := s.cache.Snapshot()
+	for _, m := range s.cfg.markets() {
+		var symbol symbolStats
+		if entry, ok := entries[m.Symbol]; ok {
+			if !entry.UpdatedAt.IsZero() {
+				price, updatedAt := entry.Price(), entry.UpdatedAt
+				symbol.Price, symbol.LastRefresh, symbol.Source = &price, &updatedAt, entry.Origin.Source
+			}
+			if entry.Err != nil {
+				symbol.LastError = entry.Err.Error()
+			}
+			symbol.Suspect = entry.Outliers > 0
+		}
+		stats.Symbols[m.Symbol] = symbol
+	}
+
+	s.writeJSON(w, http.StatusOK, stats)
+}
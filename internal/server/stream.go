@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Interval of the comments keeping idle streams open through proxies.
+const SSE_KEEPALIVE_INTERVAL = 15 * time.Second
+
+// priceHub notifies its subscribers whenever prices are refreshed.
+// Each subscriber has a single pending notification, so that a slow one never blocks the cache
+// and gets the latest prices once it catches up.
+type priceHub struct {
+	mu          sync.Mutex
+	subscribers map[chan struct{}]struct{}
+}
+
+func (h *priceHub) subscribe() chan struct{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscribers == nil {
+		h.subscribers = make(map[chan struct{}]struct{})
+	}
+	ch := make(chan struct{}, 1)
+	h.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (h *priceHub) unsubscribe(ch chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.subscribers, ch)
+}
+
+// publish notifies every subscriber of a refresh without waiting for them.
+func (h *priceHub) publish() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default: // Already notified, the update will be picked up along with the pending one.
+		}
+	}
+}
+
+// count returns the number of subscribers.
+func (h *priceHub) count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.subscribers)
+}
+
+// streamHandler pushes the prices as Server-Sent Events, on connect and whenever they are refreshed.
+func (s *Server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	// Only stream the requested symbols, if any.
+	markets := s.selectMarkets(r.URL.Query().Get("symbols"))
+	if len(markets) == 0 {
+		s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: "no supported symbol requested", Symbols: s.marketSymbols()})
+		return
+	}
+
+	// Subscribe before the initial lookup so that no refresh is missed in between.
+	updates := s.priceUpdates.subscribe()
+	defer s.priceUpdates.unsubscribe(updates)
+
+	prices, _, _, err := s.lookupPrices(r.Context(), markets)
+	if err != nil {
+		s.writeLookupError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no") // Disable response buffering by nginx.
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	s.log.InfoContext(r.Context(), "streamHandler | client connected", "subscribers", s.priceUpdates.count())
+	defer s.log.InfoContext(r.Context(), "streamHandler | client disconnected")
+
+	rc := http.NewResponseController(w)
+	send := func(event string) bool {
+		// Streams never end, but every event must be written in time.
+		s.extendWriteDeadline(w, 0)
+		if _, err := fmt.Fprint(w, event); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	if !send(s.priceEvent(prices)) {
+		return
+	}
+
+	keepAlive := time.NewTicker(SSE_KEEPALIVE_INTERVAL)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-s.shutdownCtx.Done():
+			return
+		case <-updates:
+			prices, _, _ := s.pricesFromCache(s.cache.Snapshot(), markets)
+			if !send(s.priceEvent(prices)) {
+				return
+			}
+		case <-keepAlive.C:
+			if !send(": keep-alive\n\n") {
+				return
+			}
+		}
+	}
+}
+
+// priceEvent formats prices as an SSE data event.
+func (s *Server) priceEvent(prices map[string]float64) string {
+	data, err := json.Marshal(prices)
+	if err != nil {
+		s.log.Error("priceEvent | encoding failed", "error", err)
+		return ""
+	}
+	return "data: " + string(data) + "\n\n"
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	DEFAULT_AUTOCERT_CACHE_DIR = "autocert"
+
+	// Address of the plain HTTP listener in autocert mode, where Let's Encrypt sends its HTTP-01 challenges.
+	DEFAULT_AUTOCERT_HTTP_ADDR = ":80"
+)
+
+// setupTLS returns the TLS configuration of the server, nil to serve plain HTTP,
+// along with the handler of the plain HTTP listener if one is needed, redirecting to HTTPS.
+// In autocert mode, that handler answers the ACME HTTP-01 challenges too.
+func (s *Server) setupTLS() (*tls.Config, http.Handler, error) {
+	redirect := http.HandlerFunc(s.redirectToHTTPS)
+
+	if s.cfg.AutocertDomains != "" {
+		var domains []string
+		for _, domain := range strings.Split(s.cfg.AutocertDomains, ",") {
+			if domain = strings.TrimSpace(domain); domain != "" {
+				domains = append(domains, domain)
+			}
+		}
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(s.cfg.AutocertCacheDir),
+		}
+		return manager.TLSConfig(), manager.HTTPHandler(redirect), nil
+	}
+
+	if s.cfg.TLSCertFile == "" {
+		return nil, nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(s.cfg.TLSCertFile, s.cfg.TLSKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if s.cfg.HTTPAddr == "" {
+		return tlsConfig, nil, nil
+	}
+	return tlsConfig, redirect, nil
+}
+
+// redirectToHTTPS redirects plain HTTP requests to the same URL on the HTTPS listener.
+func (s *Server) redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if _, port, err := net.SplitHostPort(s.cfg.ListenAddr); err == nil && port != "443" {
+		host = net.JoinHostPort(host, port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+}
+
+// httpAddr returns the address of the plain HTTP listener, when TLS is served.
+func (cfg *Config) httpAddr() string {
+	if cfg.HTTPAddr == "" && cfg.AutocertDomains != "" {
+		return DEFAULT_AUTOCERT_HTTP_ADDR
+	}
+	return cfg.HTTPAddr
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/wBanano/wban-prices-api/internal/tracing"
+)
+
+const DEFAULT_OTEL_SERVICE_NAME = "wban-prices-api"
+
+// traceRequests traces a server span per request handled by next, continuing the trace of an incoming traceparent.
+// Requests whose caller didn't sample its trace aren't traced either.
+func (s *Server) traceRequests(mux *http.ServeMux, next http.Handler) http.Handler {
+	if s.tracer == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, sampled, ok := tracing.ParseTraceparent(r.Header.Get("traceparent")); ok {
+			if !sampled {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ctx = tracing.ContextWith(ctx, parent)
+		}
+
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+		ctx, span := s.tracer.Start(ctx, r.Method+" "+pattern, tracing.KindServer)
+		span.SetString("http.request.method", r.Method)
+		span.SetString("http.route", pattern)
+		span.SetString("url.path", r.URL.Path)
+		span.SetString("request_id", requestID(ctx))
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		span.SetInt("http.response.status_code", recorder.status)
+		var err error
+		if recorder.status >= http.StatusInternalServerError {
+			err = fmt.Errorf("%d %s", recorder.status, http.StatusText(recorder.status))
+		}
+		span.Finish(err)
+	})
+}
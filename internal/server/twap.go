@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const DEFAULT_TWAP_MAX_WINDOW = 24 * time.Hour
+const DEFAULT_TWAP_WINDOW = 15 * time.Minute
+
+// twapResponse is the JSON body of /twap.
+type twapResponse struct {
+	Symbol  string    `json:"symbol"`
+	TWAP    float64   `json:"twap"`
+	Window  string    `json:"window"`
+	Span    string    `json:"span"` // Time actually covered by the history.
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Samples int       `json:"samples"`
+	Partial bool      `json:"partial"` // The history doesn't reach back to the start of the window.
+}
+
+// historyWindow returns the recorded prices of symbol since t, oldest first, preceded by the last one before t if any:
+// the price at t. They come from the history database if there is one, or from memory when there isn't or it fails.
+func (s *Server) historyWindow(ctx context.Context, symbol string, t time.Time) (points []pricePoint, fromStart bool) {
+	if s.historyDB != nil {
+		points, fromStart, err := s.queryHistory(ctx, symbol, t, true)
+		if err == nil {
+			if len(points) == 0 {
+				return nil, false
+			}
+			return points, fromStart
+		}
+		s.log.WarnContext(ctx, "historyWindow | history database failed, reading the memory history", "symbol", symbol, "error", err)
+	}
+	return s.memoryHistoryWindow(symbol, t)
+}
+
+// memoryHistoryWindow is historyWindow reading the memory history.
+func (s *Server) memoryHistoryWindow(symbol string, t time.Time) (points []pricePoint, fromStart bool) {
+	s.historyMutex.Lock()
+	defer s.historyMutex.Unlock()
+
+	b := s.priceHistory[symbol]
+	if b == nil {
+		return nil, false
+	}
+	for _, p := range b.ordered() {
+		if p.T < t.Unix() {
+			points, fromStart = append(points[:0], p), true
+			continue
+		}
+		points = append(points, p)
+	}
+	return points, fromStart
+}
+
+// timeWeightedAverage returns the average of points weighted by how long each price held, from start until end.
+// Before the first point, there is no price to weigh.
+func timeWeightedAverage(points []pricePoint, start, end int64) (twap float64, from int64) {
+	from = max(points[0].T, start)
+	if end <= from {
+		return points[len(points)-1].Price, from
+	}
+
+	var sum float64
+	for i, p := range points {
+		holdFrom, holdUntil := max(p.T, start), end
+		if i+1 < len(points) {
+			holdUntil = points[i+1].T
+		}
+		if holdUntil > holdFrom {
+			sum += p.Price * float64(holdUntil-holdFrom)
+		}
+	}
+	return sum / float64(end-from), from
+}
+
+// twapHandler serves the time-weighted average price of a symbol over the last window, as recorded in its history.
+func (s *Server) twapHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	symbol := query.Get("symbol")
+	m, ok := s.cfg.findMarket(symbol)
+	if !ok {
+		s.writeJSONError(w, r, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("unknown symbol %q", symbol), Symbols: s.marketSymbols()})
+		return
+	}
+
+	window := DEFAULT_TWAP_WINDOW
+	if value := query.Get("window"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 || parsed > s.cfg.TWAPMaxWindow {
+			s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: fmt.Sprintf("window must be a positive duration like 15m, up to %s", s.cfg.TWAPMaxWindow)})
+			return
+		}
+		window = parsed
+	}
+
+	now := s.now()
+	start := now.Add(-window)
+	points, fromStart := s.historyWindow(r.Context(), m.Symbol, start)
+	if len(points) == 0 {
+		s.writeJSONError(w, r, http.StatusNotFound, errorResponse{Error: fmt.Sprintf("no recorded prices of %s", m.Symbol)})
+		return
+	}
+
+	twap, from := timeWeightedAverage(points, start.Unix(), now.Unix())
+	s.writeJSON(w, http.StatusOK, twapResponse{
+		Symbol:  m.Symbol,
+		TWAP:    twap,
+		Window:  window.String(),
+		Span:    (time.Duration(now.Unix()-from) * time.Second).String(),
+		From:    time.Unix(from, 0).UTC(),
+		To:      now.UTC().Truncate(time.Second),
+		Samples: len(points),
+		Partial: !fromStart,
+	})
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/wBanano/wban-prices-api/internal/tracing"
+)
+
+const (
+	DEFAULT_UPSTREAM_MAX_IDLE_CONNS_PER_HOST = 8
+	DEFAULT_UPSTREAM_IDLE_CONN_TIMEOUT       = 90 * time.Second
+	DEFAULT_UPSTREAM_TLS_HANDSHAKE_TIMEOUT   = 5 * time.Second
+
+	// Followed by the version in the default User-Agent of the upstream requests.
+	USER_AGENT_PRODUCT = "wban-prices-api"
+	USER_AGENT_URL     = "https://bananobridge.org"
+
+	// Beginning of the upstream error bodies kept in the logs.
+	ERROR_BODY_LOG_SIZE = 200
+)
+
+// defaultUserAgent identifies the build to the price sources.
+func defaultUserAgent(info BuildInfo) string {
+	return USER_AGENT_PRODUCT + "/" + info.Version + " (+" + USER_AGENT_URL + ")"
+}
+
+// configureUpstreamClient sets the timeout, the connection pool and the proxy of upstreamClient from the configuration.
+// UPSTREAM_PROXY_URL overrides the proxy of the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+func (s *Server) configureUpstreamClient() {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = s.cfg.UpstreamMaxIdleConnsPerHost
+	transport.IdleConnTimeout = s.cfg.UpstreamIdleConnTimeout
+	transport.TLSHandshakeTimeout = s.cfg.UpstreamTLSHandshakeTimeout
+	transport.ForceAttemptHTTP2 = true
+
+	transport.Proxy = http.ProxyFromEnvironment
+	if s.cfg.upstreamProxy != nil {
+		transport.Proxy = http.ProxyURL(s.cfg.upstreamProxy)
+		s.log.Info("upstream | proxy in effect", "proxy", s.cfg.upstreamProxy.Redacted(), "from", "UPSTREAM_PROXY_URL")
+	} else if proxy := proxyOf(transport, s.cfg.CoinexAPIURL); proxy != nil {
+		s.log.Info("upstream | proxy in effect for CoinEx", "proxy", proxy.Redacted(), "from", "environment")
+	} else {
+		s.log.Info("upstream | no proxy in effect")
+	}
+
+	s.upstreamClient.Timeout = s.cfg.UpstreamTimeout
+	s.upstreamClient.Transport = upstreamTransport{transport, s.log}
+}
+
+// newUpstreamRequest builds a request to a price source, identified by UPSTREAM_USER_AGENT and continuing the trace of ctx.
+func (s *Server) newUpstreamRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", s.cfg.UpstreamUserAgent)
+	if span := tracing.FromContext(ctx); span != nil {
+		req.Header.Set("traceparent", span.Traceparent())
+	}
+	return req, nil
+}
+
+// proxyOf returns the proxy transport uses for the requests to rawURL, nil if they connect directly.
+func proxyOf(transport *http.Transport, rawURL string) *url.URL {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil
+	}
+	proxy, err := transport.Proxy(req)
+	if err != nil {
+		return nil
+	}
+	return proxy
+}
+
+// proxyError is returned when an upstream request through a proxy fails, the proxy possibly being the one failing.
+type proxyError struct {
+	Proxy string // Without password.
+	Err   error
+}
+
+func (e *proxyError) Error() string { return fmt.Sprintf("via proxy %s: %v", e.Proxy, e.Err) }
+func (e *proxyError) Unwrap() error { return e.Err }
+
+// upstreamTransport counts the upstream connections by whether they were reused from the pool,
+// to confirm the upstreams keep them alive, and names the proxy of the requests failing through one.
+type upstreamTransport struct {
+	*http.Transport
+	log *slog.Logger
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			upstreamConnectionsTotal.inc(host, strconv.FormatBool(info.Reused))
+			t.log.DebugContext(req.Context(), "upstream | got connection", "host", host, "reused", info.Reused, "idle", info.IdleTime)
+		},
+	}
+	resp, err := t.Transport.RoundTrip(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+	if err != nil {
+		if proxy, proxyErr := t.Proxy(req); proxyErr == nil && proxy != nil {
+			return nil, &proxyError{Proxy: proxy.Redacted(), Err: err}
+		}
+	}
+	return resp, err
+}
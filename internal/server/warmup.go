@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	DEFAULT_WARMUP_RETRIES = 3
+	DEFAULT_WARMUP_FAILURE = WARMUP_SERVE
+
+	// The delay between the warmup attempts doubles from the first one.
+	WARMUP_RETRY_DELAY = time.Second
+)
+
+// Warmup failures: the server either starts anyway, /ready and the requests failing until the prices are fetched, or exits.
+const (
+	WARMUP_SERVE = "serve"
+	WARMUP_EXIT  = "exit"
+)
+
+var errWarmupFailed = errors.New("prices couldn't be fetched at startup")
+
+// warmup fetches the prices of the refreshed markets into the cache, retrying WARMUP_RETRIES times,
+// and reports whether it succeeded. SIGINT and SIGTERM interrupt it.
+func (s *Server) warmup(ctx context.Context) bool {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	start := s.now()
+	markets := s.cfg.refreshedMarkets()
+	for attempt := 0; ; attempt++ {
+		_, err := s.refreshPrices(ctx, markets)
+		if err == nil {
+			s.log.Info("warmup | prices cached", "markets", len(markets), "duration", s.now().Sub(start).Round(time.Millisecond))
+			return true
+		}
+		if ctx.Err() != nil {
+			s.log.Warn("warmup | interrupted")
+			return false
+		}
+		if attempt == s.cfg.WarmupRetries {
+			s.log.Error("warmup | failed, giving up", "attempts", attempt+1, "failure", s.cfg.WarmupFailure, "error", err)
+			return false
+		}
+
+		delay := WARMUP_RETRY_DELAY << attempt
+		s.log.Warn("warmup | failed, retrying", "attempt", attempt+1, "delay", delay, "error", err)
+		select {
+		case <-ctx.Done():
+			s.log.Warn("warmup | interrupted")
+			return false
+		case <-time.After(delay):
+		}
+	}
+}
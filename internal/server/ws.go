@@ -0,0 +1,399 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	crand "crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEFAULT_WS_HEARTBEAT = 30 * time.Second
+
+	// How long a client may take to accept a message before being dropped as too slow.
+	WS_WRITE_TIMEOUT = 10 * time.Second
+
+	// Largest message accepted from clients, which have nothing to send but control frames anyway.
+	WS_MAX_MESSAGE_SIZE = 4096
+
+	// Appended to the key of the client to compute Sec-WebSocket-Accept, see RFC 6455.
+	WS_ACCEPT_GUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// WebSocket opcodes.
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xA
+)
+
+// WebSocket close codes.
+const (
+	wsCloseNormal      = 1000
+	wsCloseGoingAway   = 1001
+	wsCloseProtocol    = 1002
+	wsCloseMessageSize = 1009
+)
+
+var (
+	errWSClosed   = errors.New("websocket closed by the peer")
+	errWSShutdown = errors.New("server shutting down")
+)
+
+// wsConn is a WebSocket connection. Writes are serialized, reads are done by a single goroutine.
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	client  bool // Clients mask their frames, servers don't.
+	maxSize uint64
+
+	mu sync.Mutex // Guards writes.
+}
+
+// wsHandler pushes the prices as WebSocket messages, on connect, whenever they are refreshed and on every heartbeat.
+func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
+	markets := s.selectMarkets(r.URL.Query().Get("symbols"))
+	if len(markets) == 0 {
+		s.writeJSONError(w, r, http.StatusBadRequest, errorResponse{Error: "no supported symbol requested", Symbols: s.marketSymbols()})
+		return
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") || key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusBadRequest)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return
+	}
+
+	// Subscribe before the initial lookup so that no refresh is missed in between.
+	updates := s.priceUpdates.subscribe()
+	defer s.priceUpdates.unsubscribe(updates)
+
+	prices, _, _, err := s.lookupPrices(r.Context(), markets)
+	if err != nil {
+		s.writeLookupError(w, r, err)
+		return
+	}
+
+	ws, err := upgradeWebSocket(w, key)
+	if err != nil {
+		s.log.ErrorContext(r.Context(), "wsHandler | upgrade failed", "error", err)
+		return
+	}
+	defer ws.conn.Close()
+
+	clients := wsClients.Add(1)
+	wsClientsGauge.set(float64(clients))
+	s.log.InfoContext(r.Context(), "wsHandler | client connected", "remote", r.RemoteAddr, "clients", clients)
+	defer func() {
+		wsClientsGauge.set(float64(wsClients.Add(-1)))
+	}()
+
+	// Dead connections are reaped when they miss two heartbeats.
+	readTimeout := 2 * s.cfg.WSHeartbeat
+	ws.conn.SetReadDeadline(time.Now().Add(readTimeout))
+	done := make(chan error, 1)
+	go func() { done <- ws.readLoop(readTimeout) }()
+
+	heartbeat := time.NewTicker(s.cfg.WSHeartbeat)
+	defer heartbeat.Stop()
+
+	err = ws.writeJSON(prices)
+	for err == nil {
+		select {
+		case err = <-done:
+		case <-s.shutdownCtx.Done():
+			ws.writeClose(wsCloseGoingAway)
+			err = errWSShutdown
+		case <-updates:
+			prices, _, _ := s.pricesFromCache(s.cache.Snapshot(), markets)
+			err = ws.writeJSON(prices)
+		case <-heartbeat.C:
+			prices, _, _ := s.pricesFromCache(s.cache.Snapshot(), markets)
+			if err = ws.writeJSON(prices); err == nil {
+				err = ws.writeFrame(wsOpPing, nil)
+			}
+		}
+	}
+
+	if errors.Is(err, errWSClosed) {
+		s.log.InfoContext(r.Context(), "wsHandler | client disconnected", "remote", r.RemoteAddr)
+	} else {
+		s.log.WarnContext(r.Context(), "wsHandler | dropping client", "remote", r.RemoteAddr, "error", err)
+	}
+}
+
+// headerHasToken reports whether the comma separated values of the header contain token, case-insensitively.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket takes over the connection of w and completes the opening handshake.
+func upgradeWebSocket(w http.ResponseWriter, key string) (*wsConn, error) {
+	conn, rw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", wsAcceptKey(key))
+	conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: rw.Reader, maxSize: WS_MAX_MESSAGE_SIZE}, nil
+}
+
+// dialWebSocket connects to the ws:// or wss:// URL and completes the opening handshake.
+// Messages up to maxSize bytes are accepted from the server.
+func (s *Server) dialWebSocket(ctx context.Context, rawURL string, maxSize uint64) (*wsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), map[string]string{"ws": "80", "wss": "443"}[u.Scheme])
+	}
+
+	dialer := &net.Dialer{Timeout: s.cfg.UpstreamTimeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	case "wss":
+		conn, err = (&tls.Dialer{NetDialer: dialer}).DialContext(ctx, "tcp", addr)
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var nonce [16]byte
+	crand.Read(nonce[:])
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+
+	conn.SetDeadline(time.Now().Add(s.cfg.UpstreamTimeout))
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nUser-Agent: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n", u.RequestURI(), u.Host, s.cfg.UpstreamUserAgent, key)
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("websocket handshake failed with status %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != wsAcceptKey(key) {
+		conn.Close()
+		return nil, errors.New("websocket handshake failed with an invalid accept key")
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &wsConn{conn: conn, reader: reader, client: true, maxSize: maxSize}, nil
+}
+
+// wsAcceptKey returns the Sec-WebSocket-Accept value answering key.
+func wsAcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + WS_ACCEPT_GUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// writeJSON sends v as a text message.
+func (c *wsConn) writeJSON(v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(wsOpText, data)
+}
+
+// writeFrame sends a single frame, failing if the peer doesn't accept it in time.
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	maskBit := byte(0)
+	if c.client {
+		maskBit = 0x80
+	}
+	header := []byte{0x80 | opcode, maskBit}
+	switch n := len(payload); {
+	case n < 126:
+		header[1] |= byte(n)
+	case n <= 0xFFFF:
+		header[1] |= 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] |= 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		crand.Read(mask[:])
+		header = append(header, mask[:]...)
+		masked := make([]byte, len(payload))
+		for i, b := range payload {
+			masked[i] = b ^ mask[i%4]
+		}
+		payload = masked
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(WS_WRITE_TIMEOUT))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// writeClose sends a close frame with code, the connection is closed by the caller.
+func (c *wsConn) writeClose(code int) error {
+	return c.writeFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, uint16(code)))
+}
+
+// readLoop answers the control frames of the client until the connection fails or is closed.
+// Every frame received proves the client alive and pushes the read deadline back.
+func (c *wsConn) readLoop(timeout time.Duration) error {
+	for {
+		_, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return err
+		}
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+
+		switch opcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+		case wsOpClose:
+			c.writeClose(wsCloseNormal)
+			return errWSClosed
+		case wsOpPong, wsOpText, wsOpBinary, wsOpContinuation:
+			// Nothing to do, clients aren't expected to send anything.
+		default:
+			c.writeClose(wsCloseProtocol)
+			return fmt.Errorf("unknown websocket opcode %#x", opcode)
+		}
+	}
+}
+
+// readMessage reads the next data message from the peer, reassembling its fragments and answering control frames.
+func (c *wsConn) readMessage() (opcode byte, message []byte, err error) {
+	for {
+		fin, frameOpcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch frameOpcode {
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsOpPong:
+			continue
+		case wsOpClose:
+			c.writeClose(wsCloseNormal)
+			return 0, nil, errWSClosed
+		case wsOpText, wsOpBinary:
+			opcode, message = frameOpcode, payload
+		case wsOpContinuation:
+			message = append(message, payload...)
+		default:
+			c.writeClose(wsCloseProtocol)
+			return 0, nil, fmt.Errorf("unknown websocket opcode %#x", frameOpcode)
+		}
+
+		if uint64(len(message)) > c.maxSize {
+			c.writeClose(wsCloseMessageSize)
+			return 0, nil, fmt.Errorf("websocket message of %d bytes is too large", len(message))
+		}
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+// readFrame reads a single frame from the peer, unmasking its payload.
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(c.reader, header[:]); err != nil {
+		return false, 0, nil, err
+	}
+	fin = header[0]&0x80 != 0
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	if masked == c.client {
+		c.writeClose(wsCloseProtocol)
+		return false, 0, nil, errors.New("websocket frame wrongly masked")
+	}
+
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.reader, ext[:]); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > c.maxSize {
+		c.writeClose(wsCloseMessageSize)
+		return false, 0, nil, fmt.Errorf("websocket frame of %d bytes is too large", length)
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.reader, mask[:]); err != nil {
+			return false, 0, nil, err
+		}
+	}
+	payload = make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return false, 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return fin, opcode, payload, nil
+}
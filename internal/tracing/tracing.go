@@ -0,0 +1,316 @@
+// Package tracing traces the requests and their upstream calls, exporting the spans to an OTLP/HTTP collector.
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	EXPORT_INTERVAL = 5 * time.Second
+	EXPORT_TIMEOUT  = 10 * time.Second
+
+	// Spans ended while the collector is unreachable are dropped beyond this.
+	MAX_PENDING_SPANS = 4096
+
+	SCOPE_NAME = "wban-prices-api"
+)
+
+// OTLP span kinds.
+type Kind int
+
+const (
+	KindServer Kind = 2
+	KindClient Kind = 3
+)
+
+const statusError = 2
+
+// Tracer queues the ended spans and exports them to the collector.
+// A nil Tracer is what tracing disabled hands out, and starts nil spans.
+type Tracer struct {
+	endpoint       string
+	serviceName    string
+	serviceVersion string
+	log            *slog.Logger
+	client         *http.Client
+
+	mutex   sync.Mutex
+	pending []*Span
+	dropped int
+}
+
+// New returns a tracer exporting to the collector at endpoint, or nil when endpoint is empty.
+func New(endpoint, serviceName, serviceVersion string, log *slog.Logger) *Tracer {
+	if endpoint == "" {
+		return nil
+	}
+	return &Tracer{
+		endpoint:       endpoint,
+		serviceName:    serviceName,
+		serviceVersion: serviceVersion,
+		log:            log,
+		client:         &http.Client{Timeout: EXPORT_TIMEOUT},
+	}
+}
+
+// Span is an operation traced along with the request it belongs to.
+// A nil Span is what tracing disabled hands out, and its methods do nothing.
+type Span struct {
+	tracer   *Tracer // Nil for remote parents.
+	traceID  [16]byte
+	id       [8]byte
+	parentID [8]byte // Zero for root spans.
+	name     string
+	kind     Kind
+	start    time.Time
+	end      time.Time
+	attrs    []spanAttr
+	err      error
+}
+
+type spanAttr struct {
+	key   string
+	value any // string or int.
+}
+
+type spanKey struct{}
+
+// Start starts a span, child of the one of ctx if any, and returns a context carrying it.
+func (t *Tracer) Start(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	s := &Span{tracer: t, name: name, kind: kind, start: time.Now()}
+	if parent := FromContext(ctx); parent != nil {
+		s.traceID, s.parentID = parent.traceID, parent.id
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.id[:])
+	return ContextWith(ctx, s), s
+}
+
+// FromContext returns the span carried by ctx, nil if none.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// ContextWith returns a context carrying s, the parent of the spans started with it.
+func ContextWith(ctx context.Context, s *Span) context.Context {
+	return context.WithValue(ctx, spanKey{}, s)
+}
+
+func (s *Span) SetString(key, value string) {
+	if s != nil {
+		s.set(key, value)
+	}
+}
+
+func (s *Span) SetInt(key string, value int) {
+	if s != nil {
+		s.set(key, value)
+	}
+}
+
+func (s *Span) set(key string, value any) {
+	for i := range s.attrs {
+		if s.attrs[i].key == key {
+			s.attrs[i].value = value
+			return
+		}
+	}
+	s.attrs = append(s.attrs, spanAttr{key, value})
+}
+
+// Finish ends s, failed if err isn't nil, and queues it for export.
+func (s *Span) Finish(err error) {
+	if s == nil || s.tracer == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+
+	t := s.tracer
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if len(t.pending) >= MAX_PENDING_SPANS {
+		t.dropped++
+		return
+	}
+	t.pending = append(t.pending, s)
+}
+
+// Traceparent returns the W3C Trace Context header making s the parent of a remote span.
+func (s *Span) Traceparent() string {
+	return "00-" + hex.EncodeToString(s.traceID[:]) + "-" + hex.EncodeToString(s.id[:]) + "-01"
+}
+
+// ParseTraceparent returns the remote parent span of a W3C Trace Context header, and whether it was sampled.
+func ParseTraceparent(header string) (parent *Span, sampled bool, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return nil, false, false
+	}
+	parent = &Span{}
+	if _, err := hex.Decode(parent.traceID[:], []byte(parts[1])); err != nil {
+		return nil, false, false
+	}
+	if _, err := hex.Decode(parent.id[:], []byte(parts[2])); err != nil {
+		return nil, false, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return nil, false, false
+	}
+	if parent.traceID == [16]byte{} || parent.id == [8]byte{} {
+		return nil, false, false
+	}
+	return parent, flags[0]&1 == 1, true
+}
+
+// Run exports the ended spans every EXPORT_INTERVAL until ctx is done.
+func (t *Tracer) Run(ctx context.Context) {
+	t.log.Info("tracing | exporting spans", "endpoint", t.endpoint)
+	ticker := time.NewTicker(EXPORT_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.Export(ctx)
+		}
+	}
+}
+
+// Export sends the ended spans to the OTLP/HTTP collector, dropping them if it fails.
+func (t *Tracer) Export(ctx context.Context) {
+	t.mutex.Lock()
+	spans, dropped := t.pending, t.dropped
+	t.pending, t.dropped = nil, 0
+	t.mutex.Unlock()
+
+	if dropped > 0 {
+		t.log.Warn("tracing | collector not keeping up, spans dropped", "dropped", dropped)
+	}
+	if len(spans) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(t.otlpTraces(spans))
+	if err == nil {
+		err = t.post(ctx, body)
+	}
+	if err != nil {
+		t.log.Warn("tracing | export failed, spans dropped", "spans", len(spans), "error", err)
+	}
+}
+
+func (t *Tracer) post(ctx context.Context, body []byte) error {
+	url := strings.TrimSuffix(t.endpoint, "/") + "/v1/traces"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// OTLP/HTTP JSON encoding of the exported spans.
+type (
+	otlpExport struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope struct {
+			Name string `json:"name"`
+		} `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              Kind            `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+)
+
+func (t *Tracer) otlpTraces(spans []*Span) otlpExport {
+	scope := otlpScopeSpans{Spans: make([]otlpSpan, 0, len(spans))}
+	scope.Scope.Name = SCOPE_NAME
+	for _, s := range spans {
+		o := otlpSpan{
+			TraceID:           hex.EncodeToString(s.traceID[:]),
+			SpanID:            hex.EncodeToString(s.id[:]),
+			Name:              s.name,
+			Kind:              s.kind,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID != [8]byte{} {
+			o.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for _, a := range s.attrs {
+			o.Attributes = append(o.Attributes, otlpAttr(a.key, a.value))
+		}
+		if s.err != nil {
+			o.Status = &otlpStatus{Code: statusError, Message: s.err.Error()}
+		}
+		scope.Spans = append(scope.Spans, o)
+	}
+
+	resource := otlpResource{Attributes: []otlpAttribute{otlpAttr("service.name", t.serviceName), otlpAttr("service.version", t.serviceVersion)}}
+	return otlpExport{ResourceSpans: []otlpResourceSpans{{Resource: resource, ScopeSpans: []otlpScopeSpans{scope}}}}
+}
+
+func otlpAttr(key string, value any) otlpAttribute {
+	switch v := value.(type) {
+	case int:
+		// 64-bit integers are strings in OTLP JSON.
+		return otlpAttribute{Key: key, Value: map[string]any{"intValue": strconv.Itoa(v)}}
+	default:
+		return otlpAttribute{Key: key, Value: map[string]any{"stringValue": fmt.Sprint(v)}}
+	}
+}
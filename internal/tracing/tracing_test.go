@@ -0,0 +1,100 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDisabled(t *testing.T) {
+	tracer := New("", "test", "dev", slog.Default())
+	if tracer != nil {
+		t.Fatal("New() without endpoint returned a tracer")
+	}
+	ctx, span := tracer.Start(context.Background(), "noop", KindServer)
+	span.SetString("key", "value")
+	span.Finish(nil)
+	if FromContext(ctx) != nil {
+		t.Error("disabled tracer put a span in the context")
+	}
+}
+
+func TestExport(t *testing.T) {
+	exported := make(chan otlpExport, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" {
+			t.Errorf("posted to %s, want /v1/traces", r.URL.Path)
+		}
+		var export otlpExport
+		body, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &export); err != nil {
+			t.Errorf("invalid export %s: %v", body, err)
+		}
+		exported <- export
+	}))
+	defer collector.Close()
+
+	tracer := New(collector.URL+"/", "prices", "v1.2.3", slog.Default())
+	parent, _, ok := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	if !ok {
+		t.Fatal("ParseTraceparent() rejected a valid header")
+	}
+	ctx, server := tracer.Start(ContextWith(context.Background(), parent), "GET /prices", KindServer)
+	_, client := tracer.Start(ctx, "coinex BANANOUSDT", KindClient)
+	client.SetInt("coinex.retries", 1)
+	client.SetInt("coinex.retries", 2)
+	client.Finish(errors.New("timeout"))
+	server.Finish(nil)
+	tracer.Export(context.Background())
+
+	export := <-exported
+	if len(export.ResourceSpans) != 1 || len(export.ResourceSpans[0].ScopeSpans) != 1 {
+		t.Fatalf("export = %+v, want a single scope", export)
+	}
+	if attrs := export.ResourceSpans[0].Resource.Attributes; len(attrs) != 2 || attrs[0].Value["stringValue"] != "prices" || attrs[1].Value["stringValue"] != "v1.2.3" {
+		t.Errorf("resource attributes = %+v, want the service name and version", attrs)
+	}
+	spans := export.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("exported %d spans, want 2", len(spans))
+	}
+	c, s := spans[0], spans[1]
+	if s.TraceID != "0af7651916cd43dd8448eb211c80319c" || s.ParentSpanID != "b7ad6b7169203331" || s.Kind != KindServer || s.Status != nil {
+		t.Errorf("server span = %+v, want a successful child of the remote parent", s)
+	}
+	if c.TraceID != s.TraceID || c.ParentSpanID != s.SpanID || c.Kind != KindClient {
+		t.Errorf("client span = %+v, want a child of the server span", c)
+	}
+	if len(c.Attributes) != 1 || c.Attributes[0].Value["intValue"] != "2" {
+		t.Errorf("client span attributes = %+v, want the last retries count", c.Attributes)
+	}
+	if c.Status == nil || c.Status.Code != statusError || c.Status.Message != "timeout" {
+		t.Errorf("client span status = %+v, want the error", c.Status)
+	}
+	if header := client.Traceparent(); header != "00-"+c.TraceID+"-"+c.SpanID+"-01" {
+		t.Errorf("Traceparent() = %s", header)
+	}
+}
+
+func TestParseTraceparentRejectsInvalidHeaders(t *testing.T) {
+	for _, header := range []string{
+		"",
+		"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"00-0af7651916cd43dd8448eb211c80319z-b7ad6b7169203331-01",
+	} {
+		if _, _, ok := ParseTraceparent(header); ok {
+			t.Errorf("ParseTraceparent(%q) accepted an invalid header", header)
+		}
+	}
+	if _, sampled, _ := ParseTraceparent("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"); sampled {
+		t.Error("ParseTraceparent() sampled an unsampled trace")
+	}
+}
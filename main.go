@@ -1,153 +1,37 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"io"
-	"log"
-	"net/http"
-	"strconv"
-	"sync"
-	"time"
-)
+	"log/slog"
+	"os"
 
-const COINEX_API_URL = "https://api.coinex.com/v1"
-const CACHE_TIME = 10 * time.Second
-const PORT = "3333"
+	"github.com/wBanano/wban-prices-api/internal/server"
+)
 
-// Global cache variables
+// Build information, set with -ldflags "-X main.version=... -X main.commit=... -X main.buildDate=...".
+// Missing values are read from the build information embedded by the Go toolchain.
 var (
-	cachedPrices  map[string]float64
-	lastCacheTime time.Time
-	cacheMutex    sync.Mutex
+	version   string
+	commit    string
+	buildDate string
 )
 
 func main() {
-	// Register the /prices route.
-	http.HandleFunc("/prices", pricesHandler)
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method == http.MethodOptions {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-			w.Write([]byte("OK"))
-			return
-		}
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("OK"))
-	})
-
-	// Catch-all handler for other paths.
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain")
-		http.Error(w, "404", http.StatusNotFound)
-	})
-
-	log.Println("Server starting on http://localhost:" + PORT)
-	log.Fatal(http.ListenAndServe(":"+PORT, nil))
-}
-
-func pricesHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method == http.MethodOptions {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Write([]byte("OK"))
-		return
-	}
-
-	// Set headers for a successful JSON response.
-	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-
-	// Check if we have a valid cached result.
-	cacheMutex.Lock()
-	if time.Since(lastCacheTime) < CACHE_TIME && cachedPrices != nil {
-		log.Println("/prices | CACHE HIT")
-		cached := cachedPrices
-		cacheMutex.Unlock()
-
-		if err := json.NewEncoder(w).Encode(cached); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-		}
-		return
-	}
-	cacheMutex.Unlock()
-
-	// Cache miss: log and continue fetching new data.
-	log.Println("/prices | CACHE MISS | Fetching new data")
-
-	// Map of keys to CoinEx markets.
-	markets := map[string]string{
-		"ban":   "BANANOUSDT",
-		"bnb":   "BNBUSDC",
-		"eth":   "ETHUSDC",
-		"matic": "POLUSDC",
-		"ftm":   "SUSDC",
-	}
-
-	// Create a buffered channel to collect results.
-	resultChan := make(chan PriceResult, len(markets))
-
-	// Launch a goroutine for each market.
-	for key, market := range markets {
-		go func(key, market string) {
-			price, err := getPrice(market)
-			resultChan <- PriceResult{key: key, price: price, err: err}
-		}(key, market)
-	}
-
-	// Collect results from the channel.
-	prices := make(map[string]float64)
-	for i := 0; i < len(markets); i++ {
-		res := <-resultChan
-		if res.err != nil {
-			http.Error(w, res.err.Error(), http.StatusInternalServerError)
-			return
-		}
-		prices[res.key] = res.price
-	}
-
-	// Update the cache with the new result.
-	cacheMutex.Lock()
-	cachedPrices = prices
-	lastCacheTime = time.Now()
-	cacheMutex.Unlock()
-
-	// Encode and send the prices as JSON.
-	if err := json.NewEncoder(w).Encode(prices); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-}
-
-func getPrice(market string) (float64, error) {
-	url := fmt.Sprintf("%s%s%s", COINEX_API_URL, "/market/ticker?market=", market)
-	resp, err := http.Get(url)
+	cfg, cmd, err := server.ParseCommandLine(os.Args[1:], server.ReadBuildInfo(version, commit, buildDate))
 	if err != nil {
-		return 0, err
+		fatal("Invalid configuration", err)
 	}
-	defer resp.Body.Close()
+	log := server.NewLogger(cfg)
+	slog.SetDefault(log)
 
-	body, err := io.ReadAll(resp.Body)
+	s, err := server.New(cfg, server.Options{Log: log})
 	if err != nil {
-		return 0, err
-	}
-
-	var tickerResp TickerResponse
-	if err := json.Unmarshal(body, &tickerResp); err != nil {
-		return 0, err
+		fatal("Invalid configuration", err)
 	}
-
-	return strconv.ParseFloat(tickerResp.Data.Ticker.Last, 64)
-}
-
-type TickerResponse struct {
-	Data struct {
-		Ticker struct {
-			Last string `json:"last"`
-		} `json:"ticker"`
-	} `json:"data"`
+	os.Exit(s.Run(cmd))
 }
 
-type PriceResult struct {
-	key   string
-	price float64
-	err   error
+// fatal logs err and exits.
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }